@@ -0,0 +1,57 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewCORS(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{}
+	if c, err := NewCORS(cfg); c != nil || err != nil {
+		t.Errorf("expected no CORS without origins, got %v %v", c, err)
+	}
+
+	cfg.HTTP.CORSOrigins = "https://app.example.com, *"
+	if _, err := NewCORS(cfg); err == nil {
+		t.Error("expected any origin to be refused")
+	}
+
+	cfg.HTTP.CORSOrigins = "https://app.example.com"
+	c, err := NewCORS(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		method string
+		origin string
+		allow  string
+	}{
+		{"GET", "https://app.example.com", "https://app.example.com"},
+		{"OPTIONS", "https://app.example.com", "https://app.example.com"},
+		{"GET", "https://evil.example.com", ""},
+		{"OPTIONS", "https://evil.example.com", ""},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, "/", nil)
+		r.Header.Set("Origin", test.origin)
+		if test.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+			r.Header.Set("Access-Control-Request-Headers", "X-CSRF-Token")
+		}
+		handler.ServeHTTP(w, r)
+
+		if allow := w.Header().Get("Access-Control-Allow-Origin"); allow != test.allow {
+			t.Errorf("%d: want allowed origin %q, got %q", i, test.allow, allow)
+		}
+		if creds := w.Header().Get("Access-Control-Allow-Credentials"); (creds == "true") != (test.allow != "") {
+			t.Errorf("%d: unexpected allow credentials %q", i, creds)
+		}
+	}
+}
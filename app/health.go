@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/health"
+	"github.com/fadeojo/brito/migrate"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/volatiletech/abcweb/abcsessions"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// NewHealth returns the readiness checks of the app: the database, its
+// migration version, the session store and the websocket hub
+func NewHealth(cfg *Config, session abcsessions.Overseer, ws *melody.Melody) *health.Health {
+	h := health.New(cfg.Health.CheckTimeout, cfg.Health.CacheTTL)
+
+	if db.DB != nil {
+		h.Register("database", func(ctx context.Context) error {
+			return db.DB.PingContext(ctx)
+		})
+		h.Register("migrations", migrationCheck(cfg))
+	}
+
+	if s, ok := session.(*abcsessions.StorageOverseer); ok {
+		h.Register("sessions", func(ctx context.Context) error {
+			return checkStorer(s.Storer)
+		})
+	}
+
+	if ws != nil {
+		h.Register("websockets", func(ctx context.Context) error {
+			if ws.IsClosed() {
+				return errors.New("websocket hub is closed")
+			}
+			if max := cfg.Health.MaxWebsockets; max > 0 && ws.Len() >= max {
+				return fmt.Errorf("websocket hub is full, %d of %d sessions", ws.Len(), max)
+			}
+			return nil
+		})
+	}
+
+	return h
+}
+
+// migrationCheck checks the database is at the latest migration built into
+// the binary, like checkMigrations does on start
+func migrationCheck(cfg *Config) health.Check {
+	return func(ctx context.Context) error {
+		migrations, err := migrate.LoadDialect(db.Migrations(), cfg.DB.DB)
+		if err != nil {
+			return errors.Wrap(err, "cannot load migrations")
+		}
+		if len(migrations) == 0 {
+			return nil
+		}
+
+		// DryRun keeps Version from creating the version table
+		m := &migrate.Migrator{DB: db.DB, Driver: cfg.DB.DB, DBName: cfg.DB.DBName, DryRun: true}
+		version, err := m.Version()
+		if err != nil {
+			return errors.Wrap(err, "cannot read database version")
+		}
+		if latest := migrations[len(migrations)-1].Version; version != latest {
+			return fmt.Errorf("database version %d, latest migration %d", version, latest)
+		}
+		return nil
+	}
+}
+
+// checkStorer writes, reads back and deletes a session. Every check has its
+// own key, so the checks of the app servers sharing a store don't delete
+// each other's session. The disk storer only accepts UUIDv4 keys.
+func checkStorer(storer abcsessions.Storer) error {
+	key := uuid.NewV4().String()
+	if err := storer.Set(key, "ok"); err != nil {
+		return errors.Wrap(err, "cannot write session")
+	}
+	defer storer.Del(key)
+
+	value, err := storer.Get(key)
+	if err != nil {
+		return errors.Wrap(err, "cannot read session")
+	}
+	if value != "ok" {
+		return errors.New("session read back differs")
+	}
+	return nil
+}
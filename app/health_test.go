@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fadeojo/brito/health"
+	"github.com/volatiletech/abcweb/abcsessions"
+	"gopkg.in/olahol/melody.v1"
+)
+
+func TestNewHealth(t *testing.T) {
+	t.Parallel()
+
+	storer, err := abcsessions.NewDiskStorer(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := abcsessions.NewStorageOverseer(abcsessions.NewCookieOptions(), storer)
+
+	cfg := &Config{}
+	cfg.DB.DB = "sqlite3"
+	cfg.Health.CheckTimeout = time.Second * 5
+
+	h := NewHealth(cfg, session, melody.New())
+	report := h.Check(context.Background())
+	if report.Status != health.StatusOK {
+		t.Errorf("unexpected report %#v", report)
+	}
+	for _, name := range []string{"database", "migrations", "sessions", "websockets"} {
+		if _, ok := report.Checks[name]; !ok {
+			t.Errorf("expected check %s", name)
+		}
+	}
+
+	// The session of the check is deleted
+	if keys, _ := storer.All(); len(keys) != 0 {
+		t.Errorf("expected no sessions, got %v", keys)
+	}
+
+	// A closed hub is not ready
+	ws := melody.New()
+	ws.Close()
+	h = NewHealth(cfg, abcsessions.NewCookieOverseer(abcsessions.NewCookieOptions(), make([]byte, 32)), ws)
+	report = h.Check(context.Background())
+	if report.Checks["websockets"].OK {
+		t.Error("expected the websockets check to fail")
+	}
+	if _, ok := report.Checks["sessions"]; ok {
+		t.Error("expected no sessions check for cookie sessions")
+	}
+}
+
+// interleavedStorer runs the check of another app server sharing the
+// store right after the first session is written
+type interleavedStorer struct {
+	abcsessions.Storer
+	once  sync.Once
+	other error
+}
+
+func (s *interleavedStorer) Set(key, value string) error {
+	err := s.Storer.Set(key, value)
+	s.once.Do(func() { s.other = checkStorer(s.Storer) })
+	return err
+}
+
+func TestCheckStorerShared(t *testing.T) {
+	t.Parallel()
+
+	disk, err := abcsessions.NewDiskStorer(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storer := &interleavedStorer{Storer: disk}
+	if err := checkStorer(storer); err != nil {
+		t.Errorf("expected the check to pass while another one runs, got %v", err)
+	}
+	if storer.other != nil {
+		t.Errorf("expected the other check to pass, got %v", storer.other)
+	}
+}
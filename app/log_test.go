@@ -0,0 +1,74 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestNewLogger(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "brito.log")
+	cfg := &Config{}
+	cfg.Env = "staging"
+	cfg.Server.ProdLogger = true
+	cfg.Log = LogConfig{
+		Level:   "warn",
+		Output:  path,
+		Service: "brito",
+		Fields:  map[string]string{"region": "eu"},
+	}
+
+	level := zap.NewAtomicLevel()
+	log, err := NewLogger(cfg, level, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Info("hidden")
+	log.Warn("shown")
+
+	// The level changes at runtime
+	level.SetLevel(zap.InfoLevel)
+	log.Info("shown too")
+	log.Sync()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 entries, got %q", b)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"msg": "shown", "service": "brito", "env": "staging", "version": "v1", "region": "eu"} {
+		if entry[k] != v {
+			t.Errorf("expected %s %q, got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestNewLoggerFails(t *testing.T) {
+	t.Parallel()
+
+	tests := []LogConfig{
+		{Level: "loud", Output: "stdout"},
+		{Encoding: "xml", Output: "stdout"},
+		{StacktraceLevel: "never", Output: "stdout"},
+		{Output: " , "},
+	}
+	for _, test := range tests {
+		cfg := &Config{Log: test}
+		if _, err := NewLogger(cfg, zap.NewAtomicLevel(), ""); err == nil {
+			t.Errorf("%+v: expected an error", test)
+		}
+	}
+}
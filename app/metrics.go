@@ -0,0 +1,59 @@
+package app
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/metrics"
+)
+
+// NewMetrics returns the registry of the /metrics endpoint with the Go
+// runtime, build and database pool metrics. The HTTP request metrics are
+// added by NewMiddlewares and the websocket metrics by NewWebsocket.
+func NewMetrics(version string, buildTime string) *metrics.Registry {
+	reg := metrics.NewRegistry()
+	reg.Register(
+		metrics.BuildInfo("brito_build_info", version, buildTime),
+		metrics.Runtime(),
+		metrics.CollectorFunc(collectDBStats),
+	)
+	return reg
+}
+
+// collectDBStats writes the connection pool statistics of the primary
+// database and the read replicas, labelled by pool
+func collectDBStats(e *metrics.Encoder) {
+	stats := db.Stats()
+	if len(stats) == 0 {
+		return
+	}
+	var pools []string
+	for pool := range stats {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	families := []struct {
+		name  string
+		help  string
+		typ   string
+		value func(s sql.DBStats) float64
+	}{
+		{"brito_db_max_open_connections", "Maximum number of open connections to the database.", "gauge", func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }},
+		{"brito_db_open_connections", "The number of established connections both in use and idle.", "gauge", func(s sql.DBStats) float64 { return float64(s.OpenConnections) }},
+		{"brito_db_in_use_connections", "The number of connections currently in use.", "gauge", func(s sql.DBStats) float64 { return float64(s.InUse) }},
+		{"brito_db_idle_connections", "The number of idle connections.", "gauge", func(s sql.DBStats) float64 { return float64(s.Idle) }},
+		{"brito_db_wait_count_total", "The total number of connections waited for.", "counter", func(s sql.DBStats) float64 { return float64(s.WaitCount) }},
+		{"brito_db_wait_duration_seconds_total", "The total time blocked waiting for a new connection.", "counter", func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }},
+		{"brito_db_max_idle_closed_total", "The total number of connections closed due to SetMaxIdleConns.", "counter", func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }},
+		{"brito_db_max_idle_time_closed_total", "The total number of connections closed due to SetConnMaxIdleTime.", "counter", func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }},
+		{"brito_db_max_lifetime_closed_total", "The total number of connections closed due to SetConnMaxLifetime.", "counter", func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }},
+	}
+	for _, f := range families {
+		e.Family(f.name, f.help, f.typ)
+		for _, pool := range pools {
+			e.Sample(f.name, f.value(stats[pool]), "pool", pool)
+		}
+	}
+}
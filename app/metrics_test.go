@@ -0,0 +1,42 @@
+package app
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewMetrics(t *testing.T) {
+	t.Parallel()
+
+	reg := NewMetrics("v1.2.3", "2026-10-18")
+	NewWebsocket(reg)
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	got := w.Body.String()
+	for _, line := range []string{
+		`brito_build_info{version="v1.2.3",build_time="2026-10-18",`,
+		`brito_db_open_connections{pool="primary"} `,
+		`brito_websocket_sessions 0`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(got, "\n"+line) {
+			t.Errorf("expected %s in:\n%s", line, got)
+		}
+	}
+}
+
+func TestMetricsDisabledByDefault(t *testing.T) {
+	t.Parallel()
+
+	enabled, err := NewFlagSet().GetBool("metrics.enabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the admin listener they would be served to anyone
+	if enabled {
+		t.Error("metrics enabled by default")
+	}
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/volatiletech/abcweb/abcsessions"
+)
+
+// NewSessions returns the sessions overseer. The dev storer keeps sessions
+// in encrypted cookies so they survive restarts of "abcweb dev", and the
+// prod storer keeps them on disk. The cookie encryption key is derived from
+// the app secret key.
+func NewSessions(cfg *Config, secretKey []byte) (abcsessions.Overseer, error) {
+	opts := abcsessions.NewCookieOptions()
+	opts.Name = "brito_session"
+	// Secure cookies are never sent over plain http
+	opts.Secure = len(cfg.Server.TLSBind) > 0
+
+	if cfg.Server.SessionsDevStorer {
+		mac := hmac.New(sha256.New, secretKey)
+		mac.Write([]byte("sessions"))
+		return abcsessions.NewCookieOverseer(opts, mac.Sum(nil)), nil
+	}
+
+	// Sessions are stored in <tmp>/brito_sessions and expire after 2 days
+	storer, err := abcsessions.NewDefaultDiskStorer("brito_sessions")
+	if err != nil {
+		return nil, err
+	}
+	storer.StartCleaner()
+
+	return abcsessions.NewStorageOverseer(opts, storer), nil
+}
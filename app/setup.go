@@ -1,25 +1,72 @@
 package app
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/health"
+	"github.com/fadeojo/brito/logging"
+	"github.com/fadeojo/brito/mailer"
+	"github.com/fadeojo/brito/metrics"
+	"github.com/fadeojo/brito/models"
+	"github.com/fadeojo/brito/oidc"
+	"github.com/fadeojo/brito/reporting"
+	"github.com/fadeojo/brito/server"
+	"github.com/fadeojo/brito/tracing"
 	"github.com/go-chi/chi"
 	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
+	"github.com/rs/cors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/volatiletech/abcweb/abcconfig"
 	"github.com/volatiletech/abcweb/abcmiddleware"
 	"github.com/volatiletech/abcweb/abcrender"
+	"github.com/volatiletech/abcweb/abcsessions"
 	"github.com/volatiletech/refresh/refresh/web"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/olahol/melody.v1"
 )
 
 // App is the configuration state for the entire app.
 // The controllers are passed variables from this object when initialized.
 type App struct {
-	Config *Config
-	Log    *zap.Logger
-	Router *chi.Mux
-	Render abcrender.Renderer
-	Root   *cobra.Command
+	Config  *Config
+	Log     *zap.Logger
+	Router  *chi.Mux
+	Render  abcrender.Renderer
+	Root    *cobra.Command
+	Mailer  mailer.Mailer
+	Tokens  *auth.Signer
+	Session abcsessions.Overseer
+	OIDC    []*oidc.Provider
+	// Throttle is where the failed logins are counted
+	Throttle auth.ThrottleStore
+	// Websocket is the hub of the /ws websocket sessions
+	Websocket *melody.Melody
+	// Health runs the readiness checks of /readyz
+	Health *health.Health
+	// Metrics is exported by /metrics
+	Metrics *metrics.Registry
+	// LogLevel is the level of Log, which the admin listener changes at
+	// runtime
+	LogLevel zap.AtomicLevel
+
+	// Version and BuildTime of the binary, set by the linker
+	Version   string
+	BuildTime string
 
 	AssetsManifest map[string]string
 }
@@ -36,6 +83,286 @@ type Config struct {
 	abcconfig.AppConfig
 
 	// Custom configuration can be added here.
+
+	// AutoMigrate runs the migrations built into the binary on start
+	AutoMigrate bool `toml:"auto-migrate" mapstructure:"auto-migrate" env:"AUTO_MIGRATE"`
+	// MigrateLockTimeout is how long to wait for other replicas that are
+	// migrating the database on start
+	MigrateLockTimeout time.Duration `toml:"migrate-lock-timeout" mapstructure:"migrate-lock-timeout" env:"MIGRATE_LOCK_TIMEOUT"`
+
+	Database DatabaseConfig `toml:"database" mapstructure:"database"`
+	HTTP     HTTPConfig     `toml:"http" mapstructure:"http"`
+	Log      LogConfig      `toml:"log" mapstructure:"log"`
+	Health   HealthConfig   `toml:"health" mapstructure:"health"`
+	Metrics  MetricsConfig  `toml:"metrics" mapstructure:"metrics"`
+	Admin    AdminConfig    `toml:"admin" mapstructure:"admin"`
+	TLS      TLSConfig      `toml:"tls" mapstructure:"tls"`
+	Tracing  TracingConfig  `toml:"tracing" mapstructure:"tracing"`
+	Errors   ErrorsConfig   `toml:"errors" mapstructure:"errors"`
+	Mail     MailConfig     `toml:"mail" mapstructure:"mail"`
+	Auth     AuthConfig     `toml:"auth" mapstructure:"auth"`
+	// AccessLog selects what the access log has of every request
+	AccessLog AccessLogConfig `toml:"access-log" mapstructure:"access-log"`
+	// OIDC is the list of OpenID Connect identity providers users can
+	// log in with. Lists can only be set in the config file.
+	OIDC []OIDCConfig `toml:"oidc" mapstructure:"oidc"`
+}
+
+// DatabaseConfig holds the database settings the abcweb db section has no
+// room for
+type DatabaseConfig struct {
+	// Connection pool limits, zero keeps the database/sql default
+	MaxOpenConns    int           `toml:"max-open-conns" mapstructure:"max-open-conns" env:"DATABASE_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `toml:"max-idle-conns" mapstructure:"max-idle-conns" env:"DATABASE_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `toml:"conn-max-lifetime" mapstructure:"conn-max-lifetime" env:"DATABASE_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `toml:"conn-max-idle-time" mapstructure:"conn-max-idle-time" env:"DATABASE_CONN_MAX_IDLE_TIME"`
+	// ConnectTimeout is how long to keep trying to reach the database on
+	// start, backing off between attempts
+	ConnectTimeout time.Duration `toml:"connect-timeout" mapstructure:"connect-timeout" env:"DATABASE_CONNECT_TIMEOUT"`
+	// HealthInterval is how often the database is probed and the pool
+	// statistics are logged. Zero disables the probes, and with them the
+	// ejection of failing replicas.
+	HealthInterval time.Duration `toml:"health-interval" mapstructure:"health-interval" env:"DATABASE_HEALTH_INTERVAL"`
+	// Replicas are the connection strings of read replicas, for the driver
+	// of the db section. They can only be set in the config file.
+	Replicas []string `toml:"replicas" mapstructure:"replicas"`
+	// StickyWindow is how long a client reads from the primary after it
+	// wrote to it, while the replicas catch up. Zero only keeps the rest
+	// of the writing request on the primary.
+	StickyWindow time.Duration `toml:"sticky-window" mapstructure:"sticky-window" env:"DATABASE_STICKY_WINDOW"`
+	// SlowQuery is the duration from which queries are logged at warn
+	// level, with the request logger for the queries of requests. Zero
+	// logs no slow queries.
+	SlowQuery time.Duration `toml:"slow-query" mapstructure:"slow-query" env:"DATABASE_SLOW_QUERY"`
+	// TraceQueries logs every query at debug level with its duration
+	TraceQueries bool `toml:"trace-queries" mapstructure:"trace-queries" env:"DATABASE_TRACE_QUERIES"`
+}
+
+// HTTPConfig holds the web server settings the abcweb server section has
+// no room for
+type HTTPConfig struct {
+	// ShutdownDelay is how long requests are still served after a shutdown
+	// signal while /readyz fails, so load balancers can stop sending new
+	// ones first. Set it to a few readiness probe periods.
+	ShutdownDelay time.Duration `toml:"shutdown-delay" mapstructure:"shutdown-delay" env:"HTTP_SHUTDOWN_DELAY"`
+	// ShutdownTimeout is how long active requests are waited for on
+	// shutdown, zero waits for them forever
+	ShutdownTimeout time.Duration `toml:"shutdown-timeout" mapstructure:"shutdown-timeout" env:"HTTP_SHUTDOWN_TIMEOUT"`
+	// RestartTimeout is how long the new process of a SIGUSR2 or SIGHUP
+	// restart may take to start serving before the restart is given up
+	RestartTimeout time.Duration `toml:"restart-timeout" mapstructure:"restart-timeout" env:"HTTP_RESTART_TIMEOUT"`
+	// H2C serves cleartext HTTP/2 on the server bind besides HTTP/1, for a
+	// reverse proxy that speaks it with prior knowledge
+	H2C bool `toml:"h2c" mapstructure:"h2c" env:"HTTP_H2C"`
+	// SocketMode is the octal file mode of the unix: binds, and SocketGroup
+	// the group that owns them, the group of the process if empty
+	SocketMode  string `toml:"socket-mode" mapstructure:"socket-mode" env:"HTTP_SOCKET_MODE"`
+	SocketGroup string `toml:"socket-group" mapstructure:"socket-group" env:"HTTP_SOCKET_GROUP"`
+	// CORSOrigins is the comma separated list of the origins that may make
+	// cross-origin requests with the session cookie, like the origin of an
+	// SPA. Only same-origin requests are allowed if it is empty.
+	CORSOrigins string `toml:"cors-origins" mapstructure:"cors-origins" env:"HTTP_CORS_ORIGINS"`
+	// TrustedProxies is the comma separated list of the IP addresses and
+	// CIDR ranges of the reverse proxies whose X-Forwarded-For and X-Real-IP
+	// headers give the client address, which the login throttle and the
+	// logs use. "unix" trusts the connections of unix: binds.
+	TrustedProxies string `toml:"trusted-proxies" mapstructure:"trusted-proxies" env:"HTTP_TRUSTED_PROXIES"`
+}
+
+// LogConfig holds the logger settings. The defaults of the empty ones
+// depend on the server prod-logger mode.
+type LogConfig struct {
+	// Level is the minimum level logged until it is changed on the admin
+	// listener, info in prod-logger mode and debug otherwise
+	Level string `toml:"level" mapstructure:"level" env:"LOG_LEVEL"`
+	// Encoding is "json" or "console", json in prod-logger mode
+	Encoding string `toml:"encoding" mapstructure:"encoding" env:"LOG_ENCODING"`
+	// Output is the comma separated list of where logs are written,
+	// "stdout", "stderr" or file paths
+	Output string `toml:"output" mapstructure:"output" env:"LOG_OUTPUT"`
+	// Log files are rotated once they are MaxSize megabytes, and the
+	// rotated ones removed when older than MaxAge or more than MaxBackups.
+	// Zero limits are not applied.
+	MaxSize    int           `toml:"max-size" mapstructure:"max-size" env:"LOG_MAX_SIZE"`
+	MaxAge     time.Duration `toml:"max-age" mapstructure:"max-age" env:"LOG_MAX_AGE"`
+	MaxBackups int           `toml:"max-backups" mapstructure:"max-backups" env:"LOG_MAX_BACKUPS"`
+	// Of the entries with the same level and message, the first
+	// SamplingInitial of every second are logged and every
+	// SamplingThereafter after that. Zero disables sampling.
+	SamplingInitial    int `toml:"sampling-initial" mapstructure:"sampling-initial" env:"LOG_SAMPLING_INITIAL"`
+	SamplingThereafter int `toml:"sampling-thereafter" mapstructure:"sampling-thereafter" env:"LOG_SAMPLING_THEREAFTER"`
+	// StacktraceLevel is the level from which entries have a stack trace,
+	// or "off". Error in prod-logger mode and warn otherwise.
+	StacktraceLevel string `toml:"stacktrace-level" mapstructure:"stacktrace-level" env:"LOG_STACKTRACE_LEVEL"`
+	// Service is logged with every entry, along with the env and version
+	Service string `toml:"service" mapstructure:"service" env:"LOG_SERVICE"`
+	// Fields are more fields logged with every entry. They can only be set
+	// in the config file.
+	Fields map[string]string `toml:"fields" mapstructure:"fields"`
+}
+
+// AccessLogConfig holds the access log settings. The lists are comma
+// separated.
+type AccessLogConfig struct {
+	// Fields are the fields of every line, see logging.AccessLog
+	Fields string `toml:"fields" mapstructure:"fields" env:"ACCESS_LOG_FIELDS"`
+	// Headers are the request headers that are logged, with the values
+	// of Authorization and cookies redacted
+	Headers string `toml:"headers" mapstructure:"headers" env:"ACCESS_LOG_HEADERS"`
+	// Redact are the query parameters and form fields that are redacted
+	Redact string `toml:"redact" mapstructure:"redact" env:"ACCESS_LOG_REDACT"`
+	// BodyRoutes are the chi route patterns whose request and response
+	// bodies are logged, up to MaxBody bytes each
+	BodyRoutes string `toml:"body-routes" mapstructure:"body-routes" env:"ACCESS_LOG_BODY_ROUTES"`
+	MaxBody    int    `toml:"max-body" mapstructure:"max-body" env:"ACCESS_LOG_MAX_BODY"`
+	// SkipPaths are the paths that aren't logged, or path prefixes if they
+	// end with a *
+	SkipPaths string `toml:"skip-paths" mapstructure:"skip-paths" env:"ACCESS_LOG_SKIP_PATHS"`
+	// Sample maps route patterns to the share of their requests that are
+	// logged. It can only be set in the config file.
+	Sample map[string]float64 `toml:"sample" mapstructure:"sample"`
+}
+
+// HealthConfig holds the readiness check settings
+type HealthConfig struct {
+	// CheckTimeout is how long a readiness check may take before it fails
+	CheckTimeout time.Duration `toml:"check-timeout" mapstructure:"check-timeout" env:"HEALTH_CHECK_TIMEOUT"`
+	// CacheTTL is how long readiness results are reused between probes
+	CacheTTL time.Duration `toml:"cache-ttl" mapstructure:"cache-ttl" env:"HEALTH_CACHE_TTL"`
+	// MaxWebsockets is the number of websocket sessions from which the
+	// instance is not ready, zero for no limit
+	MaxWebsockets int `toml:"max-websockets" mapstructure:"max-websockets" env:"HEALTH_MAX_WEBSOCKETS"`
+}
+
+// MetricsConfig holds the Prometheus metrics settings
+type MetricsConfig struct {
+	// Enabled serves the metrics at /metrics, on the admin listener if it
+	// is enabled and on the public one if not. Off by default, as anyone
+	// could read them on the public one.
+	Enabled bool `toml:"enabled" mapstructure:"enabled" env:"METRICS_ENABLED"`
+}
+
+// AdminConfig holds the settings of the admin listener, which serves the
+// profiler, expvar, metrics, the log level and the route list
+type AdminConfig struct {
+	// Enabled starts the admin listener
+	Enabled bool `toml:"enabled" mapstructure:"enabled" env:"ADMIN_ENABLED"`
+	// Bind is the address of the admin listener. It has no authentication,
+	// so keep it on localhost or a private network.
+	Bind string `toml:"bind" mapstructure:"bind" env:"ADMIN_BIND"`
+}
+
+// TLSConfig holds the mutual TLS settings of the https listener, whose
+// certificate is set in the server section
+type TLSConfig struct {
+	// ClientCAFile is the PEM bundle of the CAs that client certificates
+	// are verified against. Mutual TLS is off if it is empty.
+	ClientCAFile string `toml:"client-ca-file" mapstructure:"client-ca-file" env:"TLS_CLIENT_CA_FILE"`
+	// ClientAuth is "optional" to verify client certificates that are sent,
+	// or "require" to refuse connections without one
+	ClientAuth string `toml:"client-auth" mapstructure:"client-auth" env:"TLS_CLIENT_AUTH"`
+	// ClientCertPaths are the path prefixes of the route groups that need a
+	// verified client certificate, like /admin. They can only be set in
+	// the config file.
+	ClientCertPaths []string `toml:"client-cert-paths" mapstructure:"client-cert-paths"`
+}
+
+// TracingConfig holds the distributed tracing settings
+type TracingConfig struct {
+	// Exporter is where spans are sent; "otlp", "stdout", "file" or "none".
+	// Trace IDs are propagated and logged with every exporter.
+	Exporter string `toml:"exporter" mapstructure:"exporter" env:"TRACING_EXPORTER"`
+	// Endpoint is the OTLP/HTTP traces URL of the collector
+	Endpoint string `toml:"endpoint" mapstructure:"endpoint" env:"TRACING_ENDPOINT"`
+	// Headers are sent to the collector, like an API key. They can only be
+	// set in the config file.
+	Headers map[string]string `toml:"headers" mapstructure:"headers"`
+	// File is the path the file exporter appends JSON lines to
+	File string `toml:"file" mapstructure:"file" env:"TRACING_FILE"`
+	// ServiceName is the service the spans are exported as
+	ServiceName string `toml:"service-name" mapstructure:"service-name" env:"TRACING_SERVICE_NAME"`
+	// SampleRatio is the share of new traces that are exported, between 0
+	// and 1. Traces continued from other services keep their decision.
+	SampleRatio float64 `toml:"sample-ratio" mapstructure:"sample-ratio" env:"TRACING_SAMPLE_RATIO"`
+}
+
+// ErrorsConfig holds the error reporting settings
+type ErrorsConfig struct {
+	// DSN is the Sentry DSN panics and the errors of 5xx responses are
+	// reported to, like https://<key>@sentry.example.com/<project>.
+	// Nothing is reported if it is empty.
+	DSN string `toml:"dsn" mapstructure:"dsn" env:"ERRORS_DSN"`
+	// GroupInterval is how long further events of the same error are only
+	// counted after one was reported, zero reports them all
+	GroupInterval time.Duration `toml:"group-interval" mapstructure:"group-interval" env:"ERRORS_GROUP_INTERVAL"`
+}
+
+// MailConfig holds the outgoing mail configuration
+type MailConfig struct {
+	// Driver is the mailer implementation to use; "smtp" or "log"
+	Driver string `toml:"driver" mapstructure:"driver" env:"MAIL_DRIVER"`
+	// From is the sender address used for all outgoing mail
+	From string `toml:"from" mapstructure:"from" env:"MAIL_FROM"`
+	// Dir is the folder the log mailer writes .eml files to.
+	// Leave empty to only log the outgoing mail.
+	Dir      string `toml:"dir" mapstructure:"dir" env:"MAIL_DIR"`
+	SMTPHost string `toml:"smtp-host" mapstructure:"smtp-host" env:"MAIL_SMTP_HOST"`
+	SMTPPort int    `toml:"smtp-port" mapstructure:"smtp-port" env:"MAIL_SMTP_PORT"`
+	SMTPUser string `toml:"smtp-user" mapstructure:"smtp-user" env:"MAIL_SMTP_USER"`
+	SMTPPass string `toml:"smtp-pass" mapstructure:"smtp-pass" env:"MAIL_SMTP_PASS"`
+}
+
+// AuthConfig holds the account and authentication configuration
+type AuthConfig struct {
+	// SecretKey is the hex encoded key used to sign account tokens.
+	// A random key is generated on start if left empty, which invalidates
+	// all outstanding tokens on every restart.
+	SecretKey string `toml:"secret-key" mapstructure:"secret-key" env:"AUTH_SECRET_KEY"`
+	// RootURL is the external URL of the app, used to build email links
+	RootURL string `toml:"root-url" mapstructure:"root-url" env:"AUTH_ROOT_URL"`
+	// Lifetime of password reset and email verification tokens
+	ResetTokenTTL  time.Duration `toml:"reset-token-ttl" mapstructure:"reset-token-ttl" env:"AUTH_RESET_TOKEN_TTL"`
+	VerifyTokenTTL time.Duration `toml:"verify-token-ttl" mapstructure:"verify-token-ttl" env:"AUTH_VERIFY_TOKEN_TTL"`
+	// Maximum number of account emails that can be requested per
+	// RateLimitWindow, counted separately per client IP and per email address
+	RateLimit       int           `toml:"rate-limit" mapstructure:"rate-limit" env:"AUTH_RATE_LIMIT"`
+	RateLimitWindow time.Duration `toml:"rate-limit-window" mapstructure:"rate-limit-window" env:"AUTH_RATE_LIMIT_WINDOW"`
+	// TOTPIssuer is the name accounts are listed under in authenticator apps
+	TOTPIssuer string `toml:"totp-issuer" mapstructure:"totp-issuer" env:"AUTH_TOTP_ISSUER"`
+	// ThrottleStore is where failed logins are counted; "db" shares the
+	// counts between all instances, "memory" keeps them per instance
+	ThrottleStore string `toml:"throttle-store" mapstructure:"throttle-store" env:"AUTH_THROTTLE_STORE"`
+	// Failed logins allowed per client IP and per account before every
+	// further attempt has to wait, starting at ThrottleBaseDelay and
+	// doubling up to ThrottleMaxDelay. Failures are forgotten after
+	// ThrottleWindow without a new one.
+	ThrottleFreeAttempts int           `toml:"throttle-free-attempts" mapstructure:"throttle-free-attempts" env:"AUTH_THROTTLE_FREE_ATTEMPTS"`
+	ThrottleBaseDelay    time.Duration `toml:"throttle-base-delay" mapstructure:"throttle-base-delay" env:"AUTH_THROTTLE_BASE_DELAY"`
+	ThrottleMaxDelay     time.Duration `toml:"throttle-max-delay" mapstructure:"throttle-max-delay" env:"AUTH_THROTTLE_MAX_DELAY"`
+	ThrottleWindow       time.Duration `toml:"throttle-window" mapstructure:"throttle-window" env:"AUTH_THROTTLE_WINDOW"`
+	// Failed logins after which an account is locked for LockoutDuration,
+	// and its owner is mailed an unlock link. Zero disables the lockout.
+	LockoutThreshold int           `toml:"lockout-threshold" mapstructure:"lockout-threshold" env:"AUTH_LOCKOUT_THRESHOLD"`
+	LockoutDuration  time.Duration `toml:"lockout-duration" mapstructure:"lockout-duration" env:"AUTH_LOCKOUT_DURATION"`
+}
+
+// OIDCConfig holds the configuration of an OpenID Connect identity provider,
+// set in the config file as an [[<env>.oidc]] array of tables
+type OIDCConfig struct {
+	// Name identifies the provider in the callback URL and linked accounts,
+	// and must not change once users have logged in with it
+	Name         string `toml:"name" mapstructure:"name"`
+	DisplayName  string `toml:"display-name" mapstructure:"display-name"`
+	Issuer       string `toml:"issuer" mapstructure:"issuer"`
+	ClientID     string `toml:"client-id" mapstructure:"client-id"`
+	ClientSecret string `toml:"client-secret" mapstructure:"client-secret"`
+	// Scopes requested besides "openid", "email" and "profile" if not set
+	Scopes []string `toml:"scopes" mapstructure:"scopes"`
+	// RoleClaim is the ID token claim holding the user's groups or roles,
+	// and Roles maps its values to app roles, e.g. {"it-admins" = "admin"}.
+	// When RoleClaim is set the provider decides who is an admin.
+	RoleClaim string            `toml:"role-claim" mapstructure:"role-claim"`
+	Roles     map[string]string `toml:"roles" mapstructure:"roles"`
 }
 
 // NewApp returns an initialized App object
@@ -45,35 +372,496 @@ func NewApp() *App {
 	}
 }
 
-// NewLogger returns a new zap logger
-func NewLogger(cfg *Config) (*zap.Logger, error) {
-	var zapCfg zap.Config
+// NewFlagSet returns the flags for the custom configuration sections
+// defined in Config, to be added alongside abcconfig.NewFlagSet
+func NewFlagSet() *pflag.FlagSet {
+	flags := &pflag.FlagSet{}
+
+	flags.BoolP("auto-migrate", "", false, "Run the database migrations built into the binary on start")
+	flags.DurationP("migrate-lock-timeout", "", time.Minute*5, "How long to wait for other replicas migrating the database on start")
+
+	// database subsection flags
+	flags.IntP("database.max-open-conns", "", 25, "Maximum open database connections, 0 for unlimited")
+	flags.IntP("database.max-idle-conns", "", 5, "Maximum idle database connections")
+	flags.DurationP("database.conn-max-lifetime", "", time.Minute*30, "Maximum time a database connection is reused, 0 for unlimited")
+	flags.DurationP("database.conn-max-idle-time", "", time.Minute*5, "Maximum time a database connection is kept idle, 0 for unlimited")
+	flags.DurationP("database.connect-timeout", "", time.Second*30, "How long to keep trying to reach the database on start")
+	flags.DurationP("database.health-interval", "", time.Second*30, "How often the database health is probed, 0 to disable")
+	flags.DurationP("database.sticky-window", "", time.Second*5, "How long a client reads from the primary database after writing to it")
+	flags.DurationP("database.slow-query", "", time.Millisecond*200, "Log database queries that take this long, 0 to disable")
+	flags.BoolP("database.trace-queries", "", false, "Log every database query at debug level")
+
+	// http subsection flags
+	flags.DurationP("http.shutdown-delay", "", 0, "How long to keep serving requests after a shutdown signal while /readyz fails")
+	flags.DurationP("http.shutdown-timeout", "", time.Second*30, "How long to wait for active requests on shutdown, 0 to wait forever")
+	flags.DurationP("http.restart-timeout", "", time.Minute, "How long the new process of a SIGUSR2 or SIGHUP restart may take to start")
+	flags.BoolP("http.h2c", "", false, "Serve cleartext HTTP/2 on the server bind, for a reverse proxy")
+	flags.StringP("http.socket-mode", "", "0660", "The octal file mode of unix: socket binds")
+	flags.StringP("http.socket-group", "", "", "The group of unix: socket binds")
+	flags.StringP("http.trusted-proxies", "", "unix", "Comma separated IPs and CIDR ranges of the reverse proxies trusted for the client address, unix for unix: binds")
+	flags.StringP("http.cors-origins", "", "", "Comma separated origins allowed to make cross-origin requests, like https://app.example.com")
+
+	// log subsection flags
+	flags.StringP("log.level", "", "", "The minimum log level (debug|info|warn|error), info with the prod logger and debug otherwise")
+	flags.StringP("log.encoding", "", "", "The log encoding (json|console), json with the prod logger")
+	flags.StringP("log.output", "", "stdout", "Comma separated log outputs, stdout, stderr or file paths")
+	flags.IntP("log.max-size", "", 100, "Megabytes from which log files are rotated, 0 to disable")
+	flags.DurationP("log.max-age", "", 0, "How long rotated log files are kept, 0 to keep them")
+	flags.IntP("log.max-backups", "", 0, "How many rotated log files are kept, 0 to keep them all")
+	flags.IntP("log.sampling-initial", "", 100, "Entries with the same level and message logged every second, 0 to disable sampling")
+	flags.IntP("log.sampling-thereafter", "", 100, "Log every nth entry with the same level and message after the initial ones")
+	flags.StringP("log.stacktrace-level", "", "", "The level from which entries have a stack trace, or off")
+	flags.StringP("log.service", "", "brito", "The service name logged with every entry")
 
+	// access-log subsection flags
+	flags.StringP("access-log.fields", "", strings.Join(logging.DefaultFields, ","), "Comma separated fields of the access log lines")
+	flags.StringP("access-log.headers", "", "", "Comma separated request headers logged in the access log")
+	flags.StringP("access-log.redact", "", "password,confirm_password,token,code,csrf_token", "Comma separated query parameters and form fields redacted in the access log")
+	flags.StringP("access-log.body-routes", "", "", "Comma separated routes whose bodies are logged in the access log")
+	flags.IntP("access-log.max-body", "", 4096, "Bytes of the request and response bodies logged")
+	flags.StringP("access-log.skip-paths", "", "/healthz,/readyz,/favicon.ico,/robots.txt,/ui/*,/assets/*", "Comma separated paths, or prefixes ending with *, left out of the access log")
+
+	// health subsection flags
+	flags.DurationP("health.check-timeout", "", time.Second*2, "How long a readiness check may take before it fails")
+	flags.DurationP("health.cache-ttl", "", time.Second, "How long readiness check results are reused")
+	flags.IntP("health.max-websockets", "", 0, "Websocket sessions from which the instance is not ready, 0 for no limit")
+
+	// metrics subsection flags
+	flags.BoolP("metrics.enabled", "", false, "Serve Prometheus metrics at /metrics")
+
+	// admin subsection flags
+	flags.BoolP("admin.enabled", "", false, "Serve pprof, expvar, metrics, the log level and the routes on the admin bind")
+	flags.StringP("admin.bind", "", "127.0.0.1:9090", "The address of the admin listener")
+
+	// tls subsection flags
+	flags.StringP("tls.client-ca-file", "", "", "The PEM bundle of the CAs client certificates are verified against, for mutual TLS")
+	flags.StringP("tls.client-auth", "", "optional", "Whether https clients need a certificate (optional|require)")
+
+	// tracing subsection flags
+	flags.StringP("tracing.exporter", "", "none", "Where trace spans are exported (otlp|stdout|file|none)")
+	flags.StringP("tracing.endpoint", "", "http://localhost:4318/v1/traces", "The OTLP/HTTP traces URL of the collector")
+	flags.StringP("tracing.file", "", "traces.jsonl", "The file the file exporter appends spans to")
+	flags.StringP("tracing.service-name", "", "brito", "The service name of the exported spans")
+	flags.Float64P("tracing.sample-ratio", "", 1, "The share of new traces that are exported")
+
+	// errors subsection flags
+	flags.StringP("errors.dsn", "", "", "The Sentry DSN panics and server errors are reported to")
+	flags.DurationP("errors.group-interval", "", time.Minute, "How long further events of a reported error are only counted")
+
+	// mail subsection flags
+	flags.StringP("mail.driver", "", "log", "The mailer to use (smtp|log)")
+	flags.StringP("mail.from", "", "brito <noreply@localhost>", "The sender address for outgoing mail")
+	flags.StringP("mail.dir", "", "", "The folder the log mailer writes .eml files to")
+	flags.StringP("mail.smtp-host", "", "localhost", "The SMTP server hostname")
+	flags.IntP("mail.smtp-port", "", 587, "The SMTP server port")
+	flags.StringP("mail.smtp-user", "", "", "The SMTP username")
+	flags.StringP("mail.smtp-pass", "", "", "The SMTP password")
+
+	// auth subsection flags
+	flags.StringP("auth.secret-key", "", "", "Hex encoded key used to sign account tokens")
+	flags.StringP("auth.root-url", "", "http://localhost", "The external URL of the app, used in email links")
+	flags.DurationP("auth.reset-token-ttl", "", time.Hour, "Lifetime of password reset tokens")
+	flags.DurationP("auth.verify-token-ttl", "", time.Hour*48, "Lifetime of email verification tokens")
+	flags.IntP("auth.rate-limit", "", 5, "Maximum account emails per rate limit window, per IP and per email")
+	flags.DurationP("auth.rate-limit-window", "", time.Minute*15, "The account email rate limit window")
+	flags.StringP("auth.totp-issuer", "", "brito", "The name accounts are listed under in authenticator apps")
+	flags.StringP("auth.throttle-store", "", "db", "Where failed logins are counted (db|memory)")
+	flags.IntP("auth.throttle-free-attempts", "", 3, "Failed logins per IP and per account before attempts are delayed")
+	flags.DurationP("auth.throttle-base-delay", "", time.Second, "The delay after the first throttled failed login, doubled with every failure")
+	flags.DurationP("auth.throttle-max-delay", "", time.Minute*5, "The maximum delay between login attempts")
+	flags.DurationP("auth.throttle-window", "", time.Hour*24, "How long failed logins are remembered after the last one")
+	flags.IntP("auth.lockout-threshold", "", 10, "Failed logins after which an account is locked, 0 to disable")
+	flags.DurationP("auth.lockout-duration", "", time.Hour, "How long accounts are locked after too many failed logins")
+
+	return flags
+}
+
+// NewLogger returns a new zap logger logging at level, which is set to the
+// level of the log config. Every entry has the service, env and version,
+// and the fields of the log config.
+func NewLogger(cfg *Config, level zap.AtomicLevel, version string) (*zap.Logger, error) {
 	// JSON logging for production. Should be coupled with a log analyzer
 	// like newrelic, elk, logstash etc.
-	if cfg.Server.ProdLogger {
-		zapCfg = zap.NewProductionConfig()
-	} else { // Enable colored logging
-		zapCfg = zap.NewDevelopmentConfig()
-		zapCfg.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+	prod := cfg.Server.ProdLogger
+	encCfg := zap.NewDevelopmentEncoderConfig()
+	encoding, lvl, stackLevel := "console", zapcore.DebugLevel, zapcore.WarnLevel
+	if prod {
+		encCfg = zap.NewProductionEncoderConfig()
+		encoding, lvl, stackLevel = "json", zapcore.InfoLevel, zapcore.ErrorLevel
+	}
+
+	if len(cfg.Log.Level) > 0 {
+		if err := lvl.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+			return nil, errors.Wrap(err, "invalid log level")
+		}
+	}
+	// Log at the level of the config until it is changed on level
+	level.SetLevel(lvl)
+
+	outputs, err := newLogOutputs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Log.Encoding) > 0 {
+		encoding = cfg.Log.Encoding
+	}
+	var enc zapcore.Encoder
+	switch encoding {
+	case "json":
+		enc = zapcore.NewJSONEncoder(encCfg)
+	case "console":
+		// Colors only for the terminal, not in log files
+		if !hasLogFile(cfg) {
+			encCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		}
+		enc = zapcore.NewConsoleEncoder(encCfg)
+	default:
+		return nil, fmt.Errorf("unknown log encoding %q", encoding)
 	}
 
-	// Change the log output from os.Stderr to os.Stdout to prevent
-	// the abcweb dev command from displaying duplicate lines
-	zapCfg.OutputPaths = []string{"stdout"}
+	opts := []zap.Option{zap.ErrorOutput(zapcore.Lock(os.Stderr)), zap.AddCaller()}
+	if !prod {
+		opts = append(opts, zap.Development())
+	}
+	switch cfg.Log.StacktraceLevel {
+	case "off":
+	case "":
+		opts = append(opts, zap.AddStacktrace(stackLevel))
+	default:
+		if err := stackLevel.UnmarshalText([]byte(cfg.Log.StacktraceLevel)); err != nil {
+			return nil, errors.Wrap(err, "invalid log stacktrace-level")
+		}
+		opts = append(opts, zap.AddStacktrace(stackLevel))
+	}
+
+	fields := []zapcore.Field{
+		zap.String("service", cfg.Log.Service),
+		zap.String("env", cfg.Env),
+		zap.String("version", version),
+	}
+	keys := make([]string, 0, len(cfg.Log.Fields))
+	for k := range cfg.Log.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, zap.String(k, cfg.Log.Fields[k]))
+	}
+	opts = append(opts, zap.Fields(fields...))
+
+	core := zapcore.NewCore(enc, outputs, level)
+	if cfg.Log.SamplingInitial > 0 {
+		core = zapcore.NewSampler(core, time.Second, cfg.Log.SamplingInitial, cfg.Log.SamplingThereafter)
+	}
+	return zap.New(core, opts...), nil
+}
+
+// newLogOutputs opens the outputs of the log config, with log files that
+// are rotated at the limits of the config
+func newLogOutputs(cfg *Config) (zapcore.WriteSyncer, error) {
+	var outputs []zapcore.WriteSyncer
+	for _, out := range splitList(cfg.Log.Output) {
+		switch out {
+		case "stdout":
+			outputs = append(outputs, os.Stdout)
+		case "stderr":
+			outputs = append(outputs, os.Stderr)
+		default:
+			f, err := logging.NewFile(out, int64(cfg.Log.MaxSize)<<20, cfg.Log.MaxAge, cfg.Log.MaxBackups)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot open log output %q", out)
+			}
+			outputs = append(outputs, f)
+		}
+	}
+	if len(outputs) == 0 {
+		return nil, errors.New("no log output")
+	}
+	return zap.CombineWriteSyncers(outputs...), nil
+}
+
+// hasLogFile reports whether the log config writes to a file
+func hasLogFile(cfg *Config) bool {
+	for _, out := range splitList(cfg.Log.Output) {
+		if out != "stdout" && out != "stderr" {
+			return true
+		}
+	}
+	return false
+}
 
-	return zapCfg.Build()
+// NewAccessLog returns the access log of the access-log config
+func NewAccessLog(cfg *Config, log *zap.Logger) (*logging.AccessLog, error) {
+	return logging.NewAccessLog(logging.AccessLog{
+		Log:        log,
+		Fields:     splitList(cfg.AccessLog.Fields),
+		Headers:    splitList(cfg.AccessLog.Headers),
+		Redact:     splitList(cfg.AccessLog.Redact),
+		BodyRoutes: splitList(cfg.AccessLog.BodyRoutes),
+		MaxBody:    cfg.AccessLog.MaxBody,
+		SkipPaths:  splitList(cfg.AccessLog.SkipPaths),
+		Sample:     cfg.AccessLog.Sample,
+	})
 }
 
+// NewProxies returns the trusted reverse proxies of the http config
+func NewProxies(cfg *Config) (*server.Proxies, error) {
+	return server.ParseProxies(splitList(cfg.HTTP.TrustedProxies))
+}
+
+// NewCORS returns the CORS handler of the http cors-origins, nil if there
+// are none. Cross-origin requests carry the session cookie, so an allowed
+// origin can read the CSRF token of the signed in user: allowing any
+// origin with "*" is refused.
+func NewCORS(cfg *Config) (*cors.Cors, error) {
+	origins := splitList(cfg.HTTP.CORSOrigins)
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			return nil, errors.New("http cors-origins cannot allow any origin with *, the requests carry the session cookie")
+		}
+	}
+
+	// for more ideas, see: https://developer.github.com/v3/#cross-origin-resource-sharing
+	return cors.New(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		ExposedHeaders:   []string{"Link"},
+		AllowCredentials: true,
+		MaxAge:           300, // Maximum value not ignored by any of major browsers
+	}), nil
+}
+
+// splitList returns the items of a comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// NewClientAuth returns the client CA pool and client auth mode of the
+// mutual TLS config, a nil pool if it is off
+func NewClientAuth(cfg *Config) (*x509.CertPool, tls.ClientAuthType, error) {
+	if len(cfg.TLS.ClientCAFile) == 0 {
+		if len(cfg.TLS.ClientCertPaths) > 0 {
+			return nil, tls.NoClientCert, errors.New("tls client-cert-paths need a client-ca-file")
+		}
+		return nil, tls.NoClientCert, nil
+	}
+	if len(cfg.Server.TLSBind) == 0 {
+		return nil, tls.NoClientCert, errors.New("tls client-ca-file needs the server tls-bind")
+	}
+
+	var auth tls.ClientAuthType
+	switch cfg.TLS.ClientAuth {
+	case "optional", "":
+		auth = tls.VerifyClientCertIfGiven
+	case "require":
+		auth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, tls.NoClientCert, fmt.Errorf("unknown tls client-auth %q", cfg.TLS.ClientAuth)
+	}
+
+	pool, err := server.LoadCertPool(cfg.TLS.ClientCAFile)
+	if err != nil {
+		return nil, tls.NoClientCert, errors.Wrap(err, "cannot load the tls client-ca-file")
+	}
+	return pool, auth, nil
+}
+
+// NewTracer returns the tracer of the tracing config, which exports the
+// sampled spans in the background
+func NewTracer(cfg *Config, log *zap.Logger) (*tracing.Tracer, error) {
+	var exp tracing.Exporter
+	switch cfg.Tracing.Exporter {
+	case "otlp":
+		exp = &tracing.OTLPExporter{
+			Endpoint: cfg.Tracing.Endpoint,
+			Headers:  cfg.Tracing.Headers,
+			Service:  cfg.Tracing.ServiceName,
+			Client:   &http.Client{Timeout: time.Second * 10},
+		}
+	case "stdout":
+		exp = &tracing.WriterExporter{W: os.Stdout}
+	case "file":
+		f, err := os.OpenFile(cfg.Tracing.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot open tracing file")
+		}
+		exp = &tracing.WriterExporter{W: f}
+	case "none", "":
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", cfg.Tracing.Exporter)
+	}
+
+	return tracing.NewTracer(exp, cfg.Tracing.SampleRatio, log), nil
+}
+
+// NewDBPool returns the database connection pool settings
+func NewDBPool(cfg *Config) db.PoolConfig {
+	return db.PoolConfig{
+		MaxOpenConns:    cfg.Database.MaxOpenConns,
+		MaxIdleConns:    cfg.Database.MaxIdleConns,
+		ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+		ConnMaxIdleTime: cfg.Database.ConnMaxIdleTime,
+		ConnectTimeout:  cfg.Database.ConnectTimeout,
+	}
+}
+
+// NewErrorReporter returns the error reporting client of the errors
+// config, which sends the events in the background. It reports nothing
+// without a DSN.
+func NewErrorReporter(cfg *Config, release string, log *zap.Logger) (*reporting.Client, error) {
+	if len(cfg.Errors.DSN) == 0 {
+		return &reporting.Client{}, nil
+	}
+	rep, err := reporting.NewSentryReporter(cfg.Errors.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	c := reporting.NewClient(rep, log)
+	c.Release = release
+	c.Environment = cfg.Env
+	c.ServerName, _ = os.Hostname()
+	c.GroupInterval = cfg.Errors.GroupInterval
+	c.Redact = splitList(cfg.AccessLog.Redact)
+	return c, nil
+}
+
+// NewMailer returns the mailer selected by the mail driver config.
+// The log mailer should be used in development so no mail is sent.
+func NewMailer(cfg *Config, log *zap.Logger) (mailer.Mailer, error) {
+	switch cfg.Mail.Driver {
+	case "smtp":
+		return &mailer.SMTPMailer{
+			Host:     cfg.Mail.SMTPHost,
+			Port:     cfg.Mail.SMTPPort,
+			Username: cfg.Mail.SMTPUser,
+			Password: cfg.Mail.SMTPPass,
+			From:     cfg.Mail.From,
+		}, nil
+	case "log", "":
+		return mailer.NewLogMailer(log, cfg.Mail.Dir, cfg.Mail.From)
+	}
+
+	return nil, fmt.Errorf("unknown mail driver %q", cfg.Mail.Driver)
+}
+
+// NewThrottleStore returns the store failed logins are counted in, as
+// selected by the throttle-store config. Use the database store when
+// running more than one instance so the limits hold across all of them.
+func NewThrottleStore(cfg *Config) (auth.ThrottleStore, error) {
+	switch cfg.Auth.ThrottleStore {
+	case "db", "":
+		return models.ThrottleStore{}, nil
+	case "memory":
+		return auth.NewMemoryThrottleStore(), nil
+	}
+
+	return nil, fmt.Errorf("unknown throttle store %q", cfg.Auth.ThrottleStore)
+}
+
+// NewSecretKey returns the configured app secret key used to sign account
+// tokens and to derive the session cookie key
+func NewSecretKey(cfg *Config, log *zap.Logger) ([]byte, error) {
+	if len(cfg.Auth.SecretKey) == 0 {
+		log.Warn("auth secret-key not set, using a random key that is lost on restart")
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	key, err := hex.DecodeString(cfg.Auth.SecretKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "auth secret-key must be hex encoded")
+	}
+	if len(key) < 32 {
+		return nil, errors.New("auth secret-key must be at least 32 bytes")
+	}
+
+	return key, nil
+}
+
+// NewOIDCProviders returns the configured OpenID Connect providers. Their
+// callback URLs are /login/oidc/<name>/callback under the auth root-url.
+func NewOIDCProviders(cfg *Config) ([]*oidc.Provider, error) {
+	var providers []*oidc.Provider
+	seen := map[string]bool{}
+	// Requests to the providers are traced as part of the login requests
+	oidcClient := &http.Client{Timeout: time.Second * 10, Transport: tracing.Transport{}}
+
+	for _, p := range cfg.OIDC {
+		if !validProviderName.MatchString(p.Name) {
+			return nil, fmt.Errorf("oidc provider name %q must only contain a-z, 0-9, _ and -", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("oidc provider name %q is used twice", p.Name)
+		}
+		seen[p.Name] = true
+
+		if len(p.Issuer) == 0 || len(p.ClientID) == 0 {
+			return nil, fmt.Errorf("oidc provider %q needs an issuer and client-id", p.Name)
+		}
+
+		displayName := p.DisplayName
+		if len(displayName) == 0 {
+			displayName = p.Name
+		}
+		// The email is needed to provision users
+		scopes := p.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"email", "profile"}
+		}
+
+		redirectURL := strings.TrimSuffix(cfg.Auth.RootURL, "/") + "/login/oidc/" + p.Name + "/callback"
+		providers = append(providers, oidc.NewProvider(oidc.Config{
+			Name:         p.Name,
+			DisplayName:  displayName,
+			Issuer:       p.Issuer,
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			Scopes:       scopes,
+			RoleClaim:    p.RoleClaim,
+			Roles:        p.Roles,
+		}, redirectURL, oidcClient, auth.SystemClock))
+	}
+
+	return providers, nil
+}
+
+var validProviderName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
 // NewMiddlewares returns a list of middleware to be used by the router.
 // See https://github.com/go-chi/chi#middlewares and abcweb readme for extras.
-func NewMiddlewares(cfg *Config, log *zap.Logger) []abcmiddleware.MiddlewareFunc {
+func NewMiddlewares(cfg *Config, session abcsessions.Overseer, reg *metrics.Registry, proxies *server.Proxies, crossOrigin *cors.Cors, access *logging.AccessLog, log *zap.Logger) []abcmiddleware.MiddlewareFunc {
 	m := abcmiddleware.Middleware{
 		Log: log,
 	}
 
 	middlewares := []abcmiddleware.MiddlewareFunc{}
 
+	// Sets the remote address of the requests of the trusted reverse
+	// proxies to their client, before anything logs or throttles by it
+	if proxies != nil {
+		middlewares = append(middlewares, proxies.RealIP)
+	}
+
+	// Answers the CORS preflight requests of the allowed origins
+	if crossOrigin != nil {
+		middlewares = append(middlewares, crossOrigin.Handler)
+	}
+
 	// Display "abcweb dev" build errors in the browser.
 	if !cfg.Server.ProdLogger {
 		middlewares = append(middlewares, web.ErrorChecker)
@@ -87,16 +875,46 @@ func NewMiddlewares(cfg *Config, log *zap.Logger) []abcmiddleware.MiddlewareFunc
 	// other middleware injected below this one, and in your controllers.
 	middlewares = append(middlewares, m.RequestIDLogger)
 
+	// Traces the request, continuing the trace of the caller, and adds the
+	// trace and span IDs to the request logger
+	middlewares = append(middlewares, tracing.Middleware)
+
+	// Counts the database queries of the request for the request logger,
+	// so the access log line has their number and time
+	middlewares = append(middlewares, db.QueryStats)
+
+	// Counts the requests and their durations by route for /metrics
+	if reg != nil {
+		middlewares = append(middlewares, metrics.NewHTTP(reg).Middleware)
+	}
+
 	// Graceful panic recovery that uses zap to log the stack trace
 	middlewares = append(middlewares, m.Recover)
 
-	// Use zap logger for all routing
-	middlewares = append(middlewares, m.Zap)
+	// Reports the panics and the errors of 5xx responses, which the
+	// recovery middleware answers and logs
+	middlewares = append(middlewares, reporting.Middleware)
+
+	// Writes the access log with the request logger
+	middlewares = append(middlewares, access.Middleware)
 
 	// Sets response headers to prevent clients from caching
 	if cfg.Server.AssetsNoCache {
 		middlewares = append(middlewares, chimiddleware.NoCache)
 	}
 
+	// Sends the reads of clients that just wrote to the primary database
+	// instead of the read replicas
+	if len(cfg.Database.Replicas) > 0 {
+		middlewares = append(middlewares, db.ReadYourWrites(cfg.Database.StickyWindow))
+	}
+
+	// Buffers the session cookie writes and resets the session expiry.
+	// This must come last: the sessions API needs the ResponseWriter it
+	// creates, which middleware that wraps the ResponseWriter (like the access log) hides.
+	if session != nil {
+		middlewares = append(middlewares, session.MiddlewareWithReset)
+	}
+
 	return middlewares
 }
@@ -6,13 +6,10 @@ import (
 	"testing"
 
 	"github.com/fadeojo/brito/db"
-	"github.com/volatiletech/abcweb/abcdatabase"
 )
 
 func TestMain(m *testing.M) {
-	var err error
-	var count int
-	db.DB, count, err = abcdatabase.SetupTestSuite(db.GoTestdata)
+	count, err := db.SetupTestSuite(db.GoTestdata)
 	if err != nil {
 		fmt.Printf("TestMain setup failed: %s\n", err)
 		os.Exit(1)
@@ -20,5 +17,8 @@ func TestMain(m *testing.M) {
 	fmt.Printf("TestMain Setup ran %d migrations.\n", count)
 
 	r := m.Run()
+	if err := db.TeardownTestSuite(); err != nil {
+		fmt.Printf("TestMain teardown failed: %s\n", err)
+	}
 	os.Exit(r)
 }
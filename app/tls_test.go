@@ -0,0 +1,64 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewClientAuth(t *testing.T) {
+	t.Parallel()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client CA"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{}
+	if pool, _, err := NewClientAuth(cfg); pool != nil || err != nil {
+		t.Errorf("expected mutual TLS to be off, got %v %v", pool, err)
+	}
+
+	cfg.TLS.ClientCertPaths = []string{"/admin"}
+	if _, _, err := NewClientAuth(cfg); err == nil {
+		t.Error("expected an error for paths without a CA")
+	}
+
+	cfg.TLS.ClientCAFile = caFile
+	if _, _, err := NewClientAuth(cfg); err == nil {
+		t.Error("expected an error without a tls bind")
+	}
+
+	cfg.Server.TLSBind = ":443"
+	cfg.TLS.ClientAuth = "require"
+	pool, auth, err := NewClientAuth(cfg)
+	if err != nil || pool == nil || auth != tls.RequireAndVerifyClientCert {
+		t.Errorf("unexpected %v %v %v", pool, auth, err)
+	}
+
+	cfg.TLS.ClientAuth = "always"
+	if _, _, err := NewClientAuth(cfg); err == nil {
+		t.Error("expected an error for the client-auth")
+	}
+}
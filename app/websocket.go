@@ -0,0 +1,44 @@
+package app
+
+import (
+	"github.com/fadeojo/brito/metrics"
+	"github.com/fadeojo/brito/tracing"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// NewWebsocket returns the hub of the /ws websocket sessions. Messages are
+// traced as spans of the request that opened the session, and counted in
+// reg with the active sessions if reg is set.
+//
+// It sets the message handlers of the hub, so handlers set later have to
+// call the ones they replace.
+func NewWebsocket(reg *metrics.Registry) *melody.Melody {
+	ws := melody.New()
+
+	messages := metrics.NewCounter("brito_websocket_messages_total", "Number of websocket messages.", "direction")
+	if reg != nil {
+		reg.Register(
+			metrics.GaugeFunc("brito_websocket_sessions", "Number of active websocket sessions.", func() float64 {
+				return float64(ws.Len())
+			}),
+			messages,
+		)
+	}
+
+	handle := func(direction string) func(*melody.Session, []byte) {
+		return func(s *melody.Session, msg []byte) {
+			messages.Inc(direction)
+
+			_, span := tracing.Child(s.Request.Context(), "websocket "+direction, tracing.KindInternal)
+			span.SetAttribute("websocket.direction", direction)
+			span.SetAttribute("websocket.message_size", len(msg))
+			span.End()
+		}
+	}
+	ws.HandleMessage(handle("in"))
+	ws.HandleMessageBinary(handle("in"))
+	ws.HandleSentMessage(handle("out"))
+	ws.HandleSentMessageBinary(handle("out"))
+
+	return ws
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time. Code that depends on the current time, like TOTP
+// verification, takes a Clock so tests can control time with a FakeClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock backed by time.Now
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// FakeClock is a Clock that only moves when told to
+type FakeClock struct {
+	mut sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock set to now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the fake current time
+func (f *FakeClock) Now() time.Time {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.now
+}
+
+// Advance moves the fake current time forward by d
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Set changes the fake current time to now
+func (f *FakeClock) Set(now time.Time) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.now = now
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the minimum number of characters in a password
+const MinPasswordLength = 8
+
+// BcryptCost is the bcrypt work factor used by HashPassword.
+// Tests can lower it to bcrypt.MinCost to speed things up.
+var BcryptCost = bcrypt.DefaultCost
+
+// ErrPasswordTooShort is returned by ValidatePassword for short passwords
+var ErrPasswordTooShort = errors.New("password is too short")
+
+// ValidatePassword checks that password meets the password policy
+func ValidatePassword(password string) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
+
+// HashPassword returns the bcrypt hash of password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password matches the bcrypt hash.
+// An empty hash, as stored for accounts without a password, never matches.
+func CheckPassword(hash string, password string) bool {
+	if len(hash) == 0 {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
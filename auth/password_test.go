@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPassword(t *testing.T) {
+	BcryptCost = bcrypt.MinCost
+
+	if err := ValidatePassword("short"); err != ErrPasswordTooShort {
+		t.Errorf("expected ErrPasswordTooShort, got %v", err)
+	}
+	if err := ValidatePassword("long enough"); err != nil {
+		t.Error(err)
+	}
+
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckPassword(hash, "correct horse") {
+		t.Error("expected password to match its hash")
+	}
+	if CheckPassword(hash, "battery staple") {
+		t.Error("expected wrong password not to match")
+	}
+	if CheckPassword("", "") {
+		t.Error("expected empty hash never to match")
+	}
+}
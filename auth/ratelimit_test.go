@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1500000000, 0)
+	l := NewRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	if !l.Allow("a") || !l.Allow("a") {
+		t.Fatal("expected first two events to be allowed")
+	}
+	if l.Allow("a") {
+		t.Error("expected third event to be limited")
+	}
+	if !l.Allow("b") {
+		t.Error("expected other keys to be unaffected")
+	}
+
+	now = now.Add(time.Minute)
+	if !l.Allow("a") {
+		t.Error("expected a new window to allow events again")
+	}
+	if _, ok := l.windows["b"]; ok {
+		t.Error("expected expired windows to be swept")
+	}
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// ThrottleStore keeps the failed attempt counts of a Throttle. Use a store
+// that is shared by all instances of the app, like the database, so the
+// limits hold no matter which instance a request is sent to.
+type ThrottleStore interface {
+	// Failures returns the failures recorded for key since the given time,
+	// and the time of the last one
+	Failures(key string, since time.Time) (count int, last time.Time, err error)
+	// AddFailure records a failure for key at the given time and returns
+	// the new count. Failures recorded before since are forgotten.
+	AddFailure(key string, at time.Time, since time.Time) (int, error)
+	// Reset forgets all failures of key
+	Reset(key string) error
+}
+
+// Throttle slows down guessing by delaying the next attempt exponentially
+// with every failure. The first FreeAttempts failures of a key cost nothing,
+// after that an attempt has to wait BaseDelay, doubling up to MaxDelay.
+// Failures are forgotten once no new one was recorded for Window.
+//
+// Attempts that come too early are meant to be rejected rather than held
+// up, so guessing costs the attacker time without tying up the server.
+type Throttle struct {
+	Store ThrottleStore
+	Clock Clock
+
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+// Wait returns how long the client has to wait before the next attempt is
+// allowed for all of keys, zero if it is allowed now
+func (t *Throttle) Wait(keys ...string) (time.Duration, error) {
+	now := t.Clock.Now()
+
+	var wait time.Duration
+	for _, key := range keys {
+		count, last, err := t.Store.Failures(key, now.Add(-t.Window))
+		if err != nil {
+			return 0, err
+		}
+		if w := last.Add(t.Delay(count)).Sub(now); w > wait {
+			wait = w
+		}
+	}
+
+	return wait, nil
+}
+
+// Fail records a failed attempt for key and returns the number of failures
+// within the window
+func (t *Throttle) Fail(key string) (int, error) {
+	now := t.Clock.Now()
+	return t.Store.AddFailure(key, now, now.Add(-t.Window))
+}
+
+// Reset forgets the failures of key, after a successful attempt
+func (t *Throttle) Reset(key string) error {
+	return t.Store.Reset(key)
+}
+
+// Delay returns the wait required after the given number of failures
+func (t *Throttle) Delay(failures int) time.Duration {
+	n := failures - t.FreeAttempts
+	if n <= 0 {
+		return 0
+	}
+
+	delay := t.BaseDelay
+	for i := 1; i < n && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+
+	return delay
+}
+
+// MemoryThrottleStore is a ThrottleStore for a single instance of the app,
+// and for tests
+type MemoryThrottleStore struct {
+	mut       sync.Mutex
+	failures  map[string]*throttleFailures
+	lastSweep time.Time
+}
+
+type throttleFailures struct {
+	count int
+	last  time.Time
+}
+
+// NewMemoryThrottleStore returns an empty MemoryThrottleStore
+func NewMemoryThrottleStore() *MemoryThrottleStore {
+	return &MemoryThrottleStore{
+		failures: make(map[string]*throttleFailures),
+	}
+}
+
+// Failures implements ThrottleStore
+func (m *MemoryThrottleStore) Failures(key string, since time.Time) (int, time.Time, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	f, ok := m.failures[key]
+	if !ok || f.last.Before(since) {
+		return 0, time.Time{}, nil
+	}
+	return f.count, f.last, nil
+}
+
+// AddFailure implements ThrottleStore. Expired keys are removed at most
+// once per window so the map does not grow without bound.
+func (m *MemoryThrottleStore) AddFailure(key string, at time.Time, since time.Time) (int, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if m.lastSweep.Before(since) {
+		m.lastSweep = at
+		for k, f := range m.failures {
+			if f.last.Before(since) {
+				delete(m.failures, k)
+			}
+		}
+	}
+
+	f, ok := m.failures[key]
+	if !ok || f.last.Before(since) {
+		f = &throttleFailures{}
+		m.failures[key] = f
+	}
+	f.count++
+	f.last = at
+
+	return f.count, nil
+}
+
+// Reset implements ThrottleStore
+func (m *MemoryThrottleStore) Reset(key string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	delete(m.failures, key)
+	return nil
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	t.Parallel()
+
+	th := &Throttle{FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: time.Second * 10}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, time.Second * 2},
+		{5, time.Second * 4},
+		{6, time.Second * 8},
+		{7, time.Second * 10},
+		{1000, time.Second * 10},
+	}
+
+	for _, test := range tests {
+		if got := th.Delay(test.failures); got != test.want {
+			t.Errorf("%d failures: want %s, got %s", test.failures, test.want, got)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	t.Parallel()
+
+	clock := NewFakeClock(time.Unix(1500000000, 0))
+	th := &Throttle{
+		Store:        NewMemoryThrottleStore(),
+		Clock:        clock,
+		FreeAttempts: 1,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		Window:       time.Hour,
+	}
+
+	wait := func(keys ...string) time.Duration {
+		t.Helper()
+		w, err := th.Wait(keys...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	fail := func(key string) int {
+		t.Helper()
+		n, err := th.Fail(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if fail("a") != 1 || wait("a") != 0 {
+		t.Error("expected the first failure to be free")
+	}
+	if fail("a") != 2 || wait("a") != time.Second {
+		t.Error("expected a delay after the second failure")
+	}
+	fail("a")
+	if w := wait("a", "b"); w != time.Second*2 {
+		t.Errorf("expected the longest wait of all keys, got %s", w)
+	}
+
+	clock.Advance(time.Second)
+	if w := wait("a"); w != time.Second {
+		t.Errorf("expected the wait to count down, got %s", w)
+	}
+
+	clock.Advance(time.Hour)
+	if wait("a") != 0 || fail("a") != 1 {
+		t.Error("expected failures to be forgotten after the window")
+	}
+
+	fail("a")
+	if err := th.Reset("a"); err != nil {
+		t.Fatal(err)
+	}
+	if wait("a") != 0 || fail("a") != 1 {
+		t.Error("expected reset to forget failures")
+	}
+}
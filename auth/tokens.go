@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Token purposes. A token issued for one purpose is never valid for another.
+const (
+	PurposeVerifyEmail   = "verify-email"
+	PurposeResetPassword = "reset-password"
+	PurposeUnlockAccount = "unlock-account"
+)
+
+// The errors returned when a token cannot be used
+var (
+	ErrTokenInvalid = errors.New("token is invalid")
+	ErrTokenExpired = errors.New("token has expired")
+)
+
+// stampSize is the length of the truncated stamp MAC carried in tokens
+const stampSize = 16
+
+// Signer issues and verifies signed, expiring account tokens.
+//
+// Tokens are bound to a stamp: a string derived from the account state that
+// the token acts upon, for example the password hash for a password reset.
+// Using the token changes that state, and with it the stamp, which makes
+// every token single-use without having to store them.
+type Signer struct {
+	key []byte
+	now func() time.Time
+}
+
+// Claims is the verified content of a token
+type Claims struct {
+	Purpose string
+	UserID  int64
+	Expires time.Time
+
+	stamp []byte
+}
+
+// NewSigner returns a Signer using key to sign tokens
+func NewSigner(key []byte) *Signer {
+	return &Signer{
+		key: key,
+		now: time.Now,
+	}
+}
+
+// Issue returns a token for purpose and userID that is valid for ttl
+// and only for as long as the user's stamp is unchanged.
+func (s *Signer) Issue(purpose string, userID int64, stamp string, ttl time.Duration) (string, error) {
+	// payload: expiry(8) | userID(8) | nonce(8) | stamp mac(16)
+	payload := make([]byte, 24, 24+stampSize)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(s.now().Add(ttl).Unix()))
+	binary.BigEndian.PutUint64(payload[8:16], uint64(userID))
+	if _, err := rand.Read(payload[16:24]); err != nil {
+		return "", err
+	}
+	payload = append(payload, s.stampMAC(stamp)...)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(purpose, payload)), nil
+}
+
+// Parse verifies the signature and expiry of token for purpose and returns
+// its claims. It does not check the stamp, so callers acting on the token
+// should use Verify instead.
+func (s *Signer) Parse(purpose string, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrTokenInvalid
+	}
+
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil || len(payload) != 24+stampSize {
+		return nil, ErrTokenInvalid
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	if !hmac.Equal(sig, s.sign(purpose, payload)) {
+		return nil, ErrTokenInvalid
+	}
+
+	claims := &Claims{
+		Purpose: purpose,
+		Expires: time.Unix(int64(binary.BigEndian.Uint64(payload[0:8])), 0),
+		UserID:  int64(binary.BigEndian.Uint64(payload[8:16])),
+		stamp:   payload[24:],
+	}
+
+	if !s.now().Before(claims.Expires) {
+		return nil, ErrTokenExpired
+	}
+
+	return claims, nil
+}
+
+// Verify parses token and checks it against the user's current stamp
+// returned by stampFn.
+func (s *Signer) Verify(purpose string, token string, stampFn func(userID int64) (string, error)) (*Claims, error) {
+	claims, err := s.Parse(purpose, token)
+	if err != nil {
+		return nil, err
+	}
+
+	stamp, err := stampFn(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(claims.stamp, s.stampMAC(stamp)) {
+		return nil, ErrTokenInvalid
+	}
+
+	return claims, nil
+}
+
+func (s *Signer) sign(purpose string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (s *Signer) stampMAC(stamp string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("stamp"))
+	mac.Write([]byte{0})
+	mac.Write([]byte(stamp))
+	return mac.Sum(nil)[:stampSize]
+}
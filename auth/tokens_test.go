@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(now *time.Time) *Signer {
+	s := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func stamps(m map[int64]string) func(int64) (string, error) {
+	return func(userID int64) (string, error) {
+		stamp, ok := m[userID]
+		if !ok {
+			return "", ErrTokenInvalid
+		}
+		return stamp, nil
+	}
+}
+
+func TestSignerRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1500000000, 0)
+	s := newTestSigner(&now)
+
+	token, err := s.Issue(PurposeResetPassword, 42, "hash-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := s.Verify(PurposeResetPassword, token, stamps(map[int64]string{42: "hash-1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 42 {
+		t.Errorf("expected user id 42, got %d", claims.UserID)
+	}
+	if !claims.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected expiry %s, got %s", now.Add(time.Hour), claims.Expires)
+	}
+}
+
+func TestSignerRejects(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1500000000, 0)
+	s := newTestSigner(&now)
+	current := stamps(map[int64]string{42: "hash-1"})
+
+	token, err := s.Issue(PurposeResetPassword, 42, "hash-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Verify(PurposeVerifyEmail, token, current); err != ErrTokenInvalid {
+		t.Errorf("wrong purpose: expected ErrTokenInvalid, got %v", err)
+	}
+
+	if _, err := s.Verify(PurposeResetPassword, token, stamps(map[int64]string{42: "hash-2"})); err != ErrTokenInvalid {
+		t.Errorf("changed stamp: expected ErrTokenInvalid, got %v", err)
+	}
+
+	other := NewSigner([]byte("fedcba9876543210fedcba9876543210"))
+	if _, err := other.Verify(PurposeResetPassword, token, current); err != ErrTokenInvalid {
+		t.Errorf("wrong key: expected ErrTokenInvalid, got %v", err)
+	}
+
+	// Swap in the payload of a token issued for another user
+	forged, err := s.Issue(PurposeResetPassword, 43, "hash-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]
+	if _, err := s.Verify(PurposeResetPassword, tampered, current); err != ErrTokenInvalid {
+		t.Errorf("tampered payload: expected ErrTokenInvalid, got %v", err)
+	}
+
+	for _, garbage := range []string{"", ".", "abc", "a.b.c", "!!!.???"} {
+		if _, err := s.Verify(PurposeResetPassword, garbage, current); err != ErrTokenInvalid {
+			t.Errorf("%q: expected ErrTokenInvalid, got %v", garbage, err)
+		}
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := s.Verify(PurposeResetPassword, token, current); err != ErrTokenExpired {
+		t.Errorf("expired: expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestSignerStampError(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1500000000, 0)
+	s := newTestSigner(&now)
+
+	token, err := s.Issue(PurposeVerifyEmail, 7, "a@b.c:false", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbErr := errors.New("db down")
+	_, err = s.Verify(PurposeVerifyEmail, token, func(int64) (string, error) { return "", dbErr })
+	if err != dbErr {
+		t.Errorf("expected stamp func error to be returned, got %v", err)
+	}
+}
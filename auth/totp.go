@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TOTP parameters. These are the defaults every authenticator app supports,
+// so they are not configurable.
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+	// TOTPSkew is the number of periods before and after the current one
+	// that are also accepted, to allow for clock drift.
+	TOTPSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 encoded TOTP secret
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTP generates and validates RFC 6238 time-based one-time passwords
+type TOTP struct {
+	key   []byte
+	clock Clock
+}
+
+// NewTOTP returns a TOTP for the base32 encoded secret
+func NewTOTP(secret string, clock Clock) (*TOTP, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid totp secret")
+	}
+
+	return &TOTP{key: key, clock: clock}, nil
+}
+
+// Code returns the code for the current period
+func (t *TOTP) Code() string {
+	return t.code(t.step(t.clock.Now()))
+}
+
+// Validate checks code against the current period and the periods within
+// TOTPSkew. Each period's code is only accepted once: lastStep is the step
+// of the last code the user successfully used, and codes from that step or
+// earlier are rejected. On success the step of the matched code is returned
+// and must be stored as the new lastStep.
+func (t *TOTP) Validate(code string, lastStep int64) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	current := t.step(t.clock.Now())
+	for step := current - TOTPSkew; step <= current+TOTPSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.code(step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func (t *TOTP) step(now time.Time) int64 {
+	return now.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+// code implements the HOTP algorithm from RFC 4226
+func (t *TOTP) code(step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, t.key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod)
+}
+
+// ProvisioningURI returns the otpauth:// URI that authenticator apps scan
+// from a QR code to enroll the secret for account at issuer.
+func ProvisioningURI(secret string, issuer string, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 test secret from RFC 6238 appendix B
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	t.Parallel()
+
+	// The RFC 6238 test vectors, truncated to 6 digits
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	clock := NewFakeClock(time.Time{})
+	totp, err := NewTOTP(rfc6238Secret, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for unix, want := range tests {
+		clock.Set(time.Unix(unix, 0))
+		if got := totp.Code(); got != want {
+			t.Errorf("at %d: want %s, got %s", unix, want, got)
+		}
+	}
+}
+
+func TestTOTPValidate(t *testing.T) {
+	t.Parallel()
+
+	clock := NewFakeClock(time.Unix(1111111109, 0))
+	totp, err := NewTOTP(rfc6238Secret, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := totp.Validate("081804", 0)
+	if !ok {
+		t.Fatal("expected current code to be valid")
+	}
+	if _, ok := totp.Validate("081804", step); ok {
+		t.Error("expected a used code to be rejected")
+	}
+	if _, ok := totp.Validate("081 804", 0); !ok {
+		t.Error("expected spaces to be ignored")
+	}
+
+	// The previous period's code is accepted within the skew
+	clock.Advance(TOTPPeriod)
+	if _, ok := totp.Validate("081804", 0); !ok {
+		t.Error("expected code from the previous period to be valid")
+	}
+
+	clock.Advance(TOTPPeriod)
+	if _, ok := totp.Validate("081804", 0); ok {
+		t.Error("expected code outside the skew to be rejected")
+	}
+
+	if _, ok := totp.Validate("12345", 0); ok {
+		t.Error("expected a short code to be rejected")
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	t.Parallel()
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("expected 32 characters, got %q", secret)
+	}
+	if _, err := NewTOTP(secret, SystemClock); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	t.Parallel()
+
+	uri := ProvisioningURI("ABCDEF", "brito", "a@example.com")
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("wrong scheme or type: %s", uri)
+	}
+	if u.Path != "/brito:a@example.com" {
+		t.Errorf("wrong label: %s", u.Path)
+	}
+	q := u.Query()
+	if q.Get("secret") != "ABCDEF" || q.Get("issuer") != "brito" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("wrong parameters: %s", u.RawQuery)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	t.Parallel()
+
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", RecoveryCodeCount, len(codes))
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("unexpected code format %q", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate code %q", code)
+		}
+		seen[code] = true
+	}
+
+	hash := HashRecoveryCode(codes[0])
+	loose := strings.ToUpper(strings.Replace(codes[0], "-", " ", 1))
+	if HashRecoveryCode(loose) != hash {
+		t.Error("expected case, spaces and dashes to be ignored")
+	}
+	if HashRecoveryCode(codes[1]) == hash {
+		t.Error("expected different codes to have different hashes")
+	}
+}
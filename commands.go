@@ -1,17 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/fadeojo/brito/app"
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/db/seeds"
+	"github.com/fadeojo/brito/migrate"
+	"github.com/fadeojo/brito/reporting"
+	"github.com/fadeojo/brito/routes"
+	"github.com/fadeojo/brito/seed"
+	"github.com/fadeojo/brito/server"
+	"github.com/fadeojo/brito/tracing"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/volatiletech/abcweb/abcconfig"
-	"github.com/volatiletech/abcweb/abcdatabase"
-	"github.com/volatiletech/abcweb/abcserver"
-	"github.com/volatiletech/mig"
+	"go.uber.org/zap"
 )
 
 // rootSetup sets up the root cobra command
@@ -20,7 +35,33 @@ func rootSetup(a *app.App) {
 		Use:   "brito [flags]",
 		Short: "brito web app server",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return abcserver.StartServer(a.Config.Server, a.Router, a.Log)
+			clientCAs, clientAuth, err := app.NewClientAuth(a.Config)
+			if err != nil {
+				return err
+			}
+			if a.Config.Admin.Enabled {
+				go serveAdmin(a)
+			}
+			err = server.Start(a.Config.Server, a.Router, a.Log, server.Options{
+				OnShutdown:      a.Health.Shutdown,
+				ShutdownDelay:   a.Config.HTTP.ShutdownDelay,
+				ShutdownTimeout: a.Config.HTTP.ShutdownTimeout,
+				RestartTimeout:  a.Config.HTTP.RestartTimeout,
+				ClientCAs:       clientCAs,
+				ClientAuth:      clientAuth,
+				H2C:             a.Config.HTTP.H2C,
+			})
+
+			// Export the spans and errors of the last requests
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+			if err := tracing.Default.Shutdown(ctx); err != nil {
+				a.Log.Warn("cannot shut down tracing", zap.Error(err))
+			}
+			if err := reporting.Default.Shutdown(ctx); err != nil {
+				a.Log.Warn("cannot shut down error reporting", zap.Error(err))
+			}
+			return err
 		},
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			return Setup(a, cmd.Flags())
@@ -29,55 +70,395 @@ func rootSetup(a *app.App) {
 
 	// Register the cmd-line flags for --help output
 	a.Root.Flags().AddFlagSet(abcconfig.NewFlagSet())
+	a.Root.Flags().AddFlagSet(app.NewFlagSet())
 }
 
+// serveAdmin serves the admin router on the admin bind, off the public
+// router. It has no write timeout, as CPU profiles and traces stream for
+// as long as they are asked for.
+func serveAdmin(a *app.App) {
+	bind := a.Config.Admin.Bind
+	// Unix sockets are guarded by their permissions
+	if host, _, err := net.SplitHostPort(bind); err == nil && !strings.HasPrefix(bind, "unix:") {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			a.Log.Warn("the admin listener is not bound to localhost, it has no authentication", zap.String("bind", bind))
+		}
+	}
+
+	// The listener is passed on by restarts, like the public ones
+	l, err := server.Listen("admin", bind)
+	if err != nil {
+		a.Log.Fatal("cannot listen for admin", zap.Error(err))
+	}
+
+	srv := &http.Server{
+		Handler:           routes.NewAdminRouter(a),
+		ReadHeaderTimeout: time.Second * 10,
+		ErrorLog:          zap.NewStdLog(a.Log.Named("admin")),
+	}
+	a.Log.Info("starting admin listener", zap.String("bind", bind))
+	err = srv.Serve(l)
+	a.Log.Fatal("admin listener failed", zap.Error(err))
+}
+
+// migrationsDir is where new migrations are created
+var migrationsDir = filepath.Join("db", "migrations")
+
 // migrateSetup sets up the migrate command and binds it to the root command.
 //
-// The migrate up and down command is built into the app so that you do not
-// need to deploy abcweb to your server to run your migrations.
+// The migrate commands and the migrations themselves are built into the app
+// so that you only need to deploy the binary to run your migrations.
 func migrateSetup(a *app.App) {
-	migrate := &cobra.Command{
+	migrateCmd := &cobra.Command{
 		Use:   "migrate",
 		Short: "Run your database migrations",
+		Long:  "Run your database migrations. Without a subcommand all pending migrations are applied.",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			c := abcconfig.NewConfig("")
+			m, v, err := newMigrator(a, cmd)
+			if err != nil {
+				return err
+			}
 
-			v, err := c.Bind(cmd.Flags(), a.Config)
+			if v.GetBool("down") {
+				mig, err := m.Down()
+				if err != nil {
+					return errors.Wrap(err, "migrate down failed")
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "rolled back migration %q\n", mig.Name)
+				return nil
+			}
+
+			count, err := m.Up()
 			if err != nil {
-				return errors.Wrap(err, "cannot bind app config")
+				return errors.Wrap(err, "migrate up failed")
 			}
+			fmt.Fprintf(cmd.OutOrStdout(), "migrated %d database migrations\n", count)
+			return nil
+		},
+	}
+
+	migrateCmd.Flags().BoolP("down", "d", false, "Roll back the database migration version by one")
+	migrateCmd.PersistentFlags().StringP("env", "e", "prod", "The database config file environment to load")
+	migrateCmd.PersistentFlags().BoolP("dry-run", "", false, "Print the SQL of the migrations instead of running it")
+	migrateCmd.PersistentFlags().DurationP("lock-timeout", "", time.Minute*5, "How long to wait for other migration runs against the database")
+	migrateCmd.PersistentFlags().StringP("dir", "", "", "Read the migrations from this folder instead of the ones built into the binary")
+	// Add the database config flags
+	migrateCmd.PersistentFlags().AddFlagSet(abcconfig.NewDBFlagSet())
 
-			if _, err := os.Stat(filepath.Join("db", "migrations")); err != nil {
-				return errors.Wrap(err, "could not find migrations folder")
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "List the applied and pending migrations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, _, err := newMigrator(a, cmd)
+			if err != nil {
+				return err
 			}
 
-			connStr, err := abcdatabase.GetConnStr(a.Config.DB)
+			status, err := m.Status()
 			if err != nil {
-				return errors.Wrap(err, "could not create connection string")
+				return errors.Wrap(err, "cannot get migration status")
 			}
 
-			if v.GetBool("down") {
-				name, err := mig.Down(a.Config.DB.DB, connStr, filepath.Join("db", "migrations"))
-				if err != nil {
-					return errors.Wrap(err, "call to mig down failed")
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "STATUS\tAPPLIED AT\tMIGRATION")
+			for _, s := range status {
+				state, at := "pending", ""
+				if s.Applied {
+					state = "applied"
 				}
-				fmt.Printf("rolled back migration %q\n", name)
-			} else {
-				count, err := mig.Up(a.Config.DB.DB, connStr, filepath.Join("db", "migrations"))
-				if err != nil {
-					return errors.Wrap(err, "call to mig up failed")
+				if !s.AppliedAt.IsZero() {
+					at = s.AppliedAt.Format(time.RFC3339)
 				}
-				fmt.Printf("migrated %d database migrations\n", count)
+				fmt.Fprintf(w, "%s\t%s\t%s\n", state, at, s.Name)
 			}
+			return w.Flush()
+		},
+	})
 
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a new timestamped migration in db/migrations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("migrate create takes the migration name")
+			}
+			path, err := migrate.Create(migrationsDir, args[0], time.Now())
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "created migration %q\n", path)
 			return nil
 		},
+	})
+
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "redo",
+		Short: "Roll back and re-apply the last applied migration",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, _, err := newMigrator(a, cmd)
+			if err != nil {
+				return err
+			}
+
+			mig, err := m.Redo()
+			if err != nil {
+				return errors.Wrap(err, "migrate redo failed")
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "redid migration %q\n", mig.Name)
+			return nil
+		},
+	})
+
+	migrateCmd.AddCommand(&cobra.Command{
+		Use:   "to <version>",
+		Short: "Migrate up or down to the given version, 0 rolls back everything",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("migrate to takes the target version")
+			}
+			target, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || target < 0 {
+				return fmt.Errorf("invalid migration version %q", args[0])
+			}
+
+			m, _, err := newMigrator(a, cmd)
+			if err != nil {
+				return err
+			}
+
+			count, err := m.To(target)
+			if err != nil {
+				return errors.Wrap(err, "migrate to failed")
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "ran %d database migrations, now at version %d\n", count, target)
+			return nil
+		},
+	})
+
+	reset := &cobra.Command{
+		Use:   "reset",
+		Short: "Roll back all migrations, deleting all data",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, v, err := newMigrator(a, cmd)
+			if err != nil {
+				return err
+			}
+
+			if !m.DryRun && !v.GetBool("yes") {
+				fmt.Fprintf(cmd.OutOrStdout(), "This rolls back all migrations of database %q and deletes all of its data.\nType the database name to continue: ", a.Config.DB.DBName)
+				answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+				if strings.TrimSpace(answer) != a.Config.DB.DBName {
+					return errors.New("reset cancelled")
+				}
+			}
+
+			count, err := m.Reset()
+			if err != nil {
+				return errors.Wrap(err, "migrate reset failed")
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "rolled back %d database migrations\n", count)
+			return nil
+		},
+	}
+	reset.Flags().BoolP("yes", "y", false, "Do not ask for confirmation")
+	migrateCmd.AddCommand(reset)
+
+	a.Root.AddCommand(migrateCmd)
+}
+
+// newMigrator binds the config for a migrate command and returns a Migrator
+// for the configured database and the embedded migrations, or the ones in
+// the --dir folder if set
+func newMigrator(a *app.App, cmd *cobra.Command) (*migrate.Migrator, *viper.Viper, error) {
+	c := abcconfig.NewConfig("")
+
+	v, err := c.Bind(cmd.Flags(), a.Config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot bind app config")
+	}
+
+	fsys := db.Migrations()
+	if dir := v.GetString("dir"); len(dir) > 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, nil, errors.Wrap(err, "could not find migrations folder")
+		}
+		fsys = os.DirFS(dir)
+	}
+	migrations, err := migrate.LoadDialect(fsys, a.Config.DB.DB)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot load migrations")
 	}
 
-	migrate.Flags().BoolP("down", "d", false, "Roll back the database migration version by one")
-	migrate.Flags().StringP("env", "e", "prod", "The database config file environment to load")
+	conn, err := db.Open(a.Config.DB)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot open database")
+	}
+
+	return &migrate.Migrator{
+		DB:          conn,
+		Driver:      a.Config.DB.DB,
+		DBName:      a.Config.DB.DBName,
+		Migrations:  migrations,
+		LockTimeout: v.GetDuration("lock-timeout"),
+		Log:         cmd.OutOrStdout(),
+		DryRun:      v.GetBool("dry-run"),
+	}, v, nil
+}
+
+// dbSetup sets up the db command for database maintenance and binds it to
+// the root command
+func dbSetup(a *app.App) {
+	dbCmd := &cobra.Command{
+		Use:   "db",
+		Short: "Maintain your database",
+	}
+
+	dbCmd.PersistentFlags().StringP("env", "e", "dev", "The database config file environment to load")
 	// Add the database config flags
-	migrate.Flags().AddFlagSet(abcconfig.NewDBFlagSet())
+	dbCmd.PersistentFlags().AddFlagSet(abcconfig.NewDBFlagSet())
+
+	seedCmd := &cobra.Command{
+		Use:   "seed [set]",
+		Short: "Apply the seed data of a set, the environment name by default",
+		Long:  "Apply the seeds in db/seeds of a set that were not applied to the database before. The set defaults to the name of the environment, like dev for the demo data or staging for the QA fixtures. Seeding the prod environment, whose users would get the published demo passwords, has to be allowed with --allow-prod.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return errors.New("db seed takes at most the seed set")
+			}
+
+			v, err := abcconfig.NewConfig("").Bind(cmd.Flags(), a.Config)
+			if err != nil {
+				return errors.Wrap(err, "cannot bind app config")
+			}
+			if a.Config.Env == "prod" && !v.GetBool("allow-prod") {
+				return errors.New("refusing to seed the prod environment without --allow-prod")
+			}
+			set := a.Config.Env
+			if len(args) == 1 {
+				set = args[0]
+			}
+
+			seedList, err := seed.Load(seeds.Files(), set)
+			if err != nil {
+				return errors.Wrap(err, "cannot load seeds")
+			}
+			if len(seedList) == 0 {
+				return fmt.Errorf("there are no seeds in set %q", set)
+			}
+
+			// The Go seeders use the models, which run on db.DB
+			if err := db.InitDB(a.Config.DB, db.PoolConfig{}, zap.NewNop()); err != nil {
+				return errors.Wrap(err, "cannot open database")
+			}
+			if db.DB == nil {
+				return errors.New("no database configured")
+			}
+			defer db.DB.Close()
+
+			s := &seed.Seeder{DB: db.DB, Driver: db.Driver, Log: cmd.OutOrStdout(), Force: v.GetBool("force")}
+			count, err := s.Apply(set, seedList)
+			if err != nil {
+				return errors.Wrap(err, "db seed failed")
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "applied %d seeds of set %q\n", count, set)
+			return nil
+		},
+	}
+	seedCmd.Flags().BoolP("force", "f", false, "Apply the seeds that were applied before again")
+	seedCmd.Flags().BoolP("allow-prod", "", false, "Allow seeding the prod environment")
+	dbCmd.AddCommand(seedCmd)
+
+	dumpCmd := &cobra.Command{
+		Use:   "dump [file]",
+		Short: "Write a compressed SQL dump of the database",
+		Long:  "Write a gzip compressed SQL dump of the database to file, <dbname>-<timestamp>.sql.gz by default, or to stdout for -. It runs pg_dump, mysqldump or the sqlite3 shell, which have to be installed.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return errors.New("db dump takes at most the dump file")
+			}
+
+			v, err := abcconfig.NewConfig("").Bind(cmd.Flags(), a.Config)
+			if err != nil {
+				return errors.Wrap(err, "cannot bind app config")
+			}
+
+			path := fmt.Sprintf("%s-%s.sql.gz", strings.TrimSuffix(filepath.Base(a.Config.DB.DBName), filepath.Ext(a.Config.DB.DBName)), time.Now().UTC().Format("20060102150405"))
+			if len(args) == 1 {
+				path = args[0]
+			}
+			if path == "-" {
+				return db.Dump(a.Config.DB, cmd.OutOrStdout(), v.GetBool("schema-only"))
+			}
+
+			// Dumps hold all the data, keep them private and don't overwrite
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return errors.Wrap(err, "cannot create dump file")
+			}
+			if err := db.Dump(a.Config.DB, f, v.GetBool("schema-only")); err != nil {
+				f.Close()
+				os.Remove(path)
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return errors.Wrap(err, "cannot write dump file")
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "dumped database %q to %q\n", a.Config.DB.DBName, path)
+			return nil
+		},
+	}
+	dumpCmd.Flags().BoolP("schema-only", "s", false, "Dump the schema without the data")
+	dbCmd.AddCommand(dumpCmd)
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Load a dump written by db dump into the database",
+		Long:  "Load a dump written by db dump into the database, from stdin for -. It runs psql, mysql or the sqlite3 shell, which have to be installed. Restoring into the prod environment has to be allowed with --allow-prod.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("db restore takes the dump file")
+			}
+
+			v, err := abcconfig.NewConfig("").Bind(cmd.Flags(), a.Config)
+			if err != nil {
+				return errors.Wrap(err, "cannot bind app config")
+			}
+
+			if a.Config.Env == "prod" && !v.GetBool("allow-prod") {
+				return errors.New("refusing to restore into the prod environment without --allow-prod")
+			}
+
+			in := os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return errors.Wrap(err, "cannot open dump file")
+				}
+				defer f.Close()
+				in = f
+			} else if !v.GetBool("yes") {
+				return errors.New("restoring from stdin needs --yes, as it can't ask for confirmation")
+			}
+
+			if !v.GetBool("yes") {
+				fmt.Fprintf(cmd.OutOrStdout(), "This overwrites the data of database %q with the dump.\nType the database name to continue: ", a.Config.DB.DBName)
+				answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+				if strings.TrimSpace(answer) != a.Config.DB.DBName {
+					return errors.New("restore cancelled")
+				}
+			}
+
+			if err := db.Restore(a.Config.DB, in); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "restored database %q from %q\n", a.Config.DB.DBName, args[0])
+			return nil
+		},
+	}
+	restoreCmd.Flags().BoolP("allow-prod", "", false, "Allow restoring into the prod environment")
+	restoreCmd.Flags().BoolP("yes", "y", false, "Do not ask for confirmation")
+	dbCmd.AddCommand(restoreCmd)
 
-	a.Root.AddCommand(migrate)
+	a.Root.AddCommand(dbCmd)
 }
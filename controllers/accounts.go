@@ -0,0 +1,366 @@
+package controllers
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/mailer"
+	"github.com/fadeojo/brito/models"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Accounts is the controller struct for the password reset, email
+// verification and account unlock routes.
+//
+// None of the handlers reveal whether an account exists for an email
+// address: the same page is rendered either way and mail is sent in
+// the background so response times don't differ either.
+type Accounts struct {
+	Root
+
+	Mailer  mailer.Mailer
+	Tokens  *auth.Signer
+	Limiter *auth.RateLimiter
+	// Throttle is the login throttle, reset when an account is unlocked
+	Throttle *auth.Throttle
+
+	// RootURL is the external URL of the app used to build email links
+	RootURL        string
+	ResetTokenTTL  time.Duration
+	VerifyTokenTTL time.Duration
+}
+
+// accountsForm is the binding for the account templates
+type accountsForm struct {
+	Email string
+	Token string
+	Error string
+}
+
+// ForgotPassword renders the password reset request form
+func (a Accounts) ForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	return a.Render.HTML(w, http.StatusOK, "accounts/forgot_password", accountsForm{})
+}
+
+// ForgotPasswordPost emails a password reset link to the posted email
+// address if an account exists for it
+func (a Accounts) ForgotPasswordPost(w http.ResponseWriter, r *http.Request) error {
+	email := models.NormalizeEmail(r.PostFormValue("email"))
+	if len(email) == 0 {
+		return a.Render.HTML(w, http.StatusUnprocessableEntity, "accounts/forgot_password", accountsForm{Error: "Please enter your email address."})
+	}
+
+	if !a.Limiter.Allow("ip:" + remoteIP(r)) {
+		return ErrTooManyRequests
+	}
+
+	if a.Limiter.Allow("email:" + email) {
+		go a.sendPasswordReset(Log(r), email)
+	}
+
+	return a.Render.HTML(w, http.StatusOK, "accounts/forgot_password_sent", accountsForm{Email: email})
+}
+
+// ResetPassword renders the new password form for a password reset token
+func (a Accounts) ResetPassword(w http.ResponseWriter, r *http.Request) error {
+	token := r.URL.Query().Get("token")
+	if _, err := a.Tokens.Verify(auth.PurposeResetPassword, token, stampFor(passwordStamp)); err != nil {
+		return tokenError(err)
+	}
+
+	return a.Render.HTML(w, http.StatusOK, "accounts/reset_password", accountsForm{Token: token})
+}
+
+// ResetPasswordPost sets the posted password on the account the password
+// reset token was issued for. The sessions signed in with the old password
+// end, see LoadUser.
+func (a Accounts) ResetPasswordPost(w http.ResponseWriter, r *http.Request) error {
+	token := r.PostFormValue("token")
+	claims, err := a.Tokens.Verify(auth.PurposeResetPassword, token, stampFor(passwordStamp))
+	if err != nil {
+		return tokenError(err)
+	}
+
+	password := r.PostFormValue("password")
+	if err := auth.ValidatePassword(password); err != nil {
+		form := accountsForm{Token: token, Error: "Your password must be at least " + strconv.Itoa(auth.MinPasswordLength) + " characters."}
+		return a.Render.HTML(w, http.StatusUnprocessableEntity, "accounts/reset_password", form)
+	}
+	if password != r.PostFormValue("confirm_password") {
+		form := accountsForm{Token: token, Error: "The passwords do not match."}
+		return a.Render.HTML(w, http.StatusUnprocessableEntity, "accounts/reset_password", form)
+	}
+
+	user, err := models.FindUser(db.Writer(r.Context()), claims.UserID)
+	if err != nil {
+		return err
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	// Receiving the reset link proves ownership of the email address,
+	// so it also unlocks an account locked after failed logins. The hash
+	// the token is bound to may have changed since it was verified, by a
+	// concurrent request with the same token, which must fail.
+	ok, err := user.ResetPassword(db.Writer(r.Context()), hash)
+	if err != nil {
+		return err
+	} else if !ok {
+		return ErrInvalidToken
+	}
+
+	Log(r).Info("password reset", zap.Int64("user_id", user.ID))
+	return a.Render.HTML(w, http.StatusOK, "accounts/reset_password_done", nil)
+}
+
+// VerifyEmail marks the account the email verification token was issued
+// for as verified
+func (a Accounts) VerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	claims, err := a.Tokens.Verify(auth.PurposeVerifyEmail, r.URL.Query().Get("token"), stampFor(emailStamp))
+	if err != nil {
+		return tokenError(err)
+	}
+
+	user, err := models.FindUser(db.Writer(r.Context()), claims.UserID)
+	if err != nil {
+		return err
+	}
+
+	user.EmailVerified = true
+	if err := user.Update(db.Writer(r.Context())); err != nil {
+		return err
+	}
+
+	Log(r).Info("email verified", zap.Int64("user_id", user.ID))
+	return a.Render.HTML(w, http.StatusOK, "accounts/verify_email_done", nil)
+}
+
+// VerifyEmailResend renders the form to request a new verification email
+func (a Accounts) VerifyEmailResend(w http.ResponseWriter, r *http.Request) error {
+	return a.Render.HTML(w, http.StatusOK, "accounts/verify_email_resend", accountsForm{})
+}
+
+// VerifyEmailResendPost emails a new verification link to the posted email
+// address if an unverified account exists for it
+func (a Accounts) VerifyEmailResendPost(w http.ResponseWriter, r *http.Request) error {
+	email := models.NormalizeEmail(r.PostFormValue("email"))
+	if len(email) == 0 {
+		return a.Render.HTML(w, http.StatusUnprocessableEntity, "accounts/verify_email_resend", accountsForm{Error: "Please enter your email address."})
+	}
+
+	if !a.Limiter.Allow("ip:" + remoteIP(r)) {
+		return ErrTooManyRequests
+	}
+
+	if a.Limiter.Allow("email:" + email) {
+		go a.sendVerification(Log(r), email)
+	}
+
+	return a.Render.HTML(w, http.StatusOK, "accounts/verify_email_sent", accountsForm{Email: email})
+}
+
+// UnlockAccount unlocks the account the unlock token was mailed for when
+// it was locked after too many failed logins
+func (a Accounts) UnlockAccount(w http.ResponseWriter, r *http.Request) error {
+	claims, err := a.Tokens.Verify(auth.PurposeUnlockAccount, r.URL.Query().Get("token"), stampFor(lockStamp))
+	if err != nil {
+		return tokenError(err)
+	}
+
+	user, err := models.FindUser(db.Writer(r.Context()), claims.UserID)
+	if err != nil {
+		return err
+	}
+
+	user.LockedUntil = 0
+	if err := user.Update(db.Writer(r.Context())); err != nil {
+		return err
+	}
+	_, account := throttleKeys(r, user.Email)
+	if err := a.Throttle.Reset(account); err != nil {
+		return err
+	}
+
+	audit(r, "account_unlocked", zap.Int64("user_id", user.ID), zap.String("ip", remoteIP(r)))
+	return a.Render.HTML(w, http.StatusOK, "accounts/unlock_done", nil)
+}
+
+// SendVerification emails a verification link to the user. It is exported
+// so that it can be called by the sign up flow.
+func (a Accounts) SendVerification(user *models.User) error {
+	token, err := a.Tokens.Issue(auth.PurposeVerifyEmail, user.ID, emailStamp(user), a.VerifyTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return a.send(user.Email, "Verify your email address", "mail/verify_email", mailData{
+		Email:   user.Email,
+		URL:     a.url("/email/verify", token),
+		Expires: humanDuration(a.VerifyTokenTTL),
+	})
+}
+
+// mailData is the binding for the account mail templates
+type mailData struct {
+	Email   string
+	URL     string
+	Expires string
+}
+
+func (a Accounts) sendPasswordReset(log *zap.Logger, email string) {
+	user, err := models.FindUserByEmail(db.DB, email)
+	if err == sql.ErrNoRows {
+		log.Info("password reset requested for unknown email")
+		return
+	} else if err != nil {
+		log.Error("cannot look up user for password reset", zap.Error(err))
+		return
+	}
+
+	token, err := a.Tokens.Issue(auth.PurposeResetPassword, user.ID, passwordStamp(user), a.ResetTokenTTL)
+	if err != nil {
+		log.Error("cannot issue password reset token", zap.Error(err))
+		return
+	}
+
+	err = a.send(user.Email, "Reset your password", "mail/password_reset", mailData{
+		Email:   user.Email,
+		URL:     a.url("/password/reset", token),
+		Expires: humanDuration(a.ResetTokenTTL),
+	})
+	if err != nil {
+		log.Error("cannot send password reset mail", zap.Int64("user_id", user.ID), zap.Error(err))
+	}
+}
+
+func (a Accounts) sendVerification(log *zap.Logger, email string) {
+	user, err := models.FindUserByEmail(db.DB, email)
+	if err == sql.ErrNoRows {
+		log.Info("email verification requested for unknown email")
+		return
+	} else if err != nil {
+		log.Error("cannot look up user for email verification", zap.Error(err))
+		return
+	}
+
+	if user.EmailVerified {
+		return
+	}
+
+	if err := a.SendVerification(user); err != nil {
+		log.Error("cannot send verification mail", zap.Int64("user_id", user.ID), zap.Error(err))
+	}
+}
+
+// sendUnlock mails the unlock link to the owner of a locked account.
+// The link is valid for as long as the account is locked.
+func (a Accounts) sendUnlock(log *zap.Logger, user *models.User) {
+	ttl := time.Unix(user.LockedUntil, 0).Sub(time.Now())
+	token, err := a.Tokens.Issue(auth.PurposeUnlockAccount, user.ID, lockStamp(user), ttl)
+	if err != nil {
+		log.Error("cannot issue unlock token", zap.Error(err))
+		return
+	}
+
+	err = a.send(user.Email, "Your account has been locked", "mail/unlock_account", mailData{
+		Email:   user.Email,
+		URL:     a.url("/account/unlock", token),
+		Expires: humanDuration(ttl.Round(time.Minute)),
+	})
+	if err != nil {
+		log.Error("cannot send unlock mail", zap.Int64("user_id", user.ID), zap.Error(err))
+	}
+}
+
+func (a Accounts) send(to string, subject string, template string, data mailData) error {
+	htmlBody, textBody, err := mailer.Render(a.Render, template, data)
+	if err != nil {
+		return err
+	}
+
+	return a.Mailer.Send(mailer.Message{
+		To:       to,
+		Subject:  subject,
+		TextBody: textBody,
+		HTMLBody: htmlBody,
+	})
+}
+
+func (a Accounts) url(path string, token string) string {
+	return a.RootURL + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+// passwordStamp binds password reset tokens to the current password hash,
+// so a token can no longer be used once the password has been changed
+func passwordStamp(user *models.User) string {
+	return user.PasswordHash
+}
+
+// emailStamp binds email verification tokens to the email address and
+// verification state, so a token can only be used once and only for the
+// address it was sent to
+func emailStamp(user *models.User) string {
+	return user.Email + ":" + strconv.FormatBool(user.EmailVerified)
+}
+
+// lockStamp binds unlock tokens to the lockout they were issued for, so a
+// token can only be used once and not for a later lockout
+func lockStamp(user *models.User) string {
+	return strconv.FormatInt(user.LockedUntil, 10)
+}
+
+// stampFor returns a Signer.Verify stamp func that loads the token's user
+// and computes its current stamp
+func stampFor(stamp func(*models.User) string) func(int64) (string, error) {
+	return func(userID int64) (string, error) {
+		user, err := models.FindUser(db.DB, userID)
+		if err == sql.ErrNoRows {
+			return "", auth.ErrTokenInvalid
+		} else if err != nil {
+			return "", err
+		}
+		return stamp(user), nil
+	}
+}
+
+// tokenError maps token errors to ErrInvalidToken so the invalid token page
+// is rendered, and passes through unexpected errors
+func tokenError(err error) error {
+	if err == auth.ErrTokenInvalid || err == auth.ErrTokenExpired {
+		return ErrInvalidToken
+	}
+	return errors.Wrap(err, "cannot verify token")
+}
+
+// humanDuration formats a token lifetime for use in mail, e.g. "2 hours"
+func humanDuration(d time.Duration) string {
+	n, unit := int64(d/time.Minute), "minute"
+	if d >= time.Hour*48 && d%(time.Hour*24) == 0 {
+		n, unit = int64(d/(time.Hour*24)), "day"
+	} else if d >= time.Hour && d%time.Hour == 0 {
+		n, unit = int64(d/time.Hour), "hour"
+	}
+
+	if n == 1 {
+		return "1 " + unit
+	}
+	return strconv.FormatInt(n, 10) + " " + unit + "s"
+}
+
+// remoteIP returns the IP address of the client without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
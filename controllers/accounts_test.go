@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/mailer"
+)
+
+func TestAccountsForgotPassword(t *testing.T) {
+	t.Parallel()
+
+	a := Accounts{
+		Root: newRootMock("../templates"),
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/password/forgot", nil)
+
+	if err := a.ForgotPassword(w, r); err != nil {
+		t.Error(err)
+	}
+
+	if !strings.Contains(w.Body.String(), `action="/password/forgot"`) {
+		t.Error("forgot password template not expected value")
+	}
+}
+
+func TestAccountsForgotPasswordRateLimit(t *testing.T) {
+	t.Parallel()
+
+	a := Accounts{
+		Root:    newRootMock("../templates"),
+		Limiter: auth.NewRateLimiter(0, time.Minute),
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/password/forgot", strings.NewReader(url.Values{"email": {"a@example.com"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if err := a.ForgotPasswordPost(w, r); err != ErrTooManyRequests {
+		t.Errorf("expected ErrTooManyRequests, got %v", err)
+	}
+}
+
+func TestAccountsMailTemplates(t *testing.T) {
+	t.Parallel()
+
+	root := newRootMock("../templates")
+	data := mailData{
+		Email:   "a@example.com",
+		URL:     "https://example.com/password/reset?token=abc&x=1",
+		Expires: humanDuration(time.Hour),
+	}
+
+	for _, name := range []string{"mail/password_reset", "mail/verify_email"} {
+		htmlBody, textBody, err := mailer.Render(root.Render, name, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(htmlBody, `href="https://example.com/password/reset?token=abc&amp;x=1"`) {
+			t.Errorf("%s: html body missing link:\n%s", name, htmlBody)
+		}
+		if !strings.Contains(textBody, "\nhttps://example.com/password/reset?token=abc&x=1\n") {
+			t.Errorf("%s: text body missing link:\n%s", name, textBody)
+		}
+		if !strings.Contains(textBody, "expires in 1 hour") {
+			t.Errorf("%s: text body missing expiry:\n%s", name, textBody)
+		}
+	}
+}
+
+func TestAccountsUnlockMailTemplate(t *testing.T) {
+	t.Parallel()
+
+	root := newRootMock("../templates")
+	data := mailData{
+		Email:   "a@example.com",
+		URL:     "https://example.com/account/unlock?token=abc",
+		Expires: humanDuration(time.Hour),
+	}
+
+	htmlBody, textBody, err := mailer.Render(root.Render, "mail/unlock_account", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(htmlBody, `href="https://example.com/account/unlock?token=abc"`) {
+		t.Errorf("html body missing link:\n%s", htmlBody)
+	}
+	if !strings.Contains(textBody, "unlocks on its own in 1 hour") {
+		t.Errorf("text body missing expiry:\n%s", textBody)
+	}
+}
+
+func TestHumanDuration(t *testing.T) {
+	t.Parallel()
+
+	tests := map[time.Duration]string{
+		time.Minute * 15: "15 minutes",
+		time.Hour:        "1 hour",
+		time.Minute * 90: "90 minutes",
+		time.Hour * 24:   "24 hours",
+		time.Hour * 48:   "2 days",
+	}
+	for d, expect := range tests {
+		if got := humanDuration(d); got != expect {
+			t.Errorf("%s: expected %q, got %q", d, expect, got)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fadeojo/brito/db"
+)
+
+// Admin is the controller struct for the admin routes.
+// All routes are wrapped with RequireAdmin.
+type Admin struct {
+	Root
+}
+
+// Home is the admin dashboard
+func (a Admin) Home(w http.ResponseWriter, r *http.Request) error {
+	return a.Render.HTML(w, http.StatusOK, "admin/home", CurrentUser(r))
+}
+
+// Database probes the database and its read replicas and returns their
+// health and connection pool statistics as JSON, with a 503 status if the
+// primary is unhealthy
+func (a Admin) Database(w http.ResponseWriter, r *http.Request) error {
+	health := db.Probe(time.Second * 5)
+	health.Replicas = db.ProbeReplicas(time.Second*5, Log(r))
+
+	status := http.StatusOK
+	if !health.OK {
+		status = http.StatusServiceUnavailable
+	}
+	return a.Render.JSON(w, status, health)
+}
@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"go.uber.org/zap"
+)
+
+func TestAdminDatabase(t *testing.T) {
+	t.Parallel()
+
+	a := Admin{Root: newRootMock("../templates")}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/db", nil)
+	r = r.WithContext(context.WithValue(r.Context(), abcmiddleware.CtxLoggerKey, zap.NewNop()))
+	if err := a.Database(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	var health db.Health
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if !health.OK || health.Stats.OpenConnections == 0 {
+		t.Errorf("unexpected health %#v", health)
+	}
+}
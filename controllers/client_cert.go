@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/volatiletech/abcweb/abcmiddleware"
+)
+
+// ClientIdentity is the identity of the verified TLS client certificate of
+// a mutual TLS connection
+type ClientIdentity struct {
+	// Subject is the distinguished name of the certificate
+	Subject    string
+	CommonName string
+	// The subject alternative names of the certificate; URIs hold SPIFFE
+	// IDs, for example
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	// SerialNumber is the hex serial number given by the issuer
+	SerialNumber string
+	// Fingerprint is the hex SHA-256 hash of the certificate
+	Fingerprint string
+	Issuer      string
+	NotAfter    time.Time
+}
+
+// CurrentClient returns the identity of the verified TLS client certificate
+// of the request, or nil if the client sent none or it was not verified
+// against the client CA bundle
+func CurrentClient(r *http.Request) *ClientIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+	id := &ClientIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		SerialNumber:   cert.SerialNumber.Text(16),
+		Fingerprint:    hex.EncodeToString(sum[:]),
+		Issuer:         cert.Issuer.String(),
+		NotAfter:       cert.NotAfter,
+	}
+	for _, uri := range cert.URIs {
+		id.URIs = append(id.URIs, uri.String())
+	}
+	return id
+}
+
+// RequireClientCert wraps a controller route handler so that it can only be
+// used with a verified TLS client certificate
+func RequireClientCert(ctrl abcmiddleware.AppHandler) abcmiddleware.AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if CurrentClient(r) == nil {
+			return ErrClientCertRequired
+		}
+		return ctrl(w, r)
+	}
+}
+
+// ClientCertPaths is middleware that requires a verified TLS client
+// certificate for the route groups under the path prefixes, like /admin,
+// and serves failure for requests without one
+func ClientCertPaths(prefixes []string, failure http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, prefix := range prefixes {
+				prefix = strings.TrimSuffix(prefix, "/")
+				if (r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")) && CurrentClient(r) == nil {
+					failure.ServeHTTP(w, r)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
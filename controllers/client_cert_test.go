@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestClientCert(t *testing.T) {
+	t.Parallel()
+
+	// A client CA and a client certificate it issued
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "brito client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	spiffe, _ := url.Parse("spiffe://example.com/ops")
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(0xbeef),
+		Subject:      pkix.Name{CommonName: "ops"},
+		URIs:         []*url.URL{spiffe},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *ClientIdentity
+	failure := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	handler := ClientCertPaths([]string{"/admin/"}, failure)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = CurrentClient(r)
+	}))
+
+	srv := httptest.NewUnstartedServer(handler)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+
+	status := func(client *http.Client, path string) int {
+		t.Helper()
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+
+	// Without a certificate only the other route groups can be used
+	anonymous := srv.Client()
+	if code := status(anonymous, "/"); code != http.StatusOK || got != nil {
+		t.Errorf("expected an anonymous 200, got %d %v", code, got)
+	}
+	for _, path := range []string{"/admin", "/admin/db"} {
+		if code := status(anonymous, path); code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", path, code)
+		}
+	}
+	if code := status(anonymous, "/administrators"); code != http.StatusOK {
+		t.Errorf("expected only the /admin group to need a certificate, got %d", code)
+	}
+
+	transport := anonymous.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{clientDER},
+		PrivateKey:  clientKey,
+	}}
+	client := &http.Client{Transport: transport}
+	if code := status(client, "/admin/db"); code != http.StatusOK {
+		t.Fatalf("expected 200 with a certificate, got %d", code)
+	}
+	if got == nil || got.CommonName != "ops" || got.SerialNumber != "beef" || len(got.URIs) != 1 || got.URIs[0] != "spiffe://example.com/ops" || len(got.Fingerprint) != 64 {
+		t.Errorf("unexpected identity %#v", got)
+	}
+
+	// RequireClientCert guards single routes
+	r := httptest.NewRequest("GET", "/", nil)
+	err = RequireClientCert(func(w http.ResponseWriter, r *http.Request) error { return nil })(httptest.NewRecorder(), r)
+	if err != ErrClientCertRequired {
+		t.Errorf("expected ErrClientCertRequired, got %v", err)
+	}
+}
@@ -6,15 +6,24 @@ import (
 
 	"github.com/volatiletech/abcweb/abcmiddleware"
 	"github.com/volatiletech/abcweb/abcrender"
+	"github.com/volatiletech/abcweb/abcsessions"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // The list of error types that can be returned by your controllers.
 // These can be bound in routes/routes.go to custom error handlers.
 // These error types trigger actions in the errors middleware (routes/routes.go)
 var (
-	ErrUnauthorized = errors.New("not authorized")
-	ErrForbidden    = errors.New("access is forbidden")
+	ErrUnauthorized    = errors.New("not authorized")
+	ErrForbidden       = errors.New("access is forbidden")
+	ErrTooManyRequests = errors.New("too many requests")
+	ErrInvalidToken    = errors.New("token is invalid or expired")
+	// ErrInvalidCSRFToken is returned for unsafe requests without a valid CSRF token
+	ErrInvalidCSRFToken = errors.New("csrf token missing or invalid")
+	// ErrClientCertRequired is returned for requests without a verified TLS
+	// client certificate to routes that require one
+	ErrClientCertRequired = errors.New("client certificate required")
 )
 
 // Root struct exposes useful variables to every controller route handler.
@@ -22,8 +31,9 @@ var (
 // you can add them here, and then assign them in app/routes.go where the
 // instance of controller is created.
 type Root struct {
-	Log    *zap.Logger
-	Render abcrender.Renderer
+	Log     *zap.Logger
+	Render  abcrender.Renderer
+	Session abcsessions.Overseer
 }
 
 // Main is the controller struct for the main routes (home, about, etc).
@@ -39,3 +49,11 @@ type Main struct {
 func Log(r *http.Request) *zap.Logger {
 	return abcmiddleware.Log(r)
 }
+
+// audit logs a security relevant event, like an account lockout. Audit
+// events are logged at warn level and carry audit=true and the event name,
+// so they can be filtered and alerted on.
+func audit(r *http.Request, event string, fields ...zapcore.Field) {
+	fields = append([]zapcore.Field{zap.Bool("audit", true), zap.String("event", event)}, fields...)
+	Log(r).Warn("audit: "+event, fields...)
+}
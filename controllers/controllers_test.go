@@ -8,7 +8,6 @@ import (
 	"github.com/fadeojo/brito/app"
 	"github.com/fadeojo/brito/db"
 	"github.com/fadeojo/brito/rendering"
-	"github.com/volatiletech/abcweb/abcdatabase"
 	"github.com/volatiletech/abcweb/abcsessions"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -31,17 +30,22 @@ func newRootMock(templatesDir string) Root {
 	a := app.NewApp()
 	a.Config.Server.RenderRecompile = true
 
+	// Set up an in-memory session overseer
+	storer, err := abcsessions.NewDefaultMemoryStorer()
+	if err != nil {
+		panic(err)
+	}
+
 	return Root{
 
-		Log:    log,
-		Render: rendering.New(a, templatesDir, nil),
+		Log:     log,
+		Render:  rendering.New(a, templatesDir, nil),
+		Session: abcsessions.NewStorageOverseer(abcsessions.NewCookieOptions(), storer),
 	}
 }
 
 func TestMain(m *testing.M) {
-	var err error
-	var count int
-	db.DB, count, err = abcdatabase.SetupTestSuite(db.GoTestdata)
+	count, err := db.SetupTestSuite(db.GoTestdata)
 	if err != nil {
 		fmt.Printf("TestMain setup failed: %s\n", err)
 		os.Exit(1)
@@ -49,5 +53,8 @@ func TestMain(m *testing.M) {
 	fmt.Printf("TestMain Setup ran %d migrations.\n", count)
 
 	r := m.Run()
+	if err := db.TeardownTestSuite(); err != nil {
+		fmt.Printf("TestMain teardown failed: %s\n", err)
+	}
 	os.Exit(r)
 }
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/models"
+	"go.uber.org/zap"
+)
+
+// throttleKeys returns the Throttle keys of a login attempt. Accounts are
+// keyed by email address so unknown addresses are throttled the same as
+// existing accounts, and can't be told apart by it.
+func throttleKeys(r *http.Request, email string) (ip string, account string) {
+	return "login-ip:" + remoteIP(r), "login-account:" + models.NormalizeEmail(email)
+}
+
+// throttleWait returns how long the client has to wait before it may try
+// to log in to the account with email again
+func (s Sessions) throttleWait(r *http.Request, email string) (time.Duration, error) {
+	ip, account := throttleKeys(r, email)
+	wait, err := s.Throttle.Wait(ip, account)
+	if err != nil || wait <= 0 {
+		return 0, err
+	}
+
+	Log(r).Info("login throttled", zap.Duration("wait", wait))
+	return wait, nil
+}
+
+// throttled renders tmpl with a 429 status and a Retry-After header
+func (s Sessions) throttled(w http.ResponseWriter, wait time.Duration, tmpl string, form sessionsForm) error {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+	form.Error = "Too many failed attempts, please wait a moment and try again."
+	return s.Render.HTML(w, http.StatusTooManyRequests, tmpl, form)
+}
+
+// failedAttempt records a failed password or second factor attempt for the
+// account with email and the client IP. user is nil for unknown accounts.
+// Once an account has failed LockoutThreshold times it is locked for
+// LockoutDuration and its owner is mailed a link to unlock it.
+func (s Sessions) failedAttempt(r *http.Request, user *models.User, email string) error {
+	ip, account := throttleKeys(r, email)
+	if _, err := s.Throttle.Fail(ip); err != nil {
+		return err
+	}
+	failures, err := s.Throttle.Fail(account)
+	if err != nil {
+		return err
+	}
+
+	if user == nil || s.LockoutThreshold <= 0 || failures < s.LockoutThreshold {
+		return nil
+	}
+
+	until := s.Clock.Now().Add(s.LockoutDuration)
+	locked, err := user.Lock(db.Writer(r.Context()), until)
+	if err != nil || !locked {
+		return err
+	}
+	// The account starts over with a clean slate once it is unlocked
+	if err := s.Throttle.Reset(account); err != nil {
+		return err
+	}
+
+	audit(r, "account_locked",
+		zap.Int64("user_id", user.ID),
+		zap.String("ip", remoteIP(r)),
+		zap.Int("failures", failures),
+		zap.Time("locked_until", until),
+	)
+	go s.Accounts.sendUnlock(Log(r), user)
+
+	return nil
+}
+
+// succeededAttempt forgets the failed attempts of the account with email
+// after a completed login. The client IP's failures are kept, or logging
+// in to an own account would let an attacker reset them between guesses.
+func (s Sessions) succeededAttempt(r *http.Request, email string) error {
+	_, account := throttleKeys(r, email)
+	return s.Throttle.Reset(account)
+}
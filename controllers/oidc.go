@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/models"
+	"github.com/fadeojo/brito/oidc"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"github.com/volatiletech/abcweb/abcsessions"
+	"github.com/volatiletech/sqlboiler/boil"
+	"go.uber.org/zap"
+)
+
+// OIDC is the controller struct for logging in with external OpenID Connect
+// identity providers. It embeds Sessions to share the login flow, so users
+// with second factor authentication enabled still have to pass it.
+//
+// Users are provisioned on their first login. An identity is linked to an
+// existing account with the same email address only if the provider has
+// verified the address, so a provider can't be used to take over accounts.
+type OIDC struct {
+	Sessions
+}
+
+// Errors returned by provision that are shown to the user
+var (
+	errOIDCNoEmail         = errors.New("identity provider did not share an email address")
+	errOIDCUnverifiedEmail = errors.New("identity provider email address is not verified")
+)
+
+// Start returns the handler that redirects to the provider's authorization
+// endpoint. The state, nonce and PKCE verifier are kept in the session.
+func (o OIDC) Start(p *oidc.Provider) abcmiddleware.AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		values := map[string]string{sessionOIDCProvider: p.Name}
+		for _, key := range []string{sessionOIDCState, sessionOIDCNonce, sessionOIDCVerifier} {
+			val, err := oidc.RandomString()
+			if err != nil {
+				return err
+			}
+			values[key] = val
+		}
+
+		u, err := p.AuthCodeURL(r.Context(), values[sessionOIDCState], values[sessionOIDCNonce], values[sessionOIDCVerifier])
+		if err != nil {
+			Log(r).Error("cannot reach identity provider", zap.String("provider", p.Name), zap.Error(err))
+			return o.oidcFailed(w, http.StatusBadGateway, p.DisplayName+" is not available, please try again later.")
+		}
+
+		for key, val := range values {
+			if err := abcsessions.Set(o.Session, w, r, key, val); err != nil {
+				return err
+			}
+		}
+
+		http.Redirect(w, r, u, http.StatusFound)
+		return nil
+	}
+}
+
+// Callback returns the handler for the provider's redirect back to the app.
+// It checks the state, exchanges the code, validates the ID token and logs
+// the user in, provisioning them on their first login.
+func (o OIDC) Callback(p *oidc.Provider) abcmiddleware.AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		values := map[string]string{}
+		for _, key := range []string{sessionOIDCProvider, sessionOIDCState, sessionOIDCNonce, sessionOIDCVerifier} {
+			val, err := o.sessionGet(w, r, key)
+			if err != nil {
+				return err
+			}
+			values[key] = val
+		}
+		// The login state is single use
+		if err := o.sessionDel(w, r, sessionOIDCProvider, sessionOIDCState, sessionOIDCNonce, sessionOIDCVerifier); err != nil {
+			return err
+		}
+
+		q := r.URL.Query()
+		if e := q.Get("error"); len(e) > 0 {
+			Log(r).Info("identity provider returned an error", zap.String("provider", p.Name), zap.String("error", e), zap.String("description", q.Get("error_description")))
+			return o.oidcFailed(w, http.StatusUnauthorized, "Logging in with "+p.DisplayName+" failed or was cancelled.")
+		}
+
+		state := values[sessionOIDCState]
+		if len(state) == 0 || values[sessionOIDCProvider] != p.Name || subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 {
+			return o.oidcFailed(w, http.StatusBadRequest, "Your login expired, please try again.")
+		}
+
+		token, err := p.Exchange(r.Context(), q.Get("code"), values[sessionOIDCVerifier])
+		if err != nil {
+			Log(r).Error("oidc code exchange failed", zap.String("provider", p.Name), zap.Error(err))
+			return o.oidcFailed(w, http.StatusBadGateway, "Logging in with "+p.DisplayName+" failed, please try again.")
+		}
+
+		claims, err := p.VerifyIDToken(r.Context(), token.IDToken, values[sessionOIDCNonce])
+		if err != nil {
+			Log(r).Warn("oidc id token rejected", zap.String("provider", p.Name), zap.Error(err))
+			return o.oidcFailed(w, http.StatusUnauthorized, "Logging in with "+p.DisplayName+" failed, please try again.")
+		}
+
+		user, err := o.provision(r.Context(), Log(r), p, claims)
+		switch errors.Cause(err) {
+		case nil:
+		case errOIDCNoEmail:
+			return o.oidcFailed(w, http.StatusUnauthorized, p.DisplayName+" did not share your email address.")
+		case errOIDCUnverifiedEmail:
+			return o.oidcFailed(w, http.StatusUnauthorized, "An account with your email address already exists. Log in with your password, or verify your email address with "+p.DisplayName+" first.")
+		default:
+			return err
+		}
+
+		if user.TOTPEnabled {
+			if err := o.startPending(w, r, user); err != nil {
+				return err
+			}
+			http.Redirect(w, r, "/login/2fa", http.StatusFound)
+			return nil
+		}
+
+		if err := o.signIn(w, r, user); err != nil {
+			return err
+		}
+
+		Log(r).Info("login", zap.Int64("user_id", user.ID), zap.String("provider", p.Name))
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+}
+
+// provision returns the user linked to the claims' subject. On the first
+// login the identity is linked to the account with the same verified email
+// address, or a new account is created. The user's admin flag is synced
+// with the provider's roles if the provider has a role claim configured.
+func (o OIDC) provision(ctx context.Context, log *zap.Logger, p *oidc.Provider, claims *oidc.Claims) (*models.User, error) {
+	var user *models.User
+	err := db.InTx(ctx, func(ctx context.Context) error {
+		tx := db.Executor(ctx)
+
+		var err error
+		if user, err = o.findOrCreateUser(log, tx, p, claims); err != nil {
+			return err
+		}
+		if len(p.RoleClaim) == 0 {
+			return nil
+		}
+
+		isAdmin := false
+		for _, role := range p.MapRoles(claims) {
+			if role == models.RoleAdmin {
+				isAdmin = true
+			}
+		}
+
+		if user.IsAdmin != isAdmin {
+			user.IsAdmin = isAdmin
+			if err := user.Update(tx); err != nil {
+				return err
+			}
+			log.Info("admin role synced from identity provider", zap.Int64("user_id", user.ID), zap.Bool("is_admin", isAdmin))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (o OIDC) findOrCreateUser(log *zap.Logger, tx boil.Executor, p *oidc.Provider, claims *oidc.Claims) (*models.User, error) {
+	identity, err := models.FindIdentity(tx, p.Name, claims.Subject)
+	if err == nil {
+		return models.FindUser(tx, identity.UserID)
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	email := models.NormalizeEmail(claims.Email)
+	if len(email) == 0 {
+		return nil, errOIDCNoEmail
+	}
+
+	user, err := models.FindUserByEmail(tx, email)
+	if err == sql.ErrNoRows {
+		user = &models.User{Email: email, EmailVerified: claims.EmailVerified}
+		if err := user.Insert(tx); err != nil {
+			return nil, err
+		}
+		log.Info("user provisioned", zap.Int64("user_id", user.ID), zap.String("provider", p.Name))
+	} else if err != nil {
+		return nil, err
+	} else if !claims.EmailVerified {
+		return nil, errOIDCUnverifiedEmail
+	}
+
+	identity = &models.Identity{UserID: user.ID, Provider: p.Name, Subject: claims.Subject}
+	if err := identity.Insert(tx); err != nil {
+		return nil, err
+	}
+
+	log.Info("identity linked", zap.Int64("user_id", user.ID), zap.String("provider", p.Name))
+	return user, nil
+}
+
+func (o OIDC) oidcFailed(w http.ResponseWriter, status int, msg string) error {
+	return o.Render.HTML(w, status, "sessions/login", sessionsForm{Error: msg, Providers: o.Providers})
+}
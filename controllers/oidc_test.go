@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/oidc"
+	"github.com/fadeojo/brito/oidc/oidctest"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"github.com/volatiletech/abcweb/abcsessions"
+)
+
+func TestOIDCStartAndCallbackState(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer()
+	defer idp.Close()
+	idp.Login("user-1")
+
+	p := oidc.NewProvider(oidc.Config{
+		Name:         "test",
+		DisplayName:  "Test SSO",
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+	}, "http://app.example.com/login/oidc/test/callback", nil, auth.SystemClock)
+
+	o := OIDC{Sessions: Sessions{
+		Root:      newRootMock("../templates"),
+		Clock:     auth.SystemClock,
+		Providers: []*oidc.Provider{p},
+	}}
+
+	// Start the login and capture the session cookie
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/login/oidc/test", nil)
+	abcsessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := o.Start(p)(w, r); err != nil {
+			t.Fatal(err)
+		}
+	})).ServeHTTP(w, r)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("expected the login state to be stored in the session")
+	}
+
+	// Let the fake IdP authorize the request
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.Query().Get("state") == "" || callback.Query().Get("code") == "" {
+		t.Fatalf("unexpected callback %s", callback)
+	}
+
+	// A callback with a forged state is rejected before the code is used
+	q := callback.Query()
+	q.Set("state", "forged")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", callback.Path+"?"+q.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	abcsessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := o.Callback(p)(w, r); err != nil {
+			t.Fatal(err)
+		}
+	})).ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected forged state to be rejected with 400, got %d", w.Code)
+	}
+
+	// The login state is single use, so the real callback fails too
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", callback.String(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	abcsessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := o.Callback(p)(w, r); err != nil {
+			t.Fatal(err)
+		}
+	})).ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected replayed callback to be rejected with 400, got %d", w.Code)
+	}
+}
+
+func TestOIDCCallbackProviderError(t *testing.T) {
+	t.Parallel()
+
+	p := oidc.NewProvider(oidc.Config{Name: "test", DisplayName: "Test SSO"}, "", nil, auth.SystemClock)
+	o := OIDC{Sessions: Sessions{Root: newRootMock("../templates")}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/login/oidc/test/callback?error=access_denied", nil)
+	r = r.WithContext(context.WithValue(r.Context(), abcmiddleware.CtxLoggerKey, o.Log))
+	abcsessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := o.Callback(p)(w, r); err != nil {
+			t.Fatal(err)
+		}
+	})).ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+}
@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/models"
+	"github.com/fadeojo/brito/reporting"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"github.com/volatiletech/abcweb/abcsessions"
+)
+
+// The session keys used by the login flow
+const (
+	// sessionUserID is the ID of the signed in user
+	sessionUserID = "user_id"
+	// sessionPasswordStamp is the passwordSessionStamp of the signed in user
+	// at sign in, which ends the session when the password is changed
+	sessionPasswordStamp = "password_stamp"
+	// sessionPendingUserID is the ID of a user that passed the password check
+	// but has yet to pass the second factor check. It is the intermediate
+	// state between the two steps of the login, and never grants access.
+	sessionPendingUserID = "pending_user_id"
+	// sessionPendingAt is the unix time the pending login was started at
+	sessionPendingAt = "pending_at"
+	// sessionPendingAttempts counts the failed second factor attempts
+	sessionPendingAttempts = "pending_attempts"
+	// sessionTOTPSetup is the TOTP secret being enrolled, until it is
+	// confirmed with a code and moved to the user
+	sessionTOTPSetup = "totp_setup"
+	// The OpenID Connect login in progress, checked in the callback
+	sessionOIDCProvider = "oidc_provider"
+	sessionOIDCState    = "oidc_state"
+	sessionOIDCNonce    = "oidc_nonce"
+	sessionOIDCVerifier = "oidc_verifier"
+)
+
+// ctxUserKey is the request context key for the signed in user
+type ctxUserKey struct{}
+
+// sessionGet returns the session value for key,
+// or an empty string when there is no session or the key is not set
+func (root Root) sessionGet(w http.ResponseWriter, r *http.Request, key string) (string, error) {
+	val, err := abcsessions.Get(root.Session, w, r, key)
+	if abcsessions.IsNoSessionError(err) || abcsessions.IsNoMapKeyError(err) {
+		return "", nil
+	}
+	return val, err
+}
+
+// sessionDel removes the keys from the session if there is one
+func (root Root) sessionDel(w http.ResponseWriter, r *http.Request, keys ...string) error {
+	for _, key := range keys {
+		err := abcsessions.Del(root.Session, w, r, key)
+		if err != nil && !abcsessions.IsNoSessionError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// signIn starts an authenticated session for user. Server side session IDs
+// are regenerated so that a session ID planted before login cannot be used
+// to hijack the authenticated session. Cookie sessions have no ID to plant.
+func (root Root) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	if err := root.sessionDel(w, r, sessionPendingUserID, sessionPendingAt, sessionPendingAttempts); err != nil {
+		return err
+	}
+	if _, ok := root.Session.(*abcsessions.StorageOverseer); ok {
+		if err := root.Session.Regenerate(w, r); err != nil && !abcsessions.IsNoSessionError(err) {
+			return err
+		}
+	}
+	if err := abcsessions.Set(root.Session, w, r, sessionPasswordStamp, passwordSessionStamp(user)); err != nil {
+		return err
+	}
+	return abcsessions.Set(root.Session, w, r, sessionUserID, strconv.FormatInt(user.ID, 10))
+}
+
+// passwordSessionStamp returns a digest of the user's password hash that
+// the session keeps, so the sessions signed in before a password reset no
+// longer load the user. The hash itself is not put in the session.
+func passwordSessionStamp(user *models.User) string {
+	sum := sha256.Sum256([]byte(user.PasswordHash))
+	return hex.EncodeToString(sum[:16])
+}
+
+// LoadUser middleware loads the signed in user from the session and stores
+// it in the request context, to be retrieved with CurrentUser. It ends the
+// sessions of users that were deleted or reset their password since they
+// signed in.
+func (root Root) LoadUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No database configured means there are no users to load
+		if db.DB == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		val, err := root.sessionGet(w, r, sessionUserID)
+		if err != nil {
+			panic(err)
+		}
+
+		id, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The user decides access, so a replica that didn't catch up with a
+		// password reset can't keep the old sessions signed in
+		user, err := models.FindUser(db.Primary(r.Context()), id)
+		if err != nil && err != sql.ErrNoRows {
+			panic(err)
+		}
+		if err == nil {
+			stamp, err := root.sessionGet(w, r, sessionPasswordStamp)
+			if err != nil {
+				panic(err)
+			}
+			if stamp != passwordSessionStamp(user) {
+				user = nil
+			}
+		}
+		if user == nil {
+			// The user was deleted or their password was reset since the
+			// session was signed in, so end the stale session
+			if err := root.Session.Del(w, r); err != nil {
+				panic(err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reporting.SetUser(r.Context(), strconv.FormatInt(user.ID, 10))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxUserKey{}, user)))
+	})
+}
+
+// CurrentUser returns the signed in user loaded by the LoadUser middleware,
+// or nil if nobody is signed in
+func CurrentUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value(ctxUserKey{}).(*models.User)
+	return user
+}
+
+// Transaction wraps a controller route handler so that it runs in a
+// database transaction, see db.InTx. The models take part in it when
+// passed db.Executor(r.Context()). It is rolled back if the handler returns
+// an error or panics. The response is held back until the transaction is
+// committed, so a failed commit is answered as an error instead of the
+// success the handler wrote.
+func Transaction(ctrl abcmiddleware.AppHandler) abcmiddleware.AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		bw := &bufferedResponseWriter{ResponseWriter: w, header: make(http.Header)}
+		err := db.InTx(r.Context(), func(ctx context.Context) error {
+			return ctrl(bw, r.WithContext(ctx))
+		})
+		if err != nil {
+			return err
+		}
+		return bw.flush()
+	}
+}
+
+// bufferedResponseWriter holds the response of a handler back until flush.
+// The session cookies are passed on to the session middleware, which
+// writes them with the response.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// Unwrap returns the wrapped ResponseWriter, for tracing.WriterContext
+func (b *bufferedResponseWriter) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
+
+// SetCookie implements the abcsessions cookie buffering interface
+func (b *bufferedResponseWriter) SetCookie(c *http.Cookie) {
+	if cw, ok := b.ResponseWriter.(interface{ SetCookie(*http.Cookie) }); ok {
+		cw.SetCookie(c)
+		return
+	}
+	http.SetCookie(b, c)
+}
+
+// GetCookie implements the abcsessions cookie buffering interface
+func (b *bufferedResponseWriter) GetCookie(name string) *http.Cookie {
+	if cw, ok := b.ResponseWriter.(interface{ GetCookie(string) *http.Cookie }); ok {
+		return cw.GetCookie(name)
+	}
+	return nil
+}
+
+// flush writes the held back response
+func (b *bufferedResponseWriter) flush() error {
+	for name, values := range b.header {
+		b.ResponseWriter.Header()[name] = values
+	}
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	b.ResponseWriter.WriteHeader(b.code)
+	_, err := b.ResponseWriter.Write(b.body.Bytes())
+	return err
+}
+
+// RequireUser wraps a controller route handler so that it redirects to the
+// login page when nobody is signed in
+func RequireUser(ctrl abcmiddleware.AppHandler) abcmiddleware.AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if CurrentUser(r) == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return nil
+		}
+		return ctrl(w, r)
+	}
+}
+
+// RequireAdmin wraps a controller route handler so that it can only be
+// used by admins. Admins must have second factor authentication enabled,
+// and are sent to enroll first if they don't.
+func RequireAdmin(ctrl abcmiddleware.AppHandler) abcmiddleware.AppHandler {
+	return RequireUser(func(w http.ResponseWriter, r *http.Request) error {
+		user := CurrentUser(r)
+		if !user.IsAdmin {
+			return ErrForbidden
+		}
+		if !user.TOTPEnabled {
+			http.Redirect(w, r, "/account/2fa", http.StatusFound)
+			return nil
+		}
+		return ctrl(w, r)
+	})
+}
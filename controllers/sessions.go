@@ -0,0 +1,345 @@
+package controllers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/models"
+	"github.com/fadeojo/brito/oidc"
+	"github.com/volatiletech/abcweb/abcsessions"
+	"go.uber.org/zap"
+)
+
+// Sessions is the controller struct for the login and logout routes.
+//
+// Users with second factor authentication enabled log in in two steps. After
+// the password check the session only holds a pending login, which has to be
+// completed with a TOTP or recovery code within PendingTTL and MaxAttempts.
+//
+// Failed password and second factor attempts are throttled per client IP and
+// per account, and lock the account after LockoutThreshold failures. Locked
+// accounts can't log in with a password, but logins through an external
+// identity provider without a second factor are not affected.
+type Sessions struct {
+	Root
+
+	Clock auth.Clock
+	// PendingTTL is how long the second factor step may take
+	PendingTTL time.Duration
+	// MaxAttempts is the number of wrong second factor codes allowed
+	// before the login has to be started over
+	MaxAttempts int
+
+	// Throttle delays login attempts after failures
+	Throttle *auth.Throttle
+	// LockoutThreshold is the number of failures within the throttle
+	// window after which an account is locked for LockoutDuration.
+	// Zero disables the lockout.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// Accounts mails the unlock links of locked accounts
+	Accounts Accounts
+
+	// Providers are the external identity providers shown on the login page
+	Providers []*oidc.Provider
+}
+
+// sessionsForm is the binding for the session templates
+type sessionsForm struct {
+	Email     string
+	Error     string
+	Providers []*oidc.Provider
+}
+
+// Login renders the login form
+func (s Sessions) Login(w http.ResponseWriter, r *http.Request) error {
+	if CurrentUser(r) != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	return s.Render.HTML(w, http.StatusOK, "sessions/login", sessionsForm{Providers: s.Providers})
+}
+
+// LoginPost checks the posted email and password and either signs the user
+// in or starts a pending login if second factor authentication is enabled
+func (s Sessions) LoginPost(w http.ResponseWriter, r *http.Request) error {
+	email := models.NormalizeEmail(r.PostFormValue("email"))
+	password := r.PostFormValue("password")
+
+	wait, err := s.throttleWait(r, email)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return s.throttled(w, wait, "sessions/login", sessionsForm{Email: email, Providers: s.Providers})
+	}
+
+	user, err := models.FindUserByEmail(db.Writer(r.Context()), email)
+	if err == sql.ErrNoRows {
+		// Check against a dummy hash so unknown emails take as long as
+		// wrong passwords and can't be told apart by response time
+		auth.CheckPassword(dummyPasswordHash(), password)
+		if err := s.failedAttempt(r, nil, email); err != nil {
+			return err
+		}
+		return s.loginFailed(w, email, "Invalid email or password.")
+	} else if err != nil {
+		return err
+	}
+
+	if !auth.CheckPassword(user.PasswordHash, password) {
+		Log(r).Info("login failed", zap.Int64("user_id", user.ID))
+		if err := s.failedAttempt(r, user, email); err != nil {
+			return err
+		}
+		return s.loginFailed(w, email, "Invalid email or password.")
+	}
+
+	// The lock is checked after the password, so only the owner of the
+	// account is told that it is locked, not anyone that knows the email
+	if user.Locked(s.Clock.Now()) {
+		Log(r).Info("login to locked account", zap.Int64("user_id", user.ID))
+		return s.loginFailed(w, email, lockedMessage)
+	}
+
+	if user.TOTPEnabled {
+		if err := s.startPending(w, r, user); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return nil
+	}
+
+	if err := s.signIn(w, r, user); err != nil {
+		return err
+	}
+	if err := s.succeededAttempt(r, email); err != nil {
+		return err
+	}
+
+	Log(r).Info("login", zap.Int64("user_id", user.ID))
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// TwoFactor renders the second factor form of a pending login
+func (s Sessions) TwoFactor(w http.ResponseWriter, r *http.Request) error {
+	_, ok, err := s.pendingUserID(w, r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	return s.Render.HTML(w, http.StatusOK, "sessions/two_factor", sessionsForm{})
+}
+
+// TwoFactorPost checks the posted TOTP or recovery code and completes the
+// pending login
+func (s Sessions) TwoFactorPost(w http.ResponseWriter, r *http.Request) error {
+	id, ok, err := s.pendingUserID(w, r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	user, err := models.FindUser(db.Writer(r.Context()), id)
+	if err == sql.ErrNoRows {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	wait, err := s.throttleWait(r, user.Email)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return s.throttled(w, wait, "sessions/two_factor", sessionsForm{})
+	}
+
+	if user.Locked(s.Clock.Now()) {
+		if err := s.sessionDel(w, r, sessionPendingUserID, sessionPendingAt, sessionPendingAttempts); err != nil {
+			return err
+		}
+		return s.loginFailed(w, "", lockedMessage)
+	}
+
+	valid, err := checkSecondFactor(r, s.Clock, user)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		Log(r).Info("second factor failed", zap.Int64("user_id", user.ID))
+		if err := s.failedAttempt(r, user, user.Email); err != nil {
+			return err
+		}
+		return s.twoFactorFailed(w, r)
+	}
+
+	if err := s.signIn(w, r, user); err != nil {
+		return err
+	}
+	if err := s.succeededAttempt(r, user.Email); err != nil {
+		return err
+	}
+
+	Log(r).Info("login", zap.Int64("user_id", user.ID))
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// LogoutPost ends the session
+func (s Sessions) LogoutPost(w http.ResponseWriter, r *http.Request) error {
+	if err := s.Session.Del(w, r); err != nil && !abcsessions.IsNoSessionError(err) {
+		return err
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// lockedMessage is shown on login attempts to locked accounts
+const lockedMessage = "This account is locked after too many failed attempts. Use the link we emailed you to unlock it, or try again later."
+
+func (s Sessions) loginFailed(w http.ResponseWriter, email string, msg string) error {
+	return s.Render.HTML(w, http.StatusUnauthorized, "sessions/login", sessionsForm{Email: email, Error: msg, Providers: s.Providers})
+}
+
+// twoFactorFailed counts a failed second factor attempt and starts the
+// login over once MaxAttempts is reached
+func (s Sessions) twoFactorFailed(w http.ResponseWriter, r *http.Request) error {
+	val, err := s.sessionGet(w, r, sessionPendingAttempts)
+	if err != nil {
+		return err
+	}
+	attempts, _ := strconv.Atoi(val)
+	attempts++
+
+	if attempts >= s.MaxAttempts {
+		if err := s.sessionDel(w, r, sessionPendingUserID, sessionPendingAt, sessionPendingAttempts); err != nil {
+			return err
+		}
+		return s.loginFailed(w, "", "Too many invalid codes, please log in again.")
+	}
+
+	if err := abcsessions.Set(s.Session, w, r, sessionPendingAttempts, strconv.Itoa(attempts)); err != nil {
+		return err
+	}
+
+	return s.Render.HTML(w, http.StatusUnauthorized, "sessions/two_factor", sessionsForm{Error: "Invalid code."})
+}
+
+// startPending stores the pending login state for user in the session
+func (s Sessions) startPending(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	if err := s.sessionDel(w, r, sessionUserID); err != nil {
+		return err
+	}
+
+	values := [][2]string{
+		{sessionPendingUserID, strconv.FormatInt(user.ID, 10)},
+		{sessionPendingAt, strconv.FormatInt(s.Clock.Now().Unix(), 10)},
+		{sessionPendingAttempts, "0"},
+	}
+	for _, v := range values {
+		if err := abcsessions.Set(s.Session, w, r, v[0], v[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pendingUserID returns the user ID of the pending login in the session.
+// It reports false if there is none, or if it expired or ran out of
+// attempts, in which case it is cleared.
+func (s Sessions) pendingUserID(w http.ResponseWriter, r *http.Request) (int64, bool, error) {
+	val, err := s.sessionGet(w, r, sessionPendingUserID)
+	if err != nil || len(val) == 0 {
+		return 0, false, err
+	}
+	id, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, false, s.sessionDel(w, r, sessionPendingUserID, sessionPendingAt, sessionPendingAttempts)
+	}
+
+	val, err = s.sessionGet(w, r, sessionPendingAt)
+	if err != nil {
+		return 0, false, err
+	}
+	at, _ := strconv.ParseInt(val, 10, 64)
+
+	val, err = s.sessionGet(w, r, sessionPendingAttempts)
+	if err != nil {
+		return 0, false, err
+	}
+	attempts, _ := strconv.Atoi(val)
+
+	if s.Clock.Now().After(time.Unix(at, 0).Add(s.PendingTTL)) || attempts >= s.MaxAttempts {
+		return 0, false, s.sessionDel(w, r, sessionPendingUserID, sessionPendingAt, sessionPendingAttempts)
+	}
+
+	return id, true, nil
+}
+
+// checkSecondFactor reports whether the posted code is a valid TOTP code
+// or unused recovery code of the user, and uses it up so it can't be
+// replayed
+func checkSecondFactor(r *http.Request, clock auth.Clock, user *models.User) (bool, error) {
+	code := strings.TrimSpace(r.PostFormValue("code"))
+	if isRecoveryCode(code) {
+		valid, err := models.UseRecoveryCode(db.Executor(r.Context()), user.ID, auth.HashRecoveryCode(code))
+		if valid {
+			Log(r).Info("recovery code used", zap.Int64("user_id", user.ID))
+		}
+		return valid, err
+	}
+
+	totp, err := auth.NewTOTP(user.TOTPSecret, clock)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(code, user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	return user.SetTOTPLastStep(db.Executor(r.Context()), step)
+}
+
+// isRecoveryCode tells recovery codes apart from TOTP codes,
+// which are all digits
+func isRecoveryCode(code string) bool {
+	for _, r := range code {
+		if (r < '0' || r > '9') && r != ' ' {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash returns a bcrypt hash that matches no password, created
+// with the current cost so checking it takes as long as a real check
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = auth.HashPassword("dummy password for timing")
+	})
+	return dummyHash
+}
@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/models"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"github.com/volatiletech/abcweb/abcsessions"
+	"go.uber.org/zap"
+)
+
+func TestSessionsPendingLogin(t *testing.T) {
+	t.Parallel()
+
+	clock := auth.NewFakeClock(time.Unix(1500000000, 0))
+	s := Sessions{
+		Root:        newRootMock("../templates"),
+		Clock:       clock,
+		PendingTTL:  time.Minute * 5,
+		MaxAttempts: 2,
+	}
+
+	var cookies []*http.Cookie
+	// do runs fn in a request carrying the cookies of the previous one
+	do := func(fn func(w http.ResponseWriter, r *http.Request)) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/login/2fa", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		abcsessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fn(w, r)
+			// Session cookies are written with the response header
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(w, r)
+		if c := w.Result().Cookies(); len(c) > 0 {
+			cookies = c
+		}
+	}
+
+	// expect checks the pending login state
+	expect := func(wantID int64, wantOK bool) {
+		t.Helper()
+		do(func(w http.ResponseWriter, r *http.Request) {
+			id, ok, err := s.pendingUserID(w, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != wantOK || id != wantID {
+				t.Errorf("want %d %t, got %d %t", wantID, wantOK, id, ok)
+			}
+		})
+	}
+
+	expect(0, false)
+
+	do(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.startPending(w, r, &models.User{ID: 5}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expect(5, true)
+
+	// The pending login must not count as signed in
+	do(func(w http.ResponseWriter, r *http.Request) {
+		if val, err := s.sessionGet(w, r, sessionUserID); err != nil || val != "" {
+			t.Errorf("expected no user in session, got %q %v", val, err)
+		}
+	})
+
+	clock.Advance(time.Minute * 4)
+	expect(5, true)
+
+	clock.Advance(time.Minute * 2)
+	expect(0, false)
+
+	// Expired pending logins are cleared, not revived by a clock change
+	clock.Advance(-time.Minute * 6)
+	expect(0, false)
+}
+
+func TestSessionsPendingLoginAttempts(t *testing.T) {
+	t.Parallel()
+
+	clock := auth.NewFakeClock(time.Unix(1500000000, 0))
+	s := Sessions{
+		Root:        newRootMock("../templates"),
+		Clock:       clock,
+		PendingTTL:  time.Minute * 5,
+		MaxAttempts: 2,
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login/2fa", nil)
+	abcsessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.startPending(w, r, &models.User{ID: 5}); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < s.MaxAttempts; i++ {
+			if _, ok, _ := s.pendingUserID(w, r); !ok {
+				t.Fatalf("attempt %d: expected pending login", i)
+			}
+			if err := s.twoFactorFailed(w, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, ok, _ := s.pendingUserID(w, r); ok {
+			t.Error("expected pending login to end after max attempts")
+		}
+	})).ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestIsRecoveryCode(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]bool{
+		"123456":      false,
+		"123 456":     false,
+		"abcde-fghij": true,
+		"23456-72345": true,
+	}
+
+	for code, want := range tests {
+		if got := isRecoveryCode(code); got != want {
+			t.Errorf("%q: want %t, got %t", code, want, got)
+		}
+	}
+}
+
+func TestSessionsLoginThrottled(t *testing.T) {
+	t.Parallel()
+
+	s := Sessions{
+		Root:  newRootMock("../templates"),
+		Clock: auth.SystemClock,
+		Throttle: &auth.Throttle{
+			Store:     auth.NewMemoryThrottleStore(),
+			Clock:     auth.SystemClock,
+			BaseDelay: time.Minute,
+			MaxDelay:  time.Minute,
+			Window:    time.Hour,
+		},
+	}
+
+	newRequest := func(ip string) *http.Request {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"email": {" A@example.com"}, "password": {"x"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = ip + ":1234"
+		return r.WithContext(context.WithValue(r.Context(), abcmiddleware.CtxLoggerKey, zap.NewNop()))
+	}
+
+	// An unknown account fails the same as a wrong password
+	if err := s.failedAttempt(newRequest("192.0.2.1"), nil, "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the IP and the account are throttled
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		w := httptest.NewRecorder()
+		if err := s.LoginPost(w, newRequest(ip)); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: expected 429, got %d", ip, w.Code)
+		}
+		if w.Header().Get("Retry-After") != "60" {
+			t.Errorf("%s: expected Retry-After 60, got %q", ip, w.Header().Get("Retry-After"))
+		}
+		if !strings.Contains(w.Body.String(), "Too many failed attempts") {
+			t.Errorf("%s: expected throttle message", ip)
+		}
+	}
+
+	// A completed login forgets the account's failures, but not the IP's
+	if err := s.succeededAttempt(newRequest("192.0.2.1"), "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := s.throttleWait(newRequest("192.0.2.2"), "a@example.com"); wait != 0 {
+		t.Errorf("expected account to be reset, got wait %s", wait)
+	}
+	if wait, _ := s.throttleWait(newRequest("192.0.2.1"), "b@example.com"); wait == 0 {
+		t.Error("expected IP to stay throttled")
+	}
+}
+
+func TestLoadUserPasswordReset(t *testing.T) {
+	t.Parallel()
+
+	root := newRootMock("../templates")
+	user := &models.User{Email: "load-user@example.com", PasswordHash: "old"}
+	if err := user.Insert(db.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	var cookies []*http.Cookie
+	// do runs fn behind LoadUser in a request carrying the cookies of the
+	// previous one
+	do := func(fn func(w http.ResponseWriter, r *http.Request)) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		abcsessions.Middleware(root.LoadUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fn(w, r)
+			w.WriteHeader(http.StatusOK)
+		}))).ServeHTTP(w, r)
+		if c := w.Result().Cookies(); len(c) > 0 {
+			cookies = c
+		}
+	}
+
+	do(func(w http.ResponseWriter, r *http.Request) {
+		if err := root.signIn(w, r, user); err != nil {
+			t.Fatal(err)
+		}
+	})
+	do(func(w http.ResponseWriter, r *http.Request) {
+		if u := CurrentUser(r); u == nil || u.ID != user.ID {
+			t.Errorf("expected the user to be signed in, got %+v", u)
+		}
+	})
+
+	if ok, err := user.ResetPassword(db.DB, "new"); err != nil || !ok {
+		t.Fatalf("expected the password to be reset, got %t %v", ok, err)
+	}
+	for i := 0; i < 2; i++ {
+		do(func(w http.ResponseWriter, r *http.Request) {
+			if u := CurrentUser(r); u != nil {
+				t.Errorf("%d: expected the session to end after the reset, got %+v", i, u)
+			}
+		})
+	}
+}
+
+func TestSessionsLoginLocked(t *testing.T) {
+	t.Parallel()
+
+	hash, err := auth.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Email: "locked-login@example.com", PasswordHash: hash, LockedUntil: time.Now().Add(time.Hour).Unix()}
+	if err := user.Insert(db.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	s := Sessions{
+		Root:  newRootMock("../templates"),
+		Clock: auth.SystemClock,
+		Throttle: &auth.Throttle{
+			Store:        auth.NewMemoryThrottleStore(),
+			Clock:        auth.SystemClock,
+			FreeAttempts: 10,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Minute,
+			Window:       time.Hour,
+		},
+	}
+
+	login := func(password string) string {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"email": {user.Email}, "password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), abcmiddleware.CtxLoggerKey, zap.NewNop()))
+		w := httptest.NewRecorder()
+		if err := s.LoginPost(w, r); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	// Only the password tells that the account is locked
+	if body := login("wrong"); strings.Contains(body, "account is locked") || !strings.Contains(body, "Invalid email or password") {
+		t.Error("expected a wrong password to fail like an unknown account")
+	}
+	if body := login("correct horse"); !strings.Contains(body, "account is locked") {
+		t.Error("expected the locked message for the right password")
+	}
+}
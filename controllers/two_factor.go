@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/models"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcsessions"
+	"go.uber.org/zap"
+	"rsc.io/qr"
+)
+
+// TwoFactor is the controller struct for the second factor authentication
+// account settings. All routes require a signed in user.
+//
+// Disabling second factor authentication and generating new recovery codes
+// require the user to enter their password again, or a second factor code
+// if they have no password, like the users signed up with OIDC.
+type TwoFactor struct {
+	Root
+
+	Clock auth.Clock
+	// Issuer is the name shown for the account in authenticator apps
+	Issuer string
+}
+
+// twoFactorData is the binding for the two_factor templates
+type twoFactorData struct {
+	Enabled bool
+	// HasPassword asks for the password instead of a code to
+	// reauthenticate
+	HasPassword   bool
+	RecoveryCodes []string
+	// Remaining is the number of unused recovery codes
+	Remaining int
+	Secret    string
+	URI       string
+	QRCode    template.URL
+	Error     string
+}
+
+// Show renders the second factor authentication settings
+func (t TwoFactor) Show(w http.ResponseWriter, r *http.Request) error {
+	return t.show(w, http.StatusOK, CurrentUser(r), "")
+}
+
+// Setup renders the enrollment page with a new secret as QR code
+func (t TwoFactor) Setup(w http.ResponseWriter, r *http.Request) error {
+	user := CurrentUser(r)
+	if user.TOTPEnabled {
+		http.Redirect(w, r, "/account/2fa", http.StatusFound)
+		return nil
+	}
+
+	// Keep the secret across reloads so a scanned code stays valid
+	secret, err := t.sessionGet(w, r, sessionTOTPSetup)
+	if err != nil {
+		return err
+	}
+	if len(secret) == 0 {
+		if secret, err = auth.GenerateTOTPSecret(); err != nil {
+			return err
+		}
+		if err := abcsessions.Set(t.Session, w, r, sessionTOTPSetup, secret); err != nil {
+			return err
+		}
+	}
+
+	return t.setup(w, http.StatusOK, user, secret, "")
+}
+
+// EnablePost checks the posted code against the secret being enrolled,
+// enables second factor authentication and shows the recovery codes
+func (t TwoFactor) EnablePost(w http.ResponseWriter, r *http.Request) error {
+	user := CurrentUser(r)
+	if user.TOTPEnabled {
+		http.Redirect(w, r, "/account/2fa", http.StatusFound)
+		return nil
+	}
+
+	secret, err := t.sessionGet(w, r, sessionTOTPSetup)
+	if err != nil {
+		return err
+	}
+	if len(secret) == 0 {
+		http.Redirect(w, r, "/account/2fa/setup", http.StatusFound)
+		return nil
+	}
+
+	totp, err := auth.NewTOTP(secret, t.Clock)
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(r.PostFormValue("code"), 0)
+	if !ok {
+		return t.setup(w, http.StatusUnprocessableEntity, user, secret, "Invalid code, please try again.")
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	var enabled bool
+	err = db.InTx(r.Context(), func(ctx context.Context) error {
+		exec := db.Executor(ctx)
+		var err error
+		if enabled, err = user.SetTOTP(exec, secret, true, step); err != nil || !enabled {
+			return err
+		}
+		return models.ReplaceRecoveryCodes(exec, user.ID, hashes)
+	})
+	if err != nil {
+		return err
+	}
+	// A concurrent request enabled it with its own recovery codes
+	if !enabled {
+		http.Redirect(w, r, "/account/2fa", http.StatusFound)
+		return nil
+	}
+
+	if err := t.sessionDel(w, r, sessionTOTPSetup); err != nil {
+		return err
+	}
+
+	Log(r).Info("two factor enabled", zap.Int64("user_id", user.ID))
+	return t.Render.HTML(w, http.StatusOK, "two_factor/recovery_codes", twoFactorData{RecoveryCodes: codes})
+}
+
+// DisablePost turns second factor authentication off after checking the
+// posted password, see reauthenticate. Wrap it with Transaction.
+func (t TwoFactor) DisablePost(w http.ResponseWriter, r *http.Request) error {
+	user := CurrentUser(r)
+	if !user.TOTPEnabled {
+		http.Redirect(w, r, "/account/2fa", http.StatusFound)
+		return nil
+	}
+	if ok, err := t.reauthenticate(w, r, user); err != nil || !ok {
+		return err
+	}
+
+	// The route runs in a transaction, see Transaction
+	exec := db.Executor(r.Context())
+	if _, err := user.SetTOTP(exec, "", false, 0); err != nil {
+		return err
+	}
+	if err := models.DeleteRecoveryCodes(exec, user.ID); err != nil {
+		return err
+	}
+
+	Log(r).Info("two factor disabled", zap.Int64("user_id", user.ID))
+	http.Redirect(w, r, "/account/2fa", http.StatusFound)
+	return nil
+}
+
+// RecoveryCodesPost replaces the recovery codes with new ones after checking
+// the posted password, see reauthenticate, and shows them
+func (t TwoFactor) RecoveryCodesPost(w http.ResponseWriter, r *http.Request) error {
+	user := CurrentUser(r)
+	if !user.TOTPEnabled {
+		http.Redirect(w, r, "/account/2fa", http.StatusFound)
+		return nil
+	}
+	if ok, err := t.reauthenticate(w, r, user); err != nil || !ok {
+		return err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	err = db.InTx(r.Context(), func(ctx context.Context) error {
+		return models.ReplaceRecoveryCodes(db.Executor(ctx), user.ID, hashes)
+	})
+	if err != nil {
+		return err
+	}
+
+	Log(r).Info("recovery codes regenerated", zap.Int64("user_id", user.ID))
+	return t.Render.HTML(w, http.StatusOK, "two_factor/recovery_codes", twoFactorData{RecoveryCodes: codes})
+}
+
+// reauthenticate checks the posted password, or the posted TOTP or recovery
+// code of users without a password, who could never enter one. It renders
+// the error and reports false if it is wrong.
+func (t TwoFactor) reauthenticate(w http.ResponseWriter, r *http.Request, user *models.User) (bool, error) {
+	if len(user.PasswordHash) > 0 {
+		if auth.CheckPassword(user.PasswordHash, r.PostFormValue("password")) {
+			return true, nil
+		}
+		return false, t.show(w, http.StatusUnauthorized, user, "Invalid password.")
+	}
+
+	ok, err := checkSecondFactor(r, t.Clock, user)
+	if err != nil || ok {
+		return ok, err
+	}
+	return false, t.show(w, http.StatusUnauthorized, user, "Invalid code.")
+}
+
+func (t TwoFactor) show(w http.ResponseWriter, status int, user *models.User, msg string) error {
+	data := twoFactorData{Enabled: user.TOTPEnabled, HasPassword: len(user.PasswordHash) > 0, Error: msg}
+	if user.TOTPEnabled {
+		var err error
+		if data.Remaining, err = models.CountRecoveryCodes(db.DB, user.ID); err != nil {
+			return err
+		}
+	}
+
+	return t.Render.HTML(w, status, "two_factor/show", data)
+}
+
+func (t TwoFactor) setup(w http.ResponseWriter, status int, user *models.User, secret string, msg string) error {
+	uri := auth.ProvisioningURI(secret, t.Issuer, user.Email)
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode qr code")
+	}
+	code.Scale = 4
+
+	return t.Render.HTML(w, status, "two_factor/setup", twoFactorData{
+		Secret: secret,
+		URI:    uri,
+		// template.URL stops html/template from filtering the data URI
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())),
+		Error:  msg,
+	})
+}
+
+// newRecoveryCodes returns a new set of recovery codes and their hashes
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	if codes, err = auth.GenerateRecoveryCodes(); err != nil {
+		return nil, nil, err
+	}
+	hashes = make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
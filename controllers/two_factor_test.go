@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/models"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"github.com/volatiletech/abcweb/abcsessions"
+	"go.uber.org/zap"
+)
+
+func TestTwoFactorSetup(t *testing.T) {
+	t.Parallel()
+
+	tf := TwoFactor{
+		Root:   newRootMock("../templates"),
+		Clock:  auth.SystemClock,
+		Issuer: "brito",
+	}
+
+	user := &models.User{ID: 1, Email: "a@example.com"}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/account/2fa/setup", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxUserKey{}, user))
+
+	abcsessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := tf.Setup(w, r); err != nil {
+			t.Fatal(err)
+		}
+	})).ServeHTTP(w, r)
+
+	body := w.Body.String()
+	if !strings.Contains(body, `src="data:image/png;base64,`) {
+		t.Error("expected qr code image in setup page")
+	}
+	if !strings.Contains(body, "otpauth://totp/brito:a@example.com?") {
+		t.Error("expected provisioning uri in setup page")
+	}
+	if len(w.Result().Cookies()) == 0 {
+		t.Error("expected the secret to be stored in the session")
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	t.Parallel()
+
+	ok := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	}
+
+	tests := []struct {
+		user     *models.User
+		code     int
+		location string
+		err      error
+	}{
+		{nil, http.StatusFound, "/login", nil},
+		{&models.User{}, http.StatusOK, "", ErrForbidden},
+		{&models.User{IsAdmin: true}, http.StatusFound, "/account/2fa", nil},
+		{&models.User{IsAdmin: true, TOTPEnabled: true}, http.StatusTeapot, "", nil},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/admin", nil)
+		if test.user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), ctxUserKey{}, test.user))
+		}
+
+		if err := RequireAdmin(ok)(w, r); err != test.err {
+			t.Errorf("%d: want error %v, got %v", i, test.err, err)
+		}
+		if w.Code != test.code {
+			t.Errorf("%d: want status %d, got %d", i, test.code, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != test.location {
+			t.Errorf("%d: want location %q, got %q", i, test.location, loc)
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	t.Parallel()
+
+	handler := Transaction(func(w http.ResponseWriter, r *http.Request) error {
+		if _, err := db.Executor(r.Context()).Exec(db.Rebind("INSERT INTO throttle_failures (throttle_key, count, last_failure) VALUES (?, 1, ?)"), "transaction-test", time.Now()); err != nil {
+			return err
+		}
+		return ErrForbidden
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", nil)
+	if err := handler(w, r); err != ErrForbidden {
+		t.Errorf("expected the handler error, got %v", err)
+	}
+
+	// The insert of the handler is rolled back with its transaction
+	var n int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM throttle_failures WHERE throttle_key = 'transaction-test'").Scan(&n); err != nil || n != 0 {
+		t.Errorf("expected the handler to run in a transaction, got %d rows, %v", n, err)
+	}
+}
+
+func TestTransactionHoldsResponse(t *testing.T) {
+	t.Parallel()
+
+	w := httptest.NewRecorder()
+	handler := Transaction(func(tw http.ResponseWriter, r *http.Request) error {
+		if _, err := db.Executor(r.Context()).Exec(db.Rebind("INSERT INTO throttle_failures (throttle_key, count, last_failure) VALUES (?, 1, ?)"), "transaction-response-test", time.Now()); err != nil {
+			return err
+		}
+		http.Redirect(tw, r, "/account/2fa", http.StatusFound)
+
+		// Nothing is sent before the commit
+		if w.Body.Len() > 0 || len(w.Header().Get("Location")) > 0 {
+			t.Error("expected the response to be held back until the commit")
+		}
+		return nil
+	})
+
+	r := httptest.NewRequest("POST", "/", nil)
+	if err := handler(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/account/2fa" {
+		t.Errorf("expected the redirect after the commit, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	var n int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM throttle_failures WHERE throttle_key = 'transaction-response-test'").Scan(&n); err != nil || n != 1 {
+		t.Errorf("expected the insert to be committed, got %d rows, %v", n, err)
+	}
+}
+
+func TestTwoFactorWithoutPassword(t *testing.T) {
+	t.Parallel()
+
+	clock := auth.NewFakeClock(time.Now())
+	tf := TwoFactor{Root: newRootMock("../templates"), Clock: clock, Issuer: "brito"}
+
+	// Users signed up with OIDC have no password to enter
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{Email: "oidc-2fa@example.com", TOTPSecret: secret, TOTPEnabled: true}
+	if err := user.Insert(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := models.ReplaceRecoveryCodes(db.DB, user.ID, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(handler func(w http.ResponseWriter, r *http.Request) error, code string) *httptest.ResponseRecorder {
+		current, err := models.FindUser(db.DB, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := context.WithValue(r.Context(), abcmiddleware.CtxLoggerKey, zap.NewNop())
+		r = r.WithContext(context.WithValue(ctx, ctxUserKey{}, current))
+		w := httptest.NewRecorder()
+		if err := handler(w, r); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := post(tf.RecoveryCodesPost, "wrong-code")
+	if body := w.Body.String(); w.Code != http.StatusUnauthorized || !strings.Contains(body, "Invalid code.") {
+		t.Errorf("expected a wrong code to be rejected, got %d", w.Code)
+	} else if !strings.Contains(body, `name="code"`) || strings.Contains(body, `name="password"`) {
+		t.Error("expected the form to ask for a code instead of the password")
+	}
+	if w := post(tf.RecoveryCodesPost, codes[0]); w.Code != http.StatusOK {
+		t.Errorf("expected new recovery codes for a recovery code, got %d", w.Code)
+	}
+
+	totp, err := auth.NewTOTP(secret, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := post(tf.DisablePost, totp.Code()); w.Code != http.StatusFound {
+		t.Errorf("expected two factor to be disabled for a TOTP code, got %d", w.Code)
+	}
+	if u, err := models.FindUser(db.DB, user.ID); err != nil || u.TOTPEnabled || len(u.TOTPSecret) > 0 {
+		t.Errorf("expected two factor to be off, got %+v %v", u, err)
+	}
+}
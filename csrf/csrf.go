@@ -0,0 +1,249 @@
+// Package csrf implements synchronizer token CSRF protection bound to the
+// user's session.
+//
+// Every session holds a secret token. Forms send it back in a hidden field
+// and JavaScript clients in a header, which they read from a cookie that is
+// set on every response (the double-submit pattern). Either way the token
+// is compared against the one in the session, so a cookie planted by a
+// sibling domain is of no use to an attacker.
+//
+// The tokens handed out are masked with a random pad on every response so
+// they can't be recovered through compression side channels like BREACH.
+package csrf
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcsessions"
+)
+
+// Defaults for the Protector names
+const (
+	DefaultFieldName  = "csrf_token"
+	DefaultHeaderName = "X-CSRF-Token"
+	DefaultCookieName = "XSRF-TOKEN"
+)
+
+// sessionKey is the session key the secret token is stored under
+const sessionKey = "csrf_token"
+
+const tokenSize = 32
+
+// ErrInvalidToken is the error passed to the failure handler
+var ErrInvalidToken = errors.New("csrf token missing or invalid")
+
+// Protector is the CSRF protection middleware
+type Protector struct {
+	Session abcsessions.Overseer
+
+	// FieldName is the form field the token is read from
+	FieldName string
+	// HeaderName is the request header the token is read from
+	HeaderName string
+	// CookieName is the JavaScript readable cookie the token is sent in
+	CookieName string
+	// Secure sets the Secure flag on the token cookie
+	Secure bool
+
+	// Failure handles requests that fail the check. It defaults to a
+	// plain 403 Forbidden.
+	Failure http.Handler
+}
+
+// New returns a Protector with the default names
+func New(session abcsessions.Overseer, secure bool, failure http.Handler) *Protector {
+	return &Protector{
+		Session:    session,
+		FieldName:  DefaultFieldName,
+		HeaderName: DefaultHeaderName,
+		CookieName: DefaultCookieName,
+		Secure:     secure,
+		Failure:    failure,
+	}
+}
+
+// Middleware checks the token on all requests with unsafe methods and makes
+// the token available to the handlers through Token. It must be used after
+// the sessions middleware.
+//
+// Requests with a bearer token in the Authorization header are exempt,
+// since browsers never add one on their own. Their cookies are removed so
+// that such a request can never be authenticated by the session instead.
+func (p *Protector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isBearer(r) {
+			r.Header.Del("Cookie")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		secret, err := p.secret(w, r)
+		if err != nil {
+			panic(err)
+		}
+
+		cw := &responseWriter{ResponseWriter: w, secret: secret}
+
+		if !isSafe(r.Method) {
+			sent := r.Header.Get(p.HeaderName)
+			if len(sent) == 0 {
+				sent = r.PostFormValue(p.FieldName)
+			}
+			if !valid(secret, sent) {
+				p.fail(cw, r)
+				return
+			}
+		}
+
+		http.SetCookie(cw, &http.Cookie{
+			Name:     p.CookieName,
+			Value:    cw.CSRFToken(),
+			Path:     "/",
+			Secure:   p.Secure,
+			HttpOnly: false,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// Token returns a masked token for the response, for use in forms or
+// JavaScript. w must be the ResponseWriter passed to the handler by the
+// middleware; an empty string is returned for any other writer.
+func Token(w io.Writer) string {
+	if t, ok := w.(interface{ CSRFToken() string }); ok {
+		return t.CSRFToken()
+	}
+	return ""
+}
+
+// secret returns the session's secret token, creating it if needed
+func (p *Protector) secret(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	val, err := abcsessions.Get(p.Session, w, r, sessionKey)
+	if err == nil {
+		if secret, err := base64.RawURLEncoding.DecodeString(val); err == nil && len(secret) == tokenSize {
+			return secret, nil
+		}
+	} else if !abcsessions.IsNoSessionError(err) && !abcsessions.IsNoMapKeyError(err) {
+		return nil, err
+	}
+
+	secret := make([]byte, tokenSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := abcsessions.Set(p.Session, w, r, sessionKey, base64.RawURLEncoding.EncodeToString(secret)); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func (p *Protector) fail(w http.ResponseWriter, r *http.Request) {
+	if p.Failure == nil {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	p.Failure.ServeHTTP(w, r)
+}
+
+// mask returns the secret XORed with a random pad, prefixed by the pad
+func mask(secret []byte) string {
+	b := make([]byte, 2*tokenSize)
+	if _, err := rand.Read(b[:tokenSize]); err != nil {
+		panic(err)
+	}
+	for i := range secret {
+		b[tokenSize+i] = b[i] ^ secret[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// valid reports whether the masked token sent matches the secret
+func valid(secret []byte, sent string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(sent)
+	if err != nil || len(b) != 2*tokenSize {
+		return false
+	}
+
+	token := make([]byte, tokenSize)
+	for i := range token {
+		token[i] = b[i] ^ b[tokenSize+i]
+	}
+	return subtle.ConstantTimeCompare(token, secret) == 1
+}
+
+func isSafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+func isBearer(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	return len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ")
+}
+
+// responseWriter carries the token to Token. It passes the session cookie
+// buffering and connection hijacking through to the wrapped ResponseWriter.
+type responseWriter struct {
+	http.ResponseWriter
+	secret []byte
+	token  string
+}
+
+// CSRFToken returns the masked token, the same one for the whole response
+func (w *responseWriter) CSRFToken() string {
+	if len(w.token) == 0 {
+		w.token = mask(w.secret)
+	}
+	return w.token
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// SetCookie implements the abcsessions cookie buffering interface
+func (w *responseWriter) SetCookie(c *http.Cookie) {
+	if cw, ok := w.ResponseWriter.(interface{ SetCookie(*http.Cookie) }); ok {
+		cw.SetCookie(c)
+		return
+	}
+	http.SetCookie(w.ResponseWriter, c)
+}
+
+// GetCookie implements the abcsessions cookie buffering interface
+func (w *responseWriter) GetCookie(name string) *http.Cookie {
+	if cw, ok := w.ResponseWriter.(interface{ GetCookie(string) *http.Cookie }); ok {
+		return cw.GetCookie(name)
+	}
+	return nil
+}
+
+// Hijack implements http.Hijacker if the wrapped ResponseWriter does
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("csrf: ResponseWriter does not implement http.Hijacker")
+}
+
+// Flush implements http.Flusher if the wrapped ResponseWriter does
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,171 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/volatiletech/abcweb/abcsessions"
+)
+
+func newTestHandler(t *testing.T) (http.Handler, *string) {
+	storer, err := abcsessions.NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := abcsessions.NewStorageOverseer(abcsessions.NewCookieOptions(), storer)
+	p := New(session, false, nil)
+
+	token := new(string)
+	h := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*token = Token(w)
+		// Session writes must still work behind the middleware
+		if err := abcsessions.Set(session, w, r, "seen", "1"); err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	return abcsessions.Middleware(h), token
+}
+
+// sessionCookies returns the cookies of a response, minus the token cookie
+func sessionCookies(w *httptest.ResponseRecorder) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name != DefaultCookieName {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	h, token := newTestHandler(t)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || len(*token) == 0 {
+		t.Fatalf("expected GET to pass and get a token, got %d %q", w.Code, *token)
+	}
+	formToken := *token
+	cookies := sessionCookies(w)
+
+	var readable *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == DefaultCookieName {
+			readable = c
+		}
+	}
+	if readable == nil || readable.HttpOnly || readable.Value != formToken {
+		t.Fatalf("expected a readable token cookie, got %#v", readable)
+	}
+
+	post := func(form url.Values, header string, cookies []*http.Cookie) int {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(header) > 0 {
+			r.Header.Set(DefaultHeaderName, header)
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := post(nil, "", cookies); code != http.StatusForbidden {
+		t.Errorf("expected post without token to be forbidden, got %d", code)
+	}
+	if code := post(url.Values{DefaultFieldName: {formToken}}, "", cookies); code != http.StatusOK {
+		t.Errorf("expected post with form token to pass, got %d", code)
+	}
+	if code := post(nil, readable.Value, cookies); code != http.StatusOK {
+		t.Errorf("expected post with header token to pass, got %d", code)
+	}
+	if code := post(url.Values{DefaultFieldName: {formToken}}, "", nil); code != http.StatusForbidden {
+		t.Errorf("expected token without its session to be forbidden, got %d", code)
+	}
+	if code := post(url.Values{DefaultFieldName: {"garbage"}}, "", cookies); code != http.StatusForbidden {
+		t.Errorf("expected invalid token to be forbidden, got %d", code)
+	}
+
+	// A token from another session is rejected
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if code := post(url.Values{DefaultFieldName: {*token}}, "", cookies); code != http.StatusForbidden {
+		t.Errorf("expected token of another session to be forbidden, got %d", code)
+	}
+
+	// Tokens are masked differently on every response but stay valid
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	h.ServeHTTP(w, r)
+	if *token == formToken {
+		t.Error("expected a freshly masked token")
+	}
+	if code := post(url.Values{DefaultFieldName: {*token}}, "", cookies); code != http.StatusOK {
+		t.Errorf("expected new token to pass, got %d", code)
+	}
+}
+
+func TestMiddlewareBearerExempt(t *testing.T) {
+	t.Parallel()
+
+	storer, err := abcsessions.NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := abcsessions.NewStorageOverseer(abcsessions.NewCookieOptions(), storer)
+	p := New(session, false, nil)
+
+	var cookie string
+	h := abcsessions.Middleware(p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie = r.Header.Get("Cookie")
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	r := httptest.NewRequest("POST", "/api", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+	r.AddCookie(&http.Cookie{Name: "id", Value: "session"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected bearer request to be exempt, got %d", w.Code)
+	}
+	if len(cookie) > 0 {
+		t.Errorf("expected cookies to be removed from bearer requests, got %q", cookie)
+	}
+}
+
+func TestMaskValid(t *testing.T) {
+	t.Parallel()
+
+	secret := make([]byte, tokenSize)
+	secret[0] = 1
+
+	a, b := mask(secret), mask(secret)
+	if a == b {
+		t.Error("expected masks to differ")
+	}
+	if !valid(secret, a) || !valid(secret, b) {
+		t.Error("expected masked tokens to be valid")
+	}
+
+	other := make([]byte, tokenSize)
+	if valid(other, a) {
+		t.Error("expected token to be invalid for another secret")
+	}
+	if valid(secret, "") {
+		t.Error("expected empty token to be invalid")
+	}
+}
@@ -2,40 +2,137 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/volatiletech/abcweb/abcconfig"
-	"github.com/volatiletech/abcweb/abcdatabase"
+	"github.com/volatiletech/sqlboiler/bdb/drivers"
+	"go.uber.org/zap"
 	// Import your database drivers below by uncommenting your relevant driver.
-	// _ "github.com/go-sql-driver/mysql"
-	// _ "github.com/lib/pq"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 // DB is the global database handle to your config defined db
 var DB *sql.DB
 
-// InitDB initializes the DB global database handle
-func InitDB(cfg abcconfig.DBConfig) error {
-	// No username provided is a signal to skip database usage
-	if len(cfg.User) == 0 {
+// Driver is the database software DB is connected to, as set by InitDB.
+// It is used by Rebind to pick the query placeholder syntax.
+var Driver = "postgres"
+
+// InitDB initializes the DB global database handle with the pool settings.
+// It keeps trying to reach the database for up to pool.ConnectTimeout,
+// logging the failed attempts to log.
+func InitDB(cfg abcconfig.DBConfig, pool PoolConfig, log *zap.Logger) error {
+	// No username provided is a signal to skip database usage. SQLite
+	// databases are files and have no users.
+	if len(cfg.User) == 0 && cfg.DB != "sqlite3" {
 		return nil
 	}
 
-	connStr, err := abcdatabase.GetConnStr(cfg)
+	conn, err := Open(cfg)
 	if err != nil {
 		return err
 	}
+	// More connections to an in-memory SQLite database would see other
+	// databases, and it is gone once its connection is closed
+	if cfg.DB != "sqlite3" || !sqliteMemory(cfg.DBName) {
+		pool.apply(conn)
+	}
+	DB = conn
+	Driver = cfg.DB
+	queryLog = log
+
+	return connect(DB, pool.ConnectTimeout, log)
+}
 
-	DB, err = sql.Open(cfg.DB, connStr)
+// Open returns a handle to the configured database, which traces its
+// queries, see SlowQuery. An in-memory SQLite database is limited to one
+// connection, since every connection to it would otherwise get its own
+// empty database.
+func Open(cfg abcconfig.DBConfig) (*sql.DB, error) {
+	connStr, err := ConnStr(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	p := DB.Ping()
-	if p != nil {
-		return p
+	conn, err := open(cfg.DB, connStr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DB == "sqlite3" && sqliteMemory(cfg.DBName) {
+		conn.SetMaxOpenConns(1)
 	}
 
-	return nil
+	return conn, nil
+}
+
+// ConnStr returns the connection string for the configured database.
+// It is used instead of abcdatabase.GetConnStr because abcdatabase needs
+// the app's git repository at runtime, which a deployed binary lacks.
+func ConnStr(cfg abcconfig.DBConfig) (string, error) {
+	switch cfg.DB {
+	case "postgres":
+		return drivers.PostgresBuildQueryString(cfg.User, cfg.Pass, cfg.DBName, cfg.Host, cfg.Port, cfg.SSLMode), nil
+	case "mysql":
+		return drivers.MySQLBuildQueryString(cfg.User, cfg.Pass, cfg.DBName, cfg.Host, cfg.Port, cfg.SSLMode), nil
+	case "sqlite3":
+		if len(cfg.DBName) == 0 {
+			return "", errors.New("dbname must be the path of the sqlite3 database file")
+		}
+		return sqliteConnStr(cfg.DBName), nil
+	case "":
+		return "", errors.New("db field in config.toml must be provided")
+	}
+
+	return "", fmt.Errorf("cannot get connection string for unknown database %q", cfg.DB)
+}
+
+// sqliteConnStr returns the go-sqlite3 connection string of the database
+// file at path. Writers wait for each other instead of failing with
+// "database is locked", and transactions take the write lock when they
+// begin, so two of them can't deadlock upgrading their read locks.
+// File databases use WAL journaling so reads don't block on writes.
+func sqliteConnStr(path string) string {
+	params := "_busy_timeout=5000&_txlock=immediate"
+	if !sqliteMemory(path) {
+		params += "&_journal_mode=WAL"
+	}
+
+	if strings.Contains(path, "?") {
+		return path + "&" + params
+	}
+	return path + "?" + params
+}
+
+// sqliteMemory reports whether the sqlite3 dbname is an in-memory database
+func sqliteMemory(dbName string) bool {
+	return dbName == ":memory:" || strings.Contains(dbName, "mode=memory")
+}
+
+// Rebind replaces the ? placeholders in query with the placeholder syntax
+// of Driver, so that hand written queries work against every database.
+func Rebind(query string) string {
+	if Driver != "postgres" {
+		return query
+	}
+
+	buf := make([]byte, 0, len(query)+8)
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '?' {
+			buf = append(buf, query[i])
+			continue
+		}
+		n++
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(n), 10)
+	}
+
+	return string(buf)
 }
 
 // GoTestdata is a function that can be edited and used to insert testdata
@@ -2,16 +2,16 @@ package db
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"testing"
 
-	"github.com/volatiletech/abcweb/abcdatabase"
+	"github.com/fadeojo/brito/migrate"
 )
 
 func TestMain(m *testing.M) {
-	var err error
-	var count int
-	DB, count, err = abcdatabase.SetupTestSuite(GoTestdata)
+	count, err := SetupTestSuite(GoTestdata)
 	if err != nil {
 		fmt.Printf("TestMain setup failed: %s\n", err)
 		os.Exit(1)
@@ -19,5 +19,57 @@ func TestMain(m *testing.M) {
 	fmt.Printf("TestMain Setup ran %d migrations.\n", count)
 
 	r := m.Run()
+	if err := TeardownTestSuite(); err != nil {
+		fmt.Printf("TestMain teardown failed: %s\n", err)
+	}
 	os.Exit(r)
 }
+
+func TestRebind(t *testing.T) {
+	driver := Driver
+	defer func() { Driver = driver }()
+
+	query := "SELECT * FROM users WHERE id = ? AND email = ?"
+
+	Driver = "postgres"
+	if got := Rebind(query); got != "SELECT * FROM users WHERE id = $1 AND email = $2" {
+		t.Errorf("unexpected postgres query %q", got)
+	}
+
+	Driver = "mysql"
+	if got := Rebind(query); got != query {
+		t.Errorf("unexpected mysql query %q", got)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	for _, pattern := range []string{"*.sql", "sqlite3/*.sql"} {
+		embedded, err := fs.Glob(Migrations(), pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		onDisk, err := filepath.Glob(filepath.Join("migrations", filepath.FromSlash(pattern)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(embedded) == 0 || len(embedded) != len(onDisk) {
+			t.Errorf("expected all %d %s migrations to be embedded, got %d", len(onDisk), pattern, len(embedded))
+		}
+	}
+}
+
+func TestMigrationsDownUp(t *testing.T) {
+	migrations, err := migrate.LoadDialect(Migrations(), Driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &migrate.Migrator{DB: DB, Driver: Driver, Migrations: migrations}
+
+	if count, err := m.Reset(); err != nil || count != len(migrations) {
+		t.Fatalf("expected %d migrations rolled back, got %d %v", len(migrations), count, err)
+	}
+	if count, err := m.Up(); err != nil || count != len(migrations) {
+		t.Fatalf("expected %d migrations applied, got %d %v", len(migrations), count, err)
+	}
+}
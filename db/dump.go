@@ -0,0 +1,203 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcconfig"
+)
+
+// Dump writes a gzip compressed SQL dump of the database of cfg to w, made
+// with pg_dump, mysqldump or the sqlite3 shell, which have to be installed.
+// With schemaOnly the dump has no data. Postgres and MySQL dumps drop the
+// tables they create first, so they can be restored over the database.
+func Dump(cfg abcconfig.DBConfig, w io.Writer, schemaOnly bool) error {
+	cmd, cleanup, err := dumpCmd(cfg, schemaOnly)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	gz := gzip.NewWriter(w)
+	cmd.Stdout = gz
+	if err := run(cmd); err != nil {
+		return errors.Wrap(err, "dump failed")
+	}
+	return errors.Wrap(gz.Close(), "cannot compress dump")
+}
+
+// Restore loads a dump written by Dump from r into the database of cfg,
+// with psql, mysql or the sqlite3 shell. It stops at the first error, and
+// on postgres the whole dump is loaded in one transaction.
+func Restore(cfg abcconfig.DBConfig, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "dump is not gzip compressed")
+	}
+	defer gz.Close()
+
+	cmd, cleanup, err := restoreCmd(cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd.Stdin = gz
+	return errors.Wrap(run(cmd), "restore failed")
+}
+
+// run runs cmd and returns its error output with the error
+func run(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return errors.Wrapf(err, "%s: %s", cmd.Args[0], msg)
+		}
+		return errors.Wrap(err, cmd.Args[0])
+	}
+	return nil
+}
+
+// dumpCmd returns the command that writes the dump to its stdout, and a
+// cleanup func that removes its password file
+func dumpCmd(cfg abcconfig.DBConfig, schemaOnly bool) (*exec.Cmd, func(), error) {
+	switch cfg.DB {
+	case "postgres":
+		passFile, err := pgPassFile(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		args := []string{"--clean", "--if-exists", "--no-owner", "--no-privileges"}
+		if schemaOnly {
+			args = append(args, "--schema-only")
+		}
+		cmd := exec.Command("pg_dump", append(args, cfg.DBName)...)
+		cmd.Env = append(os.Environ(), pgEnv(cfg, passFile)...)
+		return cmd, func() { os.Remove(passFile) }, nil
+	case "mysql":
+		passFile, err := mysqlPassFile(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The defaults file has to be the first option
+		args := []string{"--defaults-file=" + passFile, "--single-transaction", "--routines", "--triggers"}
+		if schemaOnly {
+			args = append(args, "--no-data")
+		}
+		cmd := exec.Command("mysqldump", append(args, cfg.DBName)...)
+		return cmd, func() { os.Remove(passFile) }, nil
+	case "sqlite3":
+		if sqliteMemory(cfg.DBName) {
+			return nil, nil, errors.New("cannot dump an in-memory sqlite database")
+		}
+		dot := ".dump"
+		if schemaOnly {
+			dot = ".schema"
+		}
+		return exec.Command("sqlite3", "-bail", cfg.DBName, dot), func() {}, nil
+	}
+
+	return nil, nil, fmt.Errorf("cannot dump database, incompatible database %q", cfg.DB)
+}
+
+// restoreCmd returns the command that loads the dump from its stdin, and a
+// cleanup func that removes its password file
+func restoreCmd(cfg abcconfig.DBConfig) (*exec.Cmd, func(), error) {
+	switch cfg.DB {
+	case "postgres":
+		passFile, err := pgPassFile(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd := exec.Command("psql", "--quiet", "--single-transaction", "-v", "ON_ERROR_STOP=1", cfg.DBName)
+		cmd.Env = append(os.Environ(), pgEnv(cfg, passFile)...)
+		return cmd, func() { os.Remove(passFile) }, nil
+	case "mysql":
+		passFile, err := mysqlPassFile(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd := exec.Command("mysql", "--defaults-file="+passFile, "--database", cfg.DBName)
+		return cmd, func() { os.Remove(passFile) }, nil
+	case "sqlite3":
+		if sqliteMemory(cfg.DBName) {
+			return nil, nil, errors.New("cannot restore into an in-memory sqlite database")
+		}
+		return exec.Command("sqlite3", "-bail", cfg.DBName), func() {}, nil
+	}
+
+	return nil, nil, fmt.Errorf("cannot restore database, incompatible database %q", cfg.DB)
+}
+
+// pgEnv returns the connection environment variables of the postgres
+// tools, as abcdatabase sets them, with the sslmode if configured
+func pgEnv(cfg abcconfig.DBConfig, passFilePath string) []string {
+	env := []string{
+		fmt.Sprintf("PGHOST=%s", cfg.Host),
+		fmt.Sprintf("PGPORT=%d", cfg.Port),
+		fmt.Sprintf("PGUSER=%s", cfg.User),
+		fmt.Sprintf("PGPASSFILE=%s", passFilePath),
+	}
+	if len(cfg.SSLMode) > 0 {
+		env = append(env, fmt.Sprintf("PGSSLMODE=%s", cfg.SSLMode))
+	}
+	return env
+}
+
+// pgPassFile creates a file in the temp directory containing the connection
+// details and password for the database to be passed to the postgres tools,
+// like abcdatabase does. TempFile creates it readable by the user only.
+func pgPassFile(cfg abcconfig.DBConfig) (string, error) {
+	tmp, err := ioutil.TempFile("", "pgpass")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create postgres pass file")
+	}
+	defer tmp.Close()
+
+	fmt.Fprintf(tmp, "%s:%d:%s:%s", cfg.Host, cfg.Port, cfg.DBName, cfg.User)
+	if len(cfg.Pass) != 0 {
+		fmt.Fprintf(tmp, ":%s", cfg.Pass)
+	}
+	fmt.Fprintln(tmp)
+
+	return tmp.Name(), nil
+}
+
+// mysqlPassFile creates a file in the temp directory containing the
+// connection details and password for the database to be passed to the
+// mysql tools, like abcdatabase does
+func mysqlPassFile(cfg abcconfig.DBConfig) (string, error) {
+	tmp, err := ioutil.TempFile("", "mysqlpass")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create mysql pass file")
+	}
+	defer tmp.Close()
+
+	fmt.Fprintln(tmp, "[client]")
+	fmt.Fprintf(tmp, "host=%s\n", cfg.Host)
+	fmt.Fprintf(tmp, "port=%d\n", cfg.Port)
+	fmt.Fprintf(tmp, "user=%s\n", cfg.User)
+	fmt.Fprintf(tmp, "password=%s\n", cfg.Pass)
+
+	var sslMode string
+	switch cfg.SSLMode {
+	case "true":
+		sslMode = "REQUIRED"
+	case "false":
+		sslMode = "DISABLED"
+	default:
+		sslMode = "PREFERRED"
+	}
+
+	fmt.Fprintf(tmp, "ssl-mode=%s\n", sslMode)
+
+	return tmp.Name(), nil
+}
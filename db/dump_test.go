@@ -0,0 +1,134 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volatiletech/abcweb/abcconfig"
+)
+
+func TestPassFiles(t *testing.T) {
+	t.Parallel()
+
+	cfg := abcconfig.DBConfig{Host: "a", Port: 1, DBName: "b", User: "c", Pass: "d", SSLMode: "true"}
+
+	name, err := pgPassFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	if b, _ := ioutil.ReadFile(name); string(b) != "a:1:b:c:d\n" {
+		t.Errorf("unexpected pgpass file %q", b)
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the pass file to be private, got %v, %v", fi.Mode(), err)
+	}
+	if env := pgEnv(cfg, name); len(env) != 5 || env[3] != "PGPASSFILE="+name || env[4] != "PGSSLMODE=true" {
+		t.Errorf("unexpected postgres env %q", env)
+	}
+
+	name, err = mysqlPassFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	if b, _ := ioutil.ReadFile(name); string(b) != "[client]\nhost=a\nport=1\nuser=c\npassword=d\nssl-mode=REQUIRED\n" {
+		t.Errorf("unexpected mysql pass file %q", b)
+	}
+}
+
+func TestDumpCmd(t *testing.T) {
+	t.Parallel()
+
+	for _, driver := range []string{"postgres", "mysql"} {
+		cmd, cleanup, err := dumpCmd(abcconfig.DBConfig{DB: driver, DBName: "brito"}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := strings.Join(cmd.Args, " ")
+		passFile := strings.TrimPrefix(cmd.Args[1], "--defaults-file=")
+		if driver == "postgres" {
+			passFile = strings.TrimPrefix(cmd.Env[len(cmd.Env)-1], "PGPASSFILE=")
+		}
+		if _, err := os.Stat(passFile); err != nil {
+			t.Errorf("expected the %s pass file, got %v", driver, err)
+		}
+		cleanup()
+		if _, err := os.Stat(passFile); !os.IsNotExist(err) {
+			t.Errorf("expected the %s pass file to be removed, got %v", driver, err)
+		}
+
+		if !strings.HasSuffix(args, " brito") || !(strings.Contains(args, "--schema-only") || strings.Contains(args, "--no-data")) {
+			t.Errorf("unexpected %s dump command %q", driver, args)
+		}
+	}
+
+	if _, _, err := dumpCmd(abcconfig.DBConfig{DB: "oracle"}, false); err == nil {
+		t.Error("expected an error for an unknown database")
+	}
+	if _, _, err := restoreCmd(abcconfig.DBConfig{DB: "sqlite3", DBName: ":memory:"}); err == nil {
+		t.Error("expected an error for an in-memory database")
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("the sqlite3 shell is not installed")
+	}
+
+	dir := t.TempDir()
+	src := abcconfig.DBConfig{DB: "sqlite3", DBName: filepath.Join(testDir, "test.db")}
+	if _, err := DB.Exec("INSERT INTO users (email) VALUES ('dump@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+	defer DB.Exec("DELETE FROM users WHERE email = 'dump@example.com'")
+
+	var schema bytes.Buffer
+	if err := Dump(src, &schema, true); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, _ := ioutil.ReadAll(gz)
+	if !strings.Contains(string(sql), "CREATE TABLE users") || strings.Contains(string(sql), "dump@example.com") {
+		t.Errorf("expected the schema only, got %s", sql)
+	}
+
+	var dump bytes.Buffer
+	if err := Dump(src, &dump, false); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := abcconfig.DBConfig{DB: "sqlite3", DBName: filepath.Join(dir, "restored.db")}
+	if err := Restore(dst, &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM users WHERE email = 'dump@example.com'").Scan(&n); err != nil || n != 1 {
+		t.Errorf("expected the restored user, got %d, %v", n, err)
+	}
+
+	if err := Restore(dst, strings.NewReader("SELECT 1;")); err == nil {
+		t.Error("expected an error for an uncompressed dump")
+	}
+	// The tables exist already
+	dump.Reset()
+	Dump(src, &dump, false)
+	if err := Restore(dst, &dump); err == nil || !strings.Contains(err.Error(), "sqlite3") {
+		t.Errorf("expected the sqlite3 error, got %v", err)
+	}
+}
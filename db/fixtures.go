@@ -0,0 +1,149 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TB is the part of testing.TB used by LoadFixtures, so the package does
+// not have to import testing
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+// fixtureRow is a row of a fixture file, inserted into table
+type fixtureRow struct {
+	table   string
+	columns []string
+	values  []interface{}
+}
+
+var validIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// LoadFixtures inserts the rows of YAML or JSON fixture files into DB for
+// the test t, and deletes them when the test and its subtests finished.
+// A fixture file maps table names to lists of rows, which map column names
+// to values. Tables are filled in the order of the file:
+//
+//	users:
+//	  - id: 1000
+//	    email: fixture@example.com
+//	recovery_codes:
+//	  - user_id: 1000
+//	    code_hash: ...
+//
+// Rows are deleted by their id column, or by all their columns if they
+// have none, so give rows the tests change an id.
+func LoadFixtures(t TB, paths ...string) {
+	t.Helper()
+
+	for _, path := range paths {
+		rows, err := readFixtures(path)
+		if err != nil {
+			t.Fatalf("cannot read fixtures: %s", err)
+		}
+
+		for i, row := range rows {
+			args := make([]string, len(row.columns))
+			for j := range args {
+				args[j] = "?"
+			}
+			query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", row.table, strings.Join(row.columns, ", "), strings.Join(args, ", "))
+			if _, err := DB.Exec(Rebind(query), row.values...); err != nil {
+				deleteFixtures(rows[:i])
+				t.Fatalf("cannot insert fixture into %s from %s: %s", row.table, path, err)
+			}
+		}
+		t.Cleanup(func() {
+			if err := deleteFixtures(rows); err != nil {
+				t.Fatalf("cannot delete fixtures of %s: %s", path, err)
+			}
+		})
+	}
+}
+
+// deleteFixtures deletes rows in reverse order, so rows are deleted before
+// the ones they reference
+func deleteFixtures(rows []fixtureRow) error {
+	for i := len(rows) - 1; i >= 0; i-- {
+		row := rows[i]
+
+		var where []string
+		var args []interface{}
+		for j, col := range row.columns {
+			if col == "id" {
+				where, args = []string{"id = ?"}, []interface{}{row.values[j]}
+				break
+			}
+			if row.values[j] == nil {
+				where = append(where, col+" IS NULL")
+				continue
+			}
+			where = append(where, col+" = ?")
+			args = append(args, row.values[j])
+		}
+
+		query := fmt.Sprintf("DELETE FROM %s WHERE %s", row.table, strings.Join(where, " AND "))
+		if _, err := DB.Exec(Rebind(query), args...); err != nil {
+			return errors.Wrapf(err, "cannot delete fixture from %s", row.table)
+		}
+	}
+	return nil
+}
+
+// readFixtures returns the rows of the fixture file at path. JSON is read
+// as YAML, which it is a subset of.
+func readFixtures(path string) ([]fixtureRow, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables yaml.MapSlice
+	if err := yaml.Unmarshal(b, &tables); err != nil {
+		return nil, errors.Wrapf(err, "invalid fixture file %s", path)
+	}
+
+	var rows []fixtureRow
+	for _, table := range tables {
+		name, _ := table.Key.(string)
+		if !validIdentifier.MatchString(name) {
+			return nil, errors.Errorf("invalid table name %v in %s", table.Key, path)
+		}
+		list, ok := table.Value.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("rows of table %s in %s are not a list", name, path)
+		}
+
+		for _, item := range list {
+			cols, ok := item.(yaml.MapSlice)
+			if !ok || len(cols) == 0 {
+				return nil, errors.Errorf("invalid row of table %s in %s", name, path)
+			}
+
+			row := fixtureRow{table: name}
+			for _, col := range cols {
+				colName, _ := col.Key.(string)
+				if !validIdentifier.MatchString(colName) {
+					return nil, errors.Errorf("invalid column name %v of table %s in %s", col.Key, name, path)
+				}
+				switch col.Value.(type) {
+				case yaml.MapSlice, []interface{}:
+					return nil, errors.Errorf("column %s of table %s in %s is not a scalar", colName, name, path)
+				}
+				row.columns = append(row.columns, colName)
+				row.values = append(row.values, col.Value)
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	return rows, nil
+}
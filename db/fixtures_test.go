@@ -0,0 +1,63 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestLoadFixtures(t *testing.T) {
+	count := func(query string) int {
+		var n int
+		if err := DB.QueryRow(query).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	users := "SELECT COUNT(*) FROM users WHERE email LIKE 'fixture-%'"
+	codes := "SELECT COUNT(*) FROM recovery_codes WHERE user_id = 9001"
+	failures := "SELECT COUNT(*) FROM throttle_failures WHERE throttle_key = 'fixture:127.0.0.1'"
+
+	t.Run("load", func(t *testing.T) {
+		LoadFixtures(t, "testdata/users.yml", "testdata/throttle.json")
+
+		if n := count(users); n != 2 {
+			t.Errorf("expected 2 fixture users, got %d", n)
+		}
+		if n := count("SELECT COUNT(*) FROM users WHERE id = 9001 AND is_admin = true"); n != 1 {
+			t.Error("expected the fixture admin with its id")
+		}
+		if n := count(codes); n != 1 {
+			t.Errorf("expected 1 recovery code, got %d", n)
+		}
+		if n := count(failures); n != 1 {
+			t.Errorf("expected 1 throttle failure, got %d", n)
+		}
+
+		// Rows with an id are deleted even if the test changed them
+		if _, err := DB.Exec("UPDATE users SET email = 'changed@example.com' WHERE id = 9001"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, query := range []string{users, codes, failures, "SELECT COUNT(*) FROM users WHERE id = 9001"} {
+		if n := count(query); n != 0 {
+			t.Errorf("expected the fixtures to be deleted, %q counted %d", query, n)
+		}
+	}
+}
+
+func TestReadFixtures(t *testing.T) {
+	rows, err := readFixtures("testdata/users.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].table != "users" || rows[2].table != "recovery_codes" {
+		t.Fatalf("expected the rows in file order, got %+v", rows)
+	}
+	if cols := rows[0].columns; len(cols) != 4 || cols[0] != "id" || cols[3] != "is_admin" {
+		t.Errorf("expected the columns in file order, got %v", cols)
+	}
+
+	if _, err := readFixtures("testdata/missing.yml"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Health is the result of a database health probe
+type Health struct {
+	// Name is the replica name, empty for the primary
+	Name    string        `json:"name,omitempty"`
+	Time    time.Time     `json:"time"`
+	OK      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"`
+	Latency time.Duration `json:"latency"`
+	Stats   sql.DBStats   `json:"stats"`
+	// Replicas is the health of the read replicas of the primary
+	Replicas []Health `json:"replicas,omitempty"`
+}
+
+// Probe pings DB and returns its health with the connection pool statistics
+func Probe(timeout time.Duration) Health {
+	if DB == nil {
+		return Health{Time: time.Now().UTC(), Error: "no database configured"}
+	}
+	return probe(DB, timeout)
+}
+
+func probe(conn *sql.DB, timeout time.Duration) Health {
+	h := Health{Time: time.Now().UTC()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := conn.PingContext(ctx)
+	h.Latency = time.Since(h.Time)
+	h.Stats = conn.Stats()
+	if err != nil {
+		h.Error = errors.Wrap(err, "ping failed").Error()
+		return h
+	}
+
+	h.OK = true
+	return h
+}
+
+// Stats returns the connection pool statistics of DB as "primary", and of
+// the read replicas by their names
+func Stats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{}
+	if DB != nil {
+		stats["primary"] = DB.Stats()
+	}
+	for _, r := range replicas {
+		stats[r.name] = r.db.Stats()
+	}
+	return stats
+}
+
+// Monitor probes DB every interval until stop is called. Healthy probes
+// are logged at debug level with the pool statistics, failed ones and
+// requests that had to wait for a free connection at warn level. The read
+// replicas are probed as well, see ProbeReplicas.
+func Monitor(interval time.Duration, log *zap.Logger) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := Health{OK: true}
+		if DB != nil {
+			last.Stats = DB.Stats()
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			timeout := interval / 2
+			if timeout > time.Second*5 {
+				timeout = time.Second * 5
+			}
+			h := Probe(timeout)
+			logHealth(log, last, h)
+			last = h
+
+			ProbeReplicas(timeout, log)
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// logHealth logs the probe h, which follows the probe last
+func logHealth(log *zap.Logger, last Health, h Health) {
+	fields := append([]zapcore.Field{zap.Duration("latency", h.Latency)}, statsFields(h.Stats)...)
+
+	switch {
+	case !h.OK:
+		log.Warn("database health probe failed", append(fields, zap.String("error", h.Error))...)
+	case !last.OK:
+		log.Info("database health probe recovered", fields...)
+	default:
+		log.Debug("database health", fields...)
+	}
+
+	if waits := h.Stats.WaitCount - last.Stats.WaitCount; waits > 0 {
+		log.Warn("database connection pool exhausted",
+			zap.Int64("waits", waits),
+			zap.Duration("wait_duration", h.Stats.WaitDuration-last.Stats.WaitDuration),
+			zap.Int("max_open", h.Stats.MaxOpenConnections),
+		)
+	}
+}
+
+func statsFields(s sql.DBStats) []zapcore.Field {
+	return []zapcore.Field{
+		zap.Int("max_open", s.MaxOpenConnections),
+		zap.Int("open", s.OpenConnections),
+		zap.Int("in_use", s.InUse),
+		zap.Int("idle", s.Idle),
+		zap.Int64("wait_count", s.WaitCount),
+		zap.Duration("wait_duration", s.WaitDuration),
+		zap.Int64("max_idle_closed", s.MaxIdleClosed),
+		zap.Int64("max_idle_time_closed", s.MaxIdleTimeClosed),
+		zap.Int64("max_lifetime_closed", s.MaxLifetimeClosed),
+	}
+}
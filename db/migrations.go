@@ -0,0 +1,21 @@
+package db
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed migrations/*.sql migrations/sqlite3/*.sql
+var migrationFiles embed.FS
+
+// Migrations returns the migrations in db/migrations as they were when the
+// binary was built, so they can be run without the source tree. Load them
+// with migrate.LoadDialect to get the copies written for the database in use,
+// which are in a folder named after its driver.
+func Migrations() fs.FS {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
@@ -0,0 +1,12 @@
+-- +mig Up
+CREATE TABLE users (
+	id serial PRIMARY KEY,
+	email varchar(255) NOT NULL UNIQUE,
+	password_hash varchar(255) NOT NULL DEFAULT '',
+	email_verified boolean NOT NULL DEFAULT false,
+	created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +mig Down
+DROP TABLE users;
@@ -0,0 +1,13 @@
+-- +mig Up
+CREATE TABLE user_identities (
+	id serial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	provider varchar(64) NOT NULL,
+	subject varchar(255) NOT NULL,
+	created_at timestamp NOT NULL,
+	UNIQUE (provider, subject)
+);
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+-- +mig Down
+DROP TABLE user_identities;
@@ -0,0 +1,14 @@
+-- +mig Up
+ALTER TABLE users ADD COLUMN locked_until bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE throttle_failures (
+	throttle_key varchar(255) PRIMARY KEY,
+	count integer NOT NULL,
+	last_failure timestamp NOT NULL
+);
+CREATE INDEX throttle_failures_last_failure_idx ON throttle_failures (last_failure);
+
+-- +mig Down
+DROP TABLE throttle_failures;
+
+ALTER TABLE users DROP COLUMN locked_until;
@@ -0,0 +1,21 @@
+-- +mig Up
+ALTER TABLE users ADD COLUMN is_admin boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN totp_secret varchar(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+	id integer PRIMARY KEY,
+	user_id bigint NOT NULL,
+	code_hash char(64) NOT NULL,
+	used_at timestamp NULL
+);
+CREATE INDEX recovery_codes_user_id_idx ON recovery_codes (user_id);
+
+-- +mig Down
+DROP TABLE recovery_codes;
+
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_enabled;
+ALTER TABLE users DROP COLUMN totp_secret;
+ALTER TABLE users DROP COLUMN is_admin;
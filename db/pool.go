@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// The wait before the second connection attempt, doubled after every
+// failed attempt up to maxConnectBackoff
+var (
+	connectBackoff    = time.Millisecond * 250
+	maxConnectBackoff = time.Second * 5
+)
+
+// PoolConfig holds the connection pool settings of DB. Zero values keep the
+// database/sql defaults.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// ConnectTimeout is how long InitDB keeps trying to reach the database,
+	// so the app can start alongside it. Zero tries once.
+	ConnectTimeout time.Duration
+}
+
+// apply sets the pool limits of conn
+func (p PoolConfig) apply(conn *sql.DB) {
+	if p.MaxOpenConns > 0 {
+		conn.SetMaxOpenConns(p.MaxOpenConns)
+	}
+	if p.MaxIdleConns > 0 {
+		conn.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	if p.ConnMaxLifetime > 0 {
+		conn.SetConnMaxLifetime(p.ConnMaxLifetime)
+	}
+	if p.ConnMaxIdleTime > 0 {
+		conn.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	}
+}
+
+// connect pings conn until it answers or timeout passes, backing off
+// between attempts
+func connect(conn *sql.DB, timeout time.Duration, log *zap.Logger) error {
+	deadline := time.Now().Add(timeout)
+	delay := connectBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := ping(conn, deadline, timeout > 0)
+		if err == nil {
+			if attempt > 1 {
+				log.Info("connected to database", zap.Int("attempts", attempt))
+			}
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return errors.Wrapf(err, "cannot connect to database after %d attempts", attempt)
+		}
+
+		log.Warn("cannot connect to database, retrying",
+			zap.Error(err),
+			zap.Int("attempt", attempt),
+			zap.Duration("retry_in", delay),
+		)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxConnectBackoff {
+			delay = maxConnectBackoff
+		}
+	}
+}
+
+// ping pings conn, giving up at deadline if set
+func ping(conn *sql.DB, deadline time.Time, set bool) error {
+	if !set {
+		return conn.Ping()
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return conn.PingContext(ctx)
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/volatiletech/abcweb/abcconfig"
+	"go.uber.org/zap"
+)
+
+func TestPoolConfig(t *testing.T) {
+	conn, err := Open(abcconfig.DBConfig{DB: "sqlite3", DBName: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	PoolConfig{MaxOpenConns: 7}.apply(conn)
+	if max := conn.Stats().MaxOpenConnections; max != 7 {
+		t.Errorf("expected 7 max open connections, got %d", max)
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	backoff := connectBackoff
+	connectBackoff = time.Millisecond * 10
+	defer func() { connectBackoff = backoff }()
+
+	// Nothing listens on port 1
+	conn, err := Open(abcconfig.DBConfig{DB: "postgres", User: "u", DBName: "d", Host: "127.0.0.1", Port: 1, SSLMode: "disable"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := connect(conn, time.Millisecond*100, zap.NewNop()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if took := time.Since(start); took < time.Millisecond*30 || took > time.Second*5 {
+		t.Errorf("expected retries for about the timeout, took %s", took)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	h := Probe(time.Second)
+	if !h.OK || len(h.Error) != 0 {
+		t.Errorf("expected a healthy database, got %q", h.Error)
+	}
+	if h.Stats.OpenConnections == 0 {
+		t.Error("expected pool statistics")
+	}
+}
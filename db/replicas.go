@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcconfig"
+	"github.com/volatiletech/sqlboiler/boil"
+	"go.uber.org/zap"
+)
+
+// replica is a read replica of DB
+type replica struct {
+	name string
+	db   *sql.DB
+	// ejected is 1 while the replica fails its health probes
+	ejected int32
+}
+
+// replicas are the read replicas set up by InitReplicas, and next is the
+// round-robin counter of Reader
+var (
+	replicas []*replica
+	next     uint32
+)
+
+// InitReplicas opens the read replicas at the connection strings dsns,
+// which use the driver of cfg. Replicas that can't be reached are ejected
+// until they pass a health probe, instead of failing the start.
+func InitReplicas(cfg abcconfig.DBConfig, dsns []string, pool PoolConfig, log *zap.Logger) error {
+	for i, dsn := range dsns {
+		conn, err := open(cfg.DB, dsn)
+		if err != nil {
+			return errors.Wrapf(err, "cannot open replica %d", i+1)
+		}
+		pool.apply(conn)
+
+		r := &replica{name: "replica-" + strconv.Itoa(i+1), db: conn}
+		if err := ping(conn, time.Now().Add(pool.ConnectTimeout), pool.ConnectTimeout > 0); err != nil {
+			log.Warn("database replica ejected", zap.String("replica", r.name), zap.Error(err))
+			r.ejected = 1
+		}
+		replicas = append(replicas, r)
+	}
+
+	return nil
+}
+
+// Reader returns the executor to run read-only queries of the request with
+// ctx on. It runs them on a healthy replica, taking turns between them, or
+// on DB if there is none or ctx is sticky because the request wrote before,
+// see ReadYourWrites. Replicas lag behind DB, so read what is about to be
+// written from Writer instead, and what decides access from Primary.
+func Reader(ctx context.Context) boil.Executor {
+	return withContext(ctx, reader(ctx))
+}
+
+func reader(ctx context.Context) *sql.DB {
+	if len(replicas) == 0 || sticky(ctx) {
+		return DB
+	}
+
+	start := int(atomic.AddUint32(&next, 1))
+	for i := range replicas {
+		r := replicas[(start+i)%len(replicas)]
+		if atomic.LoadInt32(&r.ejected) == 0 {
+			return r.db
+		}
+	}
+	return DB
+}
+
+// Primary returns the executor to run read-only queries of the request
+// with ctx on DB, the primary database, for reads that can't lag behind
+// like the signed in user. Unlike Writer it doesn't make the rest of the
+// request read from DB.
+func Primary(ctx context.Context) boil.Executor {
+	return withContext(ctx, DB)
+}
+
+// Writer returns the executor that runs the queries of the request with
+// ctx on DB, the primary database, and makes the rest of the request read
+// from it as well
+func Writer(ctx context.Context) boil.Executor {
+	return withContext(ctx, writer(ctx))
+}
+
+func writer(ctx context.Context) *sql.DB {
+	if s, ok := ctx.Value(ctxStickyKey{}).(*stickyState); ok {
+		atomic.StoreInt32(&s.wrote, 1)
+	}
+	return DB
+}
+
+// ProbeReplicas probes the replicas, ejecting the ones that fail from
+// Reader and taking back the ones that recovered
+func ProbeReplicas(timeout time.Duration, log *zap.Logger) []Health {
+	var health []Health
+	for _, r := range replicas {
+		h := probe(r.db, timeout)
+		h.Name = r.name
+		health = append(health, h)
+
+		switch {
+		case !h.OK && atomic.CompareAndSwapInt32(&r.ejected, 0, 1):
+			log.Warn("database replica ejected", zap.String("replica", r.name), zap.String("error", h.Error))
+		case h.OK && atomic.CompareAndSwapInt32(&r.ejected, 1, 0):
+			log.Info("database replica recovered", zap.String("replica", r.name))
+		}
+	}
+	return health
+}
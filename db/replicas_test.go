@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/volatiletech/abcweb/abcconfig"
+	"github.com/volatiletech/sqlboiler/boil"
+	"go.uber.org/zap"
+)
+
+// withReplicas replaces the replicas with n in-memory databases for a test
+func withReplicas(t *testing.T, n int) []*replica {
+	old := replicas
+	t.Cleanup(func() { replicas = old })
+
+	replicas = nil
+	for i := 0; i < n; i++ {
+		conn, err := Open(abcconfig.DBConfig{DB: "sqlite3", DBName: ":memory:"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		replicas = append(replicas, &replica{name: "test", db: conn})
+	}
+	return replicas
+}
+
+// handle returns the database handle an executor of Reader or Writer runs on
+func handle(e boil.Executor) interface{} {
+	return e.(ctxExecutor).q
+}
+
+func TestReader(t *testing.T) {
+	ctx := context.Background()
+	withReplicas(t, 0)
+	if handle(Reader(ctx)) != DB {
+		t.Error("expected the primary without replicas")
+	}
+
+	rs := withReplicas(t, 2)
+	seen := map[*sql.DB]int{}
+	for i := 0; i < 4; i++ {
+		seen[handle(Reader(ctx)).(*sql.DB)]++
+	}
+	if seen[rs[0].db] != 2 || seen[rs[1].db] != 2 {
+		t.Errorf("expected the replicas to take turns, got %v", seen)
+	}
+
+	rs[0].ejected = 1
+	for i := 0; i < 2; i++ {
+		if handle(Reader(ctx)) != rs[1].db {
+			t.Error("expected the ejected replica to be skipped")
+		}
+	}
+	rs[1].ejected = 1
+	if handle(Reader(ctx)) != DB {
+		t.Error("expected the primary with all replicas ejected")
+	}
+}
+
+func TestProbeReplicas(t *testing.T) {
+	rs := withReplicas(t, 2)
+	rs[1].ejected = 1
+	rs[0].db.Close()
+
+	health := ProbeReplicas(time.Second, zap.NewNop())
+	if len(health) != 2 || health[0].OK || !health[1].OK {
+		t.Errorf("unexpected health %#v", health)
+	}
+	if rs[0].ejected != 1 || rs[1].ejected != 0 {
+		t.Error("expected the closed replica ejected and the other one back")
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	rs := withReplicas(t, 1)
+
+	var reads []interface{}
+	handler := ReadYourWrites(time.Second * 5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads = append(reads, handle(Reader(r.Context())))
+		// Reading from the primary doesn't make the request sticky
+		if handle(Primary(r.Context())) != DB {
+			t.Error("expected Primary to run on the primary")
+		}
+		if r.Method == "POST" {
+			Writer(r.Context())
+			reads = append(reads, handle(Reader(r.Context())))
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if len(reads) != 2 || reads[0] != rs[0].db || reads[1] != DB {
+		t.Errorf("expected reads from the replica and then the primary, got %v", reads)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != StickyCookie || cookies[0].MaxAge != 5 {
+		t.Fatalf("expected the sticky cookie, got %v", cookies)
+	}
+
+	reads = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if len(reads) != 1 || reads[0] != rs[0].db || len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected a read from the replica without a write, got %v", reads)
+	}
+
+	reads = nil
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	handler.ServeHTTP(w, r)
+	if len(reads) != 1 || reads[0] != DB {
+		t.Errorf("expected a read from the primary, got %v", reads)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("expected the sticky cookie not to be renewed without a write")
+	}
+}
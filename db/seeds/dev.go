@@ -0,0 +1,44 @@
+package seeds
+
+import (
+	"database/sql"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/models"
+	"github.com/fadeojo/brito/seed"
+	"github.com/volatiletech/sqlboiler/boil"
+)
+
+// DemoPassword is the password of the demo users of the dev set
+const DemoPassword = "brito-demo"
+
+func init() {
+	seed.Register("dev", "01_demo_users", demoUsers)
+}
+
+// demoUsers creates a verified admin and a verified user. It is a Go
+// seeder because the password hashes have to be made with bcrypt.
+func demoUsers(exec boil.Executor) error {
+	users := []*models.User{
+		{Email: "admin@example.com", EmailVerified: true, IsAdmin: true},
+		{Email: "user@example.com", EmailVerified: true},
+	}
+
+	for _, u := range users {
+		if _, err := models.FindUserByEmail(exec, u.Email); err == nil {
+			continue
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		hash, err := auth.HashPassword(DemoPassword)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = hash
+		if err := u.Insert(exec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
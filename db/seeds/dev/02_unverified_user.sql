@@ -0,0 +1,6 @@
+-- A user that has not verified their email address yet and has no
+-- password, to try the email verification and password reset flows.
+-- Seeds skip existing rows, so they can be applied again with --force.
+INSERT INTO users (email, email_verified)
+	SELECT 'unverified@example.com', false
+	WHERE NOT EXISTS (SELECT 1 FROM users WHERE email = 'unverified@example.com');
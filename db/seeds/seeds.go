@@ -0,0 +1,17 @@
+// Package seeds has the seed sets of the app, see the seed package. The
+// SQL seeds are in a folder named after their set, and the Go seeders
+// register themselves with seed.Register.
+package seeds
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed dev/*.sql staging/*.sql
+var files embed.FS
+
+// Files returns the SQL seeds as they were when the binary was built
+func Files() fs.FS {
+	return files
+}
@@ -0,0 +1,78 @@
+package seeds
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/models"
+	"github.com/fadeojo/brito/seed"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	auth.BcryptCost = bcrypt.MinCost
+
+	count, err := db.SetupTestSuite(db.GoTestdata)
+	if err != nil {
+		fmt.Printf("TestMain setup failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("TestMain Setup ran %d migrations.\n", count)
+
+	r := m.Run()
+	if err := db.TeardownTestSuite(); err != nil {
+		fmt.Printf("TestMain teardown failed: %s\n", err)
+	}
+	os.Exit(r)
+}
+
+func TestSets(t *testing.T) {
+	for _, set := range []string{"dev", "staging"} {
+		seeds, err := seed.Load(Files(), set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seeds) == 0 {
+			t.Fatalf("expected seeds in set %s", set)
+		}
+
+		s := &seed.Seeder{DB: db.DB, Driver: db.Driver}
+		if count, err := s.Apply(set, seeds); err != nil || count != len(seeds) {
+			t.Fatalf("expected all %d seeds of %s applied, got %d, %v", len(seeds), set, count, err)
+		}
+		if count, err := s.Apply(set, seeds); err != nil || count != 0 {
+			t.Errorf("expected set %s to be applied once, got %d, %v", set, count, err)
+		}
+	}
+
+	admin, err := models.FindUserByEmail(db.DB, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !admin.IsAdmin || !auth.CheckPassword(admin.PasswordHash, DemoPassword) {
+		t.Errorf("expected an admin with the demo password, got %+v", admin)
+	}
+
+	locked, err := models.FindUserByEmail(db.DB, "qa-locked@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked.Locked(locked.CreatedAt) {
+		t.Error("expected the locked QA account to be locked")
+	}
+
+	// All seeds can be forced to run again
+	for _, set := range []string{"dev", "staging"} {
+		seeds, err := seed.Load(Files(), set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &seed.Seeder{DB: db.DB, Driver: db.Driver, Force: true}
+		if _, err := s.Apply(set, seeds); err != nil {
+			t.Errorf("expected the seeds of %s to skip existing rows, got %v", set, err)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+-- Accounts in the states QA tests the account flows with. They have no
+-- password, set one with a password reset.
+INSERT INTO users (email, email_verified)
+	SELECT 'qa-unverified@example.com', false
+	WHERE NOT EXISTS (SELECT 1 FROM users WHERE email = 'qa-unverified@example.com');
+INSERT INTO users (email, email_verified)
+	SELECT 'qa-verified@example.com', true
+	WHERE NOT EXISTS (SELECT 1 FROM users WHERE email = 'qa-verified@example.com');
+-- Locked until 2100-01-01
+INSERT INTO users (email, email_verified, locked_until)
+	SELECT 'qa-locked@example.com', true, 4102444800
+	WHERE NOT EXISTS (SELECT 1 FROM users WHERE email = 'qa-locked@example.com');
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StickyCookie is set by ReadYourWrites after a request wrote to the
+// primary, to keep the client reading from it while the replicas catch up
+const StickyCookie = "db_sticky"
+
+type ctxStickyKey struct{}
+
+// stickyState records whether a request used Writer, or came with the
+// StickyCookie of an earlier one that did
+type stickyState struct {
+	wrote  int32
+	cookie bool
+}
+
+func sticky(ctx context.Context) bool {
+	s, ok := ctx.Value(ctxStickyKey{}).(*stickyState)
+	return ok && (s.cookie || atomic.LoadInt32(&s.wrote) == 1)
+}
+
+// ReadYourWrites returns middleware that makes Reader return the primary
+// for the rest of a request once it called Writer, so it reads its own
+// writes. With a window the following requests of the client read from
+// the primary as well for that long, through the StickyCookie.
+//
+// It wraps the ResponseWriter, so it has to run before the session
+// middleware.
+func ReadYourWrites(window time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s := &stickyState{}
+			if _, err := r.Cookie(StickyCookie); err == nil {
+				s.cookie = true
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), ctxStickyKey{}, s))
+			if window <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sw := &stickyWriter{ResponseWriter: w, state: s, window: window}
+			next.ServeHTTP(sw, r)
+			// Handlers that write no response get an implicit 200
+			if !sw.wroteHeader {
+				sw.WriteHeader(http.StatusOK)
+			}
+		})
+	}
+}
+
+// stickyWriter sets the StickyCookie before the response is written if
+// the request called Writer
+type stickyWriter struct {
+	http.ResponseWriter
+	state       *stickyState
+	window      time.Duration
+	wroteHeader bool
+}
+
+func (s *stickyWriter) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.wroteHeader = true
+		if atomic.LoadInt32(&s.state.wrote) == 1 {
+			http.SetCookie(s.ResponseWriter, &http.Cookie{
+				Name:     StickyCookie,
+				Value:    "1",
+				Path:     "/",
+				MaxAge:   int((s.window + time.Second - 1) / time.Second),
+				HttpOnly: true,
+			})
+		}
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *stickyWriter) Write(b []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Hijack lets websocket upgrades through
+func (s *stickyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	// The connection is no longer an HTTP response to write
+	s.wroteHeader = true
+	return h.Hijack()
+}
+
+// Flush lets streamed responses through
+func (s *stickyWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
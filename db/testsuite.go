@@ -0,0 +1,135 @@
+package db
+
+import (
+	_ "embed"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fadeojo/brito/migrate"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcconfig"
+	"go.uber.org/zap"
+)
+
+//go:embed testdata.sql
+var testdataSQL string
+
+// TestDBEnv is the environment variable that selects the database of
+// SetupTestSuite: "sqlite3", the default, or "config" for the database of
+// the test environment of config.toml, like a Postgres or MySQL server
+const TestDBEnv = "BRITO_TEST_DB"
+
+// testDir is the folder of the test database, removed by TeardownTestSuite
+var testDir string
+
+// SetupTestSuite is called from the TestMain of packages with tests that
+// use the database. It creates an SQLite database in a temporary folder,
+// runs the migrations, testdata.sql and the testdata function against it,
+// and points DB and Driver at it. It returns the number of migrations run.
+//
+// Unlike abcdatabase.SetupTestSuite it needs no database server, so tests
+// run anywhere. Set TestDBEnv to "config" to run them against the database
+// of the test environment of config.toml instead, whose migrations are
+// rolled back and run again first.
+// Call TeardownTestSuite after the tests to remove the SQLite database.
+func SetupTestSuite(testdata func(driver string, conn string) error) (int, error) {
+	var cfg abcconfig.DBConfig
+	switch env := os.Getenv(TestDBEnv); env {
+	case "", "sqlite3":
+		dir, err := ioutil.TempDir("", "brito-test-")
+		if err != nil {
+			return 0, errors.Wrap(err, "cannot create test database folder")
+		}
+		testDir = dir
+		cfg = abcconfig.DBConfig{DB: "sqlite3", DBName: filepath.Join(dir, "test.db")}
+	case "config":
+		var err error
+		if cfg, err = testConfig(); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, errors.Errorf("unknown %s %q, want sqlite3 or config", TestDBEnv, env)
+	}
+
+	if err := InitDB(cfg, PoolConfig{}, zap.NewNop()); err != nil {
+		return 0, errors.Wrap(err, "cannot open test database")
+	}
+	if DB == nil {
+		return 0, errors.New("no database in the test environment of config.toml")
+	}
+
+	migrations, err := migrate.LoadDialect(Migrations(), cfg.DB)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot load migrations")
+	}
+	m := &migrate.Migrator{DB: DB, Driver: cfg.DB, DBName: cfg.DBName, Migrations: migrations}
+	if len(testDir) == 0 {
+		// The config database keeps the rows of earlier runs
+		if _, err := m.Reset(); err != nil {
+			return 0, errors.Wrap(err, "cannot execute migrations down")
+		}
+	}
+	count, err := m.Up()
+	if err != nil {
+		return count, errors.Wrap(err, "cannot execute migrations up")
+	}
+
+	if _, err := DB.Exec(testdataSQL); err != nil {
+		return count, errors.Wrap(err, "cannot execute testdata.sql")
+	}
+	if testdata != nil {
+		connStr, err := ConnStr(cfg)
+		if err != nil {
+			return count, err
+		}
+		if err := testdata(cfg.DB, connStr); err != nil {
+			return count, errors.Wrap(err, "unable to setup testdata")
+		}
+	}
+
+	return count, nil
+}
+
+// testConfig returns the database of the test environment of the
+// config.toml in the working directory or the closest parent with one,
+// like the package folders of the tests
+func testConfig() (abcconfig.DBConfig, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return abcconfig.DBConfig{}, errors.Wrap(err, "cannot get working directory")
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "config.toml")); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abcconfig.DBConfig{}, errors.New("cannot find config.toml")
+		}
+		dir = parent
+	}
+
+	c := &abcconfig.Config{
+		File:      filepath.Join(dir, "config.toml"),
+		LoadEnv:   "test",
+		EnvPrefix: "BRITO",
+	}
+	cfg := &abcconfig.AppConfig{}
+	if _, err := c.Bind(nil, cfg); err != nil {
+		return abcconfig.DBConfig{}, errors.Wrap(err, "cannot load environment named test from config.toml")
+	}
+	return cfg.DB, nil
+}
+
+// TeardownTestSuite closes the database of SetupTestSuite, and removes it
+// if it is an SQLite database
+func TeardownTestSuite() error {
+	if DB != nil {
+		DB.Close()
+	}
+	if len(testDir) == 0 {
+		return nil
+	}
+	return os.RemoveAll(testDir)
+}
@@ -0,0 +1,457 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fadeojo/brito/tracing"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SlowQuery is the duration from which queries are logged at warn level,
+// zero logs no slow queries. Queries run through Reader, Writer or Executor
+// are logged with the request logger, others with the logger of InitDB.
+var SlowQuery time.Duration
+
+// TraceQueries logs every query at debug level, like slow queries
+var TraceQueries bool
+
+// queryLog is the logger of the queries that are not run for a request
+var queryLog = zap.NewNop()
+
+// open returns a handle to the database at dsn, which traces its queries
+// by wrapping the driver
+func open(driverName string, dsn string) (*sql.DB, error) {
+	conn, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sql.Open does not connect, it only looks up the driver
+	d := conn.Driver()
+	conn.Close()
+
+	c := &tracedConnector{driver: d, dsn: dsn}
+	if dc, ok := d.(driver.DriverContext); ok {
+		if c.connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(c), nil
+}
+
+// ctxExecutor runs the queries of the models with the context of the
+// request they are for, so they are traced as its queries. The context
+// keeps its values without being cancelled with the request, so a client
+// going away doesn't abort a write half way.
+type ctxExecutor struct {
+	ctx context.Context
+	q   interface {
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	}
+}
+
+func (e ctxExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return e.q.ExecContext(e.ctx, query, args...)
+}
+
+func (e ctxExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return e.q.QueryContext(e.ctx, query, args...)
+}
+
+func (e ctxExecutor) QueryRow(query string, args ...interface{}) *sql.Row {
+	return e.q.QueryRowContext(e.ctx, query, args...)
+}
+
+func withContext(ctx context.Context, q *sql.DB) ctxExecutor {
+	return ctxExecutor{ctx: context.WithoutCancel(ctx), q: q}
+}
+
+type ctxStatsKey struct{}
+
+// queryStats counts the queries of a request and the time they took
+type queryStats struct {
+	count int64
+	nanos int64
+}
+
+// QueryStats is middleware that counts the queries of a request, and adds
+// the count and their time as db_queries and db_time to the log lines of
+// the request logger, including the access log line. It has to run after
+// the middleware that sets the request logger and before the access log.
+func QueryStats(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &queryStats{}
+		ctx := context.WithValue(r.Context(), ctxStatsKey{}, s)
+		if log, ok := ctx.Value(abcmiddleware.CtxLoggerKey).(*zap.Logger); ok {
+			log = log.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+				return statsCore{Core: core, stats: s}
+			}))
+			ctx = context.WithValue(ctx, abcmiddleware.CtxLoggerKey, log)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// statsCore adds the query stats of a request to the entries it writes
+type statsCore struct {
+	zapcore.Core
+	stats *queryStats
+}
+
+func (c statsCore) With(fields []zapcore.Field) zapcore.Core {
+	return statsCore{Core: c.Core.With(fields), stats: c.stats}
+}
+
+func (c statsCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c statsCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	all := make([]zapcore.Field, len(fields), len(fields)+2)
+	copy(all, fields)
+	all = append(all,
+		zap.Int64("db_queries", atomic.LoadInt64(&c.stats.count)),
+		zap.Duration("db_time", time.Duration(atomic.LoadInt64(&c.stats.nanos))),
+	)
+	return c.Core.Write(ent, all)
+}
+
+// trace records a query, started at start and done now. Queries of
+// traced requests are recorded as spans too.
+type trace struct {
+	ctx   context.Context
+	query string
+	args  []driver.NamedValue
+	start time.Time
+	span  *tracing.Span
+}
+
+func newTrace(ctx context.Context, query string, args []driver.NamedValue) *trace {
+	_, span := tracing.Child(ctx, "db.query", tracing.KindClient)
+	span.SetAttribute("db.system", Driver)
+	span.SetAttribute("db.statement", strings.Join(strings.Fields(query), " "))
+	return &trace{ctx: ctx, query: query, args: args, start: time.Now(), span: span}
+}
+
+// done records the query with the rows it returned or affected, -1 if
+// unknown, and logs it if it was slow or TraceQueries is set
+func (t *trace) done(rows int64, err error) {
+	elapsed := time.Since(t.start)
+	if t.span != nil {
+		t.span.SetAttribute("db.rows", rows)
+		if err != io.EOF {
+			t.span.SetError(err)
+		}
+		t.span.End()
+	}
+	if s, ok := t.ctx.Value(ctxStatsKey{}).(*queryStats); ok {
+		atomic.AddInt64(&s.count, 1)
+		atomic.AddInt64(&s.nanos, int64(elapsed))
+	}
+
+	slow := SlowQuery > 0 && elapsed >= SlowQuery
+	if !slow && !TraceQueries {
+		return
+	}
+
+	log := queryLog
+	if l, ok := t.ctx.Value(abcmiddleware.CtxLoggerKey).(*zap.Logger); ok {
+		log = l
+	}
+	fields := []zapcore.Field{
+		zap.String("query", strings.Join(strings.Fields(t.query), " ")),
+		zap.Strings("args", redact(t.args)),
+		zap.Duration("duration", elapsed),
+		zap.Int64("rows", rows),
+		zap.String("caller", caller()),
+	}
+	if err != nil && err != io.EOF {
+		fields = append(fields, zap.Error(err))
+	}
+
+	if slow {
+		log.Warn("slow query", fields...)
+	} else {
+		log.Debug("query", fields...)
+	}
+}
+
+// redact returns the query arguments for the log. Strings and bytes can
+// be passwords, tokens or personal data, so only their length is kept.
+func redact(args []driver.NamedValue) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.Value.(type) {
+		case nil:
+			out[i] = "NULL"
+		case string:
+			out[i] = fmt.Sprintf("<string len=%d>", len(v))
+		case []byte:
+			out[i] = fmt.Sprintf("<bytes len=%d>", len(v))
+		case time.Time:
+			out[i] = v.UTC().Format(time.RFC3339)
+		default:
+			out[i] = fmt.Sprint(v)
+		}
+	}
+	return out
+}
+
+// caller returns the file and line of the code that ran the query, the
+// first one outside of database/sql, this package and the drivers
+func caller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "database/sql.") &&
+			!strings.HasPrefix(f.Function, "github.com/fadeojo/brito/db.") &&
+			!strings.Contains(f.Function, "/vendor/") {
+			return filepath.Base(filepath.Dir(f.File)) + "/" + filepath.Base(f.File) + ":" + fmt.Sprint(f.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// tracedConnector opens connections of driver that trace their queries
+type tracedConnector struct {
+	driver driver.Driver
+	dsn    string
+	// connector is the driver's own connector, if it has one
+	connector driver.Connector
+}
+
+func (c *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if c.connector != nil {
+		conn, err = c.connector.Connect(ctx)
+	} else {
+		conn, err = c.driver.Open(c.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: conn}, nil
+}
+
+func (c *tracedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// tracedConn traces the queries run on a driver connection. It passes
+// the optional driver interfaces through, returning driver.ErrSkip for
+// the ones the driver lacks so database/sql falls back as it would.
+type tracedConn struct {
+	driver.Conn
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: stmt, conn: c.Conn, query: query}, nil
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("the database driver does not support transaction options")
+	}
+	return c.Conn.Begin()
+}
+
+// ExecContext falls back to the Exec of drivers without context support,
+// like the vendored mysql driver, so they don't prepare every statement
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var exec func() (driver.Result, error)
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		exec = func() (driver.Result, error) { return e.ExecContext(ctx, query, args) }
+	} else if e, ok := c.Conn.(driver.Execer); ok {
+		exec = func() (driver.Result, error) { return e.Exec(query, values(args)) }
+	} else {
+		return nil, driver.ErrSkip
+	}
+
+	t := newTrace(ctx, query, args)
+	res, err := exec()
+	if err == driver.ErrSkip {
+		return res, err
+	}
+	t.done(rowsAffected(res), err)
+	return res, err
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, text string, args []driver.NamedValue) (driver.Rows, error) {
+	var query func() (driver.Rows, error)
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		query = func() (driver.Rows, error) { return q.QueryContext(ctx, text, args) }
+	} else if q, ok := c.Conn.(driver.Queryer); ok {
+		query = func() (driver.Rows, error) { return q.Query(text, values(args)) }
+	} else {
+		return nil, driver.ErrSkip
+	}
+
+	t := newTrace(ctx, text, args)
+	rows, err := query()
+	if err == driver.ErrSkip {
+		return rows, err
+	} else if err != nil {
+		t.done(-1, err)
+		return rows, err
+	}
+	return &tracedRows{Rows: rows, trace: t}, nil
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// tracedStmt traces the runs of a prepared statement
+type tracedStmt struct {
+	driver.Stmt
+	conn  driver.Conn
+	query string
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	t := newTrace(ctx, s.query, args)
+
+	var res driver.Result
+	var err error
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = e.ExecContext(ctx, args)
+	} else {
+		res, err = s.Stmt.Exec(values(args))
+	}
+
+	t.done(rowsAffected(res), err)
+	return res, err
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	t := newTrace(ctx, s.query, args)
+
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(values(args))
+	}
+	if err != nil {
+		t.done(-1, err)
+		return nil, err
+	}
+	return &tracedRows{Rows: rows, trace: t}, nil
+}
+
+func (s *tracedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	if n, ok := s.conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// tracedRows counts the rows of a query, which is recorded when they
+// are closed, so the time includes reading them
+type tracedRows struct {
+	driver.Rows
+	trace *trace
+	rows  int64
+	err   error
+}
+
+func (r *tracedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.rows++
+	} else if err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *tracedRows) Close() error {
+	err := r.Rows.Close()
+	if r.trace != nil {
+		r.trace.done(r.rows, r.err)
+		r.trace = nil
+	}
+	return err
+}
+
+func rowsAffected(res driver.Result) int64 {
+	if res == nil {
+		return -1
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// values converts the arguments for drivers without context support
+func values(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vals[i] = arg.Value
+	}
+	return vals
+}
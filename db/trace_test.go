@@ -0,0 +1,170 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fadeojo/brito/tracing"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logEntries returns a logger that writes JSON to the returned buffer
+func logEntries() (*zap.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	return zap.New(zapcore.NewCore(enc, zapcore.AddSync(buf), zap.DebugLevel)), buf
+}
+
+func decodeEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestSlowQuery(t *testing.T) {
+	defer func(slow time.Duration) { SlowQuery = slow }(SlowQuery)
+	SlowQuery = time.Nanosecond
+
+	log, buf := logEntries()
+	ctx := context.WithValue(context.Background(), abcmiddleware.CtxLoggerKey, log.With(zap.String("request_id", "req-1")))
+
+	if _, err := Writer(ctx).Exec("UPDATE users SET email_verified = ? WHERE email = ?", true, "nobody@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := Reader(ctx).Query("SELECT id FROM users WHERE id < ?", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	rows.Close()
+
+	entries := decodeEntries(t, buf)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 slow queries logged, got %d: %s", len(entries), buf)
+	}
+	update, query := entries[0], entries[1]
+	if update["msg"] != "slow query" || update["level"] != "warn" || update["request_id"] != "req-1" {
+		t.Errorf("expected a slow query warning with the request id, got %v", update)
+	}
+	if update["query"] != "UPDATE users SET email_verified = ? WHERE email = ?" || update["rows"] != float64(0) {
+		t.Errorf("unexpected query fields %v", update)
+	}
+	if !reflect.DeepEqual(update["args"], []interface{}{"true", "<string len=18>"}) {
+		t.Errorf("expected the string argument redacted, got %v", update["args"])
+	}
+	if _, ok := update["caller"].(string); !ok {
+		t.Errorf("expected the caller, got %v", update["caller"])
+	}
+	if query["rows"] != float64(n) {
+		t.Errorf("expected %d rows, got %v", n, query["rows"])
+	}
+
+	// Queries outside of requests and fast queries are not logged
+	buf.Reset()
+	DB.Exec("SELECT 1")
+	SlowQuery = time.Hour
+	Writer(ctx).Exec("SELECT 1")
+	if buf.Len() > 0 {
+		t.Errorf("expected no log, got %s", buf)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	log, buf := logEntries()
+
+	handler := QueryStats(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			var n int
+			if err := Reader(r.Context()).QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		abcmiddleware.Log(r).Info("http request")
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), abcmiddleware.CtxLoggerKey, log))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries := decodeEntries(t, buf)
+	if len(entries) != 1 || entries[0]["db_queries"] != float64(3) {
+		t.Fatalf("expected 3 queries on the request log line, got %s", buf)
+	}
+	if d, ok := entries[0]["db_time"].(float64); !ok || d <= 0 {
+		t.Errorf("expected the query time, got %v", entries[0]["db_time"])
+	}
+}
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+
+	at := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	args := []driver.NamedValue{{Value: nil}, {Value: int64(7)}, {Value: "secret"}, {Value: []byte("xy")}, {Value: at}}
+	want := []string{"NULL", "7", "<string len=6>", "<bytes len=2>", "2017-01-02T03:04:05Z"}
+	if got := redact(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestQuerySpans(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(old *tracing.Tracer) { tracing.Default = old }(tracing.Default)
+	tracing.Default = tracing.NewTracer(&tracing.WriterExporter{W: &buf}, 1, zap.NewNop())
+
+	// Queries outside of traced requests have no spans
+	if _, err := Writer(context.Background()).Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := tracing.Start(context.Background(), "request", tracing.KindServer)
+	rows, err := Reader(ctx).Query("SELECT id FROM   users WHERE id < ?", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if _, err := Writer(ctx).Exec("SELECT * FROM missing_table"); err == nil {
+		t.Fatal("expected an error")
+	}
+	span.End()
+	tracing.Default.Shutdown(context.Background())
+
+	entries := decodeEntries(t, &buf)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 spans, got %d: %s", len(entries), buf.String())
+	}
+	query, failed := entries[0], entries[1]
+	attrs := query["attributes"].(map[string]interface{})
+	if query["name"] != "db.query" || query["parent_span_id"] != span.Context.SpanID.String() || query["kind"] != "client" {
+		t.Errorf("unexpected span %v", query)
+	}
+	if attrs["db.statement"] != "SELECT id FROM users WHERE id < ?" || attrs["db.system"] != Driver {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+	if _, ok := failed["error"]; !ok {
+		t.Errorf("expected the error of the query, got %v", failed)
+	}
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+	"github.com/volatiletech/sqlboiler/boil"
+)
+
+type ctxTxKey struct{}
+
+// Executor returns the executor of the transaction InTx runs the request
+// with ctx in, or Writer outside of one. Pass it to the models so they take
+// part in the transaction of the request when there is one.
+func Executor(ctx context.Context) boil.Executor {
+	if tx, ok := ctx.Value(ctxTxKey{}).(*sql.Tx); ok {
+		return ctxExecutor{ctx: context.WithoutCancel(ctx), q: tx}
+	}
+	return Writer(ctx)
+}
+
+// InTx runs fn in a transaction on the primary database, which Executor
+// returns for the ctx passed to fn. The transaction is committed if fn
+// returns nil, and rolled back if it returns an error or panics. Within
+// a transaction already, fn joins it instead of starting a new one.
+//
+// The transaction isn't tied to the cancellation of ctx: database/sql
+// would roll it back when a client disconnects, after fn succeeded.
+func InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(ctxTxKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+
+	tx, err := writer(ctx).BeginTx(context.WithoutCancel(ctx), nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin transaction")
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(context.WithValue(ctx, ctxTxKey{}, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return errors.Wrap(tx.Commit(), "cannot commit transaction")
+}
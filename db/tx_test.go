@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestInTx(t *testing.T) {
+	if _, err := DB.Exec("CREATE TABLE tx_test (n integer)"); err != nil {
+		t.Fatal(err)
+	}
+	defer DB.Exec("DROP TABLE tx_test")
+
+	count := func() int {
+		var n int
+		if err := DB.QueryRow("SELECT COUNT(*) FROM tx_test").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	insert := func(ctx context.Context) error {
+		_, err := Executor(ctx).Exec("INSERT INTO tx_test (n) VALUES (1)")
+		return err
+	}
+
+	ctx := context.Background()
+	if handle(Executor(ctx)) != DB {
+		t.Error("expected the primary outside of a transaction")
+	}
+
+	err := InTx(ctx, func(ctx context.Context) error {
+		if _, ok := handle(Executor(ctx)).(*sql.Tx); !ok {
+			t.Error("expected the transaction as executor")
+		}
+		if err := insert(ctx); err != nil {
+			return err
+		}
+		// Joins the transaction
+		return InTx(ctx, insert)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("expected 2 committed rows, got %d", n)
+	}
+
+	errTest := errors.New("test")
+	err = InTx(ctx, func(ctx context.Context) error {
+		if err := insert(ctx); err != nil {
+			return err
+		}
+		return errTest
+	})
+	if err != errTest {
+		t.Errorf("expected the error of fn, got %v", err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("expected the insert to be rolled back, got %d rows", n)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to be passed on")
+			}
+		}()
+		InTx(ctx, func(ctx context.Context) error {
+			insert(ctx)
+			panic("test")
+		})
+	}()
+	if n := count(); n != 2 {
+		t.Errorf("expected the insert to be rolled back, got %d rows", n)
+	}
+
+	// A client that disconnects after fn succeeded doesn't roll it back
+	cancelCtx, cancel := context.WithCancel(ctx)
+	err = InTx(cancelCtx, func(ctx context.Context) error {
+		if err := insert(ctx); err != nil {
+			return err
+		}
+		cancel()
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected the commit to succeed, got %v", err)
+	}
+	if n := count(); n != 3 {
+		t.Errorf("expected 3 committed rows, got %d", n)
+	}
+}
@@ -0,0 +1,196 @@
+// Package health serves the liveness and readiness probes of the app.
+// Liveness only shows the process is serving requests. Readiness runs the
+// registered checks of the dependencies the app needs to serve traffic,
+// and fails from the moment graceful shutdown begins so load balancers
+// stop sending requests before the listener closes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Check is a readiness check, failing if it returns an error. It should
+// give up when ctx is done.
+type Check func(ctx context.Context) error
+
+// Statuses of a Report
+const (
+	StatusOK           = "ok"
+	StatusFailing      = "failing"
+	StatusShuttingDown = "shutting_down"
+)
+
+// Report is the result of the readiness checks
+type Report struct {
+	Status string                 `json:"status"`
+	Time   time.Time              `json:"time"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is the result of a single check
+type CheckResult struct {
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Health runs the readiness checks. Create it with New.
+type Health struct {
+	// Timeout is how long a check may take before it fails
+	Timeout time.Duration
+	// CacheTTL is how long a report is served before the checks run again,
+	// so frequent probes don't load the dependencies
+	CacheTTL time.Duration
+
+	started  time.Time
+	shutdown int32
+
+	mu     sync.Mutex
+	checks map[string]Check
+	report *Report
+}
+
+// New returns a Health with no checks
+func New(timeout time.Duration, cacheTTL time.Duration) *Health {
+	return &Health{
+		Timeout:  timeout,
+		CacheTTL: cacheTTL,
+		started:  time.Now(),
+		checks:   map[string]Check{},
+	}
+}
+
+// Register adds the readiness check name, replacing one of the same name
+func (h *Health) Register(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks[name] = check
+	h.report = nil
+}
+
+// Shutdown makes readiness fail for the rest of the process' life. It is
+// called when graceful shutdown begins.
+func (h *Health) Shutdown() {
+	atomic.StoreInt32(&h.shutdown, 1)
+}
+
+// Check returns the readiness report, running the checks concurrently if
+// the cached report is older than CacheTTL. The checks aren't canceled with
+// ctx: the probes that wait for the report, and the ones it is cached for,
+// would get the failures of a prober that disconnected.
+func (h *Health) Check(ctx context.Context) Report {
+	if atomic.LoadInt32(&h.shutdown) == 1 {
+		return Report{Status: StatusShuttingDown, Time: time.Now().UTC()}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.report != nil && time.Since(h.report.Time) < h.CacheTTL {
+		return *h.report
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	report := &Report{Status: StatusOK, Time: time.Now().UTC(), Checks: map[string]CheckResult{}}
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			res := h.run(ctx, check)
+
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			report.Checks[name] = res
+			if !res.OK {
+				report.Status = StatusFailing
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	h.report = report
+	return *report
+}
+
+// run runs check with the Timeout. A check that ignores its context is
+// left running, and fails once the Timeout is up.
+func (h *Health) run(ctx context.Context, check Check) CheckResult {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- errors.Errorf("check panicked: %v", p)
+			}
+		}()
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "check timed out")
+	}
+
+	res := CheckResult{OK: err == nil, Duration: time.Since(start)}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Names returns the names of the registered checks, sorted
+func (h *Health) Names() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var names []string
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Live is the handler of the liveness probe. It succeeds while the process
+// serves requests, including during graceful shutdown.
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Status string        `json:"status"`
+		Uptime time.Duration `json:"uptime"`
+	}{StatusOK, time.Since(h.started)})
+}
+
+// Ready is the handler of the readiness probe. It responds with the report
+// of Check, with status 503 unless all checks pass.
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	report := h.Check(r.Context())
+
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,151 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	h := New(time.Second, time.Hour)
+	var runs int32
+	h.Register("ok", func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+
+	report := h.Check(context.Background())
+	if report.Status != StatusOK || !report.Checks["ok"].OK {
+		t.Errorf("unexpected report %#v", report)
+	}
+
+	// The report is cached
+	h.Check(context.Background())
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("expected 1 run, got %d", n)
+	}
+
+	// Registering drops the cached report
+	h.Register("broken", func(ctx context.Context) error {
+		return errors.New("broken")
+	})
+	report = h.Check(context.Background())
+	if report.Status != StatusFailing {
+		t.Errorf("expected failing, got %q", report.Status)
+	}
+	if res := report.Checks["broken"]; res.OK || res.Error != "broken" {
+		t.Errorf("unexpected result %#v", res)
+	}
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("expected 2 runs, got %d", n)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	t.Parallel()
+
+	h := New(time.Millisecond*20, 0)
+	h.Register("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	// A check ignoring its context fails on time too
+	block := make(chan struct{})
+	defer close(block)
+	h.Register("stuck", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+	h.Register("panics", func(ctx context.Context) error {
+		panic("oops")
+	})
+
+	start := time.Now()
+	report := h.Check(context.Background())
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("checks took %s", d)
+	}
+	for _, name := range []string{"slow", "stuck", "panics"} {
+		if report.Checks[name].OK {
+			t.Errorf("expected %s to fail", name)
+		}
+	}
+	if report.Checks["panics"].Error != "check panicked: oops" {
+		t.Errorf("unexpected error %q", report.Checks["panics"].Error)
+	}
+}
+
+func TestCheckCanceled(t *testing.T) {
+	t.Parallel()
+
+	h := New(time.Second, time.Hour)
+	h.Register("slow", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 20):
+			return nil
+		}
+	})
+
+	// The prober that runs the checks disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := h.Check(ctx); report.Status != StatusOK {
+		t.Errorf("expected the checks to ignore the canceled prober, got %#v", report)
+	}
+	if report := h.Check(context.Background()); report.Status != StatusOK {
+		t.Errorf("expected the cached report to pass, got %#v", report)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	t.Parallel()
+
+	h := New(time.Second, 0)
+	h.Register("ok", func(ctx context.Context) error { return nil })
+
+	w := httptest.NewRecorder()
+	h.Ready(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	var report Report
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != StatusOK || !report.Checks["ok"].OK {
+		t.Errorf("unexpected report %s", w.Body)
+	}
+
+	h.Shutdown()
+
+	w = httptest.NewRecorder()
+	h.Ready(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != StatusShuttingDown {
+		t.Errorf("expected shutting_down, got %q", report.Status)
+	}
+
+	// The process is still alive
+	w = httptest.NewRecorder()
+	h.Live(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+}
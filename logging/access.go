@@ -0,0 +1,311 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// redacted replaces the values of secrets in the access log
+const redacted = "[REDACTED]"
+
+// DefaultFields are the access log fields of the abcweb access log
+var DefaultFields = []string{"status", "method", "uri", "tls", "protocol", "host", "remote_addr", "size", "elapsed"}
+
+// accessFields are the fields the access log can have
+var accessFields = map[string]func(e *accessEntry) zapcore.Field{
+	"status":       func(e *accessEntry) zapcore.Field { return zap.Int("status", e.status) },
+	"method":       func(e *accessEntry) zapcore.Field { return zap.String("method", e.r.Method) },
+	"uri":          func(e *accessEntry) zapcore.Field { return zap.String("uri", e.uri()) },
+	"path":         func(e *accessEntry) zapcore.Field { return zap.String("path", e.r.URL.Path) },
+	"query":        func(e *accessEntry) zapcore.Field { return zap.String("query", e.query()) },
+	"route":        func(e *accessEntry) zapcore.Field { return zap.String("route", e.route) },
+	"tls":          func(e *accessEntry) zapcore.Field { return zap.Bool("tls", e.r.TLS != nil) },
+	"protocol":     func(e *accessEntry) zapcore.Field { return zap.String("protocol", e.r.Proto) },
+	"host":         func(e *accessEntry) zapcore.Field { return zap.String("host", e.r.Host) },
+	"remote_addr":  func(e *accessEntry) zapcore.Field { return zap.String("remote_addr", e.r.RemoteAddr) },
+	"user_agent":   func(e *accessEntry) zapcore.Field { return zap.String("user_agent", e.r.UserAgent()) },
+	"referer":      func(e *accessEntry) zapcore.Field { return zap.String("referer", e.r.Referer()) },
+	"request_size": func(e *accessEntry) zapcore.Field { return zap.Int64("request_size", e.r.ContentLength) },
+	"size":         func(e *accessEntry) zapcore.Field { return zap.Int("size", e.size) },
+	"elapsed":      func(e *accessEntry) zapcore.Field { return zap.Duration("elapsed", e.elapsed) },
+}
+
+// SecretHeaders are the request headers whose values are always redacted,
+// by their canonical names. The error reports leave them out too.
+var SecretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Csrf-Token":        true,
+}
+
+// AccessLog is middleware that writes an access log line for every
+// request with the request logger, so it has the request ID, trace and
+// query stats, and with Log if there is none.
+//
+// Rules on routes match the chi route pattern of the request, like
+// /users/{id}, and rules on paths match the path, or its prefix if the
+// rule ends with a *. Requests that are skipped or not sampled are still
+// logged if they fail with a server error.
+type AccessLog struct {
+	Log *zap.Logger
+	// Fields are the names of the fields every line has, DefaultFields if
+	// empty
+	Fields []string
+	// Headers are the request headers that are logged, as the headers
+	// object. Authorization and cookies are always redacted.
+	Headers []string
+	// Redact are the query parameters and form fields whose values are
+	// redacted, in the uri, the query and the request body
+	Redact []string
+	// BodyRoutes are the routes whose request and response bodies are
+	// logged, up to MaxBody bytes each
+	BodyRoutes []string
+	MaxBody    int
+	// SkipPaths are the paths that aren't logged, like health checks and
+	// static assets
+	SkipPaths []string
+	// Sample is the share of the requests of a route that are logged,
+	// between 0 and 1. Routes that aren't listed are all logged.
+	Sample map[string]float64
+
+	fields     []func(e *accessEntry) zapcore.Field
+	redact     map[string]bool
+	bodyRoutes map[string]bool
+	random     func() float64
+}
+
+// NewAccessLog returns the access log of the fields, which fails for
+// unknown fields and invalid samples or body sizes
+func NewAccessLog(a AccessLog) (*AccessLog, error) {
+	names := a.Fields
+	if len(names) == 0 {
+		names = DefaultFields
+	}
+	for _, name := range names {
+		field, ok := accessFields[name]
+		if !ok {
+			return nil, errors.Errorf("unknown access log field %q", name)
+		}
+		a.fields = append(a.fields, field)
+	}
+	for route, ratio := range a.Sample {
+		if ratio < 0 || ratio > 1 {
+			return nil, errors.Errorf("access log sample of %q is not between 0 and 1", route)
+		}
+	}
+	if a.MaxBody < 0 {
+		return nil, errors.Errorf("access log max body of %d bytes is negative", a.MaxBody)
+	}
+
+	a.redact = make(map[string]bool, len(a.Redact))
+	for _, name := range a.Redact {
+		a.redact[name] = true
+	}
+	a.bodyRoutes = make(map[string]bool, len(a.BodyRoutes))
+	for _, route := range a.BodyRoutes {
+		a.bodyRoutes[route] = true
+	}
+	a.random = rand.Float64
+	return &a, nil
+}
+
+// Middleware logs the requests
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		// The route is only known once the request was routed, so the
+		// bodies are captured for every request if any route logs them
+		var reqBody, respBody *cappedBuffer
+		if len(a.bodyRoutes) > 0 {
+			respBody = &cappedBuffer{max: a.MaxBody}
+			ww.Tee(respBody)
+			if r.Body != nil && r.Body != http.NoBody {
+				reqBody = &cappedBuffer{max: a.MaxBody}
+				r.Body = teeReadCloser{Reader: io.TeeReader(r.Body, reqBody), Closer: r.Body}
+			}
+		}
+
+		next.ServeHTTP(ww, r)
+
+		e := &accessEntry{r: r, a: a, status: ww.Status(), size: ww.BytesWritten(), elapsed: time.Since(start)}
+		if e.status == 0 {
+			e.status = http.StatusOK
+		}
+		if rctx, ok := r.Context().Value(chi.RouteCtxKey).(*chi.Context); ok && len(rctx.RoutePatterns) > 0 {
+			e.route = rctx.RoutePattern()
+		}
+		if e.status < 500 && !a.logged(e) {
+			return
+		}
+
+		fields := make([]zapcore.Field, 0, len(a.fields)+3)
+		for _, field := range a.fields {
+			fields = append(fields, field(e))
+		}
+		if len(a.Headers) > 0 {
+			fields = append(fields, zap.Object("headers", headers{h: r.Header, names: a.Headers}))
+		}
+		if a.bodyRoutes[e.route] {
+			if reqBody != nil {
+				fields = append(fields, zap.String("request_body", a.body(reqBody, r.Header.Get("Content-Type"))))
+			}
+			fields = append(fields, zap.String("response_body", respBody.String()))
+		}
+
+		log := a.Log
+		if l, ok := r.Context().Value(abcmiddleware.CtxLoggerKey).(*zap.Logger); ok {
+			log = l
+		}
+		protocol := "http"
+		if r.TLS != nil {
+			protocol = "https"
+		}
+		log.Info(fmt.Sprintf("%s request", protocol), fields...)
+	})
+}
+
+// logged reports whether the request is logged by the skip and sample
+// rules
+func (a *AccessLog) logged(e *accessEntry) bool {
+	for _, path := range a.SkipPaths {
+		if prefix := strings.TrimSuffix(path, "*"); prefix != path {
+			if strings.HasPrefix(e.r.URL.Path, prefix) {
+				return false
+			}
+		} else if e.r.URL.Path == path {
+			return false
+		}
+	}
+	if ratio, ok := a.Sample[e.route]; ok {
+		return a.random() < ratio
+	}
+	return true
+}
+
+// body returns the captured request body, with the form fields of Redact
+// redacted. A form that was cut off is redacted too, as the field it ends
+// in may be a secret.
+func (a *AccessLog) body(b *cappedBuffer, contentType string) string {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if mt != "application/x-www-form-urlencoded" {
+		return b.String()
+	}
+	values, err := url.ParseQuery(b.buf.String())
+	if err != nil && !b.truncated {
+		return redacted
+	}
+	if b.truncated {
+		return a.redactValues(values) + "..."
+	}
+	return a.redactValues(values)
+}
+
+// redactValues encodes values with the ones of Redact redacted
+func (a *AccessLog) redactValues(values url.Values) string {
+	for name := range values {
+		if a.redact[name] {
+			for i := range values[name] {
+				values[name][i] = redacted
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// accessEntry is a request to log
+type accessEntry struct {
+	r       *http.Request
+	a       *AccessLog
+	route   string
+	status  int
+	size    int
+	elapsed time.Duration
+}
+
+// uri returns the request URI with the query redacted
+func (e *accessEntry) uri() string {
+	if len(e.r.URL.RawQuery) == 0 || len(e.a.redact) == 0 {
+		return e.r.RequestURI
+	}
+	return e.r.URL.EscapedPath() + "?" + e.query()
+}
+
+// query returns the query with the parameters of Redact redacted
+func (e *accessEntry) query() string {
+	if len(e.r.URL.RawQuery) == 0 || len(e.a.redact) == 0 {
+		return e.r.URL.RawQuery
+	}
+	values, err := url.ParseQuery(e.r.URL.RawQuery)
+	if err != nil {
+		return redacted
+	}
+	return e.a.redactValues(values)
+}
+
+// headers logs the allowed request headers
+type headers struct {
+	h     http.Header
+	names []string
+}
+
+func (h headers) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, name := range h.names {
+		name = http.CanonicalHeaderKey(name)
+		value := h.h.Get(name)
+		if len(value) == 0 {
+			continue
+		}
+		if SecretHeaders[name] {
+			value = redacted
+		}
+		enc.AddString(name, value)
+	}
+	return nil
+}
+
+// cappedBuffer keeps the first max bytes written to it
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// String returns the bytes kept, marking if there were more
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "..."
+	}
+	return b.buf.String()
+}
+
+// teeReadCloser closes the request body it reads
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// accessEntries serves the requests with the access log of a and returns
+// the lines it wrote
+func accessEntries(t *testing.T, a AccessLog, requests ...*http.Request) []map[string]interface{} {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	a.Log = zap.New(zapcore.NewCore(enc, zapcore.AddSync(buf), zap.DebugLevel))
+	access, err := NewAccessLog(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access.random = func() float64 { return 0.5 }
+
+	router := chi.NewRouter()
+	router.Use(access.Middleware)
+	router.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("user " + chi.URLParam(r, "id")))
+	})
+	router.Post("/login", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Write([]byte("welcome " + r.PostForm.Get("email")))
+	})
+	router.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	for _, r := range requests {
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "/users/1?token=secret&page=2", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("X-CSRF-Token", "secret")
+	r.Header.Set("User-Agent", "curl")
+	entries := accessEntries(t, AccessLog{
+		Fields:  []string{"status", "uri", "query", "route", "size"},
+		Headers: []string{"authorization", "X-CSRF-Token", "User-Agent", "Accept"},
+		Redact:  []string{"token"},
+	}, r)
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 line, got %v", entries)
+	}
+	e := entries[0]
+	if e["msg"] != "http request" || e["status"] != 200.0 || e["route"] != "/users/{id}" || e["size"] != 6.0 {
+		t.Errorf("unexpected line %v", e)
+	}
+	if e["uri"] != "/users/1?page=2&token=%5BREDACTED%5D" || e["query"] != "page=2&token=%5BREDACTED%5D" {
+		t.Errorf("expected the token to be redacted, got %v %v", e["uri"], e["query"])
+	}
+	if _, ok := e["method"]; ok {
+		t.Error("expected only the selected fields")
+	}
+	headers, _ := e["headers"].(map[string]interface{})
+	if len(headers) != 3 || headers["Authorization"] != redacted || headers["X-Csrf-Token"] != redacted || headers["User-Agent"] != "curl" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+}
+
+func TestAccessLogBody(t *testing.T) {
+	t.Parallel()
+
+	login := httptest.NewRequest("POST", "/login", strings.NewReader("email=a%40example.com&password=hunter2"))
+	login.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	entries := accessEntries(t, AccessLog{
+		BodyRoutes: []string{"/login"},
+		MaxBody:    10,
+		Redact:     []string{"password"},
+	}, login, httptest.NewRequest("GET", "/users/1", nil))
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 lines, got %v", entries)
+	}
+	// The form is cut off after the first field
+	if got := entries[0]["request_body"]; got != "email=a%40..." {
+		t.Errorf("unexpected request body %v", got)
+	}
+	if got := entries[0]["response_body"]; got != "welcome a@..." {
+		t.Errorf("unexpected response body %v", got)
+	}
+	if _, ok := entries[1]["response_body"]; ok {
+		t.Error("expected no body for the other routes")
+	}
+
+	for _, max := range []int{100, 33} {
+		login = httptest.NewRequest("POST", "/login", strings.NewReader("email=a%40example.com&password=hunter2"))
+		login.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		entries = accessEntries(t, AccessLog{
+			BodyRoutes: []string{"/login"},
+			MaxBody:    max,
+			Redact:     []string{"password"},
+		}, login)
+		if got, _ := entries[0]["request_body"].(string); !strings.HasPrefix(got, "email=a%40example.com&password=%5BREDACTED%5D") {
+			t.Errorf("%d: expected the password to be redacted, got %v", max, got)
+		}
+	}
+}
+
+func TestAccessLogSkip(t *testing.T) {
+	t.Parallel()
+
+	entries := accessEntries(t, AccessLog{
+		SkipPaths: []string{"/healthz", "/users/*"},
+		Sample:    map[string]float64{"/login": 0.1},
+	},
+		httptest.NewRequest("GET", "/healthz", nil),
+		httptest.NewRequest("GET", "/users/1", nil),
+		httptest.NewRequest("POST", "/login", nil),
+		httptest.NewRequest("GET", "/healthz?fail=1", nil),
+		httptest.NewRequest("GET", "/missing", nil),
+	)
+
+	// Only the failing health check and the route without rules are left
+	if len(entries) != 2 || entries[0]["status"] != 503.0 || entries[1]["uri"] != "/missing" {
+		t.Errorf("unexpected lines %v", entries)
+	}
+}
+
+func TestNewAccessLogFails(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewAccessLog(AccessLog{Fields: []string{"status", "colour"}}); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+	if _, err := NewAccessLog(AccessLog{Sample: map[string]float64{"/": 2}}); err == nil {
+		t.Error("expected an error for a sample above 1")
+	}
+	if _, err := NewAccessLog(AccessLog{MaxBody: -1}); err == nil {
+		t.Error("expected an error for a negative max body")
+	}
+}
+
+func TestAccessLogReadsBody(t *testing.T) {
+	t.Parallel()
+
+	// The handler still reads the whole body when it is captured
+	access, _ := NewAccessLog(AccessLog{Log: zap.NewNop(), BodyRoutes: []string{"/"}, MaxBody: 2})
+	var got string
+	handler := access.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = string(b)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+	if got != "hello" {
+		t.Errorf("expected the body, got %q", got)
+	}
+}
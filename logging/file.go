@@ -0,0 +1,181 @@
+// Package logging has the log outputs that zap has no sink for and the
+// access log
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// backupFormat is the time format of the names of rotated files, which
+// sorts in the order they were rotated
+const backupFormat = "2006-01-02T15-04-05.000"
+
+// File is a log file that is rotated once it reaches MaxSize. The rotated
+// files are kept next to it, named after the time of the rotation, and
+// removed once they are older than MaxAge or more than MaxBackups. Zero
+// limits are not applied.
+type File struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	now  func() time.Time
+}
+
+// NewFile opens the log file at path for appending, creating it and its
+// folder if needed
+func NewFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*File, error) {
+	f := &File{Path: path, MaxSize: maxSize, MaxAge: maxAge, MaxBackups: maxBackups, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write writes p to the file, rotating it first if p doesn't fit
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	// A line bigger than the limit is written to a file of its own rather
+	// than rotating forever
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Sync flushes the file to disk
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+// Close closes the file, further writes fail
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return errors.Wrap(err, "cannot create the log folder")
+	}
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "cannot open the log file")
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "cannot open the log file")
+	}
+	f.file, f.size = file, fi.Size()
+	return nil
+}
+
+// rotate moves the file aside, opens a new one and removes the backups
+// past the limits
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return errors.Wrap(err, "cannot rotate the log file")
+	}
+	f.file = nil
+
+	if err := os.Rename(f.Path, f.backupName(f.now())); err != nil {
+		return errors.Wrap(err, "cannot rotate the log file")
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.removeBackups()
+}
+
+// backupName returns the name of the file rotated at t, like
+// app-2017-06-01T10-00-00.000.log for app.log
+func (f *File) backupName(t time.Time) string {
+	ext := filepath.Ext(f.Path)
+	return strings.TrimSuffix(f.Path, ext) + "-" + t.UTC().Format(backupFormat) + ext
+}
+
+// backup is a rotated file and the time it was rotated
+type backup struct {
+	name string
+	time time.Time
+}
+
+// backups returns the rotated files, the newest first
+func (f *File) backups() ([]backup, error) {
+	ext := filepath.Ext(f.Path)
+	prefix := strings.TrimSuffix(filepath.Base(f.Path), ext) + "-"
+
+	entries, err := os.ReadDir(filepath.Dir(f.Path))
+	if err != nil {
+		return nil, err
+	}
+	var list []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		t, err := time.Parse(backupFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+		if err != nil {
+			continue
+		}
+		list = append(list, backup{name: filepath.Join(filepath.Dir(f.Path), name), time: t})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].time.After(list[j].time) })
+	return list, nil
+}
+
+func (f *File) removeBackups() error {
+	if f.MaxAge <= 0 && f.MaxBackups <= 0 {
+		return nil
+	}
+	list, err := f.backups()
+	if err != nil {
+		return errors.Wrap(err, "cannot list the rotated log files")
+	}
+
+	cutoff := f.now().Add(-f.MaxAge)
+	for i, b := range list {
+		if (f.MaxBackups > 0 && i >= f.MaxBackups) || (f.MaxAge > 0 && b.time.Before(cutoff)) {
+			if err := os.Remove(b.name); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "cannot remove a rotated log file")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "brito.log")
+	now := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	f, err := NewFile(path, 10, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	write := func(s string) {
+		t.Helper()
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	write("12345\n")
+	write("123\n")
+	if list, _ := f.backups(); len(list) != 0 {
+		t.Fatalf("expected no rotation below the size, got %v", list)
+	}
+
+	// The line that doesn't fit goes to a new file
+	write("123\n")
+	list, _ := f.backups()
+	if len(list) != 1 || list[0].name != filepath.Join(dir, "logs", "brito-2017-06-01T10-02-00.000.log") {
+		t.Fatalf("unexpected backups %v", list)
+	}
+	if b, _ := os.ReadFile(list[0].name); string(b) != "12345\n123\n" {
+		t.Errorf("unexpected rotated file %q", b)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "123\n" {
+		t.Errorf("unexpected log file %q", b)
+	}
+
+	// Only the newest MaxBackups are kept
+	write("1234567890\n")
+	write("1234567890\n")
+	write("1234567890\n")
+	if list, _ := f.backups(); len(list) != 2 || list[0].time.Before(list[1].time) {
+		t.Errorf("expected the 2 newest backups, got %v", list)
+	}
+
+	// And none older than MaxAge
+	now = now.Add(time.Hour)
+	write("1234567890\n")
+	if list, _ := f.backups(); len(list) != 1 {
+		t.Errorf("expected the old backups to be removed, got %v", list)
+	}
+
+	f.Close()
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Error("expected an error after Close")
+	}
+}
+
+func TestFileAppends(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "brito.log")
+	if err := os.WriteFile(path, []byte("12345\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The size of the existing file counts towards the limit
+	f.Write([]byte("12345\n"))
+	if list, _ := f.backups(); len(list) != 1 {
+		t.Errorf("expected a rotation, got %v", list)
+	}
+}
@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogMailer logs outgoing mail instead of sending it, and optionally writes
+// each message to an .eml file in Dir so it can be opened in a mail client.
+// It also keeps every sent message in memory for inspection in tests.
+type LogMailer struct {
+	Log *zap.Logger
+	Dir string
+	// From is the default sender address
+	From string
+
+	mut  sync.Mutex
+	sent []Message
+}
+
+// NewLogMailer returns a LogMailer and creates dir if it is set
+func NewLogMailer(log *zap.Logger, dir string, from string) (*LogMailer, error) {
+	if len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "cannot create mail dir %q", dir)
+		}
+	}
+
+	return &LogMailer{
+		Log:  log,
+		Dir:  dir,
+		From: from,
+	}, nil
+}
+
+// Send logs the message and writes it to Dir if set
+func (l *LogMailer) Send(msg Message) error {
+	if len(msg.From) == 0 {
+		msg.From = l.From
+	}
+
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	l.mut.Lock()
+	l.sent = append(l.sent, msg)
+	l.mut.Unlock()
+
+	fields := []zapcore.Field{
+		zap.String("from", msg.From),
+		zap.String("to", msg.To),
+		zap.String("subject", msg.Subject),
+	}
+
+	if len(l.Dir) > 0 {
+		name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102150405.000000000"), sanitize(msg.To))
+		path := filepath.Join(l.Dir, name)
+		if err := ioutil.WriteFile(path, body, 0600); err != nil {
+			return errors.Wrapf(err, "cannot write mail file %q", path)
+		}
+		fields = append(fields, zap.String("file", path))
+	} else {
+		fields = append(fields, zap.String("body", msg.TextBody))
+	}
+
+	if l.Log != nil {
+		l.Log.Info("mail sent", fields...)
+	}
+
+	return nil
+}
+
+// Sent returns a copy of all messages sent so far
+func (l *LogMailer) Sent() []Message {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	sent := make([]Message, len(l.sent))
+	copy(sent, l.sent)
+	return sent
+}
+
+// sanitize makes an email address safe to use in a file name
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '@':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,146 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcrender"
+)
+
+// Mailer sends email messages. The SMTPMailer should be used in production,
+// and the LogMailer in development and tests.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Message is an email with a plain-text and an optional HTML body.
+// From can be left empty to use the mailer's default sender address.
+type Message struct {
+	From     string
+	To       string
+	Subject  string
+	TextBody string
+	HTMLBody string
+}
+
+// Layouts used by Render to wrap the HTML and plain-text mail templates
+const (
+	HTMLLayout = "layouts/mail"
+	TextLayout = "layouts/mail.txt"
+)
+
+// Render renders both variants of the mail template name using the mail
+// layouts. The HTML variant is read from templates/<name>.html and the
+// plain-text variant from templates/<name>.txt.tmpl.
+//
+// The plain-text variant is rendered by the same html/template renderer as
+// everything else, so its output is unescaped before being returned.
+func Render(r abcrender.Renderer, name string, data interface{}) (htmlBody string, textBody string, err error) {
+	buf := &bytes.Buffer{}
+	if err := r.HTMLWithLayout(buf, 200, name, data, HTMLLayout); err != nil {
+		return "", "", errors.Wrapf(err, "cannot render html mail template %q", name)
+	}
+	htmlBody = buf.String()
+
+	buf.Reset()
+	if err := r.HTMLWithLayout(buf, 200, name+".txt", data, TextLayout); err != nil {
+		return "", "", errors.Wrapf(err, "cannot render text mail template %q", name)
+	}
+	textBody = html.UnescapeString(buf.String())
+
+	return htmlBody, textBody, nil
+}
+
+// Bytes returns the message encoded as an RFC 5322 email, using
+// multipart/alternative when an HTML body is present.
+func (m Message) Bytes() ([]byte, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid from address")
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid to address")
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s@%s>\r\n", messageID(), domain(from.Address))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+
+	if len(m.HTMLBody) == 0 {
+		fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(buf, m.TextBody); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	// The preferred variant goes last in multipart/alternative
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", m.TextBody},
+		{"text/html; charset=utf-8", m.HTMLBody},
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, body); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func messageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func domain(address string) string {
+	for i := len(address) - 1; i >= 0; i-- {
+		if address[i] == '@' {
+			return address[i+1:]
+		}
+	}
+	return "localhost"
+}
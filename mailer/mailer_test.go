@@ -0,0 +1,146 @@
+package mailer
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/unrolled/render"
+	"github.com/volatiletech/abcweb/abcrender"
+	"go.uber.org/zap"
+)
+
+func TestMessageBytes(t *testing.T) {
+	t.Parallel()
+
+	msg := Message{
+		From:     "brito <noreply@example.com>",
+		To:       "user@example.com",
+		Subject:  "Réinitialiser",
+		TextBody: "plain body",
+		HTMLBody: "<p>html body</p>",
+	}
+
+	b, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != msg.Subject {
+		t.Errorf("expected subject %q, got %q (%v)", msg.Subject, subject, err)
+	}
+	if !strings.HasSuffix(m.Header.Get("Message-ID"), "@example.com>") {
+		t.Errorf("unexpected message id %q", m.Header.Get("Message-ID"))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %q (%v)", mediaType, err)
+	}
+
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type")+"="+string(body))
+	}
+
+	expect := []string{
+		"text/plain; charset=utf-8=plain body",
+		"text/html; charset=utf-8=<p>html body</p>",
+	}
+	if strings.Join(types, "|") != strings.Join(expect, "|") {
+		t.Errorf("expected parts %q, got %q", expect, types)
+	}
+
+	msg.From = "not an address"
+	if _, err := msg.Bytes(); err == nil {
+		t.Error("expected invalid from address to fail")
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "brito-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewLogMailer(zap.NewNop(), filepath.Join(dir, "out"), "noreply@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Send(Message{To: "user@example.com", Subject: "hi", TextBody: "body"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := l.Sent()
+	if len(sent) != 1 || sent[0].From != "noreply@example.com" {
+		t.Errorf("expected one message from the default sender, got %#v", sent)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "out", "*-user@example.com.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one eml file, got %v (%v)", files, err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "brito-mail-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"layouts/mail.html":     "<div>{{ yield }}</div>",
+		"layouts/mail.txt.tmpl": "{{ yield }}--",
+		"mail/hello.html":       `<a href="{{.}}">link</a>`,
+		"mail/hello.txt.tmpl":   "link: {{.}}",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := abcrender.New(render.Options{
+		Directory:  dir,
+		Extensions: []string{".tmpl", ".html"},
+	}, nil)
+
+	htmlBody, textBody, err := Render(r, "mail/hello", "https://example.com/?a=1&b=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if htmlBody != `<div><a href="https://example.com/?a=1&amp;b=2">link</a></div>` {
+		t.Errorf("unexpected html body %q", htmlBody)
+	}
+	if textBody != "link: https://example.com/?a=1&b=2--" {
+		t.Errorf("unexpected text body %q", textBody)
+	}
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+
+	"github.com/pkg/errors"
+)
+
+// SMTPMailer sends mail through an SMTP server. STARTTLS is used
+// automatically when the server supports it.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// From is the default sender address
+	From string
+}
+
+// Send delivers the message to the SMTP server
+func (s *SMTPMailer) Send(msg Message) error {
+	if len(msg.From) == 0 {
+		msg.From = s.From
+	}
+
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// Bytes already validated both addresses
+	from, _ := mail.ParseAddress(msg.From)
+	to, _ := mail.ParseAddress(msg.To)
+
+	var auth smtp.Auth
+	if len(s.Username) > 0 {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	if err := smtp.SendMail(addr, auth, from.Address, []string{to.Address}, body); err != nil {
+		return errors.Wrapf(err, "cannot send mail through %s", addr)
+	}
+
+	return nil
+}
@@ -3,15 +3,20 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/fadeojo/brito/app"
+	"github.com/fadeojo/brito/auth"
 	"github.com/fadeojo/brito/db"
+	"github.com/fadeojo/brito/migrate"
 	"github.com/fadeojo/brito/rendering"
+	"github.com/fadeojo/brito/reporting"
 	"github.com/fadeojo/brito/routes"
+	"github.com/fadeojo/brito/server"
+	"github.com/fadeojo/brito/tracing"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 	"github.com/volatiletech/abcweb/abcconfig"
-	"github.com/volatiletech/abcweb/abcdatabase"
 	"github.com/volatiletech/abcweb/abcrender"
 	"github.com/volatiletech/sqlboiler/boil"
 	"go.uber.org/zap"
@@ -32,6 +37,15 @@ func Setup(a *app.App, flags *pflag.FlagSet) error {
 	if a.Config.DB.DebugMode {
 		boil.DebugMode = true
 	}
+	db.SlowQuery = a.Config.Database.SlowQuery
+	db.TraceQueries = a.Config.Database.TraceQueries
+
+	socketMode, err := strconv.ParseUint(a.Config.HTTP.SocketMode, 8, 32)
+	if err != nil {
+		return errors.Wrapf(err, "invalid http socket-mode %q", a.Config.HTTP.SocketMode)
+	}
+	server.SocketMode = os.FileMode(socketMode)
+	server.SocketGroup = a.Config.HTTP.SocketGroup
 
 	// Set the AssetsManifest cache to the contents of the assets
 	// manifest in the public directory
@@ -42,25 +56,128 @@ func Setup(a *app.App, flags *pflag.FlagSet) error {
 		}
 	}
 
-	if a.Log, err = app.NewLogger(a.Config); err != nil {
+	a.LogLevel = zap.NewAtomicLevel()
+	if a.Log, err = app.NewLogger(a.Config, a.LogLevel, a.Version); err != nil {
 		return errors.Wrap(err, "cannot create new logger")
 	}
 
+	if a.Mailer, err = app.NewMailer(a.Config, a.Log); err != nil {
+		return errors.Wrap(err, "cannot create new mailer")
+	}
+
+	secretKey, err := app.NewSecretKey(a.Config, a.Log)
+	if err != nil {
+		return errors.Wrap(err, "cannot load secret key")
+	}
+	a.Tokens = auth.NewSigner(secretKey)
+
+	if a.Session, err = app.NewSessions(a.Config, secretKey); err != nil {
+		return errors.Wrap(err, "cannot create new session overseer")
+	}
+
+	if a.OIDC, err = app.NewOIDCProviders(a.Config); err != nil {
+		return errors.Wrap(err, "cannot create oidc providers")
+	}
+
+	if a.Throttle, err = app.NewThrottleStore(a.Config); err != nil {
+		return errors.Wrap(err, "cannot create login throttle store")
+	}
+
 	a.Render = rendering.New(a, "templates", a.AssetsManifest)
-	a.Router = routes.NewRouter(a, app.NewMiddlewares(a.Config, a.Log))
+	if a.Config.Metrics.Enabled {
+		a.Metrics = app.NewMetrics(a.Version, a.BuildTime)
+	}
+	a.Websocket = app.NewWebsocket(a.Metrics)
+
+	if tracing.Default, err = app.NewTracer(a.Config, a.Log.Named("tracing")); err != nil {
+		return errors.Wrap(err, "cannot create tracer")
+	}
+
+	if reporting.Default, err = app.NewErrorReporter(a.Config, a.Version, a.Log.Named("reporting")); err != nil {
+		return errors.Wrap(err, "cannot create error reporter")
+	}
 
-	if err := db.InitDB(a.Config.DB); err != nil {
+	pool := app.NewDBPool(a.Config)
+	if err := db.InitDB(a.Config.DB, pool, a.Log); err != nil {
 		return errors.Wrap(err, "failed to create global db connection")
 	}
+	if db.DB != nil && len(a.Config.Database.Replicas) > 0 {
+		if err := db.InitReplicas(a.Config.DB, a.Config.Database.Replicas, pool, a.Log.Named("db")); err != nil {
+			return errors.Wrap(err, "failed to create db replica connections")
+		}
+	}
+	if db.DB != nil && a.Config.Database.HealthInterval > 0 {
+		db.Monitor(a.Config.Database.HealthInterval, a.Log.Named("db"))
+	}
 
-	// Check if using the latest database migration if EnforceLatestMigration
-	if a.Config.DB.EnforceMigration {
-		migrated, version, err := abcdatabase.IsMigrated(a.Config.DB)
-		if err != nil && err != abcdatabase.ErrNoMigrations {
+	if db.DB != nil && (a.Config.AutoMigrate || a.Config.DB.EnforceMigration) {
+		if err := checkMigrations(a); err != nil {
+			return err
+		}
+	}
+
+	// The readiness checks need the database connection
+	a.Health = app.NewHealth(a.Config, a.Session, a.Websocket)
+	accessLog, err := app.NewAccessLog(a.Config, a.Log)
+	if err != nil {
+		return errors.Wrap(err, "cannot create access log")
+	}
+	proxies, err := app.NewProxies(a.Config)
+	if err != nil {
+		return err
+	}
+	cors, err := app.NewCORS(a.Config)
+	if err != nil {
+		return err
+	}
+	a.Router = routes.NewRouter(a, app.NewMiddlewares(a.Config, a.Session, a.Metrics, proxies, cors, accessLog, a.Log))
+
+	return nil
+}
+
+// checkMigrations runs the migrations built into the binary if AutoMigrate
+// is set, and checks that the database is at the latest one of them if
+// EnforceMigration is set.
+//
+// Replicas starting at the same time take turns through the migration
+// lock. The ones that waited find the migrations already run and only
+// check the version, against the embedded migrations rather than with
+// abcdatabase.IsMigrated, which needs db/migrations on disk.
+func checkMigrations(a *app.App) error {
+	migrations, err := migrate.LoadDialect(db.Migrations(), a.Config.DB.DB)
+	if err != nil {
+		return errors.Wrap(err, "cannot load migrations")
+	}
+	if len(migrations) == 0 {
+		return nil
+	}
+
+	m := &migrate.Migrator{
+		DB:          db.DB,
+		Driver:      a.Config.DB.DB,
+		DBName:      a.Config.DB.DBName,
+		Migrations:  migrations,
+		LockTimeout: a.Config.MigrateLockTimeout,
+		Log:         zap.NewStdLog(a.Log.Named("migrate")).Writer(),
+	}
+
+	if a.Config.AutoMigrate {
+		count, err := m.Up()
+		if err != nil {
+			return errors.Wrap(err, "failed to run migrations")
+		}
+		a.Log.Info("database migrated", zap.Int("count", count))
+	}
+
+	// Check if using the latest database migration if EnforceLatestMigration,
+	// and always after migrating in case another replica failed to
+	if a.Config.DB.EnforceMigration || a.Config.AutoMigrate {
+		version, err := m.Version()
+		if err != nil {
 			return errors.Wrap(err, "failed to check if using latest migration")
 		}
-		if !migrated && err != abcdatabase.ErrNoMigrations {
-			return fmt.Errorf("database is out of sync with migrations, database version: %d", version)
+		if latest := migrations[len(migrations)-1].Version; version != latest {
+			return fmt.Errorf("database is out of sync with migrations, database version: %d, latest migration: %d", version, latest)
 		}
 	}
 
@@ -76,6 +193,7 @@ func main() {
 	}
 
 	a := app.NewApp()
+	a.Version, a.BuildTime = version, buildTime
 
 	// Setup the main app root command
 	rootSetup(a)
@@ -83,6 +201,9 @@ func main() {
 	// Setup and bind the migrate command
 	migrateSetup(a)
 
+	// Setup and bind the db command
+	dbSetup(a)
+
 	if err := a.Root.Execute(); err != nil {
 		a.Log.Fatal("root command execution failed", zap.Error(err))
 	}
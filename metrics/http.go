@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+)
+
+// methods are the request methods of net/http, the others are recorded as
+// "OTHER"
+var methods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// HTTP counts the requests of a router and their durations, by method,
+// chi route pattern and status
+type HTTP struct {
+	requests *Counter
+	duration *Histogram
+}
+
+// NewHTTP returns the request metrics, registered with r
+func NewHTTP(r *Registry) *HTTP {
+	h := &HTTP{
+		requests: NewCounter("brito_http_requests_total", "Number of HTTP requests.", "method", "route", "status"),
+		duration: NewHistogram("brito_http_request_duration_seconds", "Duration of HTTP requests in seconds.", DefBuckets, "method", "route", "status"),
+	}
+	r.Register(h.requests, h.duration)
+	return h
+}
+
+// Middleware records the requests. The route pattern is only known after
+// chi routed the request, so requests that matched no route are recorded
+// as the "none" route, which keeps scans of random URLs from adding series.
+// Made up methods are recorded as "OTHER" for the same reason.
+func (h *HTTP) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		defer func() {
+			route := "none"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && len(rctx.RoutePatterns) > 0 {
+				route = rctx.RoutePattern()
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			method := r.Method
+			if !methods[method] {
+				method = "OTHER"
+			}
+
+			code := strconv.Itoa(status)
+			h.requests.Inc(method, route, code)
+			h.duration.Observe(time.Since(start).Seconds(), method, route, code)
+		}()
+
+		next.ServeHTTP(ww, r)
+	})
+}
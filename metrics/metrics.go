@@ -0,0 +1,304 @@
+// Package metrics exports metrics in the Prometheus text format. It has
+// counters, gauges and histograms with labels, and collectors that read
+// their values when scraped, like the Go runtime statistics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector writes metric families to an Encoder when the metrics are
+// scraped
+type Collector interface {
+	Collect(e *Encoder)
+}
+
+// CollectorFunc is a Collector function
+type CollectorFunc func(e *Encoder)
+
+// Collect calls f
+func (f CollectorFunc) Collect(e *Encoder) {
+	f(e)
+}
+
+// Registry is a set of collectors exported together
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds the collectors c to the registry
+func (r *Registry) Register(c ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c...)
+}
+
+// ServeHTTP writes the metrics of all collectors in the text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	buf := bufio.NewWriter(w)
+	e := &Encoder{w: buf}
+	for _, c := range collectors {
+		c.Collect(e)
+	}
+	buf.Flush()
+}
+
+// Encoder writes metric families in the text format
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// Family starts the metric family name of type typ, "counter", "gauge" or
+// "histogram"
+func (e *Encoder) Family(name string, help string, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(e.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample writes a sample of the current family. labels are pairs of label
+// names and values.
+func (e *Encoder) Sample(name string, value float64, labels ...string) {
+	e.w.WriteString(name)
+	if len(labels) > 0 {
+		e.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				e.w.WriteByte(',')
+			}
+			fmt.Fprintf(e.w, `%s="%s"`, labels[i], escapeValue(labels[i+1]))
+		}
+		e.w.WriteByte('}')
+	}
+	e.w.WriteByte(' ')
+	e.w.WriteString(formatFloat(value))
+	e.w.WriteByte('\n')
+}
+
+var valueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeValue(v string) string {
+	return valueEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec holds the series of a metric by their label values
+type vec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	// buckets and sum are set for histograms
+	buckets []uint64
+	sum     float64
+}
+
+func newVec(name string, help string, labels []string) vec {
+	return vec{name: name, help: help, labels: labels, series: map[string]*series{}}
+}
+
+// get returns the series of the label values, which the caller has to hold
+// the lock for
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series in order of their label values, so scrapes
+// are stable
+func (v *vec) sorted() []*series {
+	var keys []string
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := make([]*series, len(keys))
+	for i, key := range keys {
+		list[i] = v.series[key]
+	}
+	return list
+}
+
+func (v *vec) pairs(values []string, extra ...string) []string {
+	labels := make([]string, 0, len(values)*2+len(extra))
+	for i, name := range v.labels {
+		labels = append(labels, name, values[i])
+	}
+	return append(labels, extra...)
+}
+
+// Counter is a counter with labels
+type Counter struct {
+	vec
+}
+
+// NewCounter returns a counter with the label names labels
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{newVec(name, help, labels)}
+}
+
+// Inc adds 1 to the counter of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the counter of the label
+// values
+func (c *Counter) Add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.get(values).value += delta
+}
+
+// Collect writes the counter
+func (c *Counter) Collect(e *Encoder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.Family(c.name, c.help, "counter")
+	for _, s := range c.sorted() {
+		e.Sample(c.name, s.value, c.pairs(s.values)...)
+	}
+}
+
+// Gauge is a gauge with labels
+type Gauge struct {
+	vec
+}
+
+// NewGauge returns a gauge with the label names labels
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{newVec(name, help, labels)}
+}
+
+// Set sets the gauge of the label values
+func (g *Gauge) Set(value float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.get(values).value = value
+}
+
+// Add adds delta to the gauge of the label values
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.get(values).value += delta
+}
+
+// Collect writes the gauge
+func (g *Gauge) Collect(e *Encoder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	e.Family(g.name, g.help, "gauge")
+	for _, s := range g.sorted() {
+		e.Sample(g.name, s.value, g.pairs(s.values)...)
+	}
+}
+
+// GaugeFunc returns a gauge without labels whose value is read from fn
+func GaugeFunc(name string, help string, fn func() float64) Collector {
+	return CollectorFunc(func(e *Encoder) {
+		e.Family(name, help, "gauge")
+		e.Sample(name, fn())
+	})
+}
+
+// DefBuckets are the default histogram buckets, for durations in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is a histogram with labels
+type Histogram struct {
+	vec
+	bounds []float64
+}
+
+// NewHistogram returns a histogram with the upper bucket bounds, in
+// increasing order, and the label names labels
+func NewHistogram(name string, help string, bounds []float64, labels ...string) *Histogram {
+	return &Histogram{vec: newVec(name, help, labels), bounds: bounds}
+}
+
+// Observe adds the observation v to the histogram of the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.get(values)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.bounds))
+	}
+	for i, bound := range h.bounds {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.value++
+	s.sum += v
+}
+
+// Collect writes the histogram, with cumulative buckets
+func (h *Histogram) Collect(e *Encoder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e.Family(h.name, h.help, "histogram")
+	for _, s := range h.sorted() {
+		for i, bound := range h.bounds {
+			e.Sample(h.name+"_bucket", float64(s.buckets[i]), h.pairs(s.values, "le", formatFloat(bound))...)
+		}
+		e.Sample(h.name+"_bucket", s.value, h.pairs(s.values, "le", "+Inf")...)
+		e.Sample(h.name+"_sum", s.sum, h.pairs(s.values)...)
+		e.Sample(h.name+"_count", s.value, h.pairs(s.values)...)
+	}
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	return w.Body.String()
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	t.Parallel()
+
+	c := NewCounter("test_total", "Test counter.", "kind")
+	c.Inc("b")
+	c.Add(2, "a")
+	c.Inc("a")
+	g := NewGauge("test_gauge", "Test gauge\nwith newline.", "name")
+	g.Set(1.5, `quote"back\slash`)
+
+	r := NewRegistry()
+	r.Register(c, g, GaugeFunc("test_func", "Test func.", func() float64 { return 7 }))
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a"} 3
+test_total{kind="b"} 1
+# HELP test_gauge Test gauge\nwith newline.
+# TYPE test_gauge gauge
+test_gauge{name="quote\"back\\slash"} 1.5
+# HELP test_func Test func.
+# TYPE test_func gauge
+test_func 7
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("unexpected metrics:\n%s", got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+
+	h := NewHistogram("test_seconds", "Test histogram.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/")
+	h.Observe(0.5, "/")
+	h.Observe(3, "/")
+
+	r := NewRegistry()
+	r.Register(h)
+
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/",le="0.1"} 1
+test_seconds_bucket{route="/",le="1"} 2
+test_seconds_bucket{route="/",le="+Inf"} 3
+test_seconds_sum{route="/"} 3.55
+test_seconds_count{route="/"} 3
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("unexpected metrics:\n%s", got)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	h := NewHTTP(r)
+
+	router := chi.NewRouter()
+	router.Use(h.Middleware)
+	router.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	router.Post("/fail", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/users/1", nil),
+		httptest.NewRequest("GET", "/users/2", nil),
+		httptest.NewRequest("POST", "/fail", nil),
+		httptest.NewRequest("GET", "/random", nil),
+		httptest.NewRequest("SCAN1", "/users/1", nil),
+		httptest.NewRequest("SCAN2", "/users/1", nil),
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	got := scrape(t, r)
+	for _, line := range []string{
+		`brito_http_requests_total{method="GET",route="/users/{id}",status="200"} 2`,
+		`brito_http_requests_total{method="POST",route="/fail",status="500"} 1`,
+		`brito_http_requests_total{method="GET",route="none",status="404"} 1`,
+		`brito_http_request_duration_seconds_count{method="GET",route="/users/{id}",status="200"} 2`,
+		`brito_http_requests_total{method="OTHER",route="none",status="405"} 2`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, got)
+		}
+	}
+	if strings.Contains(got, "SCAN") {
+		t.Errorf("expected made up methods to be recorded as OTHER:\n%s", got)
+	}
+}
+
+func TestRuntime(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	r.Register(Runtime(), BuildInfo("test_build_info", "v1", "now"))
+
+	got := scrape(t, r)
+	for _, name := range []string{"go_goroutines ", "go_memstats_alloc_bytes ", "go_gc_cycles_total ", `test_build_info{version="v1",build_time="now",`} {
+		if !strings.Contains(got, "\n"+name) {
+			t.Errorf("expected %s in:\n%s", name, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// Runtime returns a collector of the Go runtime statistics, named like the
+// ones of the Prometheus Go client
+func Runtime() Collector {
+	start := float64(time.Now().UnixNano()) / 1e9
+	threads := pprof.Lookup("threadcreate")
+
+	return CollectorFunc(func(e *Encoder) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+
+		e.Family("go_info", "Information about the Go environment.", "gauge")
+		e.Sample("go_info", 1, "version", runtime.Version())
+
+		gauges := []struct {
+			name  string
+			help  string
+			value float64
+		}{
+			{"go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())},
+			{"go_threads", "Number of OS threads created.", float64(threads.Count())},
+			{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(m.Alloc)},
+			{"go_memstats_sys_bytes", "Number of bytes obtained from the system.", float64(m.Sys)},
+			{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(m.HeapInuse)},
+			{"go_memstats_heap_objects", "Number of allocated objects.", float64(m.HeapObjects)},
+			{"go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.", float64(m.NextGC)},
+			{"go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", float64(m.LastGC) / 1e9},
+			{"process_start_time_seconds", "Start time of the process since unix epoch in seconds.", start},
+		}
+		for _, g := range gauges {
+			e.Family(g.name, g.help, "gauge")
+			e.Sample(g.name, g.value)
+		}
+
+		counters := []struct {
+			name  string
+			help  string
+			value float64
+		}{
+			{"go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(m.TotalAlloc)},
+			{"go_memstats_mallocs_total", "Total number of mallocs.", float64(m.Mallocs)},
+			{"go_memstats_frees_total", "Total number of frees.", float64(m.Frees)},
+			{"go_gc_cycles_total", "Total number of completed garbage collection cycles.", float64(m.NumGC)},
+			{"go_gc_pause_seconds_total", "Total time the world was stopped for garbage collection.", float64(m.PauseTotalNs) / 1e9},
+		}
+		for _, c := range counters {
+			e.Family(c.name, c.help, "counter")
+			e.Sample(c.name, c.value)
+		}
+	})
+}
+
+// BuildInfo returns the build info gauge name, which is always 1 and has
+// the version and build time of the binary as labels
+func BuildInfo(name string, version string, buildTime string) Collector {
+	return CollectorFunc(func(e *Encoder) {
+		e.Family(name, "A metric with a constant '1' value labeled by the version and build time of the binary.", "gauge")
+		e.Sample(name, 1, "version", version, "build_time", buildTime, "goversion", runtime.Version())
+	})
+}
@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLockTimeout is returned when the migration lock could not be acquired
+// within the LockTimeout
+var ErrLockTimeout = errors.New("timed out waiting for the migration lock")
+
+// lockPoll is how often a busy migration lock is tried again
+var lockPoll = time.Millisecond * 500
+
+// lockName is the name of the advisory lock that serializes migration runs
+// against a database, so replicas migrating on start don't race
+func lockName(dbName string) string {
+	return "brito_migrate." + dbName
+}
+
+// lockKey returns the postgres advisory lock key for name. It is kept
+// below 2^31 so the key is the objid of the lock in pg_locks.
+func lockKey(name string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int64(h.Sum32() & 0x7fffffff)
+}
+
+// holderName identifies this process to other migration runs waiting for
+// the lock
+func holderName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("brito migrate %s:%d", host, os.Getpid())
+}
+
+// locked runs fn while holding the migration lock. The lock is an advisory
+// lock on a dedicated connection, so it is released by the database if the
+// process dies. Dry runs don't change anything and run without the lock.
+func (m *Migrator) locked(fn func() error) error {
+	if m.DryRun || m.LockTimeout <= 0 || (m.Driver != "postgres" && m.Driver != "mysql") {
+		return fn()
+	}
+
+	ctx := context.Background()
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot get a connection for the migration lock")
+	}
+	defer conn.Close()
+
+	name := lockName(m.DBName)
+	if m.Driver == "postgres" {
+		// Shows up as the holder in pg_stat_activity
+		if _, err := conn.ExecContext(ctx, "SELECT set_config('application_name', $1, false)", holderName()); err != nil {
+			return errors.Wrap(err, "cannot set application_name")
+		}
+	}
+
+	start := time.Now()
+	waiting := false
+	for {
+		ok, err := m.tryLock(ctx, conn, name)
+		if err != nil {
+			return errors.Wrap(err, "cannot acquire the migration lock")
+		}
+		if ok {
+			break
+		}
+
+		if !waiting {
+			waiting = true
+			holder, err := m.lockHolder(ctx, conn, name)
+			if err != nil {
+				holder = "unknown (" + err.Error() + ")"
+			}
+			fmt.Fprintf(m.log(), "waiting for the migration lock held by %s\n", holder)
+		}
+		if time.Since(start) >= m.LockTimeout {
+			return ErrLockTimeout
+		}
+		time.Sleep(lockPoll)
+	}
+	if waiting {
+		fmt.Fprintf(m.log(), "acquired the migration lock after %s\n", time.Since(start).Round(time.Millisecond))
+	}
+
+	defer m.unlock(ctx, conn, name)
+	return fn()
+}
+
+func (m *Migrator) tryLock(ctx context.Context, conn *sql.Conn, name string) (bool, error) {
+	if m.Driver == "postgres" {
+		var ok bool
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockKey(name)).Scan(&ok)
+		return ok, err
+	}
+
+	// GET_LOCK returns NULL on errors, like being killed while waiting
+	var ok sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", name).Scan(&ok); err != nil {
+		return false, err
+	}
+	return ok.Valid && ok.Int64 == 1, nil
+}
+
+func (m *Migrator) unlock(ctx context.Context, conn *sql.Conn, name string) {
+	var err error
+	if m.Driver == "postgres" {
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lockKey(name))
+	} else {
+		_, err = conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+	}
+	if err != nil {
+		// Closing the connection releases the lock as well
+		fmt.Fprintf(m.log(), "cannot release the migration lock: %v\n", err)
+	}
+}
+
+// lockHolder describes the database session holding the migration lock
+func (m *Migrator) lockHolder(ctx context.Context, conn *sql.Conn, name string) (string, error) {
+	if m.Driver == "postgres" {
+		var app, addr string
+		var pid int64
+		var since time.Time
+		err := conn.QueryRowContext(ctx, `SELECT a.application_name, COALESCE(host(a.client_addr), 'local'), a.pid, a.backend_start
+			FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+			WHERE l.locktype = 'advisory' AND l.granted AND l.classid = 0 AND l.objid = $1 AND l.objsubid = 1`,
+			lockKey(name)).Scan(&app, &addr, &pid, &since)
+		if err == sql.ErrNoRows {
+			return "nobody, it was just released", nil
+		} else if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%q from %s (pid %d, connected %s)", app, addr, pid, since.Format(time.RFC3339)), nil
+	}
+
+	var id sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?)", name).Scan(&id); err != nil {
+		return "", err
+	}
+	if !id.Valid {
+		return "nobody, it was just released", nil
+	}
+
+	var user, host string
+	err := conn.QueryRowContext(ctx, "SELECT USER, HOST FROM information_schema.PROCESSLIST WHERE ID = ?", id.Int64).Scan(&user, &host)
+	if err != nil {
+		return fmt.Sprintf("connection %d", id.Int64), nil
+	}
+	return fmt.Sprintf("%s@%s (connection %d)", user, host, id.Int64), nil
+}
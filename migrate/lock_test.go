@@ -0,0 +1,44 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockKey(t *testing.T) {
+	t.Parallel()
+
+	a, b := lockKey(lockName("brito")), lockKey(lockName("brito_test"))
+	if a != lockKey(lockName("brito")) {
+		t.Error("lock key is not stable")
+	}
+	if a == b {
+		t.Error("different databases share a lock key")
+	}
+	for _, key := range []int64{a, b} {
+		if key < 0 || key >= 1<<31 {
+			t.Errorf("lock key %d does not fit the objid", key)
+		}
+	}
+}
+
+func TestLockedWithoutLock(t *testing.T) {
+	t.Parallel()
+
+	// DB is nil, so taking the lock would panic
+	tests := []*Migrator{
+		{Driver: "postgres", LockTimeout: time.Minute, DryRun: true},
+		{Driver: "postgres"},
+		{Driver: "sqlite3", LockTimeout: time.Minute},
+	}
+
+	for i, m := range tests {
+		ran := false
+		if err := m.locked(func() error { ran = true; return nil }); err != nil {
+			t.Errorf("%d) unexpected error: %v", i, err)
+		}
+		if !ran {
+			t.Errorf("%d) fn did not run", i)
+		}
+	}
+}
@@ -0,0 +1,607 @@
+// Package migrate runs the SQL migrations in db/migrations.
+//
+// It reads the same files and keeps the same mig_migrations version table
+// as github.com/volatiletech/mig, which abcweb uses, so databases migrated
+// with either can be managed with the other. On top of that it can migrate
+// to a given version, print the SQL instead of running it, and read the
+// migrations from any fs.FS.
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoMigration is returned when there is no migration to roll back or redo
+var ErrNoMigration = errors.New("no migration to run")
+
+// Migration is a migration file
+type Migration struct {
+	Version int64
+	// Name is the file name, e.g. 20170101120000_create_users.sql
+	Name string
+
+	fsys fs.FS
+}
+
+// Statements returns the SQL statements of the Up or Down section
+func (m *Migration) Statements(up bool) ([]string, error) {
+	f, err := m.fsys.Open(m.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open migration %s", m.Name)
+	}
+	defer f.Close()
+
+	stmts, err := Split(f, up)
+	return stmts, errors.Wrapf(err, "cannot parse migration %s", m.Name)
+}
+
+// Load returns the migrations in the root of fsys, ordered by version.
+// Migration files are named <version>_<name>.sql, where version is a
+// positive number, usually the creation time as YYYYMMDDHHMMSS.
+func Load(fsys fs.FS) ([]*Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []*Migration
+	seen := map[int64]string{}
+	for _, name := range names {
+		idx := strings.Index(name, "_")
+		if idx < 0 {
+			return nil, errors.Errorf("migration %s is not named <version>_<name>.sql", name)
+		}
+		v, err := strconv.ParseInt(name[:idx], 10, 64)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("migration %s does not start with a positive version number", name)
+		}
+		if other, ok := seen[v]; ok {
+			return nil, errors.Errorf("migrations %s and %s have the same version", other, name)
+		}
+		seen[v] = name
+
+		migrations = append(migrations, &Migration{Version: v, Name: name, fsys: fsys})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// LoadDialect returns the migrations in the root of fsys like Load, with
+// the ones in the folder named after dialect, e.g. sqlite3, replacing the
+// ones of the same version. Migrations that don't work on every database
+// have their dialect specific copy there.
+func LoadDialect(fsys fs.FS, dialect string) ([]*Migration, error) {
+	migrations, err := Load(fsys)
+	if err != nil || len(dialect) == 0 {
+		return migrations, err
+	}
+
+	sub, err := fs.Sub(fsys, dialect)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := Load(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range overrides {
+		mig := find(migrations, o.Version)
+		if mig == nil {
+			return nil, errors.Errorf("migration %s/%s replaces no migration of the same version", dialect, o.Name)
+		}
+		*mig = *o
+	}
+	return migrations, nil
+}
+
+// The mig annotations that split a migration file into sections
+const (
+	cmdPrefix      = "-- +mig "
+	cmdUp          = "Up"
+	cmdDown        = "Down"
+	cmdStmtBegin   = "StatementBegin"
+	cmdStmtEnd     = "StatementEnd"
+	migrationStart = cmdPrefix + cmdUp + "\n\n" + cmdPrefix + cmdDown + "\n\n"
+)
+
+// Split returns the statements of the Up or Down section of a migration.
+// Statements end with a semicolon at the end of a line, except between
+// StatementBegin and StatementEnd annotations, for statements like
+// function definitions that contain semicolons themselves.
+func Split(r io.Reader, up bool) ([]string, error) {
+	return split(r, up, true)
+}
+
+// SplitScript returns the statements of an SQL script without Up and Down
+// sections, like a seed file. They are split the same way as migrations.
+func SplitScript(r io.Reader) ([]string, error) {
+	return split(r, true, false)
+}
+
+func split(r io.Reader, up bool, sectioned bool) ([]string, error) {
+	var stmts []string
+	var buf bytes.Buffer
+	sections := 0
+	active, inStatement := !sectioned, false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		ended := false
+
+		if strings.HasPrefix(line, cmdPrefix) {
+			switch strings.TrimSpace(line[len(cmdPrefix):]) {
+			case cmdUp:
+				active = up || !sectioned
+				sections++
+			case cmdDown:
+				active = !up || !sectioned
+				sections++
+			case cmdStmtBegin:
+				inStatement = active
+			case cmdStmtEnd:
+				ended = active && inStatement
+				inStatement = false
+			}
+		}
+
+		if !active {
+			continue
+		}
+
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+
+		if ended || (!inStatement && endsWithSemicolon(line)) {
+			stmts = append(stmts, buf.String())
+			buf.Reset()
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if inStatement {
+		return nil, errors.New("StatementBegin without a matching StatementEnd")
+	}
+	if rest := buf.String(); !onlyComments(rest) {
+		return nil, errors.Errorf("unfinished statement, missing a semicolon? %s", strings.TrimSpace(rest))
+	}
+	if sections == 0 && sectioned {
+		return nil, errors.New("no Up or Down annotations found")
+	}
+
+	return stmts, nil
+}
+
+// endsWithSemicolon reports whether line ends a statement, ignoring
+// trailing -- comments
+func endsWithSemicolon(line string) bool {
+	prev := ""
+	for _, word := range strings.Fields(line) {
+		if strings.HasPrefix(word, "--") {
+			break
+		}
+		prev = word
+	}
+	return strings.HasSuffix(prev, ";")
+}
+
+// onlyComments reports whether sql has nothing but -- comments and space
+func onlyComments(sql string) bool {
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
+
+var validName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Create writes an empty migration named <timestamp>_<name>.sql to dir and
+// returns its path. name may only contain a-z, 0-9 and underscores.
+func Create(dir string, name string, now time.Time) (string, error) {
+	if !validName.MatchString(name) {
+		return "", errors.Errorf("migration name %q must only contain a-z, 0-9 and _", name)
+	}
+
+	path := filepath.Join(dir, now.UTC().Format("20060102150405")+"_"+name+".sql")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create migration")
+	}
+	defer f.Close()
+
+	if _, err := io.WriteString(f, migrationStart); err != nil {
+		return "", errors.Wrap(err, "cannot write migration")
+	}
+
+	return path, nil
+}
+
+// Status is the state of a migration in the database
+type Status struct {
+	*Migration
+	Applied bool
+	// AppliedAt is when the migration was last applied or rolled back
+	AppliedAt time.Time
+}
+
+// Step is a migration to apply or roll back
+type Step struct {
+	*Migration
+	Up bool
+}
+
+func (s Step) String() string {
+	if s.Up {
+		return "up " + s.Name
+	}
+	return "down " + s.Name
+}
+
+// Plan returns the steps to go from the current to the target version,
+// which must be 0 or the version of one of migrations
+func Plan(migrations []*Migration, current int64, target int64) ([]Step, error) {
+	if target != 0 && find(migrations, target) == nil {
+		return nil, errors.Errorf("there is no migration with version %d", target)
+	}
+	if current != 0 && find(migrations, current) == nil {
+		return nil, errors.Errorf("the database is at version %d, which has no migration", current)
+	}
+
+	var steps []Step
+	if target >= current {
+		for _, m := range migrations {
+			if m.Version > current && m.Version <= target {
+				steps = append(steps, Step{Migration: m, Up: true})
+			}
+		}
+		return steps, nil
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if m := migrations[i]; m.Version <= current && m.Version > target {
+			steps = append(steps, Step{Migration: m, Up: false})
+		}
+	}
+	return steps, nil
+}
+
+func find(migrations []*Migration, version int64) *Migration {
+	for _, m := range migrations {
+		if m.Version == version {
+			return m
+		}
+	}
+	return nil
+}
+
+// Migrator runs migrations against a database
+type Migrator struct {
+	DB *sql.DB
+	// Driver is the database driver name, "postgres", "mysql" or "sqlite3"
+	Driver string
+	// DBName is the database name, which the migration lock is named after
+	DBName     string
+	Migrations []*Migration
+
+	// LockTimeout is how long to wait for other migration runs against the
+	// database to finish. Zero runs migrations without taking the lock.
+	LockTimeout time.Duration
+
+	// Log receives a line for every migration run
+	Log io.Writer
+	// DryRun prints the SQL of the migrations to Log instead of running it
+	DryRun bool
+}
+
+// Version returns the version of the last applied migration, 0 if none.
+// The version table is created if it does not exist, unless in DryRun.
+func (m *Migrator) Version() (int64, error) {
+	records, err := m.records()
+	if err != nil {
+		return 0, err
+	}
+	return current(records), nil
+}
+
+// Status returns the state of every migration
+func (m *Migrator) Status() ([]Status, error) {
+	records, err := m.records()
+	if err != nil {
+		return nil, err
+	}
+
+	// Records are newest first, and the newest one of a version counts
+	latest := map[int64]record{}
+	for _, r := range records {
+		if _, ok := latest[r.version]; !ok {
+			latest[r.version] = r
+		}
+	}
+
+	var status []Status
+	for _, mig := range m.Migrations {
+		r := latest[mig.Version]
+		status = append(status, Status{Migration: mig, Applied: r.applied, AppliedAt: r.at})
+	}
+	return status, nil
+}
+
+// Up applies all pending migrations and returns how many were applied
+func (m *Migrator) Up() (int, error) {
+	if len(m.Migrations) == 0 {
+		return 0, nil
+	}
+	return m.To(m.Migrations[len(m.Migrations)-1].Version)
+}
+
+// Down rolls back the last applied migration and returns it
+func (m *Migrator) Down() (*Migration, error) {
+	var mig *Migration
+	err := m.locked(func() error {
+		steps, err := m.downOne()
+		if err != nil {
+			return err
+		}
+		mig = steps[0].Migration
+		return m.run(steps)
+	})
+	return mig, err
+}
+
+// Redo rolls back and re-applies the last applied migration and returns it
+func (m *Migrator) Redo() (*Migration, error) {
+	var mig *Migration
+	err := m.locked(func() error {
+		steps, err := m.downOne()
+		if err != nil {
+			return err
+		}
+		mig = steps[0].Migration
+		return m.run(append(steps, Step{Migration: mig, Up: true}))
+	})
+	return mig, err
+}
+
+// Reset rolls back all applied migrations and returns how many were
+// rolled back
+func (m *Migrator) Reset() (int, error) {
+	return m.To(0)
+}
+
+// To migrates up or down to the target version and returns the number of
+// migrations run. Other migration runs wait for it to finish, and it waits
+// for them, for up to LockTimeout.
+func (m *Migrator) To(target int64) (int, error) {
+	var count int
+	err := m.locked(func() error {
+		version, err := m.Version()
+		if err != nil {
+			return err
+		}
+
+		steps, err := Plan(m.Migrations, version, target)
+		if err != nil {
+			return err
+		}
+
+		count = len(steps)
+		return m.run(steps)
+	})
+	return count, err
+}
+
+func (m *Migrator) downOne() ([]Step, error) {
+	version, err := m.Version()
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return nil, ErrNoMigration
+	}
+
+	// The first step of rolling back everything is the last migration
+	steps, err := Plan(m.Migrations, version, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return steps[:1], nil
+}
+
+func (m *Migrator) run(steps []Step) error {
+	for _, step := range steps {
+		if err := m.step(step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// step runs a migration in a transaction together with its version record
+func (m *Migrator) step(step Step) error {
+	stmts, err := step.Statements(step.Up)
+	if err != nil {
+		return err
+	}
+
+	if m.DryRun {
+		fmt.Fprintf(m.log(), "-- %s\n", step)
+		for _, stmt := range stmts {
+			fmt.Fprint(m.log(), stmt)
+		}
+		fmt.Fprintln(m.log())
+		return nil
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "cannot begin transaction")
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %s failed", step)
+		}
+	}
+	if _, err := tx.Exec(m.rebind("INSERT INTO mig_migrations (version_id, is_applied) VALUES (?, ?)"), step.Version, step.Up); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "cannot record migration %s", step)
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "cannot commit migration %s", step)
+	}
+
+	fmt.Fprintln(m.log(), step)
+	return nil
+}
+
+func (m *Migrator) log() io.Writer {
+	if m.Log == nil {
+		return io.Discard
+	}
+	return m.Log
+}
+
+// record is a row of the mig_migrations table. A row is added every time a
+// migration is applied or rolled back.
+type record struct {
+	version int64
+	applied bool
+	at      time.Time
+}
+
+// records returns the version records, newest first
+func (m *Migrator) records() ([]record, error) {
+	exists, err := m.versionTableExists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if m.DryRun {
+			// The table is created on the first real run
+			return nil, nil
+		}
+		return nil, m.createVersionTable()
+	}
+
+	rows, err := m.DB.Query("SELECT version_id, is_applied, tstamp FROM mig_migrations ORDER BY id DESC")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read mig_migrations")
+	}
+	defer rows.Close()
+
+	var records []record
+	for rows.Next() {
+		var r record
+		var at sql.NullTime
+		if err := rows.Scan(&r.version, &r.applied, &at); err != nil {
+			return nil, errors.Wrap(err, "cannot read mig_migrations")
+		}
+		r.at = at.Time
+		records = append(records, r)
+	}
+
+	return records, errors.Wrap(rows.Err(), "cannot read mig_migrations")
+}
+
+// current returns the version of the newest migration whose newest
+// record has it applied
+func current(records []record) int64 {
+	seen := map[int64]bool{}
+	for _, r := range records {
+		if seen[r.version] {
+			continue
+		}
+		if r.applied {
+			return r.version
+		}
+		seen[r.version] = true
+	}
+	return 0
+}
+
+// versionTableExists reports whether the mig_migrations table exists, in
+// the schema the queries of the connection use
+func (m *Migrator) versionTableExists() (bool, error) {
+	query := "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'mig_migrations'"
+	switch m.Driver {
+	case "mysql":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'mig_migrations'"
+	case "sqlite3":
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'mig_migrations'"
+	}
+
+	var n int
+	if err := m.DB.QueryRow(query).Scan(&n); err != nil {
+		return false, errors.Wrap(err, "cannot check for the mig_migrations table")
+	}
+	return n > 0, nil
+}
+
+// createVersionTable creates the mig_migrations table with mig's layout,
+// including the version 0 row mig expects
+func (m *Migrator) createVersionTable() error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "cannot begin transaction")
+	}
+
+	create := `CREATE TABLE mig_migrations (
+		id serial NOT NULL,
+		version_id bigint NOT NULL,
+		is_applied boolean NOT NULL,
+		tstamp timestamp NULL default now(),
+		PRIMARY KEY(id)
+	)`
+	if m.Driver == "sqlite3" {
+		create = `CREATE TABLE mig_migrations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			version_id INTEGER NOT NULL,
+			is_applied INTEGER NOT NULL,
+			tstamp TIMESTAMP DEFAULT (datetime('now'))
+		)`
+	}
+	if _, err := tx.Exec(create); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "cannot create mig_migrations")
+	}
+	if _, err := tx.Exec(m.rebind("INSERT INTO mig_migrations (version_id, is_applied) VALUES (?, ?)"), 0, true); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "cannot insert into mig_migrations")
+	}
+
+	return errors.Wrap(tx.Commit(), "cannot create mig_migrations")
+}
+
+// rebind replaces the ? placeholders for postgres
+func (m *Migrator) rebind(query string) string {
+	if m.Driver != "postgres" {
+		return query
+	}
+	for n := 1; strings.Contains(query, "?"); n++ {
+		query = strings.Replace(query, "?", "$"+strconv.Itoa(n), 1)
+	}
+	return query
+}
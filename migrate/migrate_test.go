@@ -0,0 +1,272 @@
+package migrate
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testMigration = `-- +mig Up
+CREATE TABLE a (id int); -- trailing comment
+CREATE TABLE b (
+	id int
+);
+-- +mig StatementBegin
+CREATE FUNCTION f() RETURNS int AS $$
+BEGIN
+	RETURN 1;
+END;
+$$ LANGUAGE plpgsql;
+-- +mig StatementEnd
+
+-- +mig Down
+DROP TABLE b;
+DROP TABLE a;
+`
+
+func TestSplit(t *testing.T) {
+	t.Parallel()
+
+	up, err := Split(strings.NewReader(testMigration), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(up) != 3 {
+		t.Fatalf("expected 3 up statements, got %d: %q", len(up), up)
+	}
+	if !strings.HasPrefix(up[0], "-- +mig Up\nCREATE TABLE a") {
+		t.Errorf("unexpected first statement %q", up[0])
+	}
+	if !strings.Contains(up[2], "RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;\n-- +mig StatementEnd\n") {
+		t.Errorf("expected the function to be one statement, got %q", up[2])
+	}
+
+	down, err := Split(strings.NewReader(testMigration), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(down) != 2 || !strings.Contains(down[0], "DROP TABLE b;") || !strings.Contains(down[1], "DROP TABLE a;") {
+		t.Errorf("unexpected down statements %q", down)
+	}
+
+	bad := []string{
+		"CREATE TABLE a (id int);\n",
+		"-- +mig Up\nCREATE TABLE a (id int)\n",
+		"-- +mig Up\n-- +mig StatementBegin\nSELECT 1;\n",
+	}
+	for _, b := range bad {
+		if _, err := Split(strings.NewReader(b), true); err == nil {
+			t.Errorf("expected an error for %q", b)
+		}
+	}
+}
+
+func TestSplitScript(t *testing.T) {
+	t.Parallel()
+
+	stmts, err := SplitScript(strings.NewReader("-- demo data\nINSERT INTO a VALUES (1);\n-- +mig StatementBegin\nSELECT 1; SELECT 2;\n-- +mig StatementEnd\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 2 || !strings.HasPrefix(stmts[0], "-- demo data\nINSERT") || !strings.Contains(stmts[1], "SELECT 1; SELECT 2;") {
+		t.Errorf("unexpected statements %q", stmts)
+	}
+
+	if stmts, err := SplitScript(strings.NewReader("-- nothing yet\n")); err != nil || len(stmts) != 0 {
+		t.Errorf("expected no statements, got %q, %v", stmts, err)
+	}
+	if _, err := SplitScript(strings.NewReader("INSERT INTO a VALUES (1)\n")); err == nil {
+		t.Error("expected an error for a missing semicolon")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"20170102000000_second.sql": {Data: []byte(testMigration)},
+		"20170101000000_first.sql":  {Data: []byte(testMigration)},
+		"README.md":                 {Data: []byte("not a migration")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Name != "20170101000000_first.sql" || migrations[1].Version != 20170102000000 {
+		t.Fatalf("unexpected migrations %v", migrations)
+	}
+	if stmts, err := migrations[0].Statements(true); err != nil || len(stmts) != 3 {
+		t.Errorf("expected 3 statements, got %d %v", len(stmts), err)
+	}
+
+	bad := []fstest.MapFS{
+		{"first.sql": {}},
+		{"0_first.sql": {}},
+		{"1_first.sql": {}, "01_other.sql": {}},
+	}
+	for _, fsys := range bad {
+		if _, err := Load(fsys); err == nil {
+			t.Errorf("expected an error for %v", fsys)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	t.Parallel()
+
+	migrations := []*Migration{{Version: 1, Name: "1_a.sql"}, {Version: 2, Name: "2_b.sql"}, {Version: 3, Name: "3_c.sql"}}
+
+	tests := []struct {
+		current int64
+		target  int64
+		want    []string
+	}{
+		{0, 3, []string{"up 1_a.sql", "up 2_b.sql", "up 3_c.sql"}},
+		{1, 2, []string{"up 2_b.sql"}},
+		{3, 1, []string{"down 3_c.sql", "down 2_b.sql"}},
+		{2, 0, []string{"down 2_b.sql", "down 1_a.sql"}},
+		{2, 2, nil},
+	}
+
+	for _, test := range tests {
+		steps, err := Plan(migrations, test.current, test.target)
+		if err != nil {
+			t.Errorf("%d to %d: %v", test.current, test.target, err)
+			continue
+		}
+		var got []string
+		for _, s := range steps {
+			got = append(got, s.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d to %d: want %v, got %v", test.current, test.target, test.want, got)
+		}
+	}
+
+	if _, err := Plan(migrations, 0, 4); err == nil {
+		t.Error("expected an error for an unknown target")
+	}
+	if _, err := Plan(migrations, 5, 0); err == nil {
+		t.Error("expected an error for an unknown current version")
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	t.Parallel()
+
+	// Newest first: 3 was applied and rolled back, so 2 is current
+	records := []record{{3, false, time.Time{}}, {3, true, time.Time{}}, {2, true, time.Time{}}, {1, true, time.Time{}}, {0, true, time.Time{}}}
+	if v := current(records); v != 2 {
+		t.Errorf("expected version 2, got %d", v)
+	}
+	if v := current(nil); v != 0 {
+		t.Errorf("expected version 0, got %d", v)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	path, err := Create(dir, "add_users", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "20170102030405_add_users.sql" {
+		t.Errorf("unexpected file name %q", path)
+	}
+
+	migrations, err := Load(os.DirFS(dir))
+	if err != nil || len(migrations) != 1 {
+		t.Fatalf("expected the new migration to load, got %v %v", migrations, err)
+	}
+	if stmts, err := migrations[0].Statements(true); err != nil || len(stmts) != 0 {
+		t.Errorf("expected an empty migration, got %q %v", stmts, err)
+	}
+
+	if _, err := Create(dir, "add_users", now); err == nil {
+		t.Error("expected an error for an existing migration")
+	}
+	if _, err := Create(dir, "../evil", now); err == nil {
+		t.Error("expected an error for an invalid name")
+	}
+}
+
+func TestLoadDialect(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"1_a.sql":         {Data: []byte(migrationStart)},
+		"2_b.sql":         {Data: []byte(migrationStart)},
+		"sqlite3/2_b.sql": {Data: []byte(testMigration)},
+	}
+
+	migrations, err := LoadDialect(fsys, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+	for i, want := range []int{0, 3} {
+		if stmts, err := migrations[i].Statements(true); err != nil || len(stmts) != want {
+			t.Errorf("%d) expected %d statements, got %d %v", i, want, len(stmts), err)
+		}
+	}
+
+	if migrations, err := LoadDialect(fsys, "postgres"); err != nil || len(migrations) != 2 {
+		t.Errorf("expected the generic migrations, got %d %v", len(migrations), err)
+	}
+
+	fsys["sqlite3/3_c.sql"] = &fstest.MapFile{}
+	if _, err := LoadDialect(fsys, "sqlite3"); err == nil {
+		t.Error("expected an error for a dialect migration without a generic one")
+	}
+}
+
+func TestVersionTable(t *testing.T) {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m := &Migrator{DB: conn, Driver: "sqlite3", DryRun: true}
+	if version, err := m.Version(); err != nil || version != 0 {
+		t.Fatalf("expected version 0, got %d %v", version, err)
+	}
+	if exists, err := m.versionTableExists(); err != nil || exists {
+		t.Fatalf("expected a dry run not to create the table, got %t %v", exists, err)
+	}
+
+	m.DryRun = false
+	for i := 0; i < 2; i++ {
+		if version, err := m.Version(); err != nil || version != 0 {
+			t.Fatalf("%d: expected version 0, got %d %v", i, version, err)
+		}
+	}
+	if exists, err := m.versionTableExists(); err != nil || !exists {
+		t.Fatalf("expected the table to be created, got %t %v", exists, err)
+	}
+
+	// Errors other than a missing table are returned, not taken for one
+	conn.Close()
+	if _, err := m.Version(); err == nil || !strings.Contains(err.Error(), "cannot check for the mig_migrations table") {
+		t.Errorf("expected the connection error, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/sqlboiler/boil"
+)
+
+// Identity links a user to their account at an external identity provider
+type Identity struct {
+	ID     int64
+	UserID int64
+	// Provider is the name of the identity provider in the app config
+	Provider string
+	// Subject is the user's ID at the identity provider
+	Subject   string
+	CreatedAt time.Time
+}
+
+// FindIdentity retrieves the identity for a provider's subject.
+// Returns sql.ErrNoRows if not found.
+func FindIdentity(exec boil.Executor, provider string, subject string) (*Identity, error) {
+	i := &Identity{}
+	query := db.Rebind("SELECT id, user_id, provider, subject, created_at FROM user_identities WHERE provider = ? AND subject = ?")
+	err := exec.QueryRow(query, provider, subject).Scan(&i.ID, &i.UserID, &i.Provider, &i.Subject, &i.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, "models: unable to select from user_identities")
+	}
+
+	return i, nil
+}
+
+// Insert a new identity and set its ID and CreatedAt
+func (i *Identity) Insert(exec boil.Executor) error {
+	i.CreatedAt = time.Now().UTC()
+
+	query := "INSERT INTO user_identities (user_id, provider, subject, created_at) VALUES (?, ?, ?, ?)"
+	args := []interface{}{i.UserID, i.Provider, i.Subject, i.CreatedAt}
+
+	if db.Driver == "postgres" {
+		err := exec.QueryRow(db.Rebind(query+" RETURNING id"), args...).Scan(&i.ID)
+		return errors.Wrap(err, "models: unable to insert into user_identities")
+	}
+
+	res, err := exec.Exec(db.Rebind(query), args...)
+	if err != nil {
+		return errors.Wrap(err, "models: unable to insert into user_identities")
+	}
+	i.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "models: unable to get id of inserted identity")
+}
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fadeojo/brito/db"
+)
+
+func TestMain(m *testing.M) {
+	count, err := db.SetupTestSuite(db.GoTestdata)
+	if err != nil {
+		fmt.Printf("TestMain setup failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("TestMain Setup ran %d migrations.\n", count)
+
+	r := m.Run()
+	if err := db.TeardownTestSuite(); err != nil {
+		fmt.Printf("TestMain teardown failed: %s\n", err)
+	}
+	os.Exit(r)
+}
+
+func TestUser(t *testing.T) {
+	u := &User{Email: " Alice@Example.com ", PasswordHash: "hash", TOTPEnabled: true}
+	if err := u.Insert(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID == 0 {
+		t.Error("expected the ID to be set")
+	}
+
+	found, err := FindUserByEmail(db.DB, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != u.ID || found.PasswordHash != "hash" || !found.TOTPEnabled || found.EmailVerified {
+		t.Errorf("unexpected user %#v", found)
+	}
+	if !found.CreatedAt.Equal(u.CreatedAt) {
+		t.Errorf("expected created at %s, got %s", u.CreatedAt, found.CreatedAt)
+	}
+
+	found.EmailVerified = true
+	if err := found.Update(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	if found, err = FindUser(db.DB, u.ID); err != nil {
+		t.Fatal(err)
+	} else if !found.EmailVerified {
+		t.Error("expected the update to be stored")
+	}
+
+	if _, err := FindUserByEmail(db.DB, "bob@example.com"); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestUserLock(t *testing.T) {
+	u := &User{Email: "locked@example.com"}
+	if err := u.Insert(db.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	until := time.Now().Add(time.Hour)
+	if ok, err := u.Lock(db.DB, until); err != nil || !ok {
+		t.Fatalf("expected the lock to be taken, got %t %v", ok, err)
+	}
+	if ok, err := u.Lock(db.DB, until.Add(-time.Minute)); err != nil || ok {
+		t.Errorf("expected a shorter lock to be ignored, got %t %v", ok, err)
+	}
+	if !u.Locked(time.Now()) || u.Locked(until) {
+		t.Error("expected the user to be locked until", until)
+	}
+}
+
+func TestUserResetPassword(t *testing.T) {
+	u := &User{Email: "reset@example.com", PasswordHash: "old", LockedUntil: time.Now().Add(time.Hour).Unix()}
+	if err := u.Insert(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	// A concurrent reset that loaded the user before the first one
+	stale := *u
+
+	if ok, err := u.ResetPassword(db.DB, "new"); err != nil || !ok {
+		t.Fatalf("expected the password to be reset, got %t %v", ok, err)
+	}
+	if ok, err := stale.ResetPassword(db.DB, "other"); err != nil || ok {
+		t.Errorf("expected a reset of a changed password to be ignored, got %t %v", ok, err)
+	}
+
+	u, err := FindUser(db.DB, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PasswordHash != "new" || !u.EmailVerified || u.LockedUntil != 0 {
+		t.Errorf("expected the first reset to be stored, got %+v", u)
+	}
+}
+
+func TestUserSetTOTP(t *testing.T) {
+	u := &User{Email: "set-totp@example.com", PasswordHash: "old"}
+	if err := u.Insert(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	// A request that loaded the user before the password was reset
+	stale := *u
+	if ok, err := u.ResetPassword(db.DB, "new"); err != nil || !ok {
+		t.Fatalf("expected the password to be reset, got %t %v", ok, err)
+	}
+
+	if ok, err := stale.SetTOTP(db.DB, "secret", true, 5); err != nil || !ok {
+		t.Fatalf("expected two factor to be enabled, got %t %v", ok, err)
+	}
+	if ok, err := u.SetTOTP(db.DB, "other", true, 6); err != nil || ok {
+		t.Errorf("expected enabling it again to be ignored, got %t %v", ok, err)
+	}
+
+	u, err := FindUser(db.DB, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PasswordHash != "new" || u.TOTPSecret != "secret" || !u.TOTPEnabled || u.TOTPLastStep != 5 {
+		t.Errorf("expected only the first second factor to be stored, got %+v", u)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	u := &User{Email: "codes@example.com"}
+	if err := u.Insert(db.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReplaceRecoveryCodes(db.DB, u.ID, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := UseRecoveryCode(db.DB, u.ID, "a"); err != nil || !ok {
+		t.Fatalf("expected the code to be used, got %t %v", ok, err)
+	}
+	if ok, err := UseRecoveryCode(db.DB, u.ID, "a"); err != nil || ok {
+		t.Errorf("expected a used code to be rejected, got %t %v", ok, err)
+	}
+	if count, err := CountRecoveryCodes(db.DB, u.ID); err != nil || count != 1 {
+		t.Errorf("expected 1 code left, got %d %v", count, err)
+	}
+}
+
+func TestThrottleStore(t *testing.T) {
+	var s ThrottleStore
+	now := time.Now()
+	window := now.Add(-time.Hour)
+
+	for i := 1; i <= 3; i++ {
+		count, err := s.AddFailure("test", now, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != i {
+			t.Errorf("expected %d failures, got %d", i, count)
+		}
+	}
+
+	count, last, err := s.Failures("test", window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || !last.Equal(now.UTC()) {
+		t.Errorf("expected 3 failures at %s, got %d at %s", now, count, last)
+	}
+
+	// Failures before the window start over
+	if count, err := s.AddFailure("test", now.Add(2*time.Hour), now.Add(time.Hour)); err != nil || count != 1 {
+		t.Errorf("expected the count to start over, got %d %v", count, err)
+	}
+
+	if err := s.Reset("test"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _, err := s.Failures("test", window); err != nil || count != 0 {
+		t.Errorf("expected no failures after reset, got %d %v", count, err)
+	}
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/sqlboiler/boil"
+)
+
+// ReplaceRecoveryCodes deletes the user's recovery codes and stores the
+// given code hashes in their place. Call it inside a transaction.
+func ReplaceRecoveryCodes(exec boil.Executor, userID int64, hashes []string) error {
+	if err := DeleteRecoveryCodes(exec, userID); err != nil {
+		return err
+	}
+
+	query := db.Rebind("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)")
+	for _, hash := range hashes {
+		if _, err := exec.Exec(query, userID, hash); err != nil {
+			return errors.Wrap(err, "models: unable to insert into recovery_codes")
+		}
+	}
+
+	return nil
+}
+
+// DeleteRecoveryCodes deletes all of the user's recovery codes
+func DeleteRecoveryCodes(exec boil.Executor, userID int64) error {
+	_, err := exec.Exec(db.Rebind("DELETE FROM recovery_codes WHERE user_id = ?"), userID)
+	return errors.Wrap(err, "models: unable to delete from recovery_codes")
+}
+
+// UseRecoveryCode marks the user's unused recovery code with the given hash
+// as used. It reports false if there is no such unused code.
+func UseRecoveryCode(exec boil.Executor, userID int64, hash string) (bool, error) {
+	query := db.Rebind("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL")
+	res, err := exec.Exec(query, time.Now().UTC(), userID, hash)
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to update recovery_codes")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to get rows affected")
+	}
+
+	return n == 1, nil
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes the user has
+func CountRecoveryCodes(exec boil.Executor, userID int64) (int, error) {
+	var count int
+	query := db.Rebind("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL")
+	err := exec.QueryRow(query, userID).Scan(&count)
+	return count, errors.Wrap(err, "models: unable to count recovery_codes")
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/pkg/errors"
+)
+
+// ThrottleStore is an auth.ThrottleStore that keeps the failure counts in
+// the throttle_failures table, so they are shared by all app instances.
+// It uses the global db.DB connection.
+type ThrottleStore struct{}
+
+// Failures implements auth.ThrottleStore
+func (ThrottleStore) Failures(key string, since time.Time) (int, time.Time, error) {
+	var count int
+	var last time.Time
+	query := db.Rebind("SELECT count, last_failure FROM throttle_failures WHERE throttle_key = ? AND last_failure >= ?")
+	err := db.DB.QueryRow(query, key, since.UTC()).Scan(&count, &last)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, nil
+	} else if err != nil {
+		return 0, time.Time{}, errors.Wrap(err, "models: unable to select from throttle_failures")
+	}
+
+	return count, last, nil
+}
+
+// AddFailure implements auth.ThrottleStore. Expired rows are deleted
+// whenever a new key is added, so the table does not grow without bound.
+func (s ThrottleStore) AddFailure(key string, at time.Time, since time.Time) (int, error) {
+	at, since = at.UTC(), since.UTC()
+
+	update := db.Rebind(`UPDATE throttle_failures SET count = CASE WHEN last_failure < ? THEN 1 ELSE count + 1 END,
+		last_failure = ? WHERE throttle_key = ?`)
+	for i := 0; i < 2; i++ {
+		res, err := db.DB.Exec(update, since, at, key)
+		if err != nil {
+			return 0, errors.Wrap(err, "models: unable to update throttle_failures")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, errors.Wrap(err, "models: unable to get rows affected")
+		}
+		if n == 1 {
+			count, _, err := s.Failures(key, since)
+			return count, err
+		}
+
+		_, err = db.DB.Exec(db.Rebind("INSERT INTO throttle_failures (throttle_key, count, last_failure) VALUES (?, 1, ?)"), key, at)
+		if err == nil {
+			_, err = db.DB.Exec(db.Rebind("DELETE FROM throttle_failures WHERE last_failure < ?"), since)
+			return 1, errors.Wrap(err, "models: unable to delete from throttle_failures")
+		}
+		// A concurrent request inserted the key first, so update it instead
+	}
+
+	return 0, errors.Errorf("models: unable to insert into throttle_failures for key %q", key)
+}
+
+// Reset implements auth.ThrottleStore
+func (ThrottleStore) Reset(key string) error {
+	_, err := db.DB.Exec(db.Rebind("DELETE FROM throttle_failures WHERE throttle_key = ?"), key)
+	return errors.Wrap(err, "models: unable to delete from throttle_failures")
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/sqlboiler/boil"
+)
+
+// User is a row in the users table
+type User struct {
+	ID            int64
+	Email         string
+	PasswordHash  string
+	EmailVerified bool
+	IsAdmin       bool
+	// TOTPSecret is the base32 encoded second factor secret. It is only
+	// in effect when TOTPEnabled is set.
+	TOTPSecret  string
+	TOTPEnabled bool
+	// TOTPLastStep is the time step of the last accepted TOTP code,
+	// used to reject replayed codes.
+	TOTPLastStep int64
+	// LockedUntil is the unix time until which the account is locked after
+	// too many failed logins, zero if it is not locked
+	LockedUntil int64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// RoleAdmin is the app role that external identity providers can map
+// their groups to, which sets User.IsAdmin
+const RoleAdmin = "admin"
+
+const userColumns = "id, email, password_hash, email_verified, is_admin, totp_secret, totp_enabled, totp_last_step, locked_until, created_at, updated_at"
+
+// NormalizeEmail returns the canonical form of an email address as it is
+// stored in the users table.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// FindUser retrieves a user by ID. Returns sql.ErrNoRows if not found.
+func FindUser(exec boil.Executor, id int64) (*User, error) {
+	return findUser(exec, "id = ?", id)
+}
+
+// FindUserByEmail retrieves a user by email address.
+// Returns sql.ErrNoRows if not found.
+func FindUserByEmail(exec boil.Executor, email string) (*User, error) {
+	return findUser(exec, "email = ?", NormalizeEmail(email))
+}
+
+func findUser(exec boil.Executor, where string, args ...interface{}) (*User, error) {
+	u := &User{}
+	query := db.Rebind("SELECT " + userColumns + " FROM users WHERE " + where)
+	err := exec.QueryRow(query, args...).Scan(
+		&u.ID, &u.Email, &u.PasswordHash, &u.EmailVerified, &u.IsAdmin,
+		&u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep, &u.LockedUntil, &u.CreatedAt, &u.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, "models: unable to select from users")
+	}
+
+	return u, nil
+}
+
+// Insert a new user and set its ID and timestamps
+func (u *User) Insert(exec boil.Executor) error {
+	now := time.Now().UTC()
+	u.Email = NormalizeEmail(u.Email)
+	u.CreatedAt = now
+	u.UpdatedAt = now
+
+	query := "INSERT INTO users (email, password_hash, email_verified, is_admin, totp_secret, totp_enabled, totp_last_step, locked_until, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	args := []interface{}{
+		u.Email, u.PasswordHash, u.EmailVerified, u.IsAdmin,
+		u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep, u.LockedUntil, u.CreatedAt, u.UpdatedAt,
+	}
+
+	if db.Driver == "postgres" {
+		err := exec.QueryRow(db.Rebind(query+" RETURNING id"), args...).Scan(&u.ID)
+		return errors.Wrap(err, "models: unable to insert into users")
+	}
+
+	res, err := exec.Exec(db.Rebind(query), args...)
+	if err != nil {
+		return errors.Wrap(err, "models: unable to insert into users")
+	}
+	u.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "models: unable to get id of inserted user")
+}
+
+// Update writes all columns of the user and bumps UpdatedAt
+func (u *User) Update(exec boil.Executor) error {
+	u.Email = NormalizeEmail(u.Email)
+	u.UpdatedAt = time.Now().UTC()
+
+	query := db.Rebind(`UPDATE users SET email = ?, password_hash = ?, email_verified = ?, is_admin = ?,
+		totp_secret = ?, totp_enabled = ?, totp_last_step = ?, locked_until = ?, updated_at = ? WHERE id = ?`)
+	_, err := exec.Exec(query,
+		u.Email, u.PasswordHash, u.EmailVerified, u.IsAdmin,
+		u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep, u.LockedUntil, u.UpdatedAt, u.ID,
+	)
+	return errors.Wrap(err, "models: unable to update users row")
+}
+
+// ResetPassword sets hash as the user's password hash, verifies the email
+// address and unlocks the account, unless the password hash was changed
+// since the user was loaded. It reports false in that case, so a password
+// reset token bound to the old hash is only used once by concurrent requests.
+func (u *User) ResetPassword(exec boil.Executor, hash string) (bool, error) {
+	now := time.Now().UTC()
+	query := db.Rebind("UPDATE users SET password_hash = ?, email_verified = ?, locked_until = 0, updated_at = ? WHERE id = ? AND password_hash = ?")
+	res, err := exec.Exec(query, hash, true, now, u.ID, u.PasswordHash)
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to update users row")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to get rows affected")
+	}
+	if n == 1 {
+		u.PasswordHash = hash
+		u.EmailVerified = true
+		u.LockedUntil = 0
+		u.UpdatedAt = now
+	}
+
+	return n == 1, nil
+}
+
+// SetTOTP sets the user's second factor secret, whether it is enabled and
+// the last accepted step, unless it was enabled or disabled since the user
+// was loaded. It reports false in that case. The other columns are left
+// alone, so a concurrent password reset or lockout isn't undone.
+func (u *User) SetTOTP(exec boil.Executor, secret string, enabled bool, step int64) (bool, error) {
+	now := time.Now().UTC()
+	query := db.Rebind("UPDATE users SET totp_secret = ?, totp_enabled = ?, totp_last_step = ?, updated_at = ? WHERE id = ? AND totp_enabled = ?")
+	res, err := exec.Exec(query, secret, enabled, step, now, u.ID, u.TOTPEnabled)
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to update users row")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to get rows affected")
+	}
+	if n == 1 {
+		u.TOTPSecret = secret
+		u.TOTPEnabled = enabled
+		u.TOTPLastStep = step
+		u.UpdatedAt = now
+	}
+
+	return n == 1, nil
+}
+
+// SetTOTPLastStep stores step as the user's last accepted TOTP step, unless
+// a step at least as new is already stored. It reports false in that case,
+// which means the code was just used by a concurrent request.
+func (u *User) SetTOTPLastStep(exec boil.Executor, step int64) (bool, error) {
+	query := db.Rebind("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?")
+	res, err := exec.Exec(query, step, u.ID, step)
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to update users row")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to get rows affected")
+	}
+	if n == 1 {
+		u.TOTPLastStep = step
+	}
+
+	return n == 1, nil
+}
+
+// Locked reports whether the account is locked at the given time
+func (u *User) Locked(now time.Time) bool {
+	return now.Unix() < u.LockedUntil
+}
+
+// Lock locks the account until the given time, unless it is already locked
+// at least that long. It reports false in that case, so a lockout is only
+// acted upon once when concurrent requests trigger it.
+func (u *User) Lock(exec boil.Executor, until time.Time) (bool, error) {
+	query := db.Rebind("UPDATE users SET locked_until = ? WHERE id = ? AND locked_until < ?")
+	res, err := exec.Exec(query, until.Unix(), u.ID, until.Unix())
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to update users row")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "models: unable to get rows affected")
+	}
+	if n == 1 {
+		u.LockedUntil = until.Unix()
+	}
+
+	return n == 1, nil
+}
@@ -0,0 +1,332 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hashes used by the signing algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/pkg/errors"
+)
+
+// Leeway is the clock skew allowed when checking token times
+const Leeway = time.Minute
+
+// keyRefreshInterval limits how often the keys are reloaded when a token
+// is signed with an unknown key, so forged tokens can't be used to make
+// the app hammer the provider
+const keyRefreshInterval = time.Minute
+
+// ErrInvalidIDToken is returned for ID tokens that fail validation
+var ErrInvalidIDToken = errors.New("oidc: invalid id token")
+
+// Claims are the validated claims of an ID token
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   bool     `json:"email_verified"`
+	Name            string   `json:"name"`
+
+	// Raw holds all claims, for provider specific claims like roles
+	Raw map[string]interface{} `json:"-"`
+}
+
+// audience is the aud claim, which can be a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyIDToken checks the ID token signature against the provider's keys
+// and validates its claims (OpenID Connect Core 3.1.3.7). nonce must be the
+// nonce sent in the authorization request.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw string, nonce string) (*Claims, error) {
+	if _, err := p.Discover(ctx); err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrInvalidIDToken, "malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(ErrInvalidIDToken, "malformed header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidIDToken, "malformed signature")
+	}
+
+	keys, err := p.keys.get(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	verified := false
+	for _, key := range keys {
+		if verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.Wrap(ErrInvalidIDToken, "invalid signature")
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, errors.Wrap(ErrInvalidIDToken, "malformed claims")
+	}
+	if err := decodeSegment(parts[1], &claims.Raw); err != nil {
+		return nil, errors.Wrap(ErrInvalidIDToken, "malformed claims")
+	}
+
+	now := p.clock.Now()
+	switch {
+	case claims.Issuer != p.Issuer:
+		return nil, errors.Wrap(ErrInvalidIDToken, "wrong issuer")
+	case !claims.Audience.contains(p.ClientID):
+		return nil, errors.Wrap(ErrInvalidIDToken, "wrong audience")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return nil, errors.Wrap(ErrInvalidIDToken, "wrong authorized party")
+	case len(claims.Subject) == 0:
+		return nil, errors.Wrap(ErrInvalidIDToken, "missing subject")
+	case now.After(time.Unix(claims.Expiry, 0).Add(Leeway)):
+		return nil, errors.Wrap(ErrInvalidIDToken, "token expired")
+	case now.Add(Leeway).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, errors.Wrap(ErrInvalidIDToken, "token issued in the future")
+	case len(nonce) == 0 || claims.Nonce != nonce:
+		return nil, errors.Wrap(ErrInvalidIDToken, "wrong nonce")
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature checks a JWS signature. Only asymmetric algorithms are
+// accepted; "none" and HMAC algorithms are rejected.
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match algorithm")
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case strings.HasPrefix(alg, "ES"):
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match algorithm")
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// keySet caches the provider's signing keys from its JWKS endpoint
+type keySet struct {
+	uri    string
+	client *http.Client
+	clock  auth.Clock
+
+	mut       sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// get returns the key with the ID kid, or all keys if kid is empty. The
+// keys are reloaded when kid is unknown, to pick up rotated keys.
+func (k *keySet) get(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+
+	if k.keys == nil || (len(kid) > 0 && k.keys[kid] == nil && k.clock.Now().Sub(k.fetchedAt) >= keyRefreshInterval) {
+		if err := k.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(kid) > 0 {
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, errors.Wrap(ErrInvalidIDToken, "unknown signing key")
+		}
+		return []crypto.PublicKey{key}, nil
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (k *keySet) fetch(ctx context.Context) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, k.client, k.uri, &set); err != nil {
+		return errors.Wrap(err, "cannot load jwks")
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for i, j := range set.Keys {
+		if len(j.Use) > 0 && j.Use != "sig" {
+			continue
+		}
+		key, err := j.publicKey()
+		if err != nil {
+			// Skip key types we don't support instead of failing,
+			// the provider may publish keys for other purposes
+			continue
+		}
+		kid := j.Kid
+		if len(kid) == 0 {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		keys[kid] = key
+	}
+
+	k.keys = keys
+	k.fetchedAt = k.clock.Now()
+	return nil
+}
+
+// jwk is a JSON Web Key (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return pub, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
@@ -0,0 +1,267 @@
+// Package oidc implements an OpenID Connect relying party for the
+// authorization code flow with PKCE.
+//
+// Only what a web app login needs is supported: discovery, the
+// authorization and token endpoints, and ID token validation against the
+// provider's JWKS. Userinfo, refresh tokens and logout are not used.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/pkg/errors"
+)
+
+// Config is the configuration of a single identity provider
+type Config struct {
+	// Name identifies the provider in URLs and in linked accounts.
+	// It must not change once users have logged in with the provider.
+	Name string
+	// DisplayName is shown on the login button
+	DisplayName string
+	// Issuer is the issuer URL the discovery document is loaded from
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes are requested in addition to "openid"
+	Scopes []string
+	// RoleClaim is the ID token claim holding the user's groups or roles.
+	// Nested claims are separated by dots, e.g. "realm_access.roles".
+	RoleClaim string
+	// Roles maps RoleClaim values to app roles
+	Roles map[string]string
+}
+
+// Discovery is the subset of the provider metadata that is used
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Token is the response of the token endpoint
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Provider is a configured identity provider. The discovery document and
+// keys are loaded on first use, so an unreachable provider does not stop
+// the app from starting.
+type Provider struct {
+	Config
+
+	// RedirectURL is the callback URL registered with the provider
+	RedirectURL string
+
+	client *http.Client
+	clock  auth.Clock
+
+	mut       sync.Mutex
+	discovery *Discovery
+	keys      *keySet
+}
+
+// NewProvider returns a Provider for cfg. A nil client uses a client with
+// a 10 second timeout.
+func NewProvider(cfg Config, redirectURL string, client *http.Client, clock auth.Clock) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: time.Second * 10}
+	}
+
+	p := &Provider{
+		Config:      cfg,
+		RedirectURL: redirectURL,
+		client:      client,
+		clock:       clock,
+	}
+	p.keys = &keySet{client: client, clock: clock}
+	return p
+}
+
+// Discover returns the provider's discovery document, loading it if it
+// has not been loaded yet
+func (p *Provider) Discover(ctx context.Context) (*Discovery, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	d := &Discovery{}
+	if err := p.getJSON(ctx, u, d); err != nil {
+		return nil, errors.Wrapf(err, "cannot load discovery document of %s", p.Name)
+	}
+
+	// The issuer must match exactly so tokens from another issuer
+	// served at a similar URL are rejected (OpenID Connect Discovery 4.3)
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: issuer %q of %s does not match discovery document issuer %q", p.Issuer, p.Name, d.Issuer)
+	}
+	if len(d.AuthorizationEndpoint) == 0 || len(d.TokenEndpoint) == 0 || len(d.JWKSURI) == 0 {
+		return nil, fmt.Errorf("oidc: discovery document of %s is missing endpoints", p.Name)
+	}
+
+	p.discovery = d
+	p.keys.uri = d.JWKSURI
+	return d, nil
+}
+
+// AuthCodeURL returns the authorization endpoint URL to redirect the user
+// to. The state and nonce must be stored in the session and checked in the
+// callback, and the PKCE verifier passed to Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	d, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(append([]string{"openid"}, p.Scopes...), " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", PKCEChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades an authorization code and its PKCE verifier for tokens
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (*Token, error) {
+	d, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic requires the credentials to be form encoded first
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "token request failed")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read token response")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &e)
+		return nil, fmt.Errorf("oidc: token request failed with status %d: %s %s", resp.StatusCode, e.Error, e.Description)
+	}
+
+	token := &Token{}
+	if err := json.Unmarshal(body, token); err != nil {
+		return nil, errors.Wrap(err, "cannot decode token response")
+	}
+	if len(token.IDToken) == 0 {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+
+	return token, nil
+}
+
+// MapRoles returns the app roles the claims map to through RoleClaim and Roles
+func (p *Provider) MapRoles(c *Claims) []string {
+	if len(p.RoleClaim) == 0 {
+		return nil
+	}
+
+	var val interface{} = c.Raw
+	for _, part := range strings.Split(p.RoleClaim, ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		val = m[part]
+	}
+
+	var values []string
+	switch v := val.(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var roles []string
+	seen := map[string]bool{}
+	for _, v := range values {
+		role, ok := p.Roles[v]
+		if ok && !seen[role] {
+			roles = append(roles, role)
+			seen[role] = true
+		}
+	}
+	return roles
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	return getJSON(ctx, p.client, u, v)
+}
+
+func getJSON(ctx context.Context, client *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s returned status %d", u, resp.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
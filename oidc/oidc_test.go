@@ -0,0 +1,290 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fadeojo/brito/auth"
+	"github.com/fadeojo/brito/oidc/oidctest"
+	"github.com/pkg/errors"
+)
+
+const redirectURL = "http://app.example.com/login/oidc/test/callback"
+
+func newProvider(idp *oidctest.Server, clock auth.Clock) *Provider {
+	return NewProvider(Config{
+		Name:         "test",
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		Scopes:       []string{"email"},
+		RoleClaim:    "groups",
+		Roles:        map[string]string{"ops": "admin", "eng": "admin"},
+	}, redirectURL, nil, clock)
+}
+
+// authorize runs the authorization request against the fake IdP and
+// returns the code and state from the callback redirect
+func authorize(t *testing.T, p *Provider, state, nonce, verifier string) (string, string) {
+	t.Helper()
+
+	u, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d", resp.StatusCode)
+	}
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), redirectURL) {
+		t.Fatalf("unexpected redirect %s", loc)
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer()
+	defer idp.Close()
+	idp.Login("user-1")
+	idp.Claims["email"] = "a@example.com"
+	idp.Claims["email_verified"] = true
+	idp.Claims["groups"] = []string{"eng", "sales"}
+
+	p := newProvider(idp, auth.SystemClock)
+	verifier, _ := RandomString()
+
+	code, state := authorize(t, p, "state-1", "nonce-1", verifier)
+	if state != "state-1" {
+		t.Errorf("state not returned, got %q", state)
+	}
+
+	token, err := p.Exchange(context.Background(), code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := p.VerifyIDToken(context.Background(), token.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "a@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %#v", claims)
+	}
+
+	roles := p.MapRoles(claims)
+	if len(roles) != 1 || roles[0] != "admin" {
+		t.Errorf("expected admin role, got %v", roles)
+	}
+
+	// Codes are single use
+	if _, err := p.Exchange(context.Background(), code, verifier); err == nil {
+		t.Error("expected reused code to be rejected")
+	}
+}
+
+func TestExchangePKCE(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer()
+	defer idp.Close()
+	idp.Login("user-1")
+
+	p := newProvider(idp, auth.SystemClock)
+	verifier, _ := RandomString()
+	code, _ := authorize(t, p, "state", "nonce", verifier)
+
+	other, _ := RandomString()
+	_, err := p.Exchange(context.Background(), code, other)
+	if err == nil || !strings.Contains(err.Error(), "pkce") {
+		t.Errorf("expected pkce failure, got %v", err)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	now := time.Now()
+	clock := auth.NewFakeClock(now)
+	idp.Now = clock.Now
+	p := newProvider(idp, clock)
+	ctx := context.Background()
+
+	tests := map[string]struct {
+		token string
+		nonce string
+		ok    bool
+	}{
+		"valid":             {idp.IDToken("sub", "n", nil), "n", true},
+		"wrong nonce":       {idp.IDToken("sub", "n", nil), "other", false},
+		"empty nonce":       {idp.IDToken("sub", "", nil), "", false},
+		"wrong issuer":      {idp.IDToken("sub", "n", map[string]interface{}{"iss": "https://evil.example.com"}), "n", false},
+		"wrong audience":    {idp.IDToken("sub", "n", map[string]interface{}{"aud": "other-client"}), "n", false},
+		"multi audience":    {idp.IDToken("sub", "n", map[string]interface{}{"aud": []string{oidctest.ClientID, "x"}, "azp": oidctest.ClientID}), "n", true},
+		"missing azp":       {idp.IDToken("sub", "n", map[string]interface{}{"aud": []string{oidctest.ClientID, "x"}}), "n", false},
+		"missing subject":   {idp.IDToken("", "n", nil), "n", false},
+		"expired":           {idp.IDToken("sub", "n", map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), "n", false},
+		"expired in leeway": {idp.IDToken("sub", "n", map[string]interface{}{"exp": now.Add(-time.Second * 30).Unix()}), "n", true},
+		"issued in future":  {idp.IDToken("sub", "n", map[string]interface{}{"iat": now.Add(time.Hour).Unix()}), "n", false},
+		"malformed":         {"abc.def", "n", false},
+	}
+
+	// A token with an alg of none and no signature
+	valid := strings.Split(idp.IDToken("sub", "n", nil), ".")
+	tests["alg none"] = struct {
+		token string
+		nonce string
+		ok    bool
+	}{"eyJhbGciOiJub25lIn0." + valid[1] + ".", "n", false}
+
+	// A token with its payload swapped for another one
+	other := strings.Split(idp.IDToken("admin", "n", nil), ".")
+	tests["tampered"] = struct {
+		token string
+		nonce string
+		ok    bool
+	}{valid[0] + "." + other[1] + "." + valid[2], "n", false}
+
+	for name, test := range tests {
+		_, err := p.VerifyIDToken(ctx, test.token, test.nonce)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		} else if !test.ok && errors.Cause(err) != ErrInvalidIDToken {
+			t.Errorf("%s: expected ErrInvalidIDToken, got %v", name, err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	clock := auth.NewFakeClock(time.Now())
+	idp.Now = clock.Now
+	p := newProvider(idp, clock)
+	ctx := context.Background()
+
+	if _, err := p.VerifyIDToken(ctx, idp.IDToken("sub", "n", nil), "n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// New keys are only fetched after the refresh interval
+	idp.RotateKey("ES256")
+	token := idp.IDToken("sub", "n", nil)
+	if _, err := p.VerifyIDToken(ctx, token, "n"); errors.Cause(err) != ErrInvalidIDToken {
+		t.Errorf("expected unknown key to be rejected, got %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := p.VerifyIDToken(ctx, token, "n"); err != nil {
+		t.Errorf("expected rotated key to be fetched, got %v", err)
+	}
+	if idp.JWKSRequests() != 2 {
+		t.Errorf("expected 2 jwks requests, got %d", idp.JWKSRequests())
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	p := NewProvider(Config{
+		Name:   "test",
+		Issuer: idp.Issuer() + "/",
+	}, redirectURL, nil, auth.SystemClock)
+
+	if _, err := p.Discover(context.Background()); err == nil {
+		t.Error("expected issuer mismatch to fail discovery")
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer()
+	defer idp.Close()
+
+	p := newProvider(idp, auth.SystemClock)
+	raw, err := p.AuthCodeURL(context.Background(), "s", "n", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             oidctest.ClientID,
+		"redirect_uri":          redirectURL,
+		"scope":                 "openid email",
+		"state":                 "s",
+		"nonce":                 "n",
+		"code_challenge":        PKCEChallenge("verifier"),
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s: want %q, got %q", k, v, q.Get(k))
+		}
+	}
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	t.Parallel()
+
+	// The example from RFC 7636 appendix B
+	got := PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("unexpected challenge %s", got)
+	}
+}
+
+func TestMapRoles(t *testing.T) {
+	t.Parallel()
+
+	p := NewProvider(Config{
+		RoleClaim: "realm_access.roles",
+		Roles:     map[string]string{"superuser": "admin"},
+	}, redirectURL, nil, auth.SystemClock)
+
+	claims := &Claims{Raw: map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []interface{}{"user", "superuser"}},
+	}}
+	if roles := p.MapRoles(claims); len(roles) != 1 || roles[0] != "admin" {
+		t.Errorf("expected nested claim to map to admin, got %v", roles)
+	}
+
+	claims = &Claims{Raw: map[string]interface{}{"realm_access": "superuser"}}
+	if roles := p.MapRoles(claims); len(roles) != 0 {
+		t.Errorf("expected no roles, got %v", roles)
+	}
+}
@@ -0,0 +1,314 @@
+// Package oidctest provides an in-process OpenID Connect identity provider
+// for tests, built on httptest.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client credentials the server accepts
+const (
+	ClientID     = "test-client"
+	ClientSecret = "test-secret"
+)
+
+// Server is a fake identity provider. It serves discovery, JWKS, and the
+// authorization and token endpoints. The authorization endpoint logs in the
+// user set with Login without asking and redirects back with a code.
+type Server struct {
+	*httptest.Server
+
+	// Claims are added to every ID token, and may override the defaults
+	Claims map[string]interface{}
+	// Now is the time tokens are issued at
+	Now func() time.Time
+
+	mut     sync.Mutex
+	keys    []signingKey
+	subject string
+	codes   map[string]authRequest
+	jwksReq int
+}
+
+type signingKey struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+type authRequest struct {
+	subject     string
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+// NewServer starts a fake identity provider with one RS256 signing key.
+// Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Claims: map[string]interface{}{},
+		Now:    time.Now,
+		codes:  map[string]authRequest{},
+	}
+	s.RotateKey("RS256")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/jwks", s.jwks)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Issuer returns the issuer URL of the server
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// Login sets the subject of the user that is logged in by the
+// authorization endpoint
+func (s *Server) Login(subject string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.subject = subject
+}
+
+// JWKSRequests returns the number of requests to the JWKS endpoint
+func (s *Server) JWKSRequests() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.jwksReq
+}
+
+// RotateKey replaces the signing key with a new one for alg,
+// which is RS256 or ES256
+func (s *Server) RotateKey(alg string) {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		panic("oidctest: unsupported algorithm " + alg)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.keys = []signingKey{{kid: randomString()[:8], alg: alg, key: key}}
+}
+
+// IDToken returns an ID token for subject signed with the current key.
+// Claims are taken from s.Claims, then from claims.
+func (s *Server) IDToken(subject string, nonce string, claims map[string]interface{}) string {
+	s.mut.Lock()
+	key := s.keys[0]
+	all := map[string]interface{}{}
+	for k, v := range s.Claims {
+		all[k] = v
+	}
+	s.mut.Unlock()
+
+	now := s.Now()
+	base := map[string]interface{}{
+		"iss":   s.Issuer(),
+		"sub":   subject,
+		"aud":   ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range base {
+		if _, ok := all[k]; !ok {
+			all[k] = v
+		}
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	return Sign(key.alg, key.kid, key.key, all)
+}
+
+// Sign returns a JWS compact serialization of claims signed by key
+func Sign(alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		panic(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, sum[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.Issuer(),
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256", "ES256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.jwksReq++
+
+	var keys []map[string]string
+	for _, k := range s.keys {
+		jwk := map[string]string{"kid": k.kid, "alg": k.alg, "use": "sig"}
+		switch pub := k.key.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk["kty"] = "EC"
+			jwk["crv"] = "P-256"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32)))
+			jwk["y"] = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))
+		}
+		keys = append(keys, jwk)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI := q.Get("redirect_uri")
+	if q.Get("client_id") != ClientID || q.Get("response_type") != "code" || len(redirectURI) == 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) == 0 {
+		http.Error(w, "pkce required", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(" "+q.Get("scope")+" ", " openid ") {
+		http.Error(w, "openid scope required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	s.mut.Lock()
+	s.codes[code] = authRequest{
+		subject:     s.subject,
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		redirectURI: redirectURI,
+	}
+	s.mut.Unlock()
+
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	v := u.Query()
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	u.RawQuery = v.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != ClientID || secret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+	s.mut.Lock()
+	req, ok := s.codes[code]
+	// Codes are single use
+	delete(s.codes, code)
+	s.mut.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	switch {
+	case !ok:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "unknown code"})
+		return
+	case req.redirectURI != r.PostFormValue("redirect_uri"):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "redirect_uri mismatch"})
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != req.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "pkce verification failed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     s.IDToken(req.subject, req.nonce, nil),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
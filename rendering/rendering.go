@@ -2,22 +2,81 @@ package rendering
 
 import (
 	"html/template"
+	"io"
+	"sync"
 
 	"github.com/fadeojo/brito/app"
+	"github.com/fadeojo/brito/csrf"
+	"github.com/fadeojo/brito/tracing"
 	"github.com/unrolled/render"
 	"github.com/volatiletech/abcweb/abcrender"
 )
 
-func CustomHelpers(a *app.App) template.FuncMap {
+// Renderer wraps abcrender.Renderer to make values that belong to the
+// response being rendered, like the CSRF token, available to the template
+// helpers. unrolled/render already renders one template at a time, so
+// serializing the renders here costs nothing.
+type Renderer struct {
+	abcrender.Renderer
+
+	mut       sync.Mutex
+	csrfToken string
+}
+
+// HTML renders a HTML template
+func (r *Renderer) HTML(w io.Writer, status int, name string, binding interface{}) error {
+	span := startRender(w, name)
+	defer span.End()
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.csrfToken = csrf.Token(w)
+	err := r.Renderer.HTML(w, status, name, binding)
+	span.SetError(err)
+	return err
+}
+
+// HTMLWithLayout renders a HTML template with the given layout
+func (r *Renderer) HTMLWithLayout(w io.Writer, status int, name string, binding interface{}, layout string) error {
+	span := startRender(w, name)
+	defer span.End()
+	span.SetAttribute("template.layout", layout)
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.csrfToken = csrf.Token(w)
+	err := r.Renderer.HTMLWithLayout(w, status, name, binding, layout)
+	span.SetError(err)
+	return err
+}
+
+// startRender starts the span of rendering the template name, if the
+// request of w is traced
+func startRender(w io.Writer, name string) *tracing.Span {
+	_, span := tracing.Child(tracing.WriterContext(w), "render "+name, tracing.KindInternal)
+	span.SetAttribute("template.name", name)
+	return span
+}
+
+func CustomHelpers(a *app.App, r *Renderer) template.FuncMap {
 	return template.FuncMap{
 		"config": func() interface{} { return a.Config },
+		// csrfToken and csrfField are only called while r.mut is held by HTML
+		"csrfToken": func() string { return r.csrfToken },
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrf.DefaultFieldName + `" value="` + template.HTMLEscapeString(r.csrfToken) + `">`)
+		},
 	}
 }
 
 func New(a *app.App, templatesDir string, manifest map[string]string) abcrender.Renderer {
+	r := &Renderer{}
+
 	appHelpers := []template.FuncMap{
 		abcrender.AppHelpers(manifest),
-		CustomHelpers(a),
+		CustomHelpers(a, r),
 	}
 
 	renderOpts := render.Options{
@@ -29,5 +88,6 @@ func New(a *app.App, templatesDir string, manifest map[string]string) abcrender.
 		DisableHTTPErrorRendering: true,
 	}
 
-	return abcrender.New(renderOpts, manifest)
+	r.Renderer = abcrender.New(renderOpts, manifest)
+	return r
 }
@@ -0,0 +1,29 @@
+package reporting
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryReporter keeps the events it is sent, for tests
+type MemoryReporter struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+// Report keeps e
+func (m *MemoryReporter) Report(ctx context.Context, e *Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events = append(m.events, e)
+	return nil
+}
+
+// Events returns the events sent so far
+func (m *MemoryReporter) Events() []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*Event(nil), m.events...)
+}
@@ -0,0 +1,293 @@
+// Package reporting reports panics and the errors of failed requests to an
+// error tracker, with the request, the signed in user, the release and
+// the breadcrumbs that led to them. Events with the same fingerprint are
+// grouped, and sent once per group interval.
+package reporting
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Limits of the background sending: events that are reported while
+// queueSize are waiting are dropped, so a slow tracker can't hold up or
+// exhaust the app
+const (
+	queueSize   = 100
+	sendTimeout = time.Second * 10
+	maxGroups   = 1000
+)
+
+// Reporter sends events to where errors are tracked
+type Reporter interface {
+	Report(ctx context.Context, e *Event) error
+}
+
+// Event is a panic or error to report
+type Event struct {
+	ID    string
+	Time  time.Time
+	Level string
+	// Message describes events without an exception
+	Message   string
+	Exception *Exception
+	Request   *Request
+	UserID    string
+	// Release and Environment are of the Client if not set
+	Release     string
+	Environment string
+	ServerName  string
+	// Tags are indexed by the tracker, like the request_id and route
+	Tags map[string]string
+	// Extra is shown with the event, like the number of events of its group
+	// that were not sent
+	Extra       map[string]interface{}
+	Fingerprint string
+	Breadcrumbs []Breadcrumb
+}
+
+// Exception is the error of an event, with the stack it happened at, the
+// outermost call first
+type Exception struct {
+	Type   string
+	Value  string
+	Frames []Frame
+}
+
+// Request is the HTTP request of an event
+type Request struct {
+	Method  string
+	URL     string
+	Query   string
+	Headers map[string]string
+	// RemoteAddr is the address of the client
+	RemoteAddr string
+}
+
+// Breadcrumb is something that happened before an event, like a log line
+type Breadcrumb struct {
+	Time     time.Time
+	Category string
+	Level    string
+	Message  string
+	Data     map[string]interface{}
+}
+
+// Client fills in the events and sends them to the Reporter in the
+// background, once per GroupInterval for every fingerprint
+type Client struct {
+	Reporter    Reporter
+	Release     string
+	Environment string
+	ServerName  string
+	// GroupInterval is how long further events with the fingerprint of a
+	// sent one are only counted, zero sends all events
+	GroupInterval time.Duration
+	// Redact are the query parameters whose values are filtered from the
+	// reported requests
+	Redact []string
+
+	log   *zap.Logger
+	queue chan *Event
+	done  chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+	groups  map[string]*group
+	// pruneAt is when the oldest of the maxGroups groups expires, before
+	// which pruning them frees none
+	pruneAt time.Time
+}
+
+// group counts the events of a fingerprint since the last one was sent
+type group struct {
+	sent       time.Time
+	suppressed int
+}
+
+// Default is the client of Capture and the middleware. It reports nothing
+// until it is replaced with NewClient.
+var Default = &Client{}
+
+// NewClient returns a client that sends to rep in the background, logging
+// failures to log. Set the fields before the first event is captured.
+func NewClient(rep Reporter, log *zap.Logger) *Client {
+	c := &Client{
+		Reporter: rep,
+		log:      log,
+		queue:    make(chan *Event, queueSize),
+		done:     make(chan struct{}),
+		groups:   make(map[string]*group),
+	}
+	go c.run()
+	return c
+}
+
+// Enabled reports whether c sends events
+func (c *Client) Enabled() bool {
+	return c.queue != nil
+}
+
+// Capture reports e, filling in its ID, time, release, environment and
+// fingerprint if not set. It doesn't wait for e to be sent.
+func (c *Client) Capture(e *Event) {
+	if !c.Enabled() {
+		return
+	}
+
+	if len(e.ID) == 0 {
+		e.ID = newID()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if len(e.Level) == 0 {
+		e.Level = "error"
+	}
+	if len(e.Release) == 0 {
+		e.Release = c.Release
+	}
+	if len(e.Environment) == 0 {
+		e.Environment = c.Environment
+	}
+	if len(e.ServerName) == 0 {
+		e.ServerName = c.ServerName
+	}
+	if len(e.Fingerprint) == 0 {
+		e.Fingerprint = fingerprint(e)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	if !c.admit(e) {
+		return
+	}
+	select {
+	case c.queue <- e:
+	default:
+		c.dropped++
+	}
+}
+
+// admit reports whether e is sent rather than counted in its group, and
+// adds the count of the group to it
+func (c *Client) admit(e *Event) bool {
+	if c.GroupInterval <= 0 {
+		return true
+	}
+
+	g, ok := c.groups[e.Fingerprint]
+	if ok && e.Time.Sub(g.sent) < c.GroupInterval {
+		g.suppressed++
+		return false
+	}
+	if !ok {
+		if len(c.groups) >= maxGroups && !e.Time.Before(c.pruneAt) {
+			c.pruneGroups(e.Time)
+		}
+		// The events of new fingerprints are sent without a group while
+		// all groups are in their interval, so there are at most maxGroups
+		if len(c.groups) >= maxGroups {
+			return true
+		}
+		g = &group{}
+		c.groups[e.Fingerprint] = g
+	}
+	if g.suppressed > 0 {
+		if e.Extra == nil {
+			e.Extra = make(map[string]interface{})
+		}
+		e.Extra["suppressed"] = g.suppressed
+	}
+	g.sent, g.suppressed = e.Time, 0
+	return true
+}
+
+// pruneGroups forgets the groups past their interval, and sets pruneAt to
+// when the oldest of the others expires. The counts of suppressed events
+// of the forgotten groups are lost.
+func (c *Client) pruneGroups(now time.Time) {
+	c.pruneAt = time.Time{}
+	for fp, g := range c.groups {
+		expires := g.sent.Add(c.GroupInterval)
+		if !now.Before(expires) {
+			delete(c.groups, fp)
+		} else if c.pruneAt.IsZero() || expires.Before(c.pruneAt) {
+			c.pruneAt = expires
+		}
+	}
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+
+	for e := range c.queue {
+		c.mu.Lock()
+		dropped := c.dropped
+		c.dropped = 0
+		c.mu.Unlock()
+		if dropped > 0 {
+			c.log.Warn("error events dropped, the reporter can't keep up", zap.Int("dropped", dropped))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		if err := c.Reporter.Report(ctx, e); err != nil {
+			c.log.Warn("cannot report error event", zap.String("event_id", e.ID), zap.Error(err))
+		}
+		cancel()
+	}
+}
+
+// Shutdown sends the captured events and stops sending, waiting at most
+// until ctx is done
+func (c *Client) Shutdown(ctx context.Context) error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "cannot send the remaining error events")
+	}
+}
+
+// CaptureError reports err with the Default client, with the request and
+// breadcrumbs of the scope of ctx if there is one. Use it for errors that
+// don't fail the request, or outside of requests.
+func CaptureError(ctx context.Context, err error) {
+	if !Default.Enabled() || err == nil {
+		return
+	}
+	e := &Event{Exception: newException(err)}
+	if s := scopeFromContext(ctx); s != nil {
+		s.fill(e, Default.Redact)
+	}
+	Default.Capture(e)
+}
+
+// newID returns a random event ID, 32 hex characters
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
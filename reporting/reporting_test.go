@@ -0,0 +1,309 @@
+package reporting
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// withDefault replaces the Default client with one that keeps the events
+// in memory, and returns its events once shut down
+func withDefault(t *testing.T) func() []*Event {
+	t.Helper()
+
+	mem := &MemoryReporter{}
+	old := Default
+	Default = NewClient(mem, zap.NewNop())
+	Default.Release = "v1"
+	Default.Environment = "test"
+	Default.Redact = []string{"token"}
+	t.Cleanup(func() { Default = old })
+
+	return func() []*Event {
+		if err := Default.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return mem.Events()
+	}
+}
+
+// newRouter returns a router with the middleware of the app in front of
+// Middleware
+func newRouter() *chi.Mux {
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	m := abcmiddleware.Middleware{Log: zap.New(zapcore.NewCore(enc, zapcore.AddSync(ioutil.Discard), zap.DebugLevel))}
+	router := chi.NewRouter()
+	router.Use(chimiddleware.RequestID, m.RequestIDLogger, m.Recover, Middleware)
+	return router
+}
+
+// errorAt returns an error with the stack of the call, so all errors it
+// returns are of the same place
+func errorAt(msg string) error {
+	return errors.New(msg)
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	events := withDefault(t)
+
+	router := newRouter()
+	router.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		SetUser(r.Context(), "7")
+		abcmiddleware.Log(r).Info("loading user", zap.String("id", chi.URLParam(r, "id")))
+		panic(errorAt("boom"))
+	})
+
+	r := httptest.NewRequest("GET", "/users/7?token=secret&page=2", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("X-CSRF-Token", "secret")
+	r.Header.Set("User-Agent", "test")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected the recovery middleware to answer, got %d", w.Code)
+	}
+
+	list := events()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(list))
+	}
+	e := list[0]
+	if e.Level != "fatal" || e.Release != "v1" || e.Environment != "test" || e.UserID != "7" || len(e.ID) != 32 {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if e.Exception == nil || e.Exception.Type != "*errors.fundamental" || e.Exception.Value != "boom" {
+		t.Fatalf("unexpected exception %+v", e.Exception)
+	}
+	frames := e.Exception.Frames
+	if last := frames[len(frames)-1]; !last.InApp || !strings.HasPrefix(last.Function, "TestMiddlewarePanic.") {
+		t.Errorf("expected the stack to end in the handler, got %+v", last)
+	}
+
+	if e.Request.URL != "http://example.com/users/7" || e.Request.Query != "page=2&token=%5BFiltered%5D" {
+		t.Errorf("unexpected request %+v", e.Request)
+	}
+	if len(e.Request.Headers) != 1 || e.Request.Headers["User-Agent"] != "test" {
+		t.Errorf("unexpected headers %v", e.Request.Headers)
+	}
+	if e.Tags["route"] != "/users/{id}" || len(e.Tags["request_id"]) == 0 {
+		t.Errorf("unexpected tags %v", e.Tags)
+	}
+	if len(e.Breadcrumbs) != 1 || e.Breadcrumbs[0].Message != "loading user" || e.Breadcrumbs[0].Data["id"] != "7" {
+		t.Errorf("unexpected breadcrumbs %+v", e.Breadcrumbs)
+	}
+}
+
+func TestMiddlewareErrors(t *testing.T) {
+	events := withDefault(t)
+
+	errForbidden := errors.New("forbidden")
+	handler := func(ctrl abcmiddleware.AppHandler) http.HandlerFunc {
+		// Like the error manager, which answers known errors
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := Errors(ctrl)(w, r); err == errForbidden {
+				w.WriteHeader(http.StatusForbidden)
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+	}
+
+	router := newRouter()
+	router.Get("/fail", handler(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.Wrap(errorAt("connection refused"), "cannot load")
+	}))
+	router.Get("/forbidden", handler(func(w http.ResponseWriter, r *http.Request) error {
+		return errForbidden
+	}))
+	router.Get("/unavailable", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	for _, path := range []string{"/fail", "/forbidden", "/unavailable"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	// Only the error that ended in a 5xx
+	list := events()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(list))
+	}
+	e := list[0]
+	if e.Level != "error" || e.Exception.Value != "cannot load: connection refused" || e.Tags["status"] != "500" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	// The stack is of where the error was made, not wrapped
+	if last := e.Exception.Frames[len(e.Exception.Frames)-1]; last.Function != "errorAt" {
+		t.Errorf("expected the stack of the cause, got %+v", last)
+	}
+}
+
+func TestClientGroups(t *testing.T) {
+	t.Parallel()
+
+	mem := &MemoryReporter{}
+	c := NewClient(mem, zap.NewNop())
+	c.GroupInterval = time.Minute
+
+	now := time.Now()
+	capture := func(err error, at time.Duration) {
+		c.Capture(&Event{Time: now.Add(at), Exception: newException(err)})
+	}
+	// The same place groups different messages
+	capture(errorAt("user 1 not found"), 0)
+	capture(errorAt("user 2 not found"), time.Second)
+	capture(errorAt("user 3 not found"), time.Second*2)
+	capture(errors.New("other"), time.Second*3)
+	capture(errorAt("user 4 not found"), time.Minute)
+	c.Shutdown(context.Background())
+
+	list := mem.Events()
+	if len(list) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(list))
+	}
+	if list[0].Fingerprint != list[2].Fingerprint || list[0].Fingerprint == list[1].Fingerprint {
+		t.Error("expected the events of errorAt to have a fingerprint of their own")
+	}
+	if list[2].Extra["suppressed"] != 2 {
+		t.Errorf("expected 2 suppressed events, got %v", list[2].Extra)
+	}
+
+	// Nothing is captured after Shutdown, or without a reporter
+	c.Capture(&Event{Message: "late"})
+	(&Client{}).Capture(&Event{Message: "off"})
+	if len(mem.Events()) != 3 {
+		t.Error("expected no more events")
+	}
+}
+
+func TestClientGroupsFull(t *testing.T) {
+	t.Parallel()
+
+	c := NewClient(&MemoryReporter{}, zap.NewNop())
+	c.GroupInterval = time.Minute
+	defer c.Shutdown(context.Background())
+
+	now := time.Now()
+	for i := 0; i < maxGroups; i++ {
+		c.admit(&Event{Time: now, Fingerprint: strconv.Itoa(i)})
+	}
+
+	// Without a group to take the place of, new fingerprints are sent
+	// untracked
+	for i := 0; i < 2; i++ {
+		if !c.admit(&Event{Time: now.Add(time.Second), Fingerprint: "new"}) {
+			t.Errorf("%d: expected the event of a new fingerprint to be sent", i)
+		}
+	}
+	if len(c.groups) != maxGroups || !c.pruneAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected %d groups until %s, got %d until %s", maxGroups, now.Add(time.Minute), len(c.groups), c.pruneAt)
+	}
+
+	// The expired groups make room
+	if !c.admit(&Event{Time: now.Add(time.Minute), Fingerprint: "new"}) {
+		t.Error("expected the event to be sent")
+	}
+	if c.admit(&Event{Time: now.Add(time.Minute), Fingerprint: "new"}) || len(c.groups) != 1 {
+		t.Errorf("expected the new fingerprint to be grouped, got %d groups", len(c.groups))
+	}
+}
+
+func TestSentryReporter(t *testing.T) {
+	t.Parallel()
+
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sentry/api/42/store/" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("X-Sentry-Auth"); !strings.Contains(auth, "sentry_key=public") || !strings.Contains(auth, "sentry_version=7") {
+			t.Errorf("unexpected auth %q", auth)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer srv.Close()
+
+	rep, err := NewSentryReporter(strings.Replace(srv.URL, "http://", "http://public@", 1) + "/sentry/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Event{
+		ID:          "abc",
+		Time:        time.Now(),
+		Level:       "error",
+		Exception:   newException(errorAt("boom")),
+		Request:     &Request{Method: "GET", URL: "http://example.com/", RemoteAddr: "10.0.0.1:1234"},
+		UserID:      "7",
+		Release:     "v1",
+		Fingerprint: "fp",
+		Breadcrumbs: []Breadcrumb{{Time: time.Now(), Category: "log", Level: "warn", Message: "slow query"}},
+	}
+	if err := rep.Report(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+
+	exception := got["exception"].(map[string]interface{})["values"].([]interface{})[0].(map[string]interface{})
+	frames := exception["stacktrace"].(map[string]interface{})["frames"].([]interface{})
+	if exception["value"] != "boom" || len(frames) == 0 {
+		t.Errorf("unexpected exception %v", exception)
+	}
+	user := got["user"].(map[string]interface{})
+	if user["id"] != "7" || user["ip_address"] != "10.0.0.1" {
+		t.Errorf("unexpected user %v", user)
+	}
+	crumb := got["breadcrumbs"].(map[string]interface{})["values"].([]interface{})[0].(map[string]interface{})
+	if crumb["level"] != "warning" || got["release"] != "v1" || got["fingerprint"].([]interface{})[0] != "fp" {
+		t.Errorf("unexpected event %v", got)
+	}
+
+	for _, dsn := range []string{"http://sentry.example.com/42", "http://public@sentry.example.com/", "::"} {
+		if _, err := NewSentryReporter(dsn); err == nil {
+			t.Errorf("%s: expected an error", dsn)
+		}
+	}
+}
+
+func TestBreadcrumbsSampled(t *testing.T) {
+	events := withDefault(t)
+
+	// The sampler logs the first entry of a message every second
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	core := zapcore.NewSampler(zapcore.NewCore(enc, zapcore.AddSync(ioutil.Discard), zap.InfoLevel), time.Second, 1, 0)
+	m := abcmiddleware.Middleware{Log: zap.New(core)}
+	router := chi.NewRouter()
+	router.Use(chimiddleware.RequestID, m.RequestIDLogger, m.Recover, Middleware)
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		log := abcmiddleware.Log(r)
+		log.Debug("below the level")
+		for i := 0; i < 3; i++ {
+			log.Info("polling")
+		}
+		panic(errorAt("boom"))
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	list := events()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(list))
+	}
+	if crumbs := list[0].Breadcrumbs; len(crumbs) != 1 || crumbs[0].Message != "polling" {
+		t.Errorf("expected the logged entry only, got %+v", crumbs)
+	}
+}
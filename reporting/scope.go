@@ -0,0 +1,254 @@
+package reporting
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fadeojo/brito/logging"
+	"github.com/fadeojo/brito/tracing"
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// maxBreadcrumbs are kept of every request, the oldest are dropped
+const maxBreadcrumbs = 50
+
+// filtered replaces the values of secrets in the reported requests
+const filtered = "[Filtered]"
+
+// scope collects what is reported with the errors of a request
+type scope struct {
+	r *http.Request
+
+	mu          sync.Mutex
+	userID      string
+	err         error
+	breadcrumbs []Breadcrumb
+}
+
+type ctxScopeKey struct{}
+
+func scopeFromContext(ctx context.Context) *scope {
+	s, _ := ctx.Value(ctxScopeKey{}).(*scope)
+	return s
+}
+
+// SetUser sets the ID of the signed in user of the request of ctx
+func SetUser(ctx context.Context, id string) {
+	if s := scopeFromContext(ctx); s != nil {
+		s.mu.Lock()
+		s.userID = id
+		s.mu.Unlock()
+	}
+}
+
+// AddBreadcrumb adds b to the breadcrumbs of the request of ctx. The log
+// lines of the request logger are added already.
+func AddBreadcrumb(ctx context.Context, b Breadcrumb) {
+	if s := scopeFromContext(ctx); s != nil {
+		if b.Time.IsZero() {
+			b.Time = time.Now()
+		}
+		s.add(b)
+	}
+}
+
+func (s *scope) add(b Breadcrumb) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.breadcrumbs) == maxBreadcrumbs {
+		copy(s.breadcrumbs, s.breadcrumbs[1:])
+		s.breadcrumbs = s.breadcrumbs[:maxBreadcrumbs-1]
+	}
+	s.breadcrumbs = append(s.breadcrumbs, b)
+}
+
+// fill adds the request, user and breadcrumbs of the scope to e
+func (s *scope) fill(e *Event, redact []string) {
+	r := s.r
+	e.Request = &Request{
+		Method:     r.Method,
+		URL:        requestURL(r),
+		Query:      redactQuery(r.URL.RawQuery, redact),
+		Headers:    make(map[string]string, len(r.Header)),
+		RemoteAddr: r.RemoteAddr,
+	}
+	for name := range r.Header {
+		if !logging.SecretHeaders[http.CanonicalHeaderKey(name)] {
+			e.Request.Headers[name] = r.Header.Get(name)
+		}
+	}
+
+	if e.Tags == nil {
+		e.Tags = make(map[string]string)
+	}
+	if id := chimiddleware.GetReqID(r.Context()); len(id) > 0 {
+		e.Tags["request_id"] = id
+	}
+	if span := tracing.SpanFromContext(r.Context()); span != nil {
+		e.Tags["trace_id"] = span.Context.TraceID.String()
+	}
+	if rctx, ok := r.Context().Value(chi.RouteCtxKey).(*chi.Context); ok && len(rctx.RoutePatterns) > 0 {
+		e.Tags["route"] = rctx.RoutePattern()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.UserID = s.userID
+	e.Breadcrumbs = append([]Breadcrumb(nil), s.breadcrumbs...)
+}
+
+// requestURL returns the URL of r without the query
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.EscapedPath()
+}
+
+// redactQuery filters the values of the redact parameters from query
+func redactQuery(query string, redact []string) string {
+	if len(query) == 0 || len(redact) == 0 {
+		return query
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return filtered
+	}
+	for _, name := range redact {
+		for i := range values[name] {
+			values[name][i] = filtered
+		}
+	}
+	return values.Encode()
+}
+
+// Middleware reports the panics of requests with the Default client, and
+// the errors of controllers wrapped with Errors whose response is a 5xx.
+// The panics are passed on for the recovery middleware to log and answer.
+// It adds the log lines of the request logger to the breadcrumbs, so it
+// has to run after the middleware that sets it.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := Default
+		if !c.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s := &scope{}
+		ctx := context.WithValue(r.Context(), ctxScopeKey{}, s)
+		if log, ok := ctx.Value(abcmiddleware.CtxLoggerKey).(*zap.Logger); ok {
+			log = log.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+				return breadcrumbCore{Core: core, scope: s}
+			}))
+			ctx = context.WithValue(ctx, abcmiddleware.CtxLoggerKey, log)
+		}
+		r = r.WithContext(ctx)
+		s.r = r
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		defer func() {
+			if v := recover(); v != nil {
+				if v != http.ErrAbortHandler {
+					e := &Event{Level: "fatal", Exception: panicException(v)}
+					s.fill(e, c.Redact)
+					c.Capture(e)
+				}
+				panic(v)
+			}
+		}()
+
+		next.ServeHTTP(ww, r)
+
+		s.mu.Lock()
+		err := s.err
+		s.mu.Unlock()
+		if err != nil && ww.Status() >= 500 {
+			e := &Event{Exception: newException(err)}
+			e.Tags = map[string]string{"status": strconv.Itoa(ww.Status())}
+			s.fill(e, c.Redact)
+			c.Capture(e)
+		}
+	})
+}
+
+// Errors wraps a controller so that its errors are reported by Middleware
+// if the error manager responds with a 5xx, like for unhandled errors
+func Errors(ctrl abcmiddleware.AppHandler) abcmiddleware.AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		err := ctrl(w, r)
+		if err != nil {
+			if s := scopeFromContext(r.Context()); s != nil {
+				s.mu.Lock()
+				s.err = err
+				s.mu.Unlock()
+			}
+		}
+		return err
+	}
+}
+
+// breadcrumbCore adds the entries of the request logger to the
+// breadcrumbs of the request
+type breadcrumbCore struct {
+	zapcore.Core
+	scope *scope
+}
+
+func (c breadcrumbCore) With(fields []zapcore.Field) zapcore.Core {
+	return breadcrumbCore{Core: c.Core.With(fields), scope: c.scope}
+}
+
+func (c breadcrumbCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	// Only the entries the core writes are breadcrumbs, so a sampler or
+	// level of the core drops them from both. The core is checked once, as
+	// a sampler counts every check.
+	checked := c.Core.Check(ent, nil)
+	if checked == nil {
+		return ce
+	}
+	return ce.AddCore(ent, checkedCore{breadcrumbCore: c, checked: checked})
+}
+
+func (c breadcrumbCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	c.add(ent, fields)
+	return c.Core.Write(ent, fields)
+}
+
+// add adds an entry to the breadcrumbs
+func (c breadcrumbCore) add(ent zapcore.Entry, fields []zapcore.Field) {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	c.scope.add(Breadcrumb{
+		Time:     ent.Time,
+		Category: "log",
+		Level:    ent.Level.String(),
+		Message:  ent.Message,
+		Data:     enc.Fields,
+	})
+}
+
+// checkedCore writes an entry that the core of a breadcrumbCore accepted
+// to the breadcrumbs and to the cores the core checked it for
+type checkedCore struct {
+	breadcrumbCore
+	checked *zapcore.CheckedEntry
+}
+
+func (c checkedCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	c.add(ent, fields)
+	c.checked.Write(fields...)
+	return nil
+}
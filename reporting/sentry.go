@@ -0,0 +1,220 @@
+package reporting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SentryReporter sends events to the store endpoint of Sentry, or of a
+// tracker that speaks its protocol, like GlitchTip
+type SentryReporter struct {
+	Client *http.Client
+
+	endpoint string
+	auth     string
+}
+
+// NewSentryReporter returns the reporter of a Sentry DSN, like
+// https://<key>@sentry.example.com/<project>
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sentry dsn")
+	}
+	if u.User == nil || len(u.User.Username()) == 0 {
+		return nil, errors.New("invalid sentry dsn: no public key")
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if slash < 0 || slash == len(u.Path)-1 {
+		return nil, errors.New("invalid sentry dsn: no project id")
+	}
+	path, project := u.Path[:slash], u.Path[slash+1:]
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=brito/1.0, sentry_key=%s", u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	return &SentryReporter{
+		Client:   &http.Client{},
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path, project),
+		auth:     auth,
+	}, nil
+}
+
+// Report sends e
+func (s *SentryReporter) Report(ctx context.Context, e *Event) error {
+	body, err := json.Marshal(newSentryEvent(e))
+	if err != nil {
+		return errors.Wrap(err, "cannot encode event")
+	}
+
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "cannot send event")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("sentry responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sentryEvent is an event of the Sentry store API
+type sentryEvent struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   string                 `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Platform    string                 `json:"platform"`
+	Message     string                 `json:"message,omitempty"`
+	Exception   *sentryValues          `json:"exception,omitempty"`
+	Request     *sentryRequest         `json:"request,omitempty"`
+	User        *sentryUser            `json:"user,omitempty"`
+	Release     string                 `json:"release,omitempty"`
+	Environment string                 `json:"environment,omitempty"`
+	ServerName  string                 `json:"server_name,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+	Fingerprint []string               `json:"fingerprint,omitempty"`
+	Breadcrumbs *sentryValues          `json:"breadcrumbs,omitempty"`
+}
+
+type sentryValues struct {
+	Values interface{} `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	AbsPath  string `json:"abs_path,omitempty"`
+	Lineno   int    `json:"lineno,omitempty"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryRequest struct {
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type sentryUser struct {
+	ID        string `json:"id,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+type sentryBreadcrumb struct {
+	Timestamp string                 `json:"timestamp"`
+	Category  string                 `json:"category,omitempty"`
+	Level     string                 `json:"level,omitempty"`
+	Message   string                 `json:"message,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// sentryLevels are the Sentry names of the zap levels of breadcrumbs
+var sentryLevels = map[string]string{"warn": "warning", "dpanic": "error", "panic": "fatal"}
+
+func newSentryEvent(e *Event) *sentryEvent {
+	se := &sentryEvent{
+		EventID:     e.ID,
+		Timestamp:   e.Time.UTC().Format(time.RFC3339Nano),
+		Level:       e.Level,
+		Platform:    "go",
+		Message:     e.Message,
+		Release:     e.Release,
+		Environment: e.Environment,
+		ServerName:  e.ServerName,
+		Tags:        e.Tags,
+		Extra:       e.Extra,
+	}
+	if len(e.Fingerprint) > 0 {
+		se.Fingerprint = []string{e.Fingerprint}
+	}
+
+	if ex := e.Exception; ex != nil {
+		sx := sentryException{Type: ex.Type, Value: ex.Value}
+		if len(ex.Frames) > 0 {
+			sx.Stacktrace = &sentryStacktrace{}
+			for _, f := range ex.Frames {
+				sx.Stacktrace.Frames = append(sx.Stacktrace.Frames, sentryFrame{
+					Function: f.Function,
+					Module:   f.Package,
+					AbsPath:  f.File,
+					Lineno:   f.Line,
+					InApp:    f.InApp,
+				})
+			}
+		}
+		se.Exception = &sentryValues{Values: []sentryException{sx}}
+	}
+
+	if r := e.Request; r != nil {
+		se.Request = &sentryRequest{Method: r.Method, URL: r.URL, QueryString: r.Query, Headers: r.Headers}
+	}
+	if len(e.UserID) > 0 || e.Request != nil {
+		se.User = &sentryUser{ID: e.UserID}
+		if e.Request != nil {
+			se.User.IPAddress = remoteIP(e.Request.RemoteAddr)
+		}
+	}
+
+	if len(e.Breadcrumbs) > 0 {
+		list := make([]sentryBreadcrumb, len(e.Breadcrumbs))
+		for i, b := range e.Breadcrumbs {
+			level := b.Level
+			if l, ok := sentryLevels[level]; ok {
+				level = l
+			}
+			list[i] = sentryBreadcrumb{
+				Timestamp: b.Time.UTC().Format(time.RFC3339Nano),
+				Category:  b.Category,
+				Level:     level,
+				Message:   b.Message,
+				Data:      b.Data,
+			}
+		}
+		se.Breadcrumbs = &sentryValues{Values: list}
+	}
+	return se
+}
+
+// remoteIP returns the IP of a remote address, empty for unix sockets
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
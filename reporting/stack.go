@@ -0,0 +1,160 @@
+package reporting
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxFrames caps the stack of an event
+const maxFrames = 64
+
+// Frame is a function call of a stack
+type Frame struct {
+	Function string
+	Package  string
+	File     string
+	Line     int
+	// InApp is set for the code of the app, not of its dependencies and Go
+	InApp bool
+}
+
+// appPackage is the import path prefix of the packages of the app, like
+// github.com/fadeojo/brito/
+var appPackage = strings.TrimSuffix(reflect.TypeOf(Frame{}).PkgPath(), "reporting")
+
+// stackTracer is an error of github.com/pkg/errors with the stack it was
+// created or wrapped at
+type stackTracer interface {
+	StackTrace() errors.StackTrace
+}
+
+// newException returns the exception of err, with the stack of the
+// innermost error that has one. The type is of the cause of err.
+func newException(err error) *Exception {
+	ex := &Exception{
+		Type:  fmt.Sprintf("%T", errors.Cause(err)),
+		Value: err.Error(),
+	}
+
+	var st stackTracer
+	for e := err; e != nil; {
+		if s, ok := e.(stackTracer); ok {
+			st = s
+		}
+		c, ok := e.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		e = c.Cause()
+	}
+	if st != nil {
+		trace := st.StackTrace()
+		pcs := make([]uintptr, len(trace))
+		for i, f := range trace {
+			pcs[i] = uintptr(f)
+		}
+		ex.Frames = frames(pcs)
+	}
+	return ex
+}
+
+// panicException returns the exception of a recovered panic v, with the
+// stack of the panic. It has to be called by the deferred function that
+// recovered.
+func panicException(v interface{}) *Exception {
+	ex := &Exception{Type: "panic", Value: fmt.Sprint(v)}
+	if err, ok := v.(error); ok {
+		ex.Type = fmt.Sprintf("%T", errors.Cause(err))
+	}
+
+	pcs := make([]uintptr, maxFrames+16)
+	pcs = pcs[:runtime.Callers(2, pcs)]
+	all := frames(pcs)
+	// Keep the frames of the function that panicked and its callers
+	for i, f := range all {
+		if f.Package == "runtime" && f.Function == "gopanic" {
+			all = all[:i]
+			break
+		}
+	}
+	ex.Frames = all
+	return ex
+}
+
+// frames returns the frames of the program counters, the outermost call
+// first like trackers show them
+func frames(pcs []uintptr) []Frame {
+	var list []Frame
+	iter := runtime.CallersFrames(pcs)
+	for {
+		f, more := iter.Next()
+		if len(f.Function) > 0 {
+			list = append(list, newFrame(f))
+		}
+		if !more || len(list) == maxFrames {
+			break
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
+
+func newFrame(f runtime.Frame) Frame {
+	pkg, fn := splitFunction(f.Function)
+	return Frame{
+		Function: fn,
+		Package:  pkg,
+		File:     f.File,
+		Line:     f.Line,
+		InApp:    strings.HasPrefix(pkg, appPackage) && !strings.Contains(pkg, "/vendor/"),
+	}
+}
+
+// splitFunction splits a function name like
+// github.com/fadeojo/brito/controllers.(*Main).Home into the package and
+// the function
+func splitFunction(name string) (string, string) {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		return name[:slash+1+dot], name[slash+1+dot+1:]
+	}
+	return "", name
+}
+
+// fingerprint groups the events of the same error at the same place: the
+// exception type and the functions of the app in its stack, all functions
+// if there are none, or the message without a stack. Lines are left out,
+// so events stay grouped across releases that move the code.
+func fingerprint(e *Event) string {
+	h := sha1.New()
+	if e.Exception == nil {
+		fmt.Fprintf(h, "message\n%s\n", e.Message)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	fmt.Fprintf(h, "%s\n", e.Exception.Type)
+	app := false
+	for _, f := range e.Exception.Frames {
+		if f.InApp {
+			app = true
+			fmt.Fprintf(h, "%s.%s\n", f.Package, f.Function)
+		}
+	}
+	if !app {
+		for _, f := range e.Exception.Frames {
+			fmt.Fprintf(h, "%s.%s\n", f.Package, f.Function)
+		}
+	}
+	if len(e.Exception.Frames) == 0 {
+		fmt.Fprintf(h, "%s\n", e.Exception.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+
+	"github.com/fadeojo/brito/app"
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+)
+
+// NewAdminRouter creates the router of the admin listener. It serves the
+// operator endpoints that must not be reachable through the public router:
+//
+//	/debug/pprof/  the net/http/pprof profiles
+//	/debug/vars    the expvar variables
+//	/metrics       the Prometheus metrics, if enabled
+//	/log/level     the log level, GET to read it and PUT {"level":"debug"}
+//	               to change it
+//	/routes        the routes of the public router
+func NewAdminRouter(a *app.App) *chi.Mux {
+	router := chi.NewRouter()
+	router.Use(chimiddleware.Recoverer)
+
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "/debug/pprof/\n/debug/vars\n/metrics\n/log/level\n/routes")
+	})
+
+	router.HandleFunc("/debug/pprof/*", pprof.Index)
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	router.Get("/debug/pprof", http.RedirectHandler("/debug/pprof/", http.StatusMovedPermanently).ServeHTTP)
+	router.Handle("/debug/vars", expvar.Handler())
+
+	if a.Metrics != nil {
+		router.Get("/metrics", a.Metrics.ServeHTTP)
+	}
+
+	router.Handle("/log/level", a.LogLevel)
+
+	router.Get("/routes", func(w http.ResponseWriter, r *http.Request) {
+		lines, err := RouteList(a.Router)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	})
+
+	return router
+}
+
+// RouteList returns the routes of router as "METHOD /pattern" lines,
+// sorted by pattern and method
+func RouteList(router chi.Routes) ([]string, error) {
+	type route struct{ method, pattern string }
+	var list []route
+	err := chi.Walk(router, func(method string, pattern string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		list = append(list, route{method, pattern})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].pattern != list[j].pattern {
+			return list[i].pattern < list[j].pattern
+		}
+		return list[i].method < list[j].method
+	})
+	lines := make([]string, len(list))
+	for i, r := range list {
+		lines[i] = r.method + " " + r.pattern
+	}
+	return lines, nil
+}
@@ -0,0 +1,52 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fadeojo/brito/app"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestAdminRouter(t *testing.T) {
+	t.Parallel()
+
+	public := chi.NewRouter()
+	public.Get("/login", func(w http.ResponseWriter, r *http.Request) {})
+	public.Post("/login", func(w http.ResponseWriter, r *http.Request) {})
+	public.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	a := &app.App{Config: &app.Config{}, Router: public, LogLevel: zap.NewAtomicLevel()}
+	admin := NewAdminRouter(a)
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/routes", nil))
+	if got, want := w.Body.String(), "GET /\nGET /login\nPOST /login\n"; got != want {
+		t.Errorf("expected routes %q, got %q", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("PUT", "/log/level", strings.NewReader(`{"level":"warn"}`)))
+	if w.Code != http.StatusOK || a.LogLevel.Level() != zapcore.WarnLevel {
+		t.Errorf("expected the level to change, got %d %s", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/vars"} {
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", path, w.Code)
+		}
+	}
+
+	// Without metrics there is no /metrics
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
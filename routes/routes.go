@@ -6,14 +6,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/fadeojo/brito/app"
+	"github.com/fadeojo/brito/auth"
 	"github.com/fadeojo/brito/controllers"
+	"github.com/fadeojo/brito/csrf"
+	"github.com/fadeojo/brito/reporting"
+	"github.com/fadeojo/brito/tracing"
 	"github.com/go-chi/chi"
-	"github.com/rs/cors"
 	"github.com/volatiletech/abcweb/abcmiddleware"
 	"github.com/volatiletech/abcweb/abcserver"
-	"gopkg.in/olahol/melody.v1"
 )
 
 // FileServer sets up a http.FileServer handler to serve
@@ -39,21 +42,6 @@ func FileServer(r chi.Router, path string, root http.FileSystem) {
 // NewRouter creates a new router
 func NewRouter(a *app.App, middlewares []abcmiddleware.MiddlewareFunc) *chi.Mux {
 	router := chi.NewRouter()
-	m := melody.New()
-
-	// Basic CORS
-	// for more ideas, see: https://developer.github.com/v3/#cross-origin-resource-sharing
-	cors := cors.New(cors.Options{
-		// AllowedOrigins: []string{"https://foo.com"}, // Use this to allow specific origin hosts
-		AllowedOrigins: []string{"*"},
-		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
-	})
-	router.Use(cors.Handler)
 
 	for _, middleware := range middlewares {
 		router.Use(middleware)
@@ -61,7 +49,8 @@ func NewRouter(a *app.App, middlewares []abcmiddleware.MiddlewareFunc) *chi.Mux
 
 	// The common state for each route handler
 	root := controllers.Root{
-		Render: a.Render,
+		Render:  a.Render,
+		Session: a.Session,
 	}
 
 	// 404 route handler
@@ -77,15 +66,118 @@ func NewRouter(a *app.App, middlewares []abcmiddleware.MiddlewareFunc) *chi.Mux
 
 	errMgr.Add(abcmiddleware.NewError(controllers.ErrUnauthorized, http.StatusUnauthorized, "errors/401", nil))
 	errMgr.Add(abcmiddleware.NewError(controllers.ErrForbidden, http.StatusForbidden, "errors/403", nil))
+	errMgr.Add(abcmiddleware.NewError(controllers.ErrInvalidCSRFToken, http.StatusForbidden, "errors/403", nil))
+	errMgr.Add(abcmiddleware.NewError(controllers.ErrClientCertRequired, http.StatusForbidden, "errors/403", nil))
+	errMgr.Add(abcmiddleware.NewError(controllers.ErrTooManyRequests, http.StatusTooManyRequests, "errors/429", nil))
+	errMgr.Add(abcmiddleware.NewError(controllers.ErrInvalidToken, http.StatusBadRequest, "accounts/invalid_token", nil))
+
+	// Wraps the controllers with the error manager, reporting the errors
+	// that end in a 5xx
+	e := func(ctrl abcmiddleware.AppHandler) http.HandlerFunc {
+		return errMgr.Errors(reporting.Errors(ctrl))
+	}
 
-	// Make a pointer to the errMgr.Errors function so it's easier to call
-	e := errMgr.Errors
+	// Liveness and readiness probes and metrics, which skip the CSRF and
+	// LoadUser middleware of the site routes, so that probes and scrapes
+	// don't create sessions. The global session middleware still runs. The
+	// metrics move to the admin listener if it is enabled.
+	if a.Health != nil {
+		router.Get("/healthz", a.Health.Live)
+		router.Get("/readyz", a.Health.Ready)
+	}
+	if a.Metrics != nil && !a.Config.Admin.Enabled {
+		router.Get("/metrics", a.Metrics.ServeHTTP)
+	}
+
+	// Makes the request context available to the template renderer
+	site := router.With(tracing.Writer)
+	if len(a.Config.TLS.ClientCertPaths) > 0 {
+		// Route groups that need a verified TLS client certificate
+		site = site.With(controllers.ClientCertPaths(a.Config.TLS.ClientCertPaths, e(func(w http.ResponseWriter, r *http.Request) error {
+			return controllers.ErrClientCertRequired
+		})))
+	}
+	if a.Session != nil {
+		// Check the CSRF token of all form posts and API calls
+		secure := len(a.Config.Server.TLSBind) > 0
+		csrfFailure := e(func(w http.ResponseWriter, r *http.Request) error {
+			return controllers.ErrInvalidCSRFToken
+		})
+		// Load the signed in user for every request
+		site = site.With(csrf.New(a.Session, secure, csrfFailure).Middleware, root.LoadUser)
+	}
 
 	main := controllers.Main{Root: root}
-	router.Get("/", e(main.Home))
+	site.Get("/", e(main.Home))
+
+	throttle := &auth.Throttle{
+		Store:        a.Throttle,
+		Clock:        auth.SystemClock,
+		FreeAttempts: a.Config.Auth.ThrottleFreeAttempts,
+		BaseDelay:    a.Config.Auth.ThrottleBaseDelay,
+		MaxDelay:     a.Config.Auth.ThrottleMaxDelay,
+		Window:       a.Config.Auth.ThrottleWindow,
+	}
+
+	accounts := controllers.Accounts{
+		Root:           root,
+		Mailer:         a.Mailer,
+		Tokens:         a.Tokens,
+		Limiter:        auth.NewRateLimiter(a.Config.Auth.RateLimit, a.Config.Auth.RateLimitWindow),
+		Throttle:       throttle,
+		RootURL:        strings.TrimSuffix(a.Config.Auth.RootURL, "/"),
+		ResetTokenTTL:  a.Config.Auth.ResetTokenTTL,
+		VerifyTokenTTL: a.Config.Auth.VerifyTokenTTL,
+	}
+	site.Get("/password/forgot", e(accounts.ForgotPassword))
+	site.Post("/password/forgot", e(accounts.ForgotPasswordPost))
+	site.Get("/password/reset", e(accounts.ResetPassword))
+	site.Post("/password/reset", e(accounts.ResetPasswordPost))
+	site.Get("/email/verify", e(accounts.VerifyEmail))
+	site.Get("/email/verify/resend", e(accounts.VerifyEmailResend))
+	site.Post("/email/verify/resend", e(accounts.VerifyEmailResendPost))
+	site.Get("/account/unlock", e(accounts.UnlockAccount))
+
+	sessions := controllers.Sessions{
+		Root:             root,
+		Clock:            auth.SystemClock,
+		PendingTTL:       time.Minute * 5,
+		MaxAttempts:      5,
+		Throttle:         throttle,
+		LockoutThreshold: a.Config.Auth.LockoutThreshold,
+		LockoutDuration:  a.Config.Auth.LockoutDuration,
+		Accounts:         accounts,
+		Providers:        a.OIDC,
+	}
+	site.Get("/login", e(sessions.Login))
+	site.Post("/login", e(sessions.LoginPost))
+	site.Get("/login/2fa", e(sessions.TwoFactor))
+	site.Post("/login/2fa", e(sessions.TwoFactorPost))
+	site.Post("/logout", e(sessions.LogoutPost))
+
+	oidcLogin := controllers.OIDC{Sessions: sessions}
+	for _, p := range a.OIDC {
+		site.Get("/login/oidc/"+p.Name, e(oidcLogin.Start(p)))
+		site.Get("/login/oidc/"+p.Name+"/callback", e(oidcLogin.Callback(p)))
+	}
 
-	router.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
-		m.HandleRequest(w, r)
+	twoFactor := controllers.TwoFactor{
+		Root:   root,
+		Clock:  auth.SystemClock,
+		Issuer: a.Config.Auth.TOTPIssuer,
+	}
+	site.Get("/account/2fa", e(controllers.RequireUser(twoFactor.Show)))
+	site.Get("/account/2fa/setup", e(controllers.RequireUser(twoFactor.Setup)))
+	site.Post("/account/2fa/enable", e(controllers.RequireUser(twoFactor.EnablePost)))
+	site.Post("/account/2fa/disable", e(controllers.RequireUser(controllers.Transaction(twoFactor.DisablePost))))
+	site.Post("/account/2fa/recovery-codes", e(controllers.RequireUser(twoFactor.RecoveryCodesPost)))
+
+	admin := controllers.Admin{Root: root}
+	site.Get("/admin", e(controllers.RequireAdmin(admin.Home)))
+	site.Get("/admin/db", e(controllers.RequireAdmin(admin.Database)))
+
+	site.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
+		a.Websocket.HandleRequest(w, r)
 	})
 
 	// Router endpoint for serving reat app in /ui
@@ -0,0 +1,204 @@
+// Package seed loads seed data into the database, like demo data for
+// development or fixtures for staging. Seeds are grouped in sets, named
+// after the config environment they are for, and are SQL files or Go
+// seeders. Every seed is applied once, which is recorded in the seed_runs
+// table, so a set can be applied again after new seeds were added to it.
+package seed
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fadeojo/brito/migrate"
+	"github.com/pkg/errors"
+	"github.com/volatiletech/sqlboiler/boil"
+)
+
+// Seed is a named unit of seed data
+type Seed struct {
+	// Name orders the seeds of a set and identifies the seed in seed_runs.
+	// It is the file name for SQL seeds.
+	Name string
+	Run  func(exec boil.Executor) error
+}
+
+// seeders are the Go seeders added with Register, by set
+var seeders = map[string][]Seed{}
+
+// Register adds a Go seeder to set, to be run with the SQL seeds of the
+// set in order of name. Call it from an init function.
+func Register(set string, name string, run func(exec boil.Executor) error) {
+	seeders[set] = append(seeders[set], Seed{Name: name, Run: run})
+}
+
+// Load returns the seeds of set: the .sql files in the folder named after
+// set in fsys and the Go seeders registered for it, sorted by name.
+func Load(fsys fs.FS, set string) ([]*Seed, error) {
+	var seeds []*Seed
+	for _, s := range seeders[set] {
+		s := s
+		seeds = append(seeds, &s)
+	}
+
+	entries, err := fs.ReadDir(fsys, set)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "cannot read seed set %q", set)
+	}
+	for _, e := range entries {
+		if e.IsDir() || path.Ext(e.Name()) != ".sql" {
+			continue
+		}
+
+		f, err := fsys.Open(path.Join(set, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		stmts, err := migrate.SplitScript(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid seed %s", e.Name())
+		}
+		seeds = append(seeds, &Seed{Name: e.Name(), Run: execAll(stmts)})
+	}
+
+	sort.Slice(seeds, func(i, j int) bool { return seeds[i].Name < seeds[j].Name })
+	for i := 1; i < len(seeds); i++ {
+		if seeds[i].Name == seeds[i-1].Name {
+			return nil, errors.Errorf("duplicate seed %q in set %q", seeds[i].Name, set)
+		}
+	}
+
+	return seeds, nil
+}
+
+func execAll(stmts []string) func(exec boil.Executor) error {
+	return func(exec boil.Executor) error {
+		for _, stmt := range stmts {
+			if _, err := exec.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Seeder applies seeds to a database
+type Seeder struct {
+	DB *sql.DB
+	// Driver is the database driver name, "postgres", "mysql" or "sqlite3"
+	Driver string
+
+	// Log receives a line for every seed applied
+	Log io.Writer
+	// Force applies seeds again that were applied before. Seeds have to be
+	// written to be run more than once for it, like the Go seeders that
+	// skip the rows that exist.
+	Force bool
+}
+
+// Apply runs the seeds of set that were not applied before, each in a
+// transaction with its record in seed_runs, and returns how many ran.
+func (s *Seeder) Apply(set string, seeds []*Seed) (int, error) {
+	if err := s.createRunsTable(); err != nil {
+		return 0, err
+	}
+
+	applied, err := s.applied(set)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, seed := range seeds {
+		if applied[seed.Name] && !s.Force {
+			continue
+		}
+		if err := s.apply(set, seed); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (s *Seeder) apply(set string, seed *Seed) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "cannot begin transaction")
+	}
+
+	if err := seed.Run(tx); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "seed %s/%s failed", set, seed.Name)
+	}
+	if _, err := tx.Exec(s.rebind("DELETE FROM seed_runs WHERE set_name = ? AND name = ?"), set, seed.Name); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "cannot record seed %s/%s", set, seed.Name)
+	}
+	if _, err := tx.Exec(s.rebind("INSERT INTO seed_runs (set_name, name) VALUES (?, ?)"), set, seed.Name); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "cannot record seed %s/%s", set, seed.Name)
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "cannot commit seed %s/%s", set, seed.Name)
+	}
+
+	fmt.Fprintf(s.log(), "%s/%s\n", set, seed.Name)
+	return nil
+}
+
+func (s *Seeder) log() io.Writer {
+	if s.Log == nil {
+		return ioutil.Discard
+	}
+	return s.Log
+}
+
+// applied returns the names of the seeds of set in seed_runs
+func (s *Seeder) applied(set string) (map[string]bool, error) {
+	rows, err := s.DB.Query(s.rebind("SELECT name FROM seed_runs WHERE set_name = ?"), set)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read seed_runs")
+	}
+	defer rows.Close()
+
+	applied := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "cannot read seed_runs")
+		}
+		applied[name] = true
+	}
+	return applied, errors.Wrap(rows.Err(), "cannot read seed_runs")
+}
+
+func (s *Seeder) createRunsTable() error {
+	_, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS seed_runs (
+		set_name varchar(64) NOT NULL,
+		name varchar(255) NOT NULL,
+		applied_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (set_name, name)
+	)`)
+	return errors.Wrap(err, "cannot create seed_runs")
+}
+
+// rebind replaces the ? placeholders for postgres
+func (s *Seeder) rebind(query string) string {
+	if s.Driver != "postgres" {
+		return query
+	}
+	for n := 1; strings.Contains(query, "?"); n++ {
+		query = strings.Replace(query, "?", "$"+strconv.Itoa(n), 1)
+	}
+	return query
+}
@@ -0,0 +1,130 @@
+package seed
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/fadeojo/brito/db"
+	"github.com/volatiletech/sqlboiler/boil"
+)
+
+func TestMain(m *testing.M) {
+	count, err := db.SetupTestSuite(db.GoTestdata)
+	if err != nil {
+		fmt.Printf("TestMain setup failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("TestMain Setup ran %d migrations.\n", count)
+
+	r := m.Run()
+	if err := db.TeardownTestSuite(); err != nil {
+		fmt.Printf("TestMain teardown failed: %s\n", err)
+	}
+	os.Exit(r)
+}
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"load/02_second.sql": {Data: []byte("INSERT INTO a VALUES (2);\n")},
+		"load/README.md":     {Data: []byte("not a seed")},
+		"other/01_other.sql": {Data: []byte("INSERT INTO a VALUES (0);\n")},
+	}
+	Register("load", "01_first", func(boil.Executor) error { return nil })
+	Register("load", "03_third", func(boil.Executor) error { return nil })
+
+	seeds, err := Load(fsys, "load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range seeds {
+		names = append(names, s.Name)
+	}
+	if fmt.Sprint(names) != "[01_first 02_second.sql 03_third]" {
+		t.Errorf("unexpected seeds %v", names)
+	}
+
+	if seeds, err := Load(fsys, "missing"); err != nil || len(seeds) != 0 {
+		t.Errorf("expected no seeds for a missing set, got %d, %v", len(seeds), err)
+	}
+
+	Register("duplicate", "01.sql", func(boil.Executor) error { return nil })
+	if _, err := Load(fstest.MapFS{"duplicate/01.sql": {Data: []byte("SELECT 1;\n")}}, "duplicate"); err == nil {
+		t.Error("expected an error for a duplicate seed name")
+	}
+	if _, err := Load(fstest.MapFS{"bad/01.sql": {Data: []byte("SELECT 1\n")}}, "bad"); err == nil {
+		t.Error("expected an error for an invalid SQL seed")
+	}
+}
+
+func TestApply(t *testing.T) {
+	if _, err := db.DB.Exec("CREATE TABLE seed_test (n integer)"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Exec("DROP TABLE seed_test")
+
+	fsys := fstest.MapFS{
+		"apply/01_one.sql": {Data: []byte("INSERT INTO seed_test (n) VALUES (1);\n")},
+	}
+	Register("apply", "02_two", func(exec boil.Executor) error {
+		_, err := exec.Exec("INSERT INTO seed_test (n) VALUES (2)")
+		return err
+	})
+	seeds, err := Load(fsys, "apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := func() int {
+		var n int
+		if err := db.DB.QueryRow("SELECT COALESCE(SUM(n), 0) FROM seed_test").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	log := &bytes.Buffer{}
+	s := &Seeder{DB: db.DB, Driver: db.Driver, Log: log}
+	if count, err := s.Apply("apply", seeds); err != nil || count != 2 {
+		t.Fatalf("expected 2 seeds applied, got %d, %v", count, err)
+	}
+	if log.String() != "apply/01_one.sql\napply/02_two\n" {
+		t.Errorf("unexpected log %q", log.String())
+	}
+
+	// Applied seeds are skipped
+	if count, err := s.Apply("apply", seeds); err != nil || count != 0 {
+		t.Errorf("expected no seeds applied again, got %d, %v", count, err)
+	}
+	if n := sum(); n != 3 {
+		t.Errorf("expected the seeds to run once, got sum %d", n)
+	}
+
+	s.Force = true
+	if count, err := s.Apply("apply", seeds); err != nil || count != 2 {
+		t.Errorf("expected 2 seeds forced, got %d, %v", count, err)
+	}
+	if n := sum(); n != 6 {
+		t.Errorf("expected the seeds to run twice, got sum %d", n)
+	}
+
+	// A failed seed is rolled back and not recorded
+	failing := append(seeds, &Seed{Name: "03_fail", Run: func(exec boil.Executor) error {
+		exec.Exec("INSERT INTO seed_test (n) VALUES (100)")
+		return fmt.Errorf("fail")
+	}})
+	s.Force = false
+	if _, err := s.Apply("apply", failing); err == nil {
+		t.Error("expected the failing seed to fail")
+	}
+	if n := sum(); n != 6 {
+		t.Errorf("expected the failed seed to be rolled back, got sum %d", n)
+	}
+	var runs int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM seed_runs WHERE set_name = 'apply'").Scan(&runs); err != nil || runs != 2 {
+		t.Errorf("expected 2 recorded seeds, got %d, %v", runs, err)
+	}
+}
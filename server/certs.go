@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// reloadDelay is how long the certificate files have to be left alone
+// before they are reloaded, so the certificate and key of a rotation are
+// loaded together
+const reloadDelay = time.Millisecond * 200
+
+// CertReloader serves the TLS certificate of a certificate and key file
+// and reloads it when the files change, so certificates are rotated
+// without a restart. A certificate that fails to load is logged and the
+// current one kept.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	log      *zap.Logger
+	cert     atomic.Pointer[tls.Certificate]
+	watcher  *fsnotify.Watcher
+}
+
+// NewCertReloader loads the certificate of certFile and keyFile and
+// watches them for changes until Close is called
+func NewCertReloader(certFile, keyFile string, log *zap.Logger) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, log: log}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot watch the tls certificate")
+	}
+	// The folders are watched, as rotations often replace the files, like
+	// the symlink swaps of Kubernetes secret volumes
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, errors.Wrapf(err, "cannot watch the tls certificate folder %q", dir)
+		}
+	}
+	c.watcher = watcher
+	go c.watch()
+
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// Reload loads the certificate from the files and reports whether it
+// changed. The current certificate is kept if it fails.
+func (c *CertReloader) Reload() (bool, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot load the tls certificate")
+	}
+	if old := c.cert.Swap(&cert); old != nil && bytes.Equal(old.Certificate[0], cert.Certificate[0]) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Close stops watching the files
+func (c *CertReloader) Close() error {
+	return c.watcher.Close()
+}
+
+func (c *CertReloader) watch() {
+	var timer *time.Timer
+	for {
+		select {
+		case _, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if timer == nil {
+				timer = time.AfterFunc(reloadDelay, c.reload)
+			} else {
+				timer.Reset(reloadDelay)
+			}
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			c.log.Warn("tls certificate watch failed", zap.Error(err))
+		}
+	}
+}
+
+func (c *CertReloader) reload() {
+	changed, err := c.Reload()
+	if err != nil {
+		c.log.Warn("cannot reload the tls certificate, keeping the current one", zap.Error(err))
+		return
+	}
+	if changed {
+		fields := []zapcore.Field{zap.String("file", c.certFile)}
+		if leaf := c.cert.Load().Leaf; leaf != nil {
+			fields = append(fields, zap.String("subject", leaf.Subject.String()), zap.Time("not_after", leaf.NotAfter))
+		}
+		c.log.Info("reloaded the tls certificate", fields...)
+	}
+}
+
+// LoadCertPool returns the pool of the PEM certificates in file, like a
+// client CA bundle
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read the certificate bundle")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no certificates in %q", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeCert writes a self-signed certificate for name and its key to dir
+func writeCert(t *testing.T, dir, name string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, "tls.crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tls.key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, dir, "one.example.com")
+
+	c, err := NewCertReloader(certFile, keyFile, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	name := func() string {
+		cert, _ := c.GetCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+	if got := name(); got != "one.example.com" {
+		t.Fatalf("expected the first certificate, got %s", got)
+	}
+
+	writeCert(t, dir, "two.example.com")
+	deadline := time.Now().Add(time.Second * 5)
+	for name() != "two.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("the certificate was not reloaded")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// A broken key keeps the current certificate
+	if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(reloadDelay * 2)
+	if got := name(); got != "two.example.com" {
+		t.Errorf("expected the current certificate to be kept, got %s", got)
+	}
+	if _, err := c.Reload(); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestNewCertReloaderFails(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if _, err := NewCertReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), zap.NewNop()); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// unixPrefix marks the binds of Unix sockets, like unix:/run/brito.sock
+const unixPrefix = "unix:"
+
+// SocketMode and SocketGroup are the permissions of the Unix sockets that
+// Listen creates. The group of the process is kept if SocketGroup is empty.
+var (
+	SocketMode  os.FileMode = 0660
+	SocketGroup string
+)
+
+// listenFDsStart is the first file descriptor passed with LISTEN_FDS, see
+// sd_listen_fds(3)
+const listenFDsStart = 3
+
+// namedListener is a listener passed on by systemd or a restart
+type namedListener struct {
+	name string
+	l    net.Listener
+}
+
+var listeners struct {
+	sync.Mutex
+	loaded bool
+	// inherited are the passed on listeners that were not taken yet
+	inherited []namedListener
+	// active are the listeners of Listen by name, which Restart passes on
+	active map[string]net.Listener
+	// restarted is set if the listeners were passed on by a Restart, so
+	// their socket files belong to this process now
+	restarted bool
+	// sockets are the socket files to remove on shutdown
+	sockets []string
+}
+
+// Listen returns a listener on addr named name, like "http" or "https".
+// The addr is a TCP address, or a Unix socket path with the unix: prefix.
+// It takes the listener passed on by systemd socket activation or a
+// Restart with that name, or else one listening on addr, and binds addr
+// only if there is none. The listener is passed on by Restart.
+func Listen(name, addr string) (net.Listener, error) {
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	if !listeners.loaded {
+		listeners.loaded = true
+		listeners.active = make(map[string]net.Listener)
+
+		var err error
+		listeners.restarted = len(os.Getenv(readyEnv)) > 0
+		listeners.inherited, err = inherit(os.Getenv, os.Getpid())
+		// Child processes must not take the listeners as theirs
+		for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			os.Unsetenv(env)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l := takeInherited(name, addr)
+	// The socket files of systemd are its own to remove
+	owned := l == nil || listeners.restarted
+	if l == nil {
+		var err error
+		if path := strings.TrimPrefix(addr, unixPrefix); path != addr {
+			l, err = listenUnix(path)
+		} else {
+			l, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if u, ok := l.Addr().(*net.UnixAddr); ok && owned {
+		listeners.sockets = append(listeners.sockets, u.Name)
+	}
+	listeners.active[name] = l
+	return l, nil
+}
+
+// listenUnix listens on a Unix socket at path with the SocketMode and
+// SocketGroup permissions, replacing a stale socket file
+func listenUnix(path string) (net.Listener, error) {
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The file is removed on shutdown, not when the listener is closed, as
+	// a restarted process still listens on it
+	l.SetUnlinkOnClose(false)
+
+	if err := chmodSocket(path); err != nil {
+		l.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return l, nil
+}
+
+func chmodSocket(path string) error {
+	if err := os.Chmod(path, SocketMode); err != nil {
+		return errors.Wrap(err, "cannot set the socket mode")
+	}
+	if len(SocketGroup) == 0 {
+		return nil
+	}
+	g, err := user.LookupGroup(SocketGroup)
+	if err != nil {
+		return errors.Wrap(err, "cannot find the socket group")
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return errors.Errorf("invalid gid %q of group %q", g.Gid, SocketGroup)
+	}
+	return errors.Wrap(os.Chown(path, -1, gid), "cannot set the socket group")
+}
+
+// removeStale removes the socket file at path that a process left behind
+// when it did not shut down gracefully. It fails if a process still
+// listens on it, or if path is not a socket.
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "cannot check the socket file")
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%q exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return errors.Errorf("another process listens on %q", path)
+	}
+	return errors.Wrap(os.Remove(path), "cannot remove the stale socket file")
+}
+
+// removeSockets removes the socket files of the Unix sockets of Listen,
+// once they are closed for good
+func removeSockets() error {
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	var err error
+	for _, path := range listeners.sockets {
+		if rerr := os.Remove(path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = errors.Wrap(rerr, "cannot remove the socket file")
+		}
+	}
+	listeners.sockets = nil
+	return err
+}
+
+// inherit returns the listeners passed on in the LISTEN_FDS protocol. The
+// LISTEN_PID is optional, as a restarting process can't know the pid of its
+// child before starting it.
+func inherit(getenv func(string) string, pid int) ([]namedListener, error) {
+	fds := getenv("LISTEN_FDS")
+	if len(fds) == 0 {
+		return nil, nil
+	}
+	if p := getenv("LISTEN_PID"); len(p) > 0 && p != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, errors.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+
+	list := make([]namedListener, n)
+	for i := range list {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "inherited file descriptor %d is not a listener", listenFDsStart+i)
+		}
+		list[i] = namedListener{name: name, l: l}
+	}
+	return list, nil
+}
+
+// takeInherited removes the inherited listener named name from the
+// inherited ones and returns it, or else the first one on addr, as systemd
+// names sockets after their unit by default. It returns nil if there is
+// none.
+func takeInherited(name, addr string) net.Listener {
+	match := -1
+	for i, nl := range listeners.inherited {
+		if nl.name == name {
+			match = i
+			break
+		}
+		if match < 0 && listensOn(nl.l, addr) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil
+	}
+
+	l := listeners.inherited[match].l
+	listeners.inherited = append(listeners.inherited[:match], listeners.inherited[match+1:]...)
+	return l
+}
+
+// listensOn reports whether the listener l is bound to addr
+func listensOn(l net.Listener, addr string) bool {
+	if u, ok := l.Addr().(*net.UnixAddr); ok {
+		return addr == unixPrefix+u.Name
+	}
+	tcp, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if p, err := net.LookupPort("tcp", port); err != nil || p != tcp.Port {
+		return false
+	}
+
+	switch host {
+	case "":
+		return tcp.IP.IsUnspecified()
+	case "localhost":
+		return tcp.IP.IsLoopback()
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(tcp.IP)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volatiletech/abcweb/abcconfig"
+	"go.uber.org/zap"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "brito.sock")
+	defer func() {
+		listeners.Lock()
+		delete(listeners.active, "unix")
+		listeners.Unlock()
+	}()
+
+	// A stale socket file is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen("unix", "unix:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != SocketMode {
+		t.Errorf("expected mode %s, got %s", SocketMode, fi.Mode().Perm())
+	}
+	if !listensOn(l, "unix:"+path) {
+		t.Error("expected the listener to listen on the path")
+	}
+
+	// A socket a process listens on is kept
+	if _, err := listenUnix(path); err == nil {
+		t.Error("expected an error for a socket in use")
+	}
+
+	// The file stays when the listener is closed, for a restarted process,
+	// and is removed on shutdown
+	l.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the socket file to stay, got %v", err)
+	}
+	if err := removeSockets(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket file to be removed, got %v", err)
+	}
+
+	// Other files are not replaced
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path); err == nil {
+		t.Error("expected an error for a file that is not a socket")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(abcconfig.ServerConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}), zap.NewNop(), Options{H2C: true})
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// A client with prior knowledge, like a reverse proxy
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	resp, err := (&http.Client{Transport: transport}).Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Proto"); got != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2.0, got %s", got)
+	}
+
+	// HTTP/1 still works
+	if code := get(t, "http://"+l.Addr().String()); code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", code)
+	}
+}
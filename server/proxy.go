@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Proxies are the reverse proxies in front of the server, whose forwarded
+// client addresses are trusted
+type Proxies struct {
+	nets []*net.IPNet
+	// unix trusts the connections of the unix: binds, which only a proxy
+	// on the same host can connect to
+	unix bool
+}
+
+// ParseProxies returns the proxies of a list of IP addresses and CIDR
+// ranges. The entry "unix" trusts the connections of the unix: binds.
+func ParseProxies(list []string) (*Proxies, error) {
+	p := &Proxies{}
+	for _, entry := range list {
+		if entry == "unix" {
+			p.unix = true
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy %q", entry)
+		}
+		p.nets = append(p.nets, ipNet)
+	}
+	return p, nil
+}
+
+// trusted reports whether addr, an IP address or the empty remote address
+// of a unix socket connection, is of a proxy
+func (p *Proxies) trusted(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return p.unix && (len(addr) == 0 || addr == "@")
+	}
+	for _, ipNet := range p.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RealIP sets the remote address of the requests of the proxies to the
+// address of their client: the last address of X-Forwarded-For that isn't
+// of a proxy, or X-Real-IP without it. The headers of other clients are
+// ignored, so they can't pose as another address.
+func (p *Proxies) RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.trusted(r.RemoteAddr) {
+			if ip := p.clientIP(r.Header); len(ip) > 0 {
+				r.RemoteAddr = ip
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the client address the proxies forwarded, empty if
+// there is none
+func (p *Proxies) clientIP(h http.Header) string {
+	var hops []string
+	for _, list := range h["X-Forwarded-For"] {
+		for _, hop := range strings.Split(list, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	// Every proxy appends the address it was connected from, so the ones
+	// left of the first address that isn't a proxy were sent by the client
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			return ""
+		}
+		if !p.trusted(hops[i]) || i == 0 {
+			return hops[i]
+		}
+	}
+
+	if ip := strings.TrimSpace(h.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	t.Parallel()
+
+	if _, err := ParseProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an invalid range to fail")
+	}
+	p, err := ParseProxies([]string{"10.0.0.0/8", "192.0.2.1", "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote  string
+		forward []string
+		realIP  string
+		want    string
+	}{
+		// Clients can't pose as another address
+		{"198.51.100.7:1234", []string{"203.0.113.1"}, "203.0.113.2", "198.51.100.7:1234"},
+		{"192.0.2.1:1234", nil, "", "192.0.2.1:1234"},
+		{"192.0.2.1:1234", nil, "203.0.113.2", "203.0.113.2"},
+		{"192.0.2.1:1234", []string{"203.0.113.1"}, "203.0.113.2", "203.0.113.1"},
+		// The addresses sent by the client are skipped
+		{"10.1.1.1:1234", []string{"203.0.113.9, 203.0.113.1", "10.2.2.2"}, "", "203.0.113.1"},
+		{"10.1.1.1:1234", []string{"10.3.3.3, 10.2.2.2"}, "", "10.3.3.3"},
+		{"10.1.1.1:1234", []string{"bogus, 10.2.2.2"}, "", "10.1.1.1:1234"},
+		{"@", []string{"203.0.113.1"}, "", "203.0.113.1"},
+		{"", []string{"203.0.113.1"}, "", "203.0.113.1"},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		r.Header["X-Forwarded-For"] = test.forward
+		if len(test.realIP) > 0 {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+
+		var got string
+		p.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.RemoteAddr
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if got != test.want {
+			t.Errorf("%d: want remote address %q, got %q", i, test.want, got)
+		}
+	}
+
+	// Unix sockets are only trusted if listed
+	if p, _ := ParseProxies(nil); p.trusted("@") || p.trusted("") {
+		t.Error("expected unix sockets not to be trusted")
+	}
+}
+
+func TestRealIPUnix(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := ParseProxies([]string{"unix"})
+	s := &http.Server{Handler: p.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}))}
+	go s.Serve(l)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	req, _ := http.NewRequest("GET", "http://unix/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "203.0.113.1" {
+		t.Errorf("expected the forwarded address over the unix socket, got %q", body)
+	}
+}
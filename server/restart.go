@@ -0,0 +1,197 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// readyEnv is the file descriptor a restarted process writes to once its
+// listeners are up
+const readyEnv = "SERVER_READY_FD"
+
+// Restart starts the binary of the process again with the same arguments,
+// passing it the listeners of Listen, and returns its pid once it is ready
+// to serve, or kills it if it isn't within timeout. New connections are
+// accepted by both processes until the caller stops serving and exits.
+func Restart(timeout time.Duration) (int, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot find the binary")
+	}
+	return restart(path, os.Args[1:], timeout)
+}
+
+func restart(path string, args []string, timeout time.Duration) (int, error) {
+	files, names, err := listenerFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot create the ready pipe")
+	}
+	defer r.Close()
+
+	// The descriptors are passed raw: os/exec calls File.Fd, which puts
+	// the sockets into blocking mode, for the parent as well, and an accept
+	// blocked in the parent would take a connection after it stopped
+	fds := []uintptr{0, 1, 2}
+	for _, f := range append(files, w) {
+		fd, err := rawFD(f)
+		if err != nil {
+			w.Close()
+			return 0, err
+		}
+		fds = append(fds, fd)
+	}
+	env := append(environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		readyEnv+"="+strconv.Itoa(listenFDsStart+len(files)),
+	)
+	pid, err := syscall.ForkExec(path, append([]string{path}, args...), &syscall.ProcAttr{Env: env, Files: fds})
+	w.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot start the new process")
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot find the new process")
+	}
+
+	// The read fails once the child exits and its end of the pipe is closed
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = errors.New("the new process exited before it was ready")
+		}
+	case <-time.After(timeout):
+		err = errors.Errorf("the new process was not ready within %s", timeout)
+	}
+	if err != nil {
+		proc.Kill()
+		proc.Wait()
+		return 0, err
+	}
+	go proc.Wait()
+
+	// Tell systemd that the child is the main process of the service now
+	if err := notify(fmt.Sprintf("MAINPID=%d", pid)); err != nil {
+		return pid, err
+	}
+	return pid, nil
+}
+
+// rawFD returns the file descriptor of f without changing its mode
+func rawFD(f *os.File) (uintptr, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot pass on file")
+	}
+	var fd uintptr
+	if err := rc.Control(func(s uintptr) { fd = s }); err != nil {
+		return 0, errors.Wrap(err, "cannot pass on file")
+	}
+	return fd, nil
+}
+
+// listenerFiles returns duplicates of the files of the listeners of Listen
+// with their names, sorted by name
+func listenerFiles() ([]*os.File, []string, error) {
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	names := make([]string, 0, len(listeners.active))
+	for name := range listeners.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names))
+	for _, name := range names {
+		l, ok := listeners.active[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return files, nil, errors.Errorf("listener %q can't be passed on", name)
+		}
+		f, err := l.File()
+		if err != nil {
+			return files, nil, errors.Wrapf(err, "cannot pass on listener %q", name)
+		}
+		files = append(files, f)
+	}
+	return files, names, nil
+}
+
+// environ returns the environment without the variables of the listeners
+// passed to this process
+func environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", readyEnv:
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// Ready tells the process that restarted into this one, and systemd if the
+// service is of Type=notify, that the listeners are up
+func Ready() error {
+	if fd := os.Getenv(readyEnv); len(fd) > 0 {
+		os.Unsetenv(readyEnv)
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return errors.Errorf("invalid %s %q", readyEnv, fd)
+		}
+		f := os.NewFile(uintptr(n), "ready")
+		_, err = f.Write([]byte{1})
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, "cannot tell the parent process it is ready")
+		}
+	}
+	return notify("READY=1")
+}
+
+// notify sends state to the systemd service manager, see sd_notify(3). It
+// does nothing when not run by systemd.
+func notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if len(addr) == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return errors.Wrap(err, "cannot reach systemd notify socket")
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrap(err, "cannot notify systemd")
+	}
+	return nil
+}
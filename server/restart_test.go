@@ -0,0 +1,204 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+func TestListensOn(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:" + port, true},
+		{"localhost:" + port, true},
+		{":" + port, false},
+		{"10.0.0.1:" + port, false},
+		{"127.0.0.1:1", false},
+		{"127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if ok := listensOn(l, test.addr); ok != test.ok {
+			t.Errorf("%s: expected %t", test.addr, test.ok)
+		}
+	}
+}
+
+func TestTakeInherited(t *testing.T) {
+	var list []namedListener
+	for _, name := range []string{"brito.socket", "https"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		list = append(list, namedListener{name: name, l: l})
+	}
+
+	listeners.Lock()
+	defer listeners.Unlock()
+	listeners.inherited = list
+	defer func() { listeners.inherited = nil }()
+
+	// By name before the address
+	if l := takeInherited("https", list[0].l.Addr().String()); l != list[1].l {
+		t.Error("expected the listener named https")
+	}
+	if l := takeInherited("http", list[0].l.Addr().String()); l != list[0].l {
+		t.Error("expected the listener on the address")
+	}
+	if l := takeInherited("admin", "127.0.0.1:1"); l != nil || len(listeners.inherited) != 0 {
+		t.Error("expected no more listeners")
+	}
+}
+
+func TestInherit(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{"LISTEN_FDS": "1", "LISTEN_PID": "2"}
+	list, err := inherit(func(k string) string { return env[k] }, 1)
+	if err != nil || len(list) != 0 {
+		t.Errorf("expected the listeners of another process to be ignored, got %v %v", list, err)
+	}
+
+	env = map[string]string{"LISTEN_FDS": "x"}
+	if _, err := inherit(func(k string) string { return env[k] }, 1); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// TestRestart restarts into the helper process, which answers the
+// requests on the listener it was passed
+func TestRestart(t *testing.T) {
+	l, err := Listen("http", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+	defer func() {
+		listeners.Lock()
+		delete(listeners.active, "http")
+		listeners.Unlock()
+	}()
+
+	t.Setenv("SERVER_TEST_HELPER", "1")
+	pid, err := restart(os.Args[0], []string{"-test.run=^TestHelperProcess$"}, time.Second*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+
+	// A blocking listener could not be closed while accepting
+	rc, _ := l.(*net.TCPListener).SyscallConn()
+	rc.Control(func(fd uintptr) {
+		if flags, _, _ := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0); flags&syscall.O_NONBLOCK == 0 {
+			t.Error("expected the listener to stay non-blocking")
+		}
+	})
+
+	// The parent stops accepting, the child takes over the socket
+	l.Close()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "child" {
+		t.Errorf("expected the child to answer, got %q", body)
+	}
+
+	// A child that never gets ready is given up
+	t.Setenv("SERVER_TEST_HELPER", "exit")
+	if _, err := restart(os.Args[0], []string{"-test.run=^TestHelperProcess$"}, time.Second*10); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("SERVER_TEST_HELPER") {
+	case "1":
+	case "exit":
+		os.Exit(1)
+	default:
+		return
+	}
+
+	l, err := Listen("http", "127.0.0.1:1")
+	if err != nil {
+		os.Exit(2)
+	}
+	if err := Ready(); err != nil {
+		os.Exit(3)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("child"))
+	}))
+	time.Sleep(time.Second * 10)
+	os.Exit(0)
+}
+
+func TestServeRestart(t *testing.T) {
+	var attempts, shutdown int32
+	restartFunc = func(time.Duration) (int, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return 0, errors.New("not ready")
+		}
+		return 1, nil
+	}
+	defer func() { restartFunc = Restart }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+
+	quit := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(srv, func() error { return srv.Serve(l) }, quit, zap.NewNop(), Options{
+			OnShutdown:    func() { atomic.StoreInt32(&shutdown, 1) },
+			ShutdownDelay: time.Hour,
+		})
+	}()
+
+	// A failed restart keeps serving
+	quit <- syscall.SIGUSR2
+	time.Sleep(time.Millisecond * 50)
+	if code := get(t, url); code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", code)
+	}
+
+	// A restart drains without the shutdown delay
+	quit <- syscall.SIGHUP
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("server did not shut down")
+	}
+	if atomic.LoadInt32(&shutdown) == 1 {
+		t.Error("expected no OnShutdown call on restart")
+	}
+}
@@ -0,0 +1,272 @@
+// Package server runs the web server of the app. It listens like
+// abcserver.StartServer, and shuts down gracefully on SIGINT and SIGTERM:
+// the OnShutdown hook is told first, so the readiness probe fails, and the
+// server keeps serving for the ShutdownDelay while load balancers take it
+// out of rotation before it stops accepting connections.
+//
+// It restarts without dropping connections on SIGUSR2 or SIGHUP: the
+// binary is started again with the listening sockets, and the old process
+// drains its requests and exits once the new one is ready. The sockets can
+// also be passed in by systemd socket activation.
+//
+// The TLS certificate is reloaded when its files change, and client
+// certificates can be verified for mutual TLS. Behind reverse proxies,
+// Proxies.RealIP gives requests the address of the client.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/volatiletech/abcweb/abcconfig"
+	"go.uber.org/zap"
+)
+
+// Options are the graceful shutdown settings
+type Options struct {
+	// OnShutdown is called when graceful shutdown begins
+	OnShutdown func()
+	// ShutdownDelay is how long requests are still accepted after
+	// OnShutdown was called
+	ShutdownDelay time.Duration
+	// ShutdownTimeout is how long active requests are waited for before
+	// their connections are closed, zero waits for them forever
+	ShutdownTimeout time.Duration
+	// RestartTimeout is how long a restarted process may take to be ready
+	// before it is killed and the restart is given up
+	RestartTimeout time.Duration
+
+	// ClientCAs verifies the client certificates of https connections for
+	// mutual TLS, as asked for by ClientAuth. It is off if nil.
+	ClientCAs  *x509.CertPool
+	ClientAuth tls.ClientAuthType
+
+	// H2C serves cleartext HTTP/2 with prior knowledge besides HTTP/1 on
+	// the http listener, for reverse proxies that speak it
+	H2C bool
+}
+
+// restartFunc restarts the process, see Restart
+var restartFunc = Restart
+
+// errLogger allows us to use the zap.Logger as the http.Server ErrorLog
+type errLogger struct {
+	log *zap.Logger
+}
+
+func (e errLogger) Write(b []byte) (int, error) {
+	e.log.Debug(string(b))
+	return len(b), nil
+}
+
+// Start starts the web server on the address of cfg, with https if a
+// TLSBind is set and http requests to the Bind redirected to it. The binds
+// are TCP addresses or Unix socket paths with the unix: prefix. It
+// returns once it was shut down by SIGINT or SIGTERM, or restarted by
+// SIGUSR2 or SIGHUP. This is a blocking call.
+func Start(cfg abcconfig.ServerConfig, handler http.Handler, logger *zap.Logger, opts Options) error {
+	srv := newServer(cfg, handler, logger, opts)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
+	defer signal.Stop(quit)
+
+	if len(cfg.TLSBind) > 0 {
+		// The certificate is reloaded when its files change
+		certs, err := NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, logger)
+		if err != nil {
+			return err
+		}
+		defer certs.Close()
+		srv.TLSConfig.GetCertificate = certs.GetCertificate
+
+		l, err := Listen("https", cfg.TLSBind)
+		if err != nil {
+			return errors.Wrap(err, "cannot listen for https")
+		}
+		logger.Info("starting https listener", zap.String("bind", cfg.TLSBind))
+
+		// Redirect http requests to https
+		redirect, err := newRedirect(cfg, logger)
+		if err != nil {
+			return err
+		}
+		rl, err := Listen("http", cfg.Bind)
+		if err != nil {
+			return errors.Wrap(err, "cannot listen for the http redirect")
+		}
+		logger.Info("starting http -> https redirect listener", zap.String("bind", cfg.Bind))
+		go redirect.Serve(rl)
+		defer redirect.Close()
+
+		ready(logger)
+		return serve(srv, func() error {
+			return srv.ServeTLS(l, "", "")
+		}, quit, logger, opts)
+	}
+
+	l, err := Listen("http", cfg.Bind)
+	if err != nil {
+		return errors.Wrap(err, "cannot listen for http")
+	}
+	logger.Info("starting http listener", zap.String("bind", cfg.Bind), zap.Bool("h2c", opts.H2C))
+
+	ready(logger)
+	return serve(srv, func() error { return srv.Serve(l) }, quit, logger, opts)
+}
+
+// newServer returns the server of handler with the settings of cfg and
+// opts, but without the certificate
+func newServer(cfg abcconfig.ServerConfig, handler http.Handler, logger *zap.Logger, opts Options) *http.Server {
+	srv := &http.Server{
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		ErrorLog:     log.New(errLogger{logger}, "", 0),
+		Handler:      handler,
+		TLSConfig: &tls.Config{
+			// Only use curves which have assembly implementations
+			CurvePreferences: []tls.CurveID{tls.CurveP256, tls.X25519},
+			ClientCAs:        opts.ClientCAs,
+			ClientAuth:       opts.ClientAuth,
+		},
+	}
+
+	// HTTP/2 over TLS is on by default, h2c only applies to the cleartext
+	// listener
+	if opts.H2C && len(cfg.TLSBind) == 0 {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
+
+// ready logs the failure to tell the parent process or systemd it is ready,
+// which will give up on this process
+func ready(logger *zap.Logger) {
+	if err := Ready(); err != nil {
+		logger.Error("cannot notify readiness", zap.Error(err))
+	}
+}
+
+// newRedirect returns the server that redirects http requests to the https
+// port of cfg, like abcserver.Redirect
+func newRedirect(cfg abcconfig.ServerConfig, logger *zap.Logger) (*http.Server, error) {
+	_, httpsPort, err := net.SplitHostPort(cfg.TLSBind)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get port from tls bind")
+	}
+
+	return &http.Server{
+		// Do not set IdleTimeout, so Go uses ReadTimeout value.
+		// IdleTimeout config value too high for redirect listener.
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		ErrorLog:     log.New(errLogger{logger}, "", 0),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Remove port if it exists so we can replace it with https port
+			httpHost := r.Host
+			if strings.ContainsRune(r.Host, ':') {
+				var err error
+				if httpHost, _, err = net.SplitHostPort(r.Host); err != nil {
+					logger.Error("failed to get http host from request", zap.String("host", r.Host), zap.Error(err))
+					w.WriteHeader(http.StatusBadRequest)
+					io.WriteString(w, "invalid host header")
+					return
+				}
+			}
+
+			var url string
+			if httpsPort != "443" {
+				url = fmt.Sprintf("https://%s:%s%s", httpHost, httpsPort, r.RequestURI)
+			} else {
+				url = fmt.Sprintf("https://%s%s", httpHost, r.RequestURI)
+			}
+
+			logger.Info("redirect", zap.String("host", r.Host), zap.String("path", r.URL.String()), zap.String("redirecturl", url))
+			http.Redirect(w, r, url, http.StatusMovedPermanently)
+		}),
+	}, nil
+}
+
+// serve runs listen until it fails or a signal arrives on quit, and then
+// shuts srv down gracefully. On SIGUSR2 and SIGHUP it restarts the process
+// first, and keeps serving if that fails.
+func serve(srv *http.Server, listen func() error, quit <-chan os.Signal, logger *zap.Logger, opts Options) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- listen()
+	}()
+
+	var sig os.Signal
+	var restarted bool
+	// The socket files stay for the restarted process
+	defer func() {
+		if restarted {
+			return
+		}
+		if err := removeSockets(); err != nil {
+			logger.Warn("cannot remove the socket files", zap.Error(err))
+		}
+	}()
+
+	for sig == nil {
+		select {
+		case err := <-errs:
+			return errors.Wrap(err, "server failed")
+		case s := <-quit:
+			if s != syscall.SIGUSR2 && s != syscall.SIGHUP {
+				sig = s
+				break
+			}
+			logger.Info("restarting server", zap.String("signal", s.String()))
+			pid, err := restartFunc(opts.RestartTimeout)
+			if err != nil {
+				logger.Error("cannot restart server", zap.Error(err))
+				continue
+			}
+			logger.Info("restarted server, draining requests", zap.Int("pid", pid))
+			sig, restarted = s, true
+		}
+	}
+
+	// The new process takes the new requests right away, so there is no
+	// need to fail the readiness probe and wait for load balancers
+	if !restarted {
+		logger.Info("shutting down server", zap.String("signal", sig.String()), zap.Duration("delay", opts.ShutdownDelay))
+		if opts.OnShutdown != nil {
+			opts.OnShutdown()
+		}
+		time.Sleep(opts.ShutdownDelay)
+	}
+
+	ctx := context.Background()
+	if opts.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.ShutdownTimeout)
+		defer cancel()
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return errors.Wrap(err, "graceful shutdown did not finish")
+	}
+
+	if err := <-errs; err != http.ErrServerClosed {
+		return errors.Wrap(err, "server failed")
+	}
+	logger.Info("server stopped")
+	return nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+
+	var shutdown int32
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&shutdown) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})}
+
+	quit := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(srv, func() error { return srv.Serve(l) }, quit, zap.NewNop(), Options{
+			OnShutdown:    func() { atomic.StoreInt32(&shutdown, 1) },
+			ShutdownDelay: time.Millisecond * 200,
+		})
+	}()
+
+	if code := get(t, url); code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", code)
+	}
+
+	quit <- syscall.SIGTERM
+	time.Sleep(time.Millisecond * 50)
+
+	// Requests are still served during the delay, after OnShutdown
+	if code := get(t, url); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", code)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("server did not shut down")
+	}
+
+	if _, err := http.Get(url); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+}
+
+func TestServeFails(t *testing.T) {
+	t.Parallel()
+
+	srv := &http.Server{}
+	err := serve(srv, func() error { return os.ErrClosed }, make(chan os.Signal), zap.NewNop(), Options{})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func get(t *testing.T, url string) int {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode
+}
@@ -0,0 +1,320 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Exporter sends spans to where traces are collected
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+// Batching limits: spans are exported every batchInterval or once
+// batchSize ended, and spans that end while queueSize are waiting are
+// dropped, so a slow collector can't hold up or exhaust the app
+const (
+	batchSize     = 512
+	batchInterval = time.Second * 5
+	queueSize     = 2048
+	exportTimeout = time.Second * 10
+)
+
+// batcher exports the spans that ended in batches, in the background
+type batcher struct {
+	exp   Exporter
+	log   *zap.Logger
+	queue chan *Span
+	done  chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+}
+
+func newBatcher(exp Exporter, log *zap.Logger) *batcher {
+	b := &batcher{
+		exp:   exp,
+		log:   log,
+		queue: make(chan *Span, queueSize),
+		done:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) add(s *Span) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- s:
+	default:
+		b.dropped++
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s, ok := <-b.queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) >= batchSize {
+				b.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			b.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (b *batcher) flush(batch []*Span) {
+	b.mu.Lock()
+	dropped := b.dropped
+	b.dropped = 0
+	b.mu.Unlock()
+	if dropped > 0 {
+		b.log.Warn("trace spans dropped, the exporter can't keep up", zap.Int("dropped", dropped))
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if err := b.exp.ExportSpans(ctx, batch); err != nil {
+		b.log.Warn("cannot export trace spans", zap.Int("spans", len(batch)), zap.Error(err))
+	}
+}
+
+func (b *batcher) shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "cannot export the remaining trace spans")
+	}
+}
+
+// WriterExporter writes spans to W as JSON lines, for local use
+type WriterExporter struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+// jsonSpan is a span written by WriterExporter
+type jsonSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	Start      time.Time              `json:"start"`
+	Duration   time.Duration          `json:"duration"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+var kindNames = map[Kind]string{KindInternal: "internal", KindServer: "server", KindClient: "client"}
+
+// ExportSpans writes spans
+func (e *WriterExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceID:    s.Context.TraceID.String(),
+			SpanID:     s.Context.SpanID.String(),
+			Name:       s.Name(),
+			Kind:       kindNames[s.Kind],
+			Start:      s.Start.UTC(),
+			Duration:   s.Finish().Sub(s.Start),
+			Attributes: s.Attributes(),
+			Error:      s.Error(),
+		}
+		if s.ParentID.IsValid() {
+			js.ParentID = s.ParentID.String()
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.W.Write(buf.Bytes())
+	return err
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP/HTTP,
+// in its JSON encoding
+type OTLPExporter struct {
+	// Endpoint is the traces URL of the collector, like
+	// http://localhost:4318/v1/traces
+	Endpoint string
+	// Headers are added to the requests, like an authorization header
+	Headers map[string]string
+	// Service is the service.name resource attribute of the spans
+	Service string
+	Client  *http.Client
+}
+
+// ExportSpans sends spans to the collector
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return errors.Wrap(err, "cannot encode spans")
+	}
+
+	req, err := http.NewRequest("POST", e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "invalid otlp endpoint")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "cannot reach otlp collector")
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("otlp collector responded with %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+type otlpValue map[string]interface{}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	TraceState   string          `json:"traceState,omitempty"`
+	Name         string          `json:"name"`
+	Kind         Kind            `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+// OTLP status codes
+const otlpStatusError = 2
+
+// request returns the ExportTraceServiceRequest of spans. IDs are hex and
+// 64 bit integers strings, as the OTLP JSON encoding has them.
+func (e *OTLPExporter) request(spans []*Span) interface{} {
+	list := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:    s.Context.TraceID.String(),
+			SpanID:     s.Context.SpanID.String(),
+			TraceState: s.Context.State,
+			Name:       s.Name(),
+			Kind:       s.Kind,
+			Start:      strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.Finish().UnixNano(), 10),
+			Attributes: otlpAttributes(s.Attributes()),
+		}
+		if s.ParentID.IsValid() {
+			o.ParentSpanID = s.ParentID.String()
+		}
+		if msg := s.Error(); len(msg) > 0 {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: msg}
+		}
+		list[i] = o
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": e.Service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/fadeojo/brito/tracing"},
+				"spans": list,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	list := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		var v otlpValue
+		switch val := attrs[k].(type) {
+		case string:
+			v = otlpValue{"stringValue": val}
+		case bool:
+			v = otlpValue{"boolValue": val}
+		case int:
+			v = otlpValue{"intValue": strconv.Itoa(val)}
+		case int64:
+			v = otlpValue{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			v = otlpValue{"doubleValue": val}
+		default:
+			v = otlpValue{"stringValue": fmt.Sprint(val)}
+		}
+		list[i] = otlpAttribute{Key: k, Value: v}
+	}
+	return list
+}
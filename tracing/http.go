@@ -0,0 +1,133 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"go.uber.org/zap"
+)
+
+// Middleware traces requests as server spans, continuing the trace of the
+// traceparent header. The span is named after the chi route pattern once
+// the request was routed. It adds the trace_id and span_id to the request
+// logger, so it has to run after the middleware that sets it.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := Extract(r.Header); ok {
+			ctx = ContextWithRemote(ctx, sc)
+		}
+		ctx, span := Start(ctx, "HTTP "+r.Method, KindServer)
+		defer span.End()
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		if id := chimiddleware.GetReqID(ctx); len(id) > 0 {
+			span.SetAttribute("http.request_id", id)
+		}
+
+		if log, ok := ctx.Value(abcmiddleware.CtxLoggerKey).(*zap.Logger); ok {
+			log = log.With(
+				zap.String("trace_id", span.Context.TraceID.String()),
+				zap.String("span_id", span.Context.SpanID.String()),
+			)
+			ctx = context.WithValue(ctx, abcmiddleware.CtxLoggerKey, log)
+		}
+
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			if rctx := chi.RouteContext(ctx); rctx != nil && len(rctx.RoutePatterns) > 0 {
+				route := rctx.RoutePattern()
+				span.SetName(r.Method + " " + route)
+				span.SetAttribute("http.route", route)
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttribute("http.status_code", status)
+			if status >= 500 {
+				span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+			}
+		}()
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+	})
+}
+
+// Writer is route middleware that makes the request context available to
+// code that only has the ResponseWriter, like the template renderer, see
+// WriterContext. It passes the session cookie buffering and connection
+// hijacking through, so it can wrap the session ResponseWriter.
+func Writer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&ctxWriter{ResponseWriter: w, ctx: r.Context()}, r)
+	})
+}
+
+// WriterContext returns the request context of the response w, unwrapping
+// ResponseWriters down to the one of Writer. It returns an empty context
+// if there is none.
+func WriterContext(w io.Writer) context.Context {
+	for {
+		switch rw := w.(type) {
+		case *ctxWriter:
+			return rw.ctx
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return context.Background()
+		}
+	}
+}
+
+// ctxWriter carries the request context to WriterContext
+type ctxWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController
+func (w *ctxWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// SetCookie implements the abcsessions cookie buffering interface
+func (w *ctxWriter) SetCookie(c *http.Cookie) {
+	if cw, ok := w.ResponseWriter.(interface{ SetCookie(*http.Cookie) }); ok {
+		cw.SetCookie(c)
+		return
+	}
+	http.SetCookie(w.ResponseWriter, c)
+}
+
+// GetCookie implements the abcsessions cookie buffering interface
+func (w *ctxWriter) GetCookie(name string) *http.Cookie {
+	if cw, ok := w.ResponseWriter.(interface{ GetCookie(string) *http.Cookie }); ok {
+		return cw.GetCookie(name)
+	}
+	return nil
+}
+
+// Hijack implements http.Hijacker if the wrapped ResponseWriter does
+func (w *ctxWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("tracing: ResponseWriter does not implement http.Hijacker")
+}
+
+// Flush implements http.Flusher if the wrapped ResponseWriter does
+func (w *ctxWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,238 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace across services
+type TraceID [16]byte
+
+// SpanID identifies a span of a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether t is not all zeros
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether s is not all zeros
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+func newTraceID() TraceID {
+	var t TraceID
+	for !t.IsValid() {
+		putUint64(t[:8], rand.Uint64())
+		putUint64(t[8:], rand.Uint64())
+	}
+	return t
+}
+
+func newSpanID() SpanID {
+	var s SpanID
+	for !s.IsValid() {
+		putUint64(s[:], rand.Uint64())
+	}
+	return s
+}
+
+func putUint64(b []byte, v uint64) {
+	for i := range b {
+		b[i] = byte(v >> (8 * uint(i)))
+	}
+}
+
+// FlagSampled is the trace flag of sampled traces, whose spans are exported
+const FlagSampled = 0x01
+
+// SpanContext is the part of a span that is propagated to other services
+// in the W3C traceparent and tracestate headers
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// State is the vendor specific tracestate, passed on unchanged
+	State string
+}
+
+// Sampled reports whether the span is exported
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// IsValid reports whether sc has a trace and span ID
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent returns the traceparent header value of sc
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value. Versions after
+// 00 are parsed as far as version 00 defines them, as the spec requires.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return sc, false
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, false
+	}
+
+	version, ok := decodeHex(value[0:2])
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(value) != 55) {
+		return sc, false
+	}
+	traceID, ok := decodeHex(value[3:35])
+	if !ok {
+		return sc, false
+	}
+	spanID, ok := decodeHex(value[36:52])
+	if !ok {
+		return sc, false
+	}
+	flags, ok := decodeHex(value[53:55])
+	if !ok {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+// decodeHex decodes lowercase hex only, as traceparent requires
+func decodeHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// maxTraceState is the longest tracestate passed on, longer ones are
+// dropped as the spec allows
+const maxTraceState = 512
+
+// Kind is the role of a span in a trace, with the values of OTLP
+type Kind int
+
+// Span kinds
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is a timed operation of a trace. Its methods do nothing on a nil
+// Span, and record nothing on spans that are not sampled.
+type Span struct {
+	Context  SpanContext
+	ParentID SpanID
+	Kind     Kind
+	Start    time.Time
+
+	tracer *Tracer
+
+	mu         sync.Mutex
+	name       string
+	finish     time.Time
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+// Name returns the name of the span
+func (s *Span) Name() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+// SetName renames the span, like a request span once it was routed
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttribute sets the attribute key of the span, to a string, bool,
+// integer or float
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.Context.Sampled() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = map[string]interface{}{}
+	}
+	s.attributes[key] = value
+}
+
+// Attributes returns a copy of the attributes of the span
+func (s *Span) Attributes() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attrs := make(map[string]interface{}, len(s.attributes))
+	for k, v := range s.attributes {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// SetError marks the span as failed with err, nil is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// Error returns the error message of a failed span
+func (s *Span) Error() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// End ends the span and hands it to the exporter if it is sampled. Only
+// the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.finish = time.Now()
+	s.mu.Unlock()
+
+	if s.Context.Sampled() && s.tracer != nil {
+		s.tracer.export(s)
+	}
+}
+
+// Finish returns the time the span ended
+func (s *Span) Finish() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finish
+}
@@ -0,0 +1,183 @@
+// Package tracing traces requests across services. It takes part in W3C
+// trace context propagation through the traceparent and tracestate
+// headers, records the spans of the requests, their database queries,
+// template renders and websocket messages, and exports them to an OTLP
+// collector or as JSON lines.
+package tracing
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Tracer starts spans and exports the sampled ones
+type Tracer struct {
+	// SampleRatio is the share of new traces that are sampled. Traces
+	// continued from another service keep the decision made there.
+	SampleRatio float64
+
+	batcher *batcher
+}
+
+// Default is the tracer of Start. It creates trace IDs for propagation and
+// the logs, but exports nothing until it is replaced with NewTracer.
+var Default = &Tracer{}
+
+// NewTracer returns a tracer that exports the sampled spans to exp in
+// batches, logging export failures to log
+func NewTracer(exp Exporter, sampleRatio float64, log *zap.Logger) *Tracer {
+	t := &Tracer{SampleRatio: sampleRatio}
+	if exp != nil {
+		t.batcher = newBatcher(exp, log)
+	}
+	return t
+}
+
+// Shutdown exports the spans that ended and stops exporting, waiting at
+// most until ctx is done
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.batcher == nil {
+		return nil
+	}
+	return t.batcher.shutdown(ctx)
+}
+
+type ctxSpanKey struct{}
+type ctxRemoteKey struct{}
+
+// SpanFromContext returns the current span of ctx, nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(ctxSpanKey{}).(*Span)
+	return s
+}
+
+// ContextWithSpan returns ctx with the current span s
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, ctxSpanKey{}, s)
+}
+
+// ContextWithRemote returns ctx with the span of another service, which
+// the next span started with ctx is a child of
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, ctxRemoteKey{}, sc)
+}
+
+// Start starts a span with the Default tracer, see Tracer.Start
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	return Default.Start(ctx, name, kind)
+}
+
+// Child starts a span with the Default tracer if ctx has a span, so only
+// the work of traced operations is traced. It returns a nil Span if not.
+func Child(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return Default.Start(ctx, name, kind)
+}
+
+// Start starts a span, a child of the current span of ctx, or of the span
+// of another service set with ContextWithRemote, or the root of a new
+// trace. The returned context has the span as its current span.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	s := &Span{
+		Kind:   kind,
+		Start:  time.Now(),
+		tracer: t,
+		name:   name,
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.Context = parent.Context
+		s.ParentID = parent.Context.SpanID
+	} else if remote, ok := ctx.Value(ctxRemoteKey{}).(SpanContext); ok && remote.IsValid() {
+		s.Context = remote
+		s.ParentID = remote.SpanID
+	} else {
+		s.Context.TraceID = newTraceID()
+		if t.batcher != nil && rand.Float64() < t.SampleRatio {
+			s.Context.Flags |= FlagSampled
+		}
+	}
+	s.Context.SpanID = newSpanID()
+
+	return ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) export(s *Span) {
+	if t.batcher != nil {
+		t.batcher.add(s)
+	}
+}
+
+// Inject sets the traceparent and tracestate headers of the current span
+// of ctx on h, for a request to another service
+func Inject(ctx context.Context, h http.Header) {
+	s := SpanFromContext(ctx)
+	if s == nil {
+		return
+	}
+	h.Set("traceparent", s.Context.Traceparent())
+	if len(s.Context.State) > 0 {
+		h.Set("tracestate", s.Context.State)
+	}
+}
+
+// Extract returns the span of another service set in the traceparent and
+// tracestate headers of h
+func Extract(h http.Header) (SpanContext, bool) {
+	sc, ok := ParseTraceparent(h.Get("traceparent"))
+	if !ok {
+		return sc, false
+	}
+	if state := h.Values("tracestate"); len(state) > 0 {
+		// Multiple headers are one list
+		joined := state[0]
+		for _, v := range state[1:] {
+			joined += "," + v
+		}
+		if len(joined) <= maxTraceState {
+			sc.State = joined
+		}
+	}
+	return sc, true
+}
+
+// Transport is a http.RoundTripper that traces requests to other services
+// as client spans of the request context, and propagates the trace to them
+type Transport struct {
+	// Base is the transport making the requests, http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+// RoundTrip makes the request req
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx, span := Child(req.Context(), "HTTP "+req.Method, KindClient)
+	if span == nil {
+		return base.RoundTrip(req)
+	}
+	defer span.End()
+
+	// RoundTrippers must not change the request
+	req = req.Clone(ctx)
+	Inject(ctx, req.Header)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	return resp, nil
+}
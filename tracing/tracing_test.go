@@ -0,0 +1,288 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/volatiletech/abcweb/abcmiddleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// memoryExporter keeps the exported spans
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		// Later versions may add fields
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		sc, ok := ParseTraceparent(test.value)
+		if ok != test.ok {
+			t.Errorf("%q: expected ok %t", test.value, test.ok)
+			continue
+		}
+		if ok && test.value[:2] == "00" && sc.Traceparent() != test.value {
+			t.Errorf("%q: formatted as %q", test.value, sc.Traceparent())
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	t.Parallel()
+
+	exp := &memoryExporter{}
+	tracer := NewTracer(exp, 1, zap.NewNop())
+
+	ctx, root := tracer.Start(context.Background(), "root", KindServer)
+	_, child := tracer.Start(ctx, "child", KindInternal)
+	child.SetAttribute("n", 1)
+	child.End()
+	root.End()
+	root.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(exp.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(exp.spans))
+	}
+	if child.Context.TraceID != root.Context.TraceID || child.ParentID != root.Context.SpanID {
+		t.Error("expected child to be a child of root")
+	}
+	if root.ParentID.IsValid() || !root.Context.Sampled() {
+		t.Errorf("unexpected root %#v", root.Context)
+	}
+
+	// Not sampled spans are not exported
+	tracer = NewTracer(exp, 0, zap.NewNop())
+	_, span := tracer.Start(context.Background(), "unsampled", KindServer)
+	span.End()
+	tracer.Shutdown(context.Background())
+	if len(exp.spans) != 2 {
+		t.Errorf("expected no more spans, got %d", len(exp.spans))
+	}
+
+	// Child starts no trace
+	if _, span := Child(context.Background(), "orphan", KindInternal); span != nil {
+		t.Error("expected no span")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	exp := &memoryExporter{}
+	old := Default
+	Default = NewTracer(exp, 0, zap.NewNop())
+	defer func() { Default = old }()
+
+	var logs bytes.Buffer
+	log := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&logs), zap.DebugLevel))
+
+	router := chi.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), abcmiddleware.CtxLoggerKey, log)))
+		})
+	})
+	router.Use(Middleware)
+	router.With(Writer).Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		r.Context().Value(abcmiddleware.CtxLoggerKey).(*zap.Logger).Info("handled")
+		if SpanFromContext(WriterContext(w)) == nil {
+			t.Error("expected the request context from the writer")
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	// The sampling decision of the caller is kept, despite a ratio of 0
+	r := httptest.NewRequest("GET", "/users/1", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("tracestate", "vendor=value")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	Default.Shutdown(context.Background())
+
+	if len(exp.spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(exp.spans))
+	}
+	span := exp.spans[0]
+	if span.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentID.String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the trace of the caller, got %s parent %s", span.Context.TraceID, span.ParentID)
+	}
+	if span.Context.State != "vendor=value" {
+		t.Errorf("unexpected tracestate %q", span.Context.State)
+	}
+	if span.Name() != "GET /users/{id}" || span.Error() != "500 Internal Server Error" {
+		t.Errorf("unexpected span %q error %q", span.Name(), span.Error())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["trace_id"] != span.Context.TraceID.String() || entry["span_id"] != span.Context.SpanID.String() {
+		t.Errorf("expected the trace IDs in the log, got %v", entry)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	tracer := NewTracer(&memoryExporter{}, 1, zap.NewNop())
+	ctx, span := tracer.Start(context.Background(), "root", KindServer)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := (&http.Client{Transport: Transport{}}).Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	sc, ok := ParseTraceparent(got)
+	if !ok || sc.TraceID != span.Context.TraceID || sc.SpanID == span.Context.SpanID {
+		t.Errorf("expected the traceparent of a client span, got %q", got)
+	}
+	if len(req.Header.Get("traceparent")) > 0 {
+		t.Error("the request was changed")
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	tracer := NewTracer(&WriterExporter{W: &buf}, 1, zap.NewNop())
+	ctx, root := tracer.Start(context.Background(), "root", KindServer)
+	_, child := tracer.Start(ctx, "child", KindInternal)
+	child.SetAttribute("db.statement", "SELECT 1")
+	child.End()
+	root.End()
+	tracer.Shutdown(context.Background())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	var span jsonSpan
+	if err := json.Unmarshal([]byte(lines[0]), &span); err != nil {
+		t.Fatal(err)
+	}
+	if span.Name != "child" || span.Kind != "internal" || span.ParentID != root.Context.SpanID.String() || span.Attributes["db.statement"] != "SELECT 1" {
+		t.Errorf("unexpected span %s", lines[0])
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	t.Parallel()
+
+	var body []byte
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		auth = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	exp := &OTLPExporter{Endpoint: srv.URL, Headers: map[string]string{"Authorization": "Bearer key"}, Service: "brito"}
+	tracer := NewTracer(exp, 1, zap.NewNop())
+	_, span := tracer.Start(context.Background(), "GET /", KindServer)
+	span.SetAttribute("http.status_code", 500)
+	span.SetError(http.ErrHandlerTimeout)
+	span.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if auth != "Bearer key" {
+		t.Errorf("expected the headers, got %q", auth)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	rs := req.ResourceSpans[0]
+	if rs.Resource.Attributes[0].Value["stringValue"] != "brito" {
+		t.Errorf("unexpected resource %s", body)
+	}
+	got := rs.ScopeSpans[0].Spans[0]
+	if got.TraceID != span.Context.TraceID.String() || got.Kind != KindServer || got.Status.Code != otlpStatusError {
+		t.Errorf("unexpected span %s", body)
+	}
+	if got.Attributes[0].Value["intValue"] != "500" {
+		t.Errorf("unexpected attributes %s", body)
+	}
+	if start, end := got.Start, got.End; len(start) == 0 || end < start {
+		t.Errorf("unexpected times %s %s", start, end)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	block := make(chan struct{})
+	defer close(block)
+	tracer := NewTracer(exporterFunc(func() { <-block }), 1, zap.NewNop())
+	_, span := tracer.Start(context.Background(), "root", KindServer)
+	span.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := tracer.Shutdown(ctx); err == nil {
+		t.Error("expected a timeout")
+	}
+}
+
+type exporterFunc func()
+
+func (f exporterFunc) ExportSpans(ctx context.Context, spans []*Span) error {
+	f()
+	return nil
+}